@@ -0,0 +1,422 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package changes serves a feed of the changes made to stored keys, so that
+// downstream consumers such as mirrors and search indexes can follow them
+// without reconciling.
+//
+// The feed is read a page at a time from the storage change log with
+// GET /pks/changes?since=<cursor>, or streamed as server-sent events as the
+// changes are made by requesting it with Accept: text/event-stream. Each
+// event streamed from the change log carries its cursor as its ID, so that a
+// client which reconnects with the Last-Event-ID header resumes where it left
+// off, missing nothing.
+package changes
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+
+	// DefaultPingInterval is how often an idle stream is sent a comment, so
+	// that proxies do not time it out.
+	DefaultPingInterval = 30 * time.Second
+
+	// streamBuffer is the number of changes buffered for each stream from
+	// storage without a change log. A client which falls further behind is
+	// disconnected, as those changes cannot be read again.
+	streamBuffer = 256
+)
+
+// Change is an entry in the feed.
+type Change struct {
+	// Cursor identifies the change in the storage change log. It is not set
+	// on changes streamed from storage without a change log.
+	Cursor      string             `json:"cursor,omitempty"`
+	Fingerprint string             `json:"fingerprint"`
+	Type        storage.ChangeType `json:"type"`
+	OldDigest   string             `json:"oldDigest,omitempty"`
+	NewDigest   string             `json:"newDigest,omitempty"`
+	Time        time.Time          `json:"time"`
+}
+
+// Page is a page of the feed. Next is the cursor from which to read the
+// following page; it is the requested cursor if there were no changes.
+type Page struct {
+	Changes []Change `json:"changes"`
+	Next    string   `json:"next"`
+}
+
+type Handler struct {
+	storage storage.Storage
+
+	pingInterval time.Duration
+
+	mu      sync.Mutex
+	streams map[chan Change]bool
+	wakers  map[chan struct{}]bool
+}
+
+type HandlerOption func(h *Handler) error
+
+// PingInterval sets how often idle streams are sent a comment.
+func PingInterval(interval time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		if interval <= 0 {
+			return errgo.Newf("invalid ping interval %v", interval)
+		}
+		h.pingInterval = interval
+		return nil
+	}
+}
+
+// NewHandler returns a handler serving the changes made to keys in the given
+// storage. Pages of the feed are only served if the storage is a
+// storage.ChangeLogger, but changes may be streamed from any storage.
+func NewHandler(st storage.Storage, options ...HandlerOption) (*Handler, error) {
+	h := &Handler{
+		storage:      st,
+		pingInterval: DefaultPingInterval,
+		streams:      make(map[chan Change]bool),
+		wakers:       make(map[chan struct{}]bool),
+	}
+	for _, option := range options {
+		err := option(h)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	st.Subscribe(h.notify)
+	return h, nil
+}
+
+func (h *Handler) Register(r *httprouter.Router) {
+	r.GET("/pks/changes", h.Get)
+}
+
+func httpError(w http.ResponseWriter, statusCode int, err error) {
+	if statusCode != http.StatusBadRequest {
+		log.Errorf("HTTP %d: %v", statusCode, errgo.Details(err))
+	}
+	http.Error(w, http.StatusText(statusCode), statusCode)
+}
+
+// Get serves a page of the feed, or streams it to clients which accept
+// server-sent events.
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if acceptsEventStream(r) {
+		h.stream(w, r)
+		return
+	}
+	h.page(w, r)
+}
+
+// acceptsEventStream returns whether the request accepts server-sent
+// events.
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) page(w http.ResponseWriter, r *http.Request) {
+	changeLog, ok := h.storage.(storage.ChangeLogger)
+	if !ok {
+		http.Error(w, "change log not supported by storage", http.StatusNotImplemented)
+		return
+	}
+
+	since := r.URL.Query().Get("since")
+	limit := DefaultLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			httpError(w, http.StatusBadRequest, errgo.Newf("invalid limit %q", s))
+			return
+		}
+		if n < MaxLimit {
+			limit = n
+		} else {
+			limit = MaxLimit
+		}
+	}
+
+	changes, err := changeLog.Changes(r.Context(), since, limit)
+	if errgo.Cause(err) == storage.ErrInvalidCursor {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+
+	page := Page{Changes: []Change{}, Next: since}
+	for _, change := range changes {
+		page.Changes = append(page.Changes, Change{
+			Cursor:      change.Cursor,
+			Fingerprint: openpgp.Reverse(change.RFingerprint),
+			Type:        change.Type,
+			OldDigest:   change.OldDigest,
+			NewDigest:   change.NewDigest,
+			Time:        change.Time,
+		})
+		page.Next = change.Cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&page)
+	if err != nil {
+		log.Errorf("error writing change feed: %v", err)
+	}
+}
+
+// notify passes a key change notification to the open streams. It never
+// blocks the storage making the change: streams from the change log are only
+// woken to read it, and other streams which have fallen behind are closed.
+func (h *Handler) notify(kc storage.KeyChange) error {
+	change := Change{Time: time.Now().UTC()}
+	var rfp string
+	switch kc := kc.(type) {
+	case storage.KeyAdded:
+		rfp, change.Type = kc.RFingerprint, storage.ChangeAdded
+		change.NewDigest = kc.Digest
+	case storage.KeyReplaced:
+		rfp, change.Type = kc.RFingerprint, storage.ChangeReplaced
+		change.OldDigest, change.NewDigest = kc.OldDigest, kc.NewDigest
+	case storage.KeyRemoved:
+		rfp, change.Type = kc.RFingerprint, storage.ChangeRemoved
+		change.OldDigest = kc.Digest
+	default:
+		return nil
+	}
+	if rfp == "" {
+		// Renotifications of stored keys are not changes.
+		return nil
+	}
+	change.Fingerprint = openpgp.Reverse(rfp)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for wake := range h.wakers {
+		select {
+		case wake <- struct{}{}:
+		default:
+			// Already woken.
+		}
+	}
+	for ch := range h.streams {
+		select {
+		case ch <- change:
+		default:
+			delete(h.streams, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) subscribeWake() chan struct{} {
+	wake := make(chan struct{}, 1)
+	h.mu.Lock()
+	h.wakers[wake] = true
+	h.mu.Unlock()
+	return wake
+}
+
+func (h *Handler) unsubscribeWake(wake chan struct{}) {
+	h.mu.Lock()
+	delete(h.wakers, wake)
+	h.mu.Unlock()
+}
+
+func (h *Handler) subscribe() chan Change {
+	ch := make(chan Change, streamBuffer)
+	h.mu.Lock()
+	h.streams[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *Handler) unsubscribe(ch chan Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams[ch] {
+		delete(h.streams, ch)
+		close(ch)
+	}
+}
+
+// stream sends changes to the client as server-sent events until it goes
+// away. Changes are read from the change log if the storage keeps one, after
+// the cursor given by the Last-Event-ID header or the since parameter, or
+// else from its start.
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, errgo.New("streaming not supported"))
+		return
+	}
+	changeLog, ok := h.storage.(storage.ChangeLogger)
+	if !ok {
+		h.streamNotifications(w, r, flusher)
+		return
+	}
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("since")
+	}
+	// Subscribe before reading, so that no change is made unnoticed between.
+	wake := h.subscribeWake()
+	defer h.unsubscribeWake(wake)
+
+	changes, err := changeLog.Changes(r.Context(), cursor, MaxLimit)
+	if errgo.Cause(err) == storage.ErrInvalidCursor {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		return
+	}
+	startStream(w, flusher)
+
+	ping := time.NewTicker(h.pingInterval)
+	defer ping.Stop()
+	for {
+		for len(changes) > 0 {
+			for _, change := range changes {
+				err = writeEvent(w, change.Cursor, &Change{
+					Cursor:      change.Cursor,
+					Fingerprint: openpgp.Reverse(change.RFingerprint),
+					Type:        change.Type,
+					OldDigest:   change.OldDigest,
+					NewDigest:   change.NewDigest,
+					Time:        change.Time,
+				})
+				if err != nil {
+					return
+				}
+				cursor = change.Cursor
+			}
+			flusher.Flush()
+			if len(changes) < MaxLimit {
+				break
+			}
+			changes, err = changeLog.Changes(r.Context(), cursor, MaxLimit)
+			if err != nil {
+				log.Errorf("error reading change log: %v", err)
+				return
+			}
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			// Changes are also read on each ping, in case one logged
+			// elsewhere could not yet be read when the stream was woken.
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-wake:
+		}
+		changes, err = changeLog.Changes(r.Context(), cursor, MaxLimit)
+		if err != nil {
+			log.Errorf("error reading change log: %v", err)
+			return
+		}
+	}
+}
+
+// streamNotifications sends the changes notified by storage without a
+// change log to the client as server-sent events, until it goes away or
+// falls too far behind. The events have no IDs, since they cannot be read
+// again.
+func (h *Handler) streamNotifications(w http.ResponseWriter, r *http.Request, flusher http.Flusher) {
+	ch := h.subscribe()
+	defer h.unsubscribe(ch)
+	startStream(w, flusher)
+
+	ping := time.NewTicker(h.pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		case change, ok := <-ch:
+			if !ok {
+				log.Warningf("closing change stream to %s, which fell behind", r.RemoteAddr)
+				return
+			}
+			err := writeEvent(w, "", &change)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func startStream(w http.ResponseWriter, flusher http.Flusher) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+}
+
+// writeEvent writes the change as a server-sent event with the given ID,
+// if any.
+func writeEvent(w http.ResponseWriter, id string, change *Change) error {
+	buf, err := json.Marshal(change)
+	if err != nil {
+		log.Errorf("error encoding change: %v", err)
+		return errgo.Mask(err)
+	}
+	if id != "" {
+		_, err = fmt.Fprintf(w, "id: %s\n", id)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", change.Type, buf)
+	return errgo.Mask(err)
+}
@@ -0,0 +1,292 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package changes
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	stdtesting "testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+)
+
+const (
+	caseyRFP = "d113e86ebae6324d2fa392ff64a66194a1b6c7d8"
+	caseyFP  = "8d7c6b1a49166a46ff293af2d4236eabe68e311d"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type HandlerSuite struct {
+	storage *mock.Storage
+	srv     *httptest.Server
+
+	mu      sync.Mutex
+	changes []storage.Change
+}
+
+var _ = gc.Suite(&HandlerSuite{})
+
+var changeTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (s *HandlerSuite) SetUpTest(c *gc.C) {
+	s.changes = []storage.Change{{
+		Cursor: "1", RFingerprint: caseyRFP, Type: storage.ChangeAdded,
+		NewDigest: "aaa", Time: changeTime,
+	}, {
+		Cursor: "2", RFingerprint: caseyRFP, Type: storage.ChangeReplaced,
+		OldDigest: "aaa", NewDigest: "bbb", Time: changeTime,
+	}}
+	s.storage = mock.NewStorage(
+		mock.Changes(func(cursor string, limit int) ([]storage.Change, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// Cursors count the changes read.
+			n := 0
+			if cursor != "" {
+				var err error
+				n, err = strconv.Atoi(cursor)
+				if err != nil || n > len(s.changes) {
+					return nil, errgo.WithCausef(nil, storage.ErrInvalidCursor, "")
+				}
+			}
+			changes := s.changes[n:]
+			if len(changes) > limit {
+				changes = changes[:limit]
+			}
+			return changes, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, PingInterval(time.Hour))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	s.srv = httptest.NewServer(r)
+}
+
+func (s *HandlerSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *HandlerSuite) getPage(c *gc.C, query string) *Page {
+	res, err := http.Get(s.srv.URL + "/pks/changes" + query)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/json")
+	var page Page
+	err = json.NewDecoder(res.Body).Decode(&page)
+	c.Assert(err, gc.IsNil)
+	return &page
+}
+
+func (s *HandlerSuite) TestPage(c *gc.C) {
+	page := s.getPage(c, "")
+	c.Assert(page, gc.DeepEquals, &Page{
+		Changes: []Change{{
+			Cursor: "1", Fingerprint: caseyFP, Type: storage.ChangeAdded,
+			NewDigest: "aaa", Time: changeTime,
+		}, {
+			Cursor: "2", Fingerprint: caseyFP, Type: storage.ChangeReplaced,
+			OldDigest: "aaa", NewDigest: "bbb", Time: changeTime,
+		}},
+		Next: "2",
+	})
+	c.Assert(s.storage.Calls[0].Args, gc.DeepEquals, []interface{}{"", DefaultLimit})
+
+	// The cursor is kept when there are no more changes.
+	page = s.getPage(c, "?since=2")
+	c.Assert(page.Changes, gc.HasLen, 0)
+	c.Assert(page.Next, gc.Equals, "2")
+
+	page = s.getPage(c, "?limit=1")
+	c.Assert(page.Changes, gc.HasLen, 1)
+	c.Assert(page.Next, gc.Equals, "1")
+}
+
+func (s *HandlerSuite) TestPageLimit(c *gc.C) {
+	s.getPage(c, "?limit=5000&since=2")
+	c.Assert(s.storage.Calls[0].Args, gc.DeepEquals, []interface{}{"2", MaxLimit})
+
+	for _, query := range []string{"?limit=0", "?limit=x", "?since=bogus"} {
+		res, err := http.Get(s.srv.URL + "/pks/changes" + query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("%s", query))
+	}
+}
+
+func (s *HandlerSuite) TestPageUnsupported(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(unloggedStorage{s.storage})
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/changes")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotImplemented)
+}
+
+// unloggedStorage hides the change log of the storage it wraps.
+type unloggedStorage struct {
+	storage.Storage
+}
+
+// openStream requests the feed as server-sent events, with the given
+// Last-Event-ID if any.
+func openStream(c *gc.C, url, lastEventID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequest("GET", url+"/pks/changes", nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	return res, bufio.NewReader(res.Body)
+}
+
+// readEvent reads a server-sent event, returning its ID and change.
+func readEvent(c *gc.C, body *bufio.Reader) (string, Change) {
+	var id string
+	line, err := body.ReadString('\n')
+	c.Assert(err, gc.IsNil)
+	if strings.HasPrefix(line, "id: ") {
+		id = strings.TrimSuffix(line[len("id: "):], "\n")
+		line, err = body.ReadString('\n')
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(strings.HasPrefix(line, "event: "), gc.Equals, true, gc.Commentf("%q", line))
+	eventType := strings.TrimSuffix(line[len("event: "):], "\n")
+	line, err = body.ReadString('\n')
+	c.Assert(err, gc.IsNil)
+	c.Assert(strings.HasPrefix(line, "data: "), gc.Equals, true)
+	var change Change
+	err = json.Unmarshal([]byte(line[len("data: "):]), &change)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(change.Type), gc.Equals, eventType)
+	line, err = body.ReadString('\n')
+	c.Assert(err, gc.IsNil)
+	c.Assert(line, gc.Equals, "\n")
+	return id, change
+}
+
+func (s *HandlerSuite) TestStream(c *gc.C) {
+	res, body := openStream(c, s.srv.URL, "")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "text/event-stream")
+
+	// The log is streamed from its start, each change with its cursor as
+	// its ID.
+	for _, cursor := range []string{"1", "2"} {
+		id, change := readEvent(c, body)
+		c.Assert(id, gc.Equals, cursor)
+		c.Assert(change.Cursor, gc.Equals, cursor)
+		c.Assert(change.Fingerprint, gc.Equals, caseyFP)
+	}
+
+	// Then changes as they are logged.
+	s.mu.Lock()
+	s.changes = append(s.changes, storage.Change{
+		Cursor: "3", RFingerprint: caseyRFP, Type: storage.ChangeRemoved,
+		OldDigest: "bbb", Time: changeTime,
+	})
+	s.mu.Unlock()
+	s.storage.Notify(storage.KeyRemoved{Digest: "bbb", RFingerprint: caseyRFP})
+	id, change := readEvent(c, body)
+	c.Assert(id, gc.Equals, "3")
+	c.Assert(change, gc.DeepEquals, Change{
+		Cursor: "3", Fingerprint: caseyFP, Type: storage.ChangeRemoved,
+		OldDigest: "bbb", Time: changeTime,
+	})
+}
+
+func (s *HandlerSuite) TestStreamResume(c *gc.C) {
+	res, body := openStream(c, s.srv.URL, "1")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	id, change := readEvent(c, body)
+	c.Assert(id, gc.Equals, "2")
+	c.Assert(change.Type, gc.Equals, storage.ChangeReplaced)
+
+	res, _ = openStream(c, s.srv.URL, "bogus")
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *HandlerSuite) TestStreamNotifications(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(unloggedStorage{s.storage})
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, body := openStream(c, srv.URL, "")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	// Renotifications are not changes, so are not streamed.
+	s.storage.Notify(storage.KeyAdded{Digest: "aaa"})
+	s.storage.Notify(storage.KeyReplaced{OldDigest: "aaa", NewDigest: "bbb", RFingerprint: caseyRFP})
+	s.storage.Notify(storage.KeyRemoved{Digest: "bbb", RFingerprint: caseyRFP})
+
+	for _, expect := range []Change{{
+		Fingerprint: caseyFP, Type: storage.ChangeReplaced, OldDigest: "aaa", NewDigest: "bbb",
+	}, {
+		Fingerprint: caseyFP, Type: storage.ChangeRemoved, OldDigest: "bbb",
+	}} {
+		// Without a change log, changes cannot be resumed, so have no IDs.
+		id, change := readEvent(c, body)
+		c.Assert(id, gc.Equals, "")
+		c.Assert(change.Time.IsZero(), gc.Equals, false)
+		change.Time = time.Time{}
+		c.Assert(change, gc.DeepEquals, expect)
+	}
+}
+
+func (s *HandlerSuite) TestStreamFallsBehind(c *gc.C) {
+	handler, err := NewHandler(s.storage)
+	c.Assert(err, gc.IsNil)
+	ch := handler.subscribe()
+	for i := 0; i <= streamBuffer; i++ {
+		s.storage.Notify(storage.KeyRemoved{Digest: "bbb", RFingerprint: caseyRFP})
+	}
+	var n int
+	for range ch {
+		n++
+	}
+	c.Assert(n, gc.Equals, streamBuffer)
+	// Unsubscribing a stream already closed is harmless.
+	handler.unsubscribe(ch)
+}
@@ -18,14 +18,22 @@
 package hkp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -35,17 +43,36 @@ import (
 	"hockeypuck/conflux/recon"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/takedown"
+	"hockeypuck/hkp/verify"
 	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
 )
 
 const (
-	shortKeyIDLen       = 8
-	longKeyIDLen        = 16
-	fingerprintKeyIDLen = 40
+	shortKeyIDLen         = 8
+	longKeyIDLen          = 16
+	v3FingerprintKeyIDLen = 32
+	fingerprintKeyIDLen   = 40
+	v6FingerprintKeyIDLen = 64
 )
 
-var errKeywordSearchNotAvailable = errgo.New("keyword search is not available")
+var (
+	errKeywordSearchNotAvailable = errgo.New("keyword search is not available")
+	errShortKeyIDNotAvailable    = errgo.New("short key ID search is not available")
+	errInvalidKeyID              = errgo.New("invalid key ID")
+)
+
+// storageError responds to a failed storage operation. If the operation was
+// abandoned because its timeout expired, the client is told to try again
+// later rather than that the server failed.
+func storageError(ctx context.Context, w http.ResponseWriter, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		httpError(w, http.StatusServiceUnavailable, errgo.Notef(err, "storage timeout"))
+		return
+	}
+	httpError(w, http.StatusInternalServerError, err)
+}
 
 func httpError(w http.ResponseWriter, statusCode int, err error) {
 	if statusCode != http.StatusNotFound {
@@ -63,8 +90,29 @@ type Handler struct {
 	statsTemplate *template.Template
 	statsFunc     func() (interface{}, error)
 
-	selfSignedOnly  bool
-	fingerprintOnly bool
+	selfSignedOnly      bool
+	attestedCertsOnly   bool
+	fingerprintOnly     bool
+	shortKeyIDsDisabled bool
+
+	adminKeys      []string
+	adminSigMaxAge time.Duration
+	adminSigsMu    sync.Mutex
+	adminSigs      map[string]time.Time
+
+	verifier *verify.Verifier
+	remover  *takedown.Remover
+
+	lookupTimeout    time.Duration
+	addTimeout       time.Duration
+	deleteTimeout    time.Duration
+	hashQueryTimeout time.Duration
+
+	cacheControl map[Operation]string
+
+	honourNoModify bool
+	certPolicy     *openpgp.CertPolicy
+	keyPolicy      openpgp.KeyPolicy
 
 	keyReaderOptions []openpgp.KeyReaderOption
 }
@@ -134,6 +182,15 @@ func SelfSignedOnly(selfSignedOnly bool) HandlerOption {
 	}
 }
 
+// AttestedCertsOnly only serves the third-party certifications of user IDs
+// and user attributes which the key holder has attested.
+func AttestedCertsOnly(attestedCertsOnly bool) HandlerOption {
+	return func(h *Handler) error {
+		h.attestedCertsOnly = attestedCertsOnly
+		return nil
+	}
+}
+
 func FingerprintOnly(fingerprintOnly bool) HandlerOption {
 	return func(h *Handler) error {
 		h.fingerprintOnly = fingerprintOnly
@@ -141,6 +198,144 @@ func FingerprintOnly(fingerprintOnly bool) HandlerOption {
 	}
 }
 
+// ShortKeyIDsDisabled refuses lookups by 8-digit short key ID, which are
+// trivial to collide.
+func ShortKeyIDsDisabled(disabled bool) HandlerOption {
+	return func(h *Handler) error {
+		h.shortKeyIDsDisabled = disabled
+		return nil
+	}
+}
+
+// AdminKeys configures the fingerprints of keys which are authorized to sign
+// administrative requests, such as key deletion.
+func AdminKeys(adminKeys []string) HandlerOption {
+	return func(h *Handler) error {
+		h.adminKeys = adminKeys
+		return nil
+	}
+}
+
+// DefaultAdminSignatureMaxAge is how long a signed administrative request
+// may be made after it was signed, by default.
+const DefaultAdminSignatureMaxAge = 5 * time.Minute
+
+// maxAdminClockSkew is how far in the future the signature of an
+// administrative request may be dated, allowing for clocks out of step.
+const maxAdminClockSkew = time.Minute
+
+// AdminSignatureMaxAge sets how long a signed administrative request may be
+// made after it was signed. Each signature is accepted only once, so a
+// request cannot be replayed.
+func AdminSignatureMaxAge(maxAge time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		if maxAge <= 0 {
+			return errgo.Newf("invalid admin signature maximum age %v", maxAge)
+		}
+		h.adminSigMaxAge = maxAge
+		return nil
+	}
+}
+
+// Verifier only serves user IDs whose email addresses have been verified
+// with the given Verifier, which is asked to verify the addresses of keys
+// added to the server.
+func Verifier(verifier *verify.Verifier) HandlerOption {
+	return func(h *Handler) error {
+		h.verifier = verifier
+		return nil
+	}
+}
+
+// Remover lets key owners take down their keys with the given Remover, once
+// they have proven control of the key or of an email address on it.
+func Remover(remover *takedown.Remover) HandlerOption {
+	return func(h *Handler) error {
+		h.remover = remover
+		return nil
+	}
+}
+
+// LookupTimeout limits the time spent in storage answering a /pks/lookup
+// request. Zero means no limit other than the client's connection.
+func LookupTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.lookupTimeout = timeout
+		return nil
+	}
+}
+
+// AddTimeout limits the time spent in storage handling a /pks/add request.
+func AddTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.addTimeout = timeout
+		return nil
+	}
+}
+
+// DeleteTimeout limits the time spent in storage handling a /pks/delete
+// request.
+func DeleteTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.deleteTimeout = timeout
+		return nil
+	}
+}
+
+// HashQueryTimeout limits the time spent in storage handling a
+// /pks/hashquery request.
+func HashQueryTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.hashQueryTimeout = timeout
+		return nil
+	}
+}
+
+// CacheControl sets the Cache-Control header of successful responses to the
+// given lookup operation. An empty value sends none.
+func CacheControl(op Operation, value string) HandlerOption {
+	return func(h *Handler) error {
+		switch op {
+		case OperationGet, OperationHGet, OperationIndex, OperationVIndex:
+		default:
+			return errgo.Newf("cannot set Cache-Control of operation %q", op)
+		}
+		if value == "" {
+			delete(h.cacheControl, op)
+		} else {
+			h.cacheControl[op] = value
+		}
+		return nil
+	}
+}
+
+// HonourNoModify only accepts material self-signed by the key holder into
+// keys which carry the keyserver no-modify preference.
+func HonourNoModify(honour bool) HandlerOption {
+	return func(h *Handler) error {
+		h.honourNoModify = honour
+		return nil
+	}
+}
+
+// CertPolicy limits the third-party certifications accepted into keys, and
+// served from them, with the given policy. The issuers of certifications are
+// only checked as keys are added, not as they are served.
+func CertPolicy(policy *openpgp.CertPolicy) HandlerOption {
+	return func(h *Handler) error {
+		h.certPolicy = policy
+		return nil
+	}
+}
+
+// KeyPolicy rejects added keys which the given policy does not accept.
+func KeyPolicy(policy openpgp.KeyPolicy) HandlerOption {
+	return func(h *Handler) error {
+		h.keyPolicy = policy
+		return nil
+	}
+}
+
 func KeyReaderOptions(opts []openpgp.KeyReaderOption) HandlerOption {
 	return func(h *Handler) error {
 		h.keyReaderOptions = opts
@@ -150,7 +345,10 @@ func KeyReaderOptions(opts []openpgp.KeyReaderOption) HandlerOption {
 
 func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, error) {
 	h := &Handler{
-		storage: storage,
+		storage:        storage,
+		cacheControl:   make(map[Operation]string),
+		adminSigMaxAge: DefaultAdminSignatureMaxAge,
+		adminSigs:      make(map[string]time.Time),
 	}
 	for _, option := range options {
 		err := option(h)
@@ -161,10 +359,33 @@ func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, er
 	return h, nil
 }
 
+// requestContext returns a context for storage operations on behalf of the
+// given request. It is cancelled when the client goes away, or once timeout
+// elapses if non-zero.
+func requestContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
 func (h *Handler) Register(r *httprouter.Router) {
 	r.GET("/pks/lookup", h.Lookup)
 	r.POST("/pks/add", h.Add)
+	r.POST("/pks/delete", h.Delete)
 	r.POST("/pks/hashquery", h.HashQuery)
+	if h.verifier != nil {
+		r.GET("/pks/verify", h.ConfirmVerify)
+		r.POST("/pks/verify", h.Verify)
+	}
+	if h.remover != nil {
+		r.POST("/pks/takedown/challenge", h.TakedownChallenge)
+		if h.remover.EmailEnabled() {
+			r.POST("/pks/takedown/email", h.TakedownEmail)
+			r.GET("/pks/takedown", h.ConfirmTakedown)
+		}
+		r.POST("/pks/takedown", h.Takedown)
+	}
 }
 
 func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -173,13 +394,15 @@ func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		httpError(w, http.StatusBadRequest, err)
 		return
 	}
+	ctx, cancel := requestContext(r, h.lookupTimeout)
+	defer cancel()
 	switch l.Op {
 	case OperationGet, OperationHGet:
-		h.get(w, l)
+		h.get(ctx, w, r, l)
 	case OperationIndex:
-		h.index(w, l, h.indexWriter)
+		h.index(ctx, w, l, h.indexWriter)
 	case OperationVIndex:
-		h.index(w, l, h.vindexWriter)
+		h.index(ctx, w, l, h.vindexWriter)
 	case OperationStats:
 		h.stats(w, l)
 	default:
@@ -188,26 +411,43 @@ func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 	}
 }
 
+// HashQuery serves the keys with the requested digests, as recon peers ask
+// for the keys they are missing. As with lookups, only verified user IDs are
+// served if the handler has a Verifier, so peers are sent keys with digests
+// other than those asked for when user IDs are withheld.
 func (h *Handler) HashQuery(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	hq, err := ParseHashQuery(r)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, errgo.Mask(err))
 		return
 	}
+	ctx, cancel := requestContext(r, h.hashQueryTimeout)
+	defer cancel()
 	var result []*openpgp.PrimaryKey
 	for _, digest := range hq.Digests {
-		rfps, err := h.storage.MatchMD5([]string{digest})
+		if ctx.Err() != nil {
+			storageError(ctx, w, errgo.Mask(ctx.Err()))
+			return
+		}
+		rfps, err := h.storage.MatchMD5Context(ctx, []string{digest})
 		if err != nil {
 			log.Errorf("error resolving hashquery digest %q", digest)
 			continue
 		}
-		keys, err := h.storage.FetchKeys(rfps)
+		keys, err := h.storage.FetchKeysContext(ctx, rfps)
 		if err != nil {
 			log.Errorf("error fetching hashquery key %q", digest)
 			continue
 		}
 		result = append(result, keys...)
 	}
+	if h.verifier != nil {
+		err = h.verifier.Filter(ctx, result)
+		if err != nil {
+			storageError(ctx, w, errgo.Mask(err))
+			return
+		}
+	}
 
 	w.Header().Set("Content-Type", "pgp/keys")
 
@@ -250,35 +490,86 @@ func writeHashqueryKey(w http.ResponseWriter, key *openpgp.PrimaryKey) error {
 	return nil
 }
 
-func (h *Handler) resolve(l *Lookup) ([]string, error) {
+func (h *Handler) resolve(ctx context.Context, l *Lookup) ([]string, error) {
 	if l.Op == OperationHGet {
-		return h.storage.MatchMD5([]string{l.Search})
+		return h.storage.MatchMD5Context(ctx, []string{l.Search})
 	}
 	if strings.HasPrefix(l.Search, "0x") {
 		keyID := openpgp.Reverse(strings.ToLower(l.Search[2:]))
 		switch len(keyID) {
-		case shortKeyIDLen, longKeyIDLen, fingerprintKeyIDLen:
-			return h.storage.Resolve([]string{keyID})
+		case shortKeyIDLen:
+			if h.shortKeyIDsDisabled {
+				return nil, errShortKeyIDNotAvailable
+			}
+			fallthrough
+		case longKeyIDLen, v3FingerprintKeyIDLen, fingerprintKeyIDLen, v6FingerprintKeyIDLen:
+			if _, err := hex.DecodeString(keyID); err != nil {
+				return nil, errInvalidKeyID
+			}
+			return h.storage.ResolveContext(ctx, []string{keyID})
 		}
 	}
 	if h.fingerprintOnly {
 		return nil, errKeywordSearchNotAvailable
 	}
-	return h.storage.MatchKeyword([]string{l.Search})
+	if l.Exact {
+		if email, ok := storage.ParseEmail(l.Search); ok {
+			return h.storage.MatchEmailContext(ctx, []string{email})
+		}
+	}
+	return h.storage.MatchKeywordContext(ctx, []string{l.Search})
+}
+
+// isQueryError returns whether err means the lookup cannot be answered as
+// requested, rather than that it failed.
+func isQueryError(err error) bool {
+	switch err {
+	case errKeywordSearchNotAvailable, errShortKeyIDNotAvailable, errInvalidKeyID:
+		return true
+	}
+	return false
 }
 
-func (h *Handler) keys(l *Lookup) ([]*openpgp.PrimaryKey, error) {
-	rfps, err := h.resolve(l)
+// keys returns the keys matching the lookup, and the time they were last
+// modified in storage.
+func (h *Handler) keys(ctx context.Context, l *Lookup) ([]*openpgp.PrimaryKey, time.Time, error) {
+	var mtime time.Time
+	rfps, err := h.resolve(ctx, l)
 	if err != nil {
-		return nil, err
+		return nil, mtime, err
 	}
-	keys, err := h.storage.FetchKeys(rfps)
+	keyrings, err := h.storage.FetchKeyringsContext(ctx, rfps)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, mtime, errgo.Mask(err)
+	}
+	keys := make([]*openpgp.PrimaryKey, len(keyrings))
+	mtimes := make(map[string]time.Time)
+	for i, keyring := range keyrings {
+		keys[i] = keyring.PrimaryKey
+		mtimes[keyring.RFingerprint] = keyring.MTime
+		if err := openpgp.ValidSelfSigned(keys[i], h.selfSignedOnly); err != nil {
+			return nil, mtime, errgo.Mask(err)
+		}
+		if h.attestedCertsOnly {
+			if _, err := openpgp.DropUnattested(keys[i]); err != nil {
+				return nil, mtime, errgo.Mask(err)
+			}
+		}
+		if policy := h.certPolicy.WithoutLookups(); policy != nil {
+			if _, err := policy.Apply(keys[i], nil); err != nil {
+				return nil, mtime, errgo.Mask(err)
+			}
+		}
+	}
+	if h.verifier != nil {
+		keys, err = h.published(ctx, l, keys)
+		if err != nil {
+			return nil, mtime, errgo.Mask(err)
+		}
 	}
 	for _, key := range keys {
-		if err := openpgp.ValidSelfSigned(key, h.selfSignedOnly); err != nil {
-			return nil, errgo.Mask(err)
+		if t := mtimes[key.RFingerprint]; t.After(mtime) {
+			mtime = t
 		}
 		log.WithFields(log.Fields{
 			"fp":     key.Fingerprint(),
@@ -286,16 +577,111 @@ func (h *Handler) keys(l *Lookup) ([]*openpgp.PrimaryKey, error) {
 			"op":     l.Op,
 		}).Info("lookup")
 	}
-	return keys, nil
+	return keys, mtime, nil
+}
+
+// published removes unverified user IDs from the given keys. Keys found by
+// searching their user IDs are dropped unless the search matches a verified
+// one, so that unverified user IDs cannot be used to find keys.
+func (h *Handler) published(ctx context.Context, l *Lookup, keys []*openpgp.PrimaryKey) ([]*openpgp.PrimaryKey, error) {
+	err := h.verifier.Filter(ctx, keys)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if l.Op == OperationHGet || isKeyIDSearch(l.Search) {
+		return keys, nil
+	}
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		for _, uid := range key.UserIDs {
+			if matchesUserID(uid, l) {
+				result = append(result, key)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// isKeyIDSearch returns whether resolve looks up the given search by key ID
+// or fingerprint.
+func isKeyIDSearch(search string) bool {
+	if !strings.HasPrefix(search, "0x") {
+		return false
+	}
+	switch len(search) - 2 {
+	case shortKeyIDLen, longKeyIDLen, v3FingerprintKeyIDLen, fingerprintKeyIDLen, v6FingerprintKeyIDLen:
+		return true
+	}
+	return false
+}
+
+// matchesUserID returns whether the given user ID would match the search. A
+// keyword search matches if the user ID contains every word searched for,
+// ignoring case.
+func matchesUserID(uid *openpgp.UserID, l *Lookup) bool {
+	if l.Exact {
+		if email, ok := storage.ParseEmail(l.Search); ok {
+			uidEmail, ok := storage.ParseEmail(uid.Keywords)
+			return ok && uidEmail == email
+		}
+	}
+	keywords := strings.ToLower(uid.Keywords)
+	for _, word := range strings.Fields(strings.ToLower(l.Search)) {
+		if !strings.Contains(keywords, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// keysETag returns a strong entity tag for the given keys, derived from
+// their digests.
+func keysETag(keys []*openpgp.PrimaryKey) string {
+	if len(keys) == 1 {
+		return `"` + keys[0].MD5 + `"`
+	}
+	digest := md5.New()
+	for _, key := range keys {
+		digest.Write([]byte(key.MD5))
+	}
+	return `"` + hex.EncodeToString(digest.Sum(nil)) + `"`
+}
+
+// notModified returns whether the client already has the current response,
+// with the given entity tag and modification time, according to the
+// conditional request headers. If-Modified-Since is ignored if
+// If-None-Match is given, or if mtime is zero.
+func notModified(r *http.Request, etag string, mtime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !mtime.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !mtime.Truncate(time.Second).After(t)
+	}
+	return false
 }
 
-func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
-	keys, err := h.keys(l)
-	if err == errKeywordSearchNotAvailable {
+func (h *Handler) setCacheControl(w http.ResponseWriter, op Operation) {
+	if value, ok := h.cacheControl[op]; ok {
+		w.Header().Set("Cache-Control", value)
+	}
+}
+
+func (h *Handler) get(ctx context.Context, w http.ResponseWriter, r *http.Request, l *Lookup) {
+	keys, mtime, err := h.keys(ctx, l)
+	if isQueryError(err) {
 		httpError(w, http.StatusBadRequest, errgo.Mask(err))
 		return
 	} else if err != nil {
-		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		storageError(ctx, w, errgo.Mask(err))
 		return
 	}
 	if len(keys) == 0 {
@@ -303,6 +689,21 @@ func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
 		return
 	}
 
+	etag := keysETag(keys)
+	w.Header().Set("ETag", etag)
+	if h.verifier != nil {
+		// Verifying an email address publishes its user ID without
+		// modifying the key, so only the entity tag can be relied upon.
+		mtime = time.Time{}
+	} else if !mtime.IsZero() {
+		w.Header().Set("Last-Modified", mtime.UTC().Format(http.TimeFormat))
+	}
+	h.setCacheControl(w, l.Op)
+	if notModified(r, etag, mtime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// Drop malformed packets, since these break GPG imports.
 	for _, key := range keys {
 		var others []*openpgp.Packet
@@ -328,13 +729,13 @@ func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
 	}
 }
 
-func (h *Handler) index(w http.ResponseWriter, l *Lookup, f IndexFormat) {
-	keys, err := h.keys(l)
-	if err == errKeywordSearchNotAvailable {
+func (h *Handler) index(ctx context.Context, w http.ResponseWriter, l *Lookup, f IndexFormat) {
+	keys, _, err := h.keys(ctx, l)
+	if isQueryError(err) {
 		httpError(w, http.StatusBadRequest, errgo.Mask(err))
 		return
 	} else if err != nil {
-		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
+		storageError(ctx, w, errgo.Mask(err))
 		return
 	}
 	if len(keys) == 0 {
@@ -348,6 +749,7 @@ func (h *Handler) index(w http.ResponseWriter, l *Lookup, f IndexFormat) {
 		f = jsonFormat
 	}
 
+	h.setCacheControl(w, l.Op)
 	err = f.Write(w, l, keys)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, errgo.Mask(err))
@@ -400,9 +802,149 @@ func (h *Handler) stats(w http.ResponseWriter, l *Lookup) {
 }
 
 type AddResponse struct {
-	Inserted []string `json:"inserted"`
-	Updated  []string `json:"updated"`
-	Ignored  []string `json:"ignored"`
+	Inserted []string         `json:"inserted"`
+	Updated  []string         `json:"updated"`
+	Ignored  []string         `json:"ignored"`
+	Rejected []RejectedPacket `json:"rejected,omitempty"`
+
+	// Keys has the result for each key submitted, including those which
+	// were not stored.
+	Keys []AddResult `json:"keys"`
+
+	// DryRun is set when nothing was stored, as requested by the
+	// "dry-run" option.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// AddStatus is the outcome of adding a key.
+type AddStatus string
+
+const (
+	AddInserted  = AddStatus("inserted")
+	AddUpdated   = AddStatus("updated")
+	AddUnchanged = AddStatus("unchanged")
+	AddRejected  = AddStatus("rejected")
+	AddFailed    = AddStatus("error")
+)
+
+// AddReason says why a key was rejected or failed to be added.
+type AddReason string
+
+const (
+	ReasonBlacklisted     = AddReason("blacklisted")
+	ReasonTooLarge        = AddReason("too-large")
+	ReasonNoSelfSignature = AddReason("no-self-signature")
+	ReasonMalformed       = AddReason("malformed")
+	ReasonStorageError    = AddReason("storage-error")
+	ReasonPolicy          = AddReason("policy")
+	ReasonSuppressed      = AddReason("suppressed")
+)
+
+// AddResult describes the outcome of adding a single key.
+type AddResult struct {
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Status      AddStatus `json:"status"`
+	Reason      AddReason `json:"reason,omitempty"`
+
+	// Message explains the reason, where there is more to say, such as
+	// which rule of the key policy rejected the key.
+	Message string `json:"message,omitempty"`
+
+	// Dropped counts the malformed and oversized packets which were
+	// dropped from a key that was otherwise accepted.
+	Dropped int `json:"dropped,omitempty"`
+
+	// Diff summarizes the material added to the stored key.
+	Diff *AddDiff `json:"diff,omitempty"`
+}
+
+// AddDiff summarizes the material added to a stored key.
+type AddDiff struct {
+	UserIDs        []string `json:"uids,omitempty"`
+	UserAttributes int      `json:"uats,omitempty"`
+	SubKeys        []string `json:"subkeys,omitempty"`
+	Signatures     int      `json:"signatures,omitempty"`
+}
+
+func newAddDiff(diff *openpgp.KeyDiff) *AddDiff {
+	result := &AddDiff{
+		UserAttributes: len(diff.UserAttributes),
+		Signatures:     len(diff.Signatures),
+	}
+	for _, uid := range diff.UserIDs {
+		result.UserIDs = append(result.UserIDs, uid.Keywords)
+	}
+	for _, subKey := range diff.SubKeys {
+		result.SubKeys = append(result.SubKeys, subKey.QualifiedFingerprint())
+	}
+	return result
+}
+
+// RejectedPacket describes material which was not added to a key because
+// its holder has asked that it not be modified by others.
+type RejectedPacket struct {
+	// Fingerprint is the qualified fingerprint of the key the packet was
+	// submitted with, as in the other lists.
+	Fingerprint string `json:"fingerprint"`
+
+	// Type is one of "signature", "uid", "uat", "subkey" or "other".
+	Type string `json:"type"`
+
+	// Issuer is the key ID of the issuer of a rejected signature.
+	Issuer string `json:"issuer,omitempty"`
+
+	// UserID is the content of a rejected user ID.
+	UserID string `json:"uid,omitempty"`
+
+	// SubKey is the fingerprint of a rejected subkey.
+	SubKey string `json:"subkey,omitempty"`
+}
+
+func rejectedPackets(fp string, unowned *openpgp.Unowned) []RejectedPacket {
+	var result []RejectedPacket
+	for _, sig := range unowned.Signatures {
+		result = append(result, RejectedPacket{
+			Fingerprint: fp, Type: "signature", Issuer: strings.ToUpper(sig.IssuerKeyID()),
+		})
+	}
+	for _, uid := range unowned.UserIDs {
+		result = append(result, RejectedPacket{Fingerprint: fp, Type: "uid", UserID: uid.Keywords})
+	}
+	for range unowned.UserAttributes {
+		result = append(result, RejectedPacket{Fingerprint: fp, Type: "uat"})
+	}
+	for _, subKey := range unowned.SubKeys {
+		result = append(result, RejectedPacket{Fingerprint: fp, Type: "subkey", SubKey: subKey.QualifiedFingerprint()})
+	}
+	for range unowned.Others {
+		result = append(result, RejectedPacket{Fingerprint: fp, Type: "other"})
+	}
+	return result
+}
+
+// addBodies returns the readers of the key material posted, one for each
+// armor block of the keytext.
+func addBodies(add *Add) ([]io.Reader, error) {
+	if add.Binary {
+		return []io.Reader{strings.NewReader(add.Keytext)}, nil
+	}
+	var bodies []io.Reader
+	// armor.Decode reads from a bufio.Reader of sufficient size as given,
+	// so that it continues from the end of the previous block.
+	r := bufio.NewReader(strings.NewReader(add.Keytext))
+	for {
+		block, err := armor.Decode(r)
+		if err == io.EOF && len(bodies) > 0 {
+			return bodies, nil
+		} else if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		body, err := ioutil.ReadAll(block.Body)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		bodies = append(bodies, bytes.NewReader(body))
+	}
 }
 
 func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -413,48 +955,506 @@ func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 	}
 
 	// Check and decode the armor
-	armorBlock, err := armor.Decode(bytes.NewBufferString(add.Keytext))
+	bodies, err := addBodies(add)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, errgo.Mask(err))
 		return
 	}
 
-	var result AddResponse
-	kr := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...)
-	keys, err := kr.Read()
-	if err != nil {
-		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+	ctx, cancel := requestContext(r, h.addTimeout)
+	defer cancel()
+
+	// Every block is read before any key is stored, so that a request which
+	// cannot be read is refused as a whole.
+	var keys []*addKeyResult
+	for _, body := range bodies {
+		results, err := h.readAddKeys(body)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, errgo.Mask(err))
+			return
+		}
+		keys = append(keys, results...)
+	}
+
+	result := AddResponse{Keys: []AddResult{}, DryRun: add.Options[OptionDryRun]}
+	var stored int
+	var storageErr error
+	for _, kr := range keys {
+		if kr.key != nil {
+			err := h.addKey(ctx, add, kr.key, &kr.AddResult, &result)
+			if err != nil {
+				log.Errorf("add %q: %v", kr.Fingerprint, errgo.Details(err))
+				if storageErr == nil {
+					storageErr = err
+				}
+			} else {
+				stored++
+			}
+		}
+		result.Keys = append(result.Keys, kr.AddResult)
+	}
+	if stored == 0 && storageErr != nil {
+		storageError(ctx, w, errgo.Mask(storageErr))
 		return
 	}
-	for _, key := range keys {
-		err := openpgp.DropDuplicates(key)
+	log.WithFields(log.Fields{
+		"inserted": result.Inserted,
+		"updated":  result.Updated,
+		"rejected": len(result.Rejected),
+		"dryRun":   result.DryRun,
+	}).Info("add")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(&result)
+}
+
+// addKeyResult is a key read from an add request, with the result so far.
+// key is nil if the key was rejected while reading it.
+type addKeyResult struct {
+	AddResult
+	key *openpgp.PrimaryKey
+}
+
+// readAddKeys reads the keys posted in body, noting those which are rejected
+// and the packets dropped from the rest.
+func (h *Handler) readAddKeys(body io.Reader) ([]*addKeyResult, error) {
+	var results []*addKeyResult
+	dropped := make(map[string]int)
+	opts := append([]openpgp.KeyReaderOption{}, h.keyReaderOptions...)
+	opts = append(opts, openpgp.Dropped(func(fp string, reason openpgp.DropReason) {
+		switch reason {
+		case openpgp.DropBlacklisted:
+			results = append(results, &addKeyResult{AddResult: AddResult{
+				Fingerprint: fp, Status: AddRejected, Reason: ReasonBlacklisted,
+			}})
+		case openpgp.DropKeyTooLarge:
+			results = append(results, &addKeyResult{AddResult: AddResult{
+				Fingerprint: fp, Status: AddRejected, Reason: ReasonTooLarge,
+			}})
+		default:
+			dropped[fp]++
+		}
+	}))
+	okr, err := openpgp.NewOpaqueKeyReader(body, opts...)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	keyrings, err := okr.Read()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, keyring := range keyrings {
+		key, err := keyring.Parse()
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
-			return
+			log.Debugf("add: malformed key: %v", err)
+			results = append(results, &addKeyResult{AddResult: AddResult{
+				Status: AddRejected, Reason: ReasonMalformed,
+			}})
+			continue
+		}
+		kr := &addKeyResult{
+			AddResult: AddResult{Fingerprint: key.Fingerprint(), Dropped: dropped[key.Fingerprint()]},
+			key:       key,
 		}
-		change, err := storage.UpsertKey(h.storage, key)
+		n, err := openpgp.SanitizeKey(key)
+		kr.Dropped += n
+		if errgo.Cause(err) == openpgp.ErrNoSelfSignature {
+			kr.Status, kr.Reason, kr.key = AddRejected, ReasonNoSelfSignature, nil
+		} else if err != nil {
+			log.Debugf("add %q: %v", kr.Fingerprint, err)
+			kr.Status, kr.Reason, kr.key = AddRejected, ReasonMalformed, nil
+		}
+		results = append(results, kr)
+	}
+	return results, nil
+}
+
+// addKey stores the given key, recording the outcome in kr and the response.
+func (h *Handler) addKey(ctx context.Context, add *Add, key *openpgp.PrimaryKey, kr *AddResult, result *AddResponse) error {
+	var unowned openpgp.Unowned
+	var diff openpgp.KeyDiff
+	upsertOptions := []storage.UpsertOption{storage.Rejected(&unowned), storage.Diff(&diff)}
+	if add.Options[OptionNotModifiable] {
+		upsertOptions = append(upsertOptions, storage.NotModifiable())
+	}
+	if h.honourNoModify {
+		upsertOptions = append(upsertOptions, storage.HonourNoModify())
+	}
+	if h.certPolicy != nil {
+		upsertOptions = append(upsertOptions, storage.CertPolicy(h.certPolicy))
+	}
+	if h.keyPolicy != nil {
+		upsertOptions = append(upsertOptions, storage.KeyPolicy(h.keyPolicy))
+	}
+	if add.Options[OptionDryRun] {
+		upsertOptions = append(upsertOptions, storage.DryRun())
+	}
+	change, err := storage.UpsertKeyContext(ctx, h.storage, key, upsertOptions...)
+	if errgo.Cause(err) == openpgp.ErrKeyRejected {
+		kr.Status, kr.Reason, kr.Message = AddRejected, ReasonPolicy, err.Error()
+		return nil
+	} else if errgo.Cause(err) == storage.ErrKeySuppressed {
+		kr.Status, kr.Reason = AddRejected, ReasonSuppressed
+		return nil
+	} else if err != nil {
+		kr.Status, kr.Reason = AddFailed, ReasonStorageError
+		return errgo.Mask(err, errgo.Any)
+	}
+
+	fp := key.QualifiedFingerprint()
+	result.Rejected = append(result.Rejected, rejectedPackets(fp, &unowned)...)
+	switch change.(type) {
+	case storage.KeyAdded:
+		result.Inserted = append(result.Inserted, fp)
+		kr.Status = AddInserted
+	case storage.KeyReplaced:
+		result.Updated = append(result.Updated, fp)
+		kr.Status = AddUpdated
+	case storage.KeyNotChanged:
+		result.Ignored = append(result.Ignored, fp)
+		kr.Status = AddUnchanged
+	}
+	if kr.Status != AddUnchanged {
+		kr.Diff = newAddDiff(&diff)
+	}
+
+	if h.verifier != nil && !add.Options[OptionDryRun] {
+		_, err = h.verifier.RequestVerification(ctx, key)
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, errgo.Mask(err))
-			return
+			log.Errorf("add %q: verification request failed: %v", fp, errgo.Details(err))
 		}
+	}
+	return nil
+}
+
+var confirmVerifyTemplate = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Publish email address</title></head>
+<body>
+<form method="post" action="/pks/verify">
+<p>Publish the email address {{.Email}} with the OpenPGP key {{.Fingerprint}}?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="submit" value="Publish">
+</form>
+</body>
+</html>
+`))
+
+// ConfirmVerify asks the owner of an email address to confirm that it should
+// be published. Addresses are only published by the form it posts, so that
+// following a verification link does not publish the address by itself, as
+// when mail filters prefetch links.
+func (h *Handler) ConfirmVerify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	v, err := ParseVerify(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	fp, email, err := h.verifier.ParseToken(v.Token)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = confirmVerifyTemplate.Execute(w, struct {
+		Email, Fingerprint, Token string
+	}{email, strings.ToUpper(fp), v.Token})
+	if err != nil {
+		log.Errorf("verify: error writing confirmation: %v", err)
+	}
+}
 
+// Verify publishes the email address for which a verification token was
+// issued.
+func (h *Handler) Verify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	v, err := ParseVerify(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	ctx, cancel := requestContext(r, h.addTimeout)
+	defer cancel()
+	fp, email, err := h.verifier.Verify(ctx, v.Token)
+	if errgo.Cause(err) == verify.ErrInvalidToken {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	} else if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Published %s with key %s.\n", email, strings.ToUpper(fp))
+}
+
+type DeleteResponse struct {
+	Deleted []string `json:"deleted"`
+	Ignored []string `json:"ignored"`
+}
+
+// Delete removes the keys in the request, which must have been signed
+// recently by an administrator key. Keys are suppressed, if the storage
+// supports it, before they are deleted so that they are not recovered from
+// peers or uploaded again; those which were not stored are suppressed too.
+// The suppression can be lifted with hockeypuck-unsuppress.
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	del, err := ParseDelete(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+
+	ctx, cancel := requestContext(r, h.deleteTimeout)
+	defer cancel()
+
+	err = h.checkAdminSignature(ctx, del.Keytext, del.Keysig)
+	if err != nil {
+		httpError(w, http.StatusForbidden, errgo.Mask(err))
+		return
+	}
+
+	keys, err := openpgp.ReadArmorKeys(bytes.NewBufferString(del.Keytext))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+
+	suppressor, _ := h.storage.(storage.Suppressor)
+	var result DeleteResponse
+	for _, key := range keys {
 		fp := key.QualifiedFingerprint()
-		switch change.(type) {
-		case storage.KeyAdded:
-			result.Inserted = append(result.Inserted, fp)
-		case storage.KeyReplaced:
-			result.Updated = append(result.Updated, fp)
-		case storage.KeyNotChanged:
+		if suppressor != nil {
+			err := suppressor.Suppress(ctx, key.RFingerprint)
+			if err != nil {
+				storageError(ctx, w, errgo.Mask(err))
+				return
+			}
+		}
+		_, err := h.storage.DeleteContext(ctx, key.RFingerprint)
+		if storage.IsNotFound(err) {
 			result.Ignored = append(result.Ignored, fp)
+			continue
+		} else if err != nil {
+			storageError(ctx, w, errgo.Mask(err))
+			return
 		}
+		result.Deleted = append(result.Deleted, fp)
 	}
 	log.WithFields(log.Fields{
-		"inserted": result.Inserted,
-		"updated":  result.Updated,
-	}).Info("add")
+		"deleted": result.Deleted,
+	}).Info("delete")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	enc := json.NewEncoder(w)
 	enc.Encode(&result)
 }
+
+// TakedownChallenge responds with a challenge which the owner of a key signs
+// with it to have it taken down.
+func (h *Handler) TakedownChallenge(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tr, err := ParseTakedownRequest(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	ctx, cancel := requestContext(r, h.deleteTimeout)
+	defer cancel()
+	challenge, err := h.remover.Challenge(ctx, tr.Fingerprint)
+	if storage.IsNotFound(err) {
+		httpError(w, http.StatusNotFound, errgo.Mask(err))
+		return
+	} else if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, challenge)
+}
+
+// TakedownEmail mails a takedown link for a key to one of its addresses.
+func (h *Handler) TakedownEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tr, err := ParseTakedownRequest(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	} else if tr.Email == "" {
+		httpError(w, http.StatusBadRequest, errgo.New("missing required parameter: email"))
+		return
+	}
+	ctx, cancel := requestContext(r, h.deleteTimeout)
+	defer cancel()
+	err = h.remover.RequestToken(ctx, tr.Fingerprint, tr.Email)
+	if storage.IsNotFound(err) {
+		httpError(w, http.StatusNotFound, errgo.Mask(err))
+		return
+	} else if errgo.Cause(err) == takedown.ErrUnauthorized {
+		httpError(w, http.StatusForbidden, errgo.Mask(err))
+		return
+	} else if errgo.Cause(err) == takedown.ErrTooSoon {
+		httpError(w, http.StatusTooManyRequests, errgo.Mask(err))
+		return
+	} else if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Sent a takedown link for key %s to %s.\n", strings.ToUpper(tr.Fingerprint), tr.Email)
+}
+
+var confirmTakedownTemplate = template.Must(template.New("takedown").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Remove OpenPGP key</title></head>
+<body>
+<form method="post" action="/pks/takedown">
+<p>Remove the OpenPGP key {{.Fingerprint}}, requested by {{.Email}}, from this server?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="submit" value="Remove">
+</form>
+</body>
+</html>
+`))
+
+// ConfirmTakedown asks the recipient of a takedown link to confirm that the
+// key should be removed, so that following the link does not remove it by
+// itself.
+func (h *Handler) ConfirmTakedown(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	td, err := ParseTakedown(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	} else if td.Token == "" {
+		httpError(w, http.StatusBadRequest, errgo.New("missing required parameter: token"))
+		return
+	}
+	fp, email, err := h.remover.ParseToken(td.Token)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = confirmTakedownTemplate.Execute(w, struct {
+		Email, Fingerprint, Token string
+	}{email, strings.ToUpper(fp), td.Token})
+	if err != nil {
+		log.Errorf("takedown: error writing confirmation: %v", err)
+	}
+}
+
+// TakedownResponse is the response to a successful /pks/takedown request.
+type TakedownResponse struct {
+	Removed string `json:"removed"`
+}
+
+// Takedown removes a key whose owner has proven control of it, either with a
+// mailed token or by signing a challenge. Unlike Delete, it does not require
+// an administrator's signature.
+func (h *Handler) Takedown(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	td, err := ParseTakedown(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	}
+	ctx, cancel := requestContext(r, h.deleteTimeout)
+	defer cancel()
+
+	var fp string
+	if td.Token != "" {
+		if !h.remover.EmailEnabled() {
+			httpError(w, http.StatusBadRequest, errgo.New("takedown by email not enabled"))
+			return
+		}
+		fp, err = h.remover.RemoveByToken(ctx, td.Token, r.RemoteAddr)
+	} else {
+		fp, err = h.remover.RemoveSigned(ctx, td.Challenge, td.Keysig, r.RemoteAddr)
+	}
+	switch {
+	case err == nil:
+	case storage.IsNotFound(err):
+		httpError(w, http.StatusNotFound, errgo.Mask(err))
+		return
+	case errgo.Cause(err) == takedown.ErrInvalidToken:
+		httpError(w, http.StatusBadRequest, errgo.Mask(err))
+		return
+	case errgo.Cause(err) == takedown.ErrUnauthorized:
+		httpError(w, http.StatusForbidden, errgo.Mask(err))
+		return
+	default:
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(&TakedownResponse{Removed: strings.ToUpper(fp)})
+}
+
+// checkAdminSignature verifies that sigtext is a valid armored detached
+// signature over text, made by one of the configured administrator keys.
+// The creation time of the signature dates the request: it is refused once
+// the signature is older than the maximum age, or if the signature has been
+// used already.
+func (h *Handler) checkAdminSignature(ctx context.Context, text, sigtext string) error {
+	if len(h.adminKeys) == 0 {
+		return errgo.New("no admin keys configured")
+	}
+	var rfps []string
+	for _, fp := range h.adminKeys {
+		rfps = append(rfps, openpgp.Reverse(strings.ToLower(fp)))
+	}
+	adminKeys, err := h.storage.FetchKeysContext(ctx, rfps)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var sig *openpgp.Signature
+	var signer *openpgp.PrimaryKey
+	err = errgo.New("admin keys not found")
+	for _, key := range adminKeys {
+		sig, err = openpgp.CheckArmoredDetachedSignature(key, []byte(text), strings.NewReader(sigtext))
+		if err == nil {
+			signer = key
+			break
+		}
+	}
+	if signer == nil {
+		return errgo.Notef(err, "admin signature verification failed")
+	}
+	err = h.useAdminSignature(sig, time.Now())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	log.WithFields(log.Fields{
+		"fp": signer.Fingerprint(),
+	}).Info("admin request authorized")
+	return nil
+}
+
+// useAdminSignature records the use of an admin signature at the given time,
+// returning an error if it is stale, or has been used before. Signatures are
+// remembered until they are stale.
+func (h *Handler) useAdminSignature(sig *openpgp.Signature, now time.Time) error {
+	if sig.Creation.After(now.Add(maxAdminClockSkew)) {
+		return errgo.Newf("admin signature is dated %v, in the future", sig.Creation.UTC())
+	}
+	stale := sig.Creation.Add(h.adminSigMaxAge)
+	if !now.Before(stale) {
+		return errgo.Newf("admin signature made at %v is older than %v, sign the request again",
+			sig.Creation.UTC(), h.adminSigMaxAge)
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256(sig.Packet.Packet))
+
+	h.adminSigsMu.Lock()
+	defer h.adminSigsMu.Unlock()
+	for d, t := range h.adminSigs {
+		if !now.Before(t) {
+			delete(h.adminSigs, d)
+		}
+	}
+	if _, ok := h.adminSigs[digest]; ok {
+		return errgo.New("admin signature has already been used")
+	}
+	h.adminSigs[digest] = stale
+	return nil
+}
@@ -19,21 +19,36 @@ package hkp
 
 import (
 	"bytes"
+	"crypto"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strings"
 	stdtesting "testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
+	"hockeypuck/conflux/recon"
 	"hockeypuck/openpgp"
 	"hockeypuck/testing"
 
+	"hockeypuck/hkp/jsonhkp"
+	"hockeypuck/hkp/storage"
 	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/hkp/takedown"
+	"hockeypuck/hkp/verify"
 )
 
 type testKey struct {
@@ -124,7 +139,37 @@ func (s *HandlerSuite) TestGetKeyID(c *gc.C) {
 	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
 	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 1)
 	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
-	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("FetchKeyrings"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestGetShortKeyIDDisabled(c *gc.C) {
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, ShortKeyIDsDisabled(true))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + testKeyDefault.sid)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 0)
+
+	// Long key IDs are still allowed.
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + testKeyDefault.fp[24:])
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestGetInvalidKeyID(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x%25%25%25%25%25%25%25%25")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 0)
 }
 
 func (s *HandlerSuite) TestGetKeyword(c *gc.C) {
@@ -137,7 +182,42 @@ func (s *HandlerSuite) TestGetKeyword(c *gc.C) {
 	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
 	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 0)
 	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 1)
-	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("FetchKeyrings"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestGetExactEmail(c *gc.C) {
+	s.storage = mock.NewStorage(
+		mock.MatchEmail(func(emails []string) ([]string, error) {
+			c.Assert(emails, gc.DeepEquals, []string{"alice@example.com"})
+			return []string{testKeyDefault.fp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&exact=on&search=Alice%40EXAMPLE.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(s.storage.MethodCount("MatchEmail"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
+
+	// Without exact=on, or with a search which is not an address, keywords
+	// are matched as before.
+	for _, query := range []string{"search=alice%40example.com", "exact=on&search=alice"} {
+		res, err = http.Get(srv.URL + "/pks/lookup?op=get&" + query)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+	}
+	c.Assert(s.storage.MethodCount("MatchEmail"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 2)
 }
 
 func (s *HandlerSuite) TestGetMD5(c *gc.C) {
@@ -151,7 +231,83 @@ func (s *HandlerSuite) TestGetMD5(c *gc.C) {
 	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 1)
 	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 0)
 	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
-	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("FetchKeyrings"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestGetConditional(c *gc.C) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	key := openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file))[0]
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.FetchKeyrings(func([]string) ([]*storage.Keyring, error) {
+			key := openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file))[0]
+			return []*storage.Keyring{{PrimaryKey: key, CTime: mtime, MTime: mtime.Add(time.Second / 2)}}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st,
+		CacheControl(OperationGet, "public, max-age=300"),
+		CacheControl(OperationIndex, "no-cache"),
+	)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(op string, header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+"/pks/lookup?op="+op+"&search=0x"+testKeyDefault.fp, nil)
+		c.Assert(err, gc.IsNil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		_, err = ioutil.ReadAll(res.Body)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	res := get("get", nil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	etag := `"` + key.MD5 + `"`
+	c.Assert(res.Header.Get("ETag"), gc.Equals, etag)
+	c.Assert(res.Header.Get("Last-Modified"), gc.Equals, "Thu, 02 Jan 2020 03:04:05 GMT")
+	c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "public, max-age=300")
+
+	for _, t := range []struct {
+		header http.Header
+		status int
+	}{
+		{http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"other", W/` + etag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+		{http.Header{"If-Modified-Since": {"Thu, 02 Jan 2020 03:04:05 GMT"}}, http.StatusNotModified},
+		{http.Header{"If-Modified-Since": {"Thu, 02 Jan 2020 03:04:04 GMT"}}, http.StatusOK},
+		// If-None-Match takes precedence.
+		{http.Header{
+			"If-None-Match":     {`"other"`},
+			"If-Modified-Since": {"Thu, 02 Jan 2020 03:04:05 GMT"},
+		}, http.StatusOK},
+	} {
+		res := get("get", t.header)
+		c.Assert(res.StatusCode, gc.Equals, t.status, gc.Commentf("%v", t.header))
+		c.Assert(res.Header.Get("ETag"), gc.Equals, etag)
+		c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "public, max-age=300")
+	}
+
+	// Cache-Control is set per operation.
+	res = get("index", nil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "no-cache")
+	res = get("hget", nil)
+	c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "")
+
+	_, err = NewHandler(st, CacheControl(OperationStats, "no-cache"))
+	c.Assert(err, gc.ErrorMatches, `cannot set Cache-Control of operation "stats"`)
 }
 
 func (s *HandlerSuite) TestIndexAlice(c *gc.C) {
@@ -176,7 +332,7 @@ func (s *HandlerSuite) TestIndexAlice(c *gc.C) {
 	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
 	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
 	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 2)
-	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 2)
+	c.Assert(s.storage.MethodCount("FetchKeyrings"), gc.Equals, 2)
 }
 
 func (s *HandlerSuite) TestIndexAliceMR(c *gc.C) {
@@ -192,6 +348,113 @@ func (s *HandlerSuite) TestIndexAliceMR(c *gc.C) {
 	c.Assert(string(doc), gc.Equals, `info:1:1
 pub:361BC1F023E0DCCA:1:2048:1345589945::
 uid:alice <alice@example.com>:1345589945::
+sig:361BC1F023E0DCCA:1345589945::13
+sig:62AEA01D67640FB5:1345597811::10
+`)
+
+	res, err = http.Get(fmt.Sprintf("%s/pks/lookup?op=index&options=mr&search=0x"+tk.sid, s.srv.URL))
+	c.Assert(err, gc.IsNil)
+	doc, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(doc), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <alice@example.com>:1345589945::
+`)
+}
+
+func (s *HandlerSuite) TestIndexMRFlags(c *gc.C) {
+	// Expired keys are listed, flagged as such.
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("revok_orig.asc"))
+	w := httptest.NewRecorder()
+	err := mrFormat.Write(w, &Lookup{Op: OperationIndex}, keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Body.String(), gc.Equals, `info:1:1
+pub:0AAAE5A5B3ACD94D:1:2048:1452021269:1452107669:e
+uid:Test Test <test@example.com>:1452021269:1452107669:e
+`)
+
+	// Revoked user IDs are flagged, and user IDs are escaped.
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 1024}
+	entity, err := xopenpgp.NewEntity("Zoë: Test", "", "zoe@example.com", config)
+	c.Assert(err, gc.IsNil)
+	err = entity.SelfSign(config)
+	c.Assert(err, gc.IsNil)
+	for name, ident := range entity.Identities {
+		revocation := &packet.Signature{
+			SigType:      0x30, // certification revocation
+			PubKeyAlgo:   entity.PrimaryKey.PubKeyAlgo,
+			Hash:         crypto.SHA256,
+			CreationTime: ident.SelfSignature.CreationTime.Add(time.Minute),
+			IssuerKeyId:  &entity.PrimaryKey.KeyId,
+		}
+		err = revocation.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, config)
+		c.Assert(err, gc.IsNil)
+		ident.Signatures = append(ident.Signatures, revocation)
+	}
+	var buf bytes.Buffer
+	err = entity.Serialize(&buf)
+	c.Assert(err, gc.IsNil)
+	keys = openpgp.MustReadKeys(&buf)
+	c.Assert(keys, gc.HasLen, 1)
+
+	w = httptest.NewRecorder()
+	err = mrFormat.Write(w, &Lookup{Op: OperationIndex}, keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Body.String(), gc.Matches, `info:1:1
+pub:[0-9A-F]{16}:1:1024:\d+::
+uid:Zo%c3%ab%3a Test <zoe@example.com>:::r
+`)
+}
+
+func (s *HandlerSuite) TestIndexMRRenewed(c *gc.C) {
+	// A key which expired, and was then renewed without an expiration.
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := &packet.Config{
+		Algorithm: packet.PubKeyAlgoRSA,
+		RSABits:   1024,
+		Time:      func() time.Time { return created },
+	}
+	entity, err := xopenpgp.NewEntity("Renewed", "", "renewed@example.com", config)
+	c.Assert(err, gc.IsNil)
+	err = entity.SelfSign(config)
+	c.Assert(err, gc.IsNil)
+	for name, ident := range entity.Identities {
+		lifetime := uint32(86400)
+		expiring := &packet.Signature{
+			SigType:         packet.SigTypePositiveCert,
+			PubKeyAlgo:      entity.PrimaryKey.PubKeyAlgo,
+			Hash:            crypto.SHA256,
+			CreationTime:    created,
+			IssuerKeyId:     &entity.PrimaryKey.KeyId,
+			KeyLifetimeSecs: &lifetime,
+		}
+		err = expiring.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, config)
+		c.Assert(err, gc.IsNil)
+		renewed := &packet.Signature{
+			SigType:      packet.SigTypePositiveCert,
+			PubKeyAlgo:   entity.PrimaryKey.PubKeyAlgo,
+			Hash:         crypto.SHA256,
+			CreationTime: created.Add(48 * time.Hour),
+			IssuerKeyId:  &entity.PrimaryKey.KeyId,
+		}
+		err = renewed.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, config)
+		c.Assert(err, gc.IsNil)
+		ident.SelfSignature = expiring
+		ident.Signatures = []*packet.Signature{renewed}
+	}
+	var buf bytes.Buffer
+	err = entity.Serialize(&buf)
+	c.Assert(err, gc.IsNil)
+	keys := openpgp.MustReadKeys(&buf)
+	c.Assert(keys, gc.HasLen, 1)
+
+	w := httptest.NewRecorder()
+	err = mrFormat.Write(w, &Lookup{Op: OperationIndex}, keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Body.String(), gc.Matches, `info:1:1
+pub:[0-9A-F]{16}:1:1024:1577836800::
+uid:Renewed <renewed@example.com>:1578009600::
 `)
 }
 
@@ -231,6 +494,247 @@ func (s *HandlerSuite) TestAdd(c *gc.C) {
 	c.Assert(addRes.Ignored, gc.HasLen, 1)
 }
 
+func (s *HandlerSuite) TestAddNotModifiable(c *gc.C) {
+	storage := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(storage)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+		"options": []string{"nm"},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.Ignored, gc.HasLen, 1)
+	c.Assert(addRes.Rejected, gc.DeepEquals, []RejectedPacket{{
+		Fingerprint: "rsa2048/10fe8cf1b483f7525039aa2a361bc1f023e0dcca",
+		Type:        "signature",
+		Issuer:      "62AEA01D67640FB5",
+	}})
+	c.Assert(storage.MethodCount("Update"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestAddResults(c *gc.C) {
+	storage := mock.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(storage, KeyReaderOptions([]openpgp.KeyReaderOption{
+		openpgp.Blacklist([]string{"8d7c6b1a49166a46ff293af2d4236eabe68e311d"}),
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Several armor blocks may be posted in the keytext.
+	var keytext bytes.Buffer
+	for _, name := range []string{"alice_unsigned.asc", "e68e311d.asc"} {
+		b, err := ioutil.ReadAll(testing.MustInput(name))
+		c.Assert(err, gc.IsNil)
+		keytext.Write(b)
+	}
+	unsigned := openpgp.MustReadArmorKeys(testing.MustInput("d7346e26.asc"))
+	c.Assert(unsigned, gc.HasLen, 1)
+	unsigned[0].UserIDs = nil
+	unsigned[0].UserAttributes = nil
+	unsigned[0].SubKeys = nil
+	err = openpgp.WriteArmoredPackets(&keytext, unsigned)
+	c.Assert(err, gc.IsNil)
+
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{keytext.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.Inserted, gc.DeepEquals, []string{"rsa2048/10fe8cf1b483f7525039aa2a361bc1f023e0dcca"})
+	c.Assert(addRes.Keys, gc.HasLen, 3)
+	c.Assert(addRes.Keys[0].Fingerprint, gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(addRes.Keys[0].Status, gc.Equals, AddInserted)
+	c.Assert(addRes.Keys[0].Diff.UserIDs, gc.DeepEquals, []string{"alice <alice@example.com>"})
+	c.Assert(addRes.Keys[1], gc.DeepEquals, AddResult{
+		Fingerprint: "8d7c6b1a49166a46ff293af2d4236eabe68e311d",
+		Status:      AddRejected,
+		Reason:      ReasonBlacklisted,
+	})
+	c.Assert(addRes.Keys[2].Status, gc.Equals, AddRejected)
+	c.Assert(addRes.Keys[2].Reason, gc.Equals, ReasonNoSelfSignature)
+	c.Assert(storage.MethodCount("Insert"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestAddUnreadableBlock(c *gc.C) {
+	storage := mock.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(storage)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// A valid key, followed by a block which is not key material.
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	buf.Write(keytext)
+	enc, err := armor.Encode(&buf, xopenpgp.PublicKeyType, nil)
+	c.Assert(err, gc.IsNil)
+	_, err = enc.Write([]byte("not a key"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(enc.Close(), gc.IsNil)
+
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{buf.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	// Nothing is stored from a request which is refused.
+	c.Assert(storage.MethodCount("FetchKeys"), gc.Equals, 0)
+	c.Assert(storage.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestAddBinaryDryRun(c *gc.C) {
+	storage := mock.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(storage)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var body bytes.Buffer
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	err = openpgp.WritePackets(&body, key)
+	c.Assert(err, gc.IsNil)
+
+	res, err := http.Post(srv.URL+"/pks/add?options=dry-run", "application/pgp-keys", &body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.DryRun, gc.Equals, true)
+	c.Assert(addRes.Keys, gc.HasLen, 1)
+	c.Assert(addRes.Keys[0].Status, gc.Equals, AddInserted)
+	c.Assert(addRes.Keys[0].Diff, gc.DeepEquals, &AddDiff{
+		UserIDs:    []string{"alice <alice@example.com>"},
+		SubKeys:    []string{key.SubKeys[0].QualifiedFingerprint()},
+		Signatures: 2,
+	})
+	c.Assert(storage.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestAddStorageError(c *gc.C) {
+	storage := mock.NewStorage(
+		mock.Insert(func([]*openpgp.PrimaryKey) (int, error) {
+			return 0, errgo.New("boom")
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(storage)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusInternalServerError)
+}
+
+func (s *HandlerSuite) TestAddKeyPolicy(c *gc.C) {
+	storage := mock.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(storage, KeyPolicy(openpgp.MinRSABits(4096)))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var keytext bytes.Buffer
+	for _, name := range []string{"alice_unsigned.asc", "tails.asc"} {
+		b, err := ioutil.ReadAll(testing.MustInput(name))
+		c.Assert(err, gc.IsNil)
+		keytext.Write(b)
+	}
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{keytext.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.Keys, gc.HasLen, 2)
+	c.Assert(addRes.Keys[0], gc.DeepEquals, AddResult{
+		Fingerprint: "10fe8cf1b483f7525039aa2a361bc1f023e0dcca",
+		Status:      AddRejected,
+		Reason:      ReasonPolicy,
+		Message:     "RSA key 361bc1f023e0dcca has 2048 bits, fewer than 4096",
+	})
+	c.Assert(addRes.Keys[1].Status, gc.Equals, AddInserted)
+	c.Assert(storage.MethodCount("Insert"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestAddSuppressed(c *gc.C) {
+	storage := mock.NewStorage(mock.Suppressed(func(rfps []string) ([]string, error) {
+		return rfps, nil
+	}))
+	r := httprouter.New()
+	handler, err := NewHandler(storage)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.Keys, gc.DeepEquals, []AddResult{{
+		Fingerprint: "10fe8cf1b483f7525039aa2a361bc1f023e0dcca",
+		Status:      AddRejected,
+		Reason:      ReasonSuppressed,
+	}})
+	c.Assert(addRes.Ignored, gc.HasLen, 0)
+	c.Assert(storage.MethodCount("Insert"), gc.Equals, 0)
+}
+
 func (s *HandlerSuite) TestFetchWithBadSigs(c *gc.C) {
 	tk := testKeyBadSigs
 
@@ -246,3 +750,490 @@ func (s *HandlerSuite) TestFetchWithBadSigs(c *gc.C) {
 	c.Assert(keys[0].ShortID(), gc.Equals, tk.sid)
 	c.Assert(len(keys[0].Others), gc.Equals, 0)
 }
+
+func (s *HandlerSuite) TestFetchCertPolicy(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			// Only Alice's key is stored, not the issuer of the
+			// certification on it.
+			if keys[0] == testKeyDefault.rfp {
+				return []string{testKeyDefault.rfp}, nil
+			}
+			return nil, nil
+		}),
+		mock.FetchKeyrings(func([]string) ([]*storage.Keyring, error) {
+			key := openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file))[0]
+			return []*storage.Keyring{{PrimaryKey: key}}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, CertPolicy(&openpgp.CertPolicy{KnownIssuersOnly: true}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + testKeyDefault.fp)
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	// Issuers are checked as keys are stored, so are not looked up for
+	// each key served.
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	signed := openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file))[0]
+	c.Assert(keys[0].MD5, gc.Equals, signed.MD5)
+	c.Assert(st.MethodCount("Resolve"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestAttestedCertsOnly(c *gc.C) {
+	const bob, carol = "8a540eb0b84d8c4f", "dda31aed3596b178"
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"9b061a183e702093696f9c8d8ff6cc0e4aac8393"}, nil
+		}),
+		mock.FetchKeyrings(func([]string) ([]*storage.Keyring, error) {
+			key := openpgp.MustReadArmorKeys(testing.MustInput("attested.asc"))[0]
+			return []*storage.Keyring{{PrimaryKey: key}}, nil
+		}),
+	)
+	lookup := func(query string, options ...HandlerOption) []byte {
+		r := httprouter.New()
+		handler, err := NewHandler(st, options...)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+		res, err := http.Get(srv.URL + "/pks/lookup?search=0x390207e381a160b9&" + query)
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		return body
+	}
+
+	// The index shows which certifications are attested.
+	var keys []*jsonhkp.PrimaryKey
+	err := json.Unmarshal(lookup("op=vindex&options=json"), &keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	attested := make(map[string]bool)
+	for _, sig := range keys[0].UserIDs[0].Signatures {
+		attested[sig.IssuerKeyID] = sig.Attested
+	}
+	c.Assert(attested, gc.DeepEquals, map[string]bool{
+		"390207e381a160b9": false, bob: true, carol: false,
+	})
+
+	// Only attested certifications are served.
+	get := openpgp.MustReadArmorKeys(bytes.NewBuffer(lookup("op=get", AttestedCertsOnly(true))))
+	c.Assert(get, gc.HasLen, 1)
+	issuers := make(map[string]bool)
+	for _, sig := range get[0].UserIDs[0].Signatures {
+		issuers[sig.IssuerKeyID()] = true
+	}
+	c.Assert(issuers, gc.DeepEquals, map[string]bool{"390207e381a160b9": true, bob: true})
+}
+
+func (s *HandlerSuite) TestLookupTimeout(c *gc.C) {
+	storage := mock.NewStorage(
+		mock.MatchKeyword(func([]string) ([]string, error) {
+			time.Sleep(50 * time.Millisecond)
+			return nil, errgo.New("canceled")
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(storage, LookupTimeout(time.Millisecond))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusServiceUnavailable)
+	c.Assert(storage.MethodCount("FetchKeys"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestDeleteNoAdminKeys(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(s.srv.URL+"/pks/delete", url.Values{
+		"keytext": []string{string(keytext)},
+		"keysig":  []string{"bogus"},
+	})
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(s.storage.MethodCount("Delete"), gc.Equals, 0)
+}
+
+var testEntityConfig = &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+
+// newTestEntity generates a new signing key, returned both as a private
+// entity and as its parsed public key.
+func newTestEntity(c *gc.C, name string) (*xopenpgp.Entity, *openpgp.PrimaryKey) {
+	entity, err := xopenpgp.NewEntity(name, "", name+"@example.com", testEntityConfig)
+	c.Assert(err, gc.IsNil)
+	err = entity.SelfSign(testEntityConfig)
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	err = entity.Serialize(&buf)
+	c.Assert(err, gc.IsNil)
+	keys := openpgp.MustReadKeys(&buf)
+	c.Assert(keys, gc.HasLen, 1)
+	return entity, keys[0]
+}
+
+func (s *HandlerSuite) TestDeleteAdmin(c *gc.C) {
+	admin, adminKey := newTestEntity(c, "admin")
+	adminKeys := []*openpgp.PrimaryKey{adminKey}
+
+	var deleted, suppressed []string
+	storage := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return adminKeys, nil
+		}),
+		mock.Delete(func(rfp string) (string, error) {
+			deleted = append(deleted, rfp)
+			return "decafbad", nil
+		}),
+		mock.Suppress(func(rfp string) error {
+			suppressed = append(suppressed, rfp)
+			return nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(storage, AdminKeys([]string{adminKey.Fingerprint()}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+
+	// A signature by some other key is rejected.
+	other, _ := newTestEntity(c, "other")
+	var badSig bytes.Buffer
+	err = xopenpgp.ArmoredDetachSign(&badSig, other, bytes.NewBuffer(keytext), nil)
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/delete", url.Values{
+		"keytext": []string{string(keytext)},
+		"keysig":  []string{badSig.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(deleted, gc.HasLen, 0)
+
+	var sig bytes.Buffer
+	err = xopenpgp.ArmoredDetachSign(&sig, admin, bytes.NewBuffer(keytext), nil)
+	c.Assert(err, gc.IsNil)
+	res, err = http.PostForm(srv.URL+"/pks/delete", url.Values{
+		"keytext": []string{string(keytext)},
+		"keysig":  []string{sig.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	doc, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+
+	var delRes DeleteResponse
+	err = json.Unmarshal(doc, &delRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(delRes.Deleted, gc.HasLen, 1)
+	c.Assert(deleted, gc.DeepEquals, []string{testKeyDefault.rfp})
+	c.Assert(suppressed, gc.DeepEquals, []string{testKeyDefault.rfp})
+
+	// The same signed request cannot be replayed.
+	res, err = http.PostForm(srv.URL+"/pks/delete", url.Values{
+		"keytext": []string{string(keytext)},
+		"keysig":  []string{sig.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(deleted, gc.HasLen, 1)
+
+	// Nor can a request signed too long ago.
+	var staleSig bytes.Buffer
+	err = xopenpgp.ArmoredDetachSign(&staleSig, admin, bytes.NewBuffer(keytext), &packet.Config{
+		Time: func() time.Time { return time.Now().Add(-DefaultAdminSignatureMaxAge - time.Minute) },
+	})
+	c.Assert(err, gc.IsNil)
+	res, err = http.PostForm(srv.URL+"/pks/delete", url.Values{
+		"keytext": []string{string(keytext)},
+		"keysig":  []string{staleSig.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(deleted, gc.HasLen, 1)
+}
+
+func (s *HandlerSuite) TestDeleteAdminV6(c *gc.C) {
+	adminKey := openpgp.MustReadArmorKeys(testing.MustInput("rfc9580_v6.asc"))[0]
+	var deleted []string
+	storage := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{adminKey}, nil
+		}),
+		mock.Delete(func(rfp string) (string, error) {
+			deleted = append(deleted, rfp)
+			return "decafbad", nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(storage, AdminKeys([]string{adminKey.Fingerprint()}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	sig := testing.MustDetachSignV6(testing.RFC9580V6Seed, testing.RFC9580V6Fingerprint, time.Now(), keytext)
+	res, err := http.PostForm(srv.URL+"/pks/delete", url.Values{
+		"keytext": []string{string(keytext)},
+		"keysig":  []string{sig},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(deleted, gc.DeepEquals, []string{testKeyDefault.rfp})
+}
+
+type testMailSender struct {
+	msgs [][]byte
+}
+
+func (s *testMailSender) SendMail(from string, to []string, msg []byte) error {
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+// hashQuery requests the keys with the given digests as a recon peer does.
+func (s *HandlerSuite) hashQuery(c *gc.C, url string, digests ...string) []*openpgp.PrimaryKey {
+	var req bytes.Buffer
+	c.Assert(recon.WriteInt(&req, len(digests)), gc.IsNil)
+	for _, digest := range digests {
+		buf, err := hex.DecodeString(digest)
+		c.Assert(err, gc.IsNil)
+		c.Assert(recon.WriteInt(&req, len(buf)), gc.IsNil)
+		req.Write(buf)
+	}
+	res, err := http.Post(url+"/pks/hashquery", "sks/hashquery", &req)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	n, err := recon.ReadInt(res.Body)
+	c.Assert(err, gc.IsNil)
+	var keys []*openpgp.PrimaryKey
+	for i := 0; i < n; i++ {
+		size, err := recon.ReadInt(res.Body)
+		c.Assert(err, gc.IsNil)
+		buf := make([]byte, size)
+		_, err = io.ReadFull(res.Body, buf)
+		c.Assert(err, gc.IsNil)
+		kr := openpgp.NewKeyReader(bytes.NewBuffer(buf))
+		read, err := kr.Read()
+		c.Assert(err, gc.IsNil)
+		keys = append(keys, read...)
+	}
+	return keys
+}
+
+func (s *HandlerSuite) TestVerification(c *gc.C) {
+	states := map[string]storage.UIDStatus{}
+	s.storage = mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.MatchKeyword(func(keywords []string) ([]string, error) {
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.MatchMD5(func([]string) ([]string, error) {
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+		mock.UIDStates(func(rfps []string) (map[string][]storage.UIDStatus, error) {
+			result := map[string][]storage.UIDStatus{}
+			for _, status := range states {
+				result[testKeyDefault.rfp] = append(result[testKeyDefault.rfp], status)
+			}
+			return result, nil
+		}),
+		mock.SetUIDState(func(rfp string, status storage.UIDStatus) error {
+			c.Assert(rfp, gc.Equals, testKeyDefault.rfp)
+			states[status.Email] = status
+			return nil
+		}),
+	)
+	sender := &testMailSender{}
+	verifier, err := verify.NewVerifier(s.storage,
+		verify.Secret("sekrit"), verify.BaseURL("https://keys.example.com"),
+		verify.From("keyserver@example.com"), verify.Sender(sender))
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Verifier(verifier))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Unverified user IDs are not served, and cannot be searched for.
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + testKeyDefault.fp)
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 0)
+
+	// Nor are they served to recon peers.
+	keys = s.hashQuery(c, srv.URL, keys[0].MD5)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 0)
+
+	// Adding the key mails a verification link to its address.
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err = http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(sender.msgs, gc.HasLen, 1)
+	link := regexp.MustCompile(`https://keys\.example\.com(/pks/verify\?token=\S+)`).FindSubmatch(sender.msgs[0])
+	c.Assert(link, gc.HasLen, 2)
+	verifyURL, err := url.Parse(string(link[1]))
+	c.Assert(err, gc.IsNil)
+
+	// Following the link asks for confirmation without publishing.
+	res, err = http.Get(srv.URL + verifyURL.String())
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(string(doc), gc.Matches, `(?s).*<form method="post" action="/pks/verify">.*`)
+	c.Assert(states["alice@example.com"].State, gc.Equals, storage.UIDPending)
+
+	res, err = http.PostForm(srv.URL+"/pks/verify", verifyURL.Query())
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(states["alice@example.com"].State, gc.Equals, storage.UIDPublished)
+
+	// The token cannot be used again.
+	res, err = http.PostForm(srv.URL+"/pks/verify", verifyURL.Query())
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&search=alice")
+	c.Assert(err, gc.IsNil)
+	armor, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	keys = openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+}
+
+func (s *HandlerSuite) TestTakedownSigned(c *gc.C) {
+	owner, key := newTestEntity(c, "owner")
+	var deleted []string
+	s.storage = mock.NewStorage(
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			if len(rfps) == 1 && rfps[0] == key.RFingerprint {
+				return []*openpgp.PrimaryKey{key}, nil
+			}
+			return nil, nil
+		}),
+		mock.Delete(func(rfp string) (string, error) {
+			deleted = append(deleted, rfp)
+			return key.MD5, nil
+		}),
+	)
+	remover, err := takedown.NewRemover(s.storage, takedown.Secret("sekrit"))
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Remover(remover))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for fp, status := range map[string]int{
+		"0x" + key.Fingerprint():                   http.StatusOK,
+		"0000000000000000000000000000000000000000": http.StatusNotFound,
+		key.Fingerprint()[:16]:                     http.StatusBadRequest,
+	} {
+		res, err := http.PostForm(srv.URL+"/pks/takedown/challenge", url.Values{"fingerprint": {fp}})
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, status, gc.Commentf("fingerprint=%s", fp))
+	}
+
+	res, err := http.PostForm(srv.URL+"/pks/takedown/challenge", url.Values{"fingerprint": {key.Fingerprint()}})
+	c.Assert(err, gc.IsNil)
+	challenge, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	// Only the key's own signature over the challenge will do.
+	other, _ := newTestEntity(c, "other")
+	var badSig bytes.Buffer
+	err = xopenpgp.ArmoredDetachSign(&badSig, other, bytes.NewBuffer(challenge), nil)
+	c.Assert(err, gc.IsNil)
+	res, err = http.PostForm(srv.URL+"/pks/takedown", url.Values{
+		"challenge": {string(challenge)},
+		"keysig":    {badSig.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusForbidden)
+	c.Assert(deleted, gc.HasLen, 0)
+
+	// Takedown by email is not offered without a mail sender.
+	res, err = http.PostForm(srv.URL+"/pks/takedown", url.Values{"token": {"x.y"}})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+
+	var sig bytes.Buffer
+	err = xopenpgp.ArmoredDetachSign(&sig, owner, bytes.NewBuffer(challenge), nil)
+	c.Assert(err, gc.IsNil)
+	res, err = http.PostForm(srv.URL+"/pks/takedown", url.Values{
+		"challenge": {string(challenge)},
+		"keysig":    {sig.String()},
+	})
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var tdRes TakedownResponse
+	err = json.NewDecoder(res.Body).Decode(&tdRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(tdRes.Removed, gc.Equals, strings.ToUpper(key.Fingerprint()))
+	c.Assert(deleted, gc.DeepEquals, []string{key.RFingerprint})
+	c.Assert(s.storage.MethodCount("Suppress"), gc.Equals, 1)
+}
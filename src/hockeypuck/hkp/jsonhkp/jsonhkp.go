@@ -127,14 +127,33 @@ func NewPrimaryKey(from *openpgp.PrimaryKey) *PrimaryKey {
 		to.SubKeys = append(to.SubKeys, NewSubKey(fromSubKey))
 	}
 	for _, fromUid := range from.UserIDs {
-		to.UserIDs = append(to.UserIDs, NewUserID(fromUid))
+		uid := NewUserID(fromUid)
+		markAttested(uid.Signatures, fromUid.Signatures, fromUid.AttestedCerts(from))
+		to.UserIDs = append(to.UserIDs, uid)
 	}
 	for _, fromUat := range from.UserAttributes {
-		to.UserAttrs = append(to.UserAttrs, NewUserAttribute(fromUat))
+		uat := NewUserAttribute(fromUat)
+		markAttested(uat.Signatures, fromUat.Signatures, fromUat.AttestedCerts(from))
+		to.UserAttrs = append(to.UserAttrs, uat)
 	}
 	return to
 }
 
+// markAttested marks the signatures converted from the given ones which are
+// among the attested certifications.
+func markAttested(to []*Signature, from, attested []*openpgp.Signature) {
+	if len(attested) == 0 {
+		return
+	}
+	isAttested := make(map[*openpgp.Signature]bool)
+	for _, sig := range attested {
+		isAttested[sig] = true
+	}
+	for i, sig := range from {
+		to[i].Attested = isAttested[sig]
+	}
+}
+
 func (pk *PrimaryKey) Serialize(w io.Writer) error {
 	packets := pk.packets()
 	for _, packet := range packets {
@@ -226,6 +245,10 @@ type Signature struct {
 	Expiration   string  `json:"expiration,omitempty"`
 	NeverExpires bool    `json:"neverExpires,omitempty"`
 	Packet       *Packet `json:"packet,omitempty"`
+
+	// Attested is set on third-party certifications which the key holder
+	// has attested.
+	Attested bool `json:"attested,omitempty"`
 }
 
 func NewSignature(from *openpgp.Signature) *Signature {
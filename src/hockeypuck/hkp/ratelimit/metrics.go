@@ -0,0 +1,32 @@
+package ratelimit
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rateLimitMetrics = struct {
+	requestsThrottled *prometheus.CounterVec
+}{
+	requestsThrottled: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "http_requests_throttled",
+			Help:      "Requests refused by rate limiting since startup",
+		},
+		[]string{"operation"},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(rateLimitMetrics.requestsThrottled)
+	})
+}
+
+func recordThrottled(op string) {
+	rateLimitMetrics.requestsThrottled.WithLabelValues(op).Inc()
+}
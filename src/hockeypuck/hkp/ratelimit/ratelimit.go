@@ -0,0 +1,341 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package ratelimit throttles HKP clients with token buckets, kept per
+// client network and per operation.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	log "hockeypuck/logrus"
+)
+
+// Operations which may be limited.
+const (
+	OpGet       = "get"
+	OpIndex     = "index"
+	OpVIndex    = "vindex"
+	OpAdd       = "add"
+	OpHashQuery = "hashquery"
+	OpVerify    = "verify"
+	OpDelete    = "delete"
+
+	// OpTakedown covers every step of a takedown, including those which
+	// mail the key owner.
+	OpTakedown = "takedown"
+)
+
+const (
+	DefaultIPv4Prefix = 32
+	DefaultIPv6Prefix = 64
+
+	// sweepInterval is how often idle buckets are discarded.
+	sweepInterval = time.Minute
+)
+
+// Limit is a token bucket: Rate tokens are added per second, up to Burst,
+// and each request takes one. A zero Rate means no limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// fill adds the tokens accrued since the bucket was last used.
+func (b *bucket) fill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// take takes a token from the bucket if there is one. Otherwise it returns
+// how long until there will be.
+func (b *bucket) take(now time.Time) time.Duration {
+	b.fill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// IPMatcher matches client addresses, such as those of recon partners.
+type IPMatcher interface {
+	Match(ip net.IP) bool
+}
+
+// Limiter limits the rate of requests from each client network, for each
+// operation.
+type Limiter struct {
+	limits         map[string]Limit
+	ipv4Mask       net.IPMask
+	ipv6Mask       net.IPMask
+	exempt         []IPMatcher
+	exemptNets     []*net.IPNet
+	clientIPHeader string
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type Option func(l *Limiter) error
+
+// OpLimit limits the rate of the given operation for each client network.
+// Operations without a limit are not throttled.
+func OpLimit(op string, limit Limit) Option {
+	return func(l *Limiter) error {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return errgo.Newf("invalid rate limit for %q", op)
+		}
+		if limit.Rate > 0 {
+			if limit.Burst < 1 {
+				limit.Burst = 1
+			}
+			l.limits[op] = limit
+		}
+		return nil
+	}
+}
+
+// IPv4Prefix sets the prefix length of the networks into which IPv4 clients
+// are grouped. The default of 32 limits each address separately.
+func IPv4Prefix(bits int) Option {
+	return func(l *Limiter) error {
+		if bits < 1 || bits > 32 {
+			return errgo.Newf("invalid IPv4 prefix length %d", bits)
+		}
+		l.ipv4Mask = net.CIDRMask(bits, 32)
+		return nil
+	}
+}
+
+// IPv6Prefix sets the prefix length of the networks into which IPv6 clients
+// are grouped. The default of 64 limits each subnet as a single client,
+// since a host usually has a whole subnet to choose addresses from.
+func IPv6Prefix(bits int) Option {
+	return func(l *Limiter) error {
+		if bits < 1 || bits > 128 {
+			return errgo.Newf("invalid IPv6 prefix length %d", bits)
+		}
+		l.ipv6Mask = net.CIDRMask(bits, 128)
+		return nil
+	}
+}
+
+// Exempt does not throttle clients matched by the given matcher, such as
+// recon partners.
+func Exempt(m IPMatcher) Option {
+	return func(l *Limiter) error {
+		l.exempt = append(l.exempt, m)
+		return nil
+	}
+}
+
+// ExemptCIDRs does not throttle clients in the given networks.
+func ExemptCIDRs(cidrs []string) Option {
+	return func(l *Limiter) error {
+		for _, cidr := range cidrs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return errgo.Notef(err, "invalid exempt CIDR %q", cidr)
+			}
+			l.exemptNets = append(l.exemptNets, ipnet)
+		}
+		return nil
+	}
+}
+
+// ClientIPHeader identifies clients by the last address in the given request
+// header, such as X-Forwarded-For, as set by a trusted reverse proxy. Clients
+// are identified by their connection's remote address by default.
+func ClientIPHeader(header string) Option {
+	return func(l *Limiter) error {
+		l.clientIPHeader = http.CanonicalHeaderKey(header)
+		return nil
+	}
+}
+
+func NewLimiter(options ...Option) (*Limiter, error) {
+	l := &Limiter{
+		limits:   make(map[string]Limit),
+		ipv4Mask: net.CIDRMask(DefaultIPv4Prefix, 32),
+		ipv6Mask: net.CIDRMask(DefaultIPv6Prefix, 128),
+		buckets:  make(map[string]*bucket),
+		now:      time.Now,
+	}
+	for _, option := range options {
+		err := option(l)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	registerMetrics()
+	return l, nil
+}
+
+// Operation returns the limited operation requested, or "" if the request is
+// not subject to limits.
+func Operation(r *http.Request) string {
+	switch path := r.URL.Path; {
+	case path == "/pks/lookup":
+		switch op := strings.ToLower(r.URL.Query().Get("op")); op {
+		case OpIndex, OpVIndex:
+			return op
+		default:
+			return OpGet
+		}
+	case path == "/pks/add", path == "/vks/v1/upload":
+		return OpAdd
+	case path == "/pks/hashquery":
+		return OpHashQuery
+	case path == "/pks/verify":
+		return OpVerify
+	case path == "/pks/delete":
+		return OpDelete
+	case path == "/pks/takedown", strings.HasPrefix(path, "/pks/takedown/"):
+		return OpTakedown
+	case strings.HasPrefix(path, "/vks/v1/by-"), strings.HasPrefix(path, "/.well-known/openpgpkey/"):
+		return OpGet
+	}
+	return ""
+}
+
+// clientIP returns the address of the client making the request. If the
+// client IP header is missing or invalid, the client is identified by its
+// connection's remote address instead.
+func (l *Limiter) clientIP(r *http.Request) net.IP {
+	if l.clientIPHeader != "" {
+		if values := r.Header[l.clientIPHeader]; len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); ip != nil {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (l *Limiter) isExempt(ip net.IP) bool {
+	for _, m := range l.exempt {
+		if m.Match(ip) {
+			return true
+		}
+	}
+	for _, ipnet := range l.exemptNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// network returns the client network of the given address.
+func (l *Limiter) network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(l.ipv4Mask).String()
+	}
+	return ip.Mask(l.ipv6Mask).String()
+}
+
+// Take takes a token for an operation by a client, returning zero if the
+// operation may proceed, or otherwise how long the client should wait before
+// trying again.
+func (l *Limiter) Take(op string, ip net.IP) time.Duration {
+	limit, ok := l.limits[op]
+	if !ok || l.isExempt(ip) {
+		return 0
+	}
+	key := op + " " + l.network(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now)
+}
+
+// sweep discards the buckets which have refilled, since they are no
+// different from new ones.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.fill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Middleware refuses requests from clients which have exceeded their limit
+// with 429 Too Many Requests, saying when they may retry.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := Operation(r)
+		if op == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := l.clientIP(r)
+		if ip == nil {
+			// Clients without a known address, such as those connecting
+			// over a Unix socket, share a limit rather than none.
+			log.Debugf("rate limit: cannot determine client address of %q", r.RemoteAddr)
+			ip = net.IPv4zero
+		}
+		wait := l.Take(op, ip)
+		if wait == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recordThrottled(op)
+		log.WithFields(log.Fields{
+			"op":   op,
+			"from": ip.String(),
+			"wait": wait.String(),
+		}).Debug("rate limited")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	})
+}
@@ -0,0 +1,188 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type LimiterSuite struct {
+	now time.Time
+}
+
+var _ = gc.Suite(&LimiterSuite{})
+
+func (s *LimiterSuite) SetUpTest(c *gc.C) {
+	s.now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *LimiterSuite) newLimiter(c *gc.C, options ...Option) *Limiter {
+	l, err := NewLimiter(options...)
+	c.Assert(err, gc.IsNil)
+	l.now = func() time.Time { return s.now }
+	return l
+}
+
+type matcherFunc func(net.IP) bool
+
+func (f matcherFunc) Match(ip net.IP) bool { return f(ip) }
+
+func (s *LimiterSuite) TestNewLimiter(c *gc.C) {
+	_, err := NewLimiter(OpLimit(OpGet, Limit{Rate: -1}))
+	c.Assert(err, gc.ErrorMatches, `invalid rate limit for "get"`)
+	_, err = NewLimiter(IPv6Prefix(129))
+	c.Assert(err, gc.ErrorMatches, "invalid IPv6 prefix length 129")
+	_, err = NewLimiter(ExemptCIDRs([]string{"10.0.0.0"}))
+	c.Assert(err, gc.ErrorMatches, `invalid exempt CIDR "10.0.0.0": .*`)
+}
+
+func (s *LimiterSuite) TestTake(c *gc.C) {
+	l := s.newLimiter(c, OpLimit(OpIndex, Limit{Rate: 0.5, Burst: 2}))
+	ip := net.ParseIP("192.0.2.1")
+
+	// The burst is allowed, then one request every two seconds.
+	c.Assert(l.Take(OpIndex, ip), gc.Equals, time.Duration(0))
+	c.Assert(l.Take(OpIndex, ip), gc.Equals, time.Duration(0))
+	c.Assert(l.Take(OpIndex, ip), gc.Equals, 2*time.Second)
+	s.now = s.now.Add(time.Second)
+	c.Assert(l.Take(OpIndex, ip), gc.Equals, time.Second)
+	s.now = s.now.Add(time.Second)
+	c.Assert(l.Take(OpIndex, ip), gc.Equals, time.Duration(0))
+
+	// Other clients and operations are unaffected.
+	c.Assert(l.Take(OpIndex, net.ParseIP("192.0.2.2")), gc.Equals, time.Duration(0))
+	for i := 0; i < 10; i++ {
+		c.Assert(l.Take(OpGet, ip), gc.Equals, time.Duration(0))
+	}
+
+	// Buckets which have refilled are discarded.
+	c.Assert(l.buckets, gc.HasLen, 2)
+	s.now = s.now.Add(sweepInterval)
+	c.Assert(l.Take(OpIndex, ip), gc.Equals, time.Duration(0))
+	c.Assert(l.buckets, gc.HasLen, 1)
+}
+
+func (s *LimiterSuite) TestNetworks(c *gc.C) {
+	l := s.newLimiter(c, OpLimit(OpAdd, Limit{Rate: 1, Burst: 1}), IPv4Prefix(24))
+	c.Assert(l.Take(OpAdd, net.ParseIP("192.0.2.1")), gc.Equals, time.Duration(0))
+	c.Assert(l.Take(OpAdd, net.ParseIP("192.0.2.200")), gc.Equals, time.Second)
+	c.Assert(l.Take(OpAdd, net.ParseIP("198.51.100.1")), gc.Equals, time.Duration(0))
+
+	// IPv6 clients are grouped by /64 by default.
+	c.Assert(l.Take(OpAdd, net.ParseIP("2001:db8::1")), gc.Equals, time.Duration(0))
+	c.Assert(l.Take(OpAdd, net.ParseIP("2001:db8::ffff:1")), gc.Equals, time.Second)
+	c.Assert(l.Take(OpAdd, net.ParseIP("2001:db8:0:1::1")), gc.Equals, time.Duration(0))
+}
+
+func (s *LimiterSuite) TestExempt(c *gc.C) {
+	partner := net.ParseIP("203.0.113.5")
+	l := s.newLimiter(c,
+		OpLimit(OpHashQuery, Limit{Rate: 1, Burst: 1}),
+		Exempt(matcherFunc(func(ip net.IP) bool { return ip.Equal(partner) })),
+		ExemptCIDRs([]string{"10.0.0.0/8"}),
+	)
+	for _, ip := range []net.IP{partner, net.ParseIP("10.1.2.3")} {
+		for i := 0; i < 3; i++ {
+			c.Assert(l.Take(OpHashQuery, ip), gc.Equals, time.Duration(0))
+		}
+	}
+	ip := net.ParseIP("192.0.2.1")
+	c.Assert(l.Take(OpHashQuery, ip), gc.Equals, time.Duration(0))
+	c.Assert(l.Take(OpHashQuery, ip), gc.Equals, time.Second)
+}
+
+func (s *LimiterSuite) TestOperation(c *gc.C) {
+	for _, t := range []struct {
+		method, url, op string
+	}{
+		{"GET", "/pks/lookup?op=get&search=0xdeadbeef", OpGet},
+		{"GET", "/pks/lookup?op=INDEX&search=alice", OpIndex},
+		{"GET", "/pks/lookup?op=vindex&search=alice", OpVIndex},
+		{"GET", "/pks/lookup?op=hget&search=00", OpGet},
+		{"POST", "/pks/add", OpAdd},
+		{"POST", "/vks/v1/upload", OpAdd},
+		{"POST", "/pks/hashquery", OpHashQuery},
+		{"POST", "/pks/verify", OpVerify},
+		{"GET", "/pks/verify?token=abc", OpVerify},
+		{"POST", "/pks/delete", OpDelete},
+		{"POST", "/pks/takedown/email", OpTakedown},
+		{"POST", "/pks/takedown/challenge", OpTakedown},
+		{"GET", "/pks/takedown?token=abc", OpTakedown},
+		{"POST", "/pks/takedown", OpTakedown},
+		{"GET", "/vks/v1/by-email/alice@example.com", OpGet},
+		{"GET", "/.well-known/openpgpkey/hu/abc", OpGet},
+		{"GET", "/", ""},
+		{"GET", "/pks/stats", ""},
+	} {
+		r := httptest.NewRequest(t.method, t.url, nil)
+		c.Check(Operation(r), gc.Equals, t.op, gc.Commentf("%s %s", t.method, t.url))
+	}
+}
+
+func (s *LimiterSuite) TestMiddleware(c *gc.C) {
+	l := s.newLimiter(c, OpLimit(OpIndex, Limit{Rate: 0.4, Burst: 1}), ClientIPHeader("x-forwarded-for"))
+	var served int
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+	do := func(url, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("/pks/lookup?op=index&search=alice", "127.0.0.1:1234", "198.51.100.1, 192.0.2.1")
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	w = do("/pks/lookup?op=index&search=bob", "127.0.0.1:1234", "192.0.2.1")
+	c.Assert(w.Code, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(w.Header().Get("Retry-After"), gc.Equals, "3")
+	c.Assert(served, gc.Equals, 1)
+
+	// The proxy's own address and unlimited operations are not throttled.
+	w = do("/pks/lookup?op=index&search=bob", "127.0.0.1:1234", "")
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	w = do("/pks/lookup?op=get&search=0xdeadbeef", "127.0.0.1:1234", "192.0.2.1")
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	c.Assert(served, gc.Equals, 3)
+
+	// Without a valid forwarded address, clients are limited by their
+	// remote address.
+	w = do("/pks/lookup?op=index&search=bob", "127.0.0.1:1234", "bogus")
+	c.Assert(w.Code, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(served, gc.Equals, 3)
+
+	// Clients without any address share a limit.
+	w = do("/pks/lookup?op=index&search=bob", "@", "")
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	w = do("/pks/lookup?op=index&search=bob", "", "not an address")
+	c.Assert(w.Code, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(served, gc.Equals, 4)
+}
@@ -20,7 +20,9 @@ package hkp
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
 
@@ -57,6 +59,7 @@ const (
 	OptionMachineReadable = Option("mr")
 	OptionJSON            = Option("json")
 	OptionNotModifiable   = Option("nm")
+	OptionDryRun          = Option("dry-run")
 )
 
 type OptionSet map[Option]bool
@@ -122,14 +125,39 @@ func ParseLookup(req *http.Request) (*Lookup, error) {
 type Add struct {
 	Keytext string
 	Options OptionSet
+
+	// Binary is set when Keytext holds unarmored keys, posted as the
+	// request body with the application/pgp-keys content type.
+	Binary bool
 }
 
+// maxAddBodyLen limits the length of keys posted as the request body, as
+// net/http limits that of form content.
+const maxAddBodyLen = 10 << 20
+
 func ParseAdd(req *http.Request) (*Add, error) {
 	if req.Method != "POST" {
 		return nil, errgo.Newf("invalid HTTP method: %s", req.Method)
 	}
 
 	var add Add
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/pgp-keys" {
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxAddBodyLen+1))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if len(body) > maxAddBodyLen {
+			return nil, errgo.Newf("request body too large")
+		}
+		if len(body) == 0 {
+			return nil, errgo.Newf("missing request body")
+		}
+		add.Keytext = string(body)
+		add.Binary = !bytes.HasPrefix(bytes.TrimSpace(body), []byte("-----BEGIN "))
+		add.Options = ParseOptionSet(req.URL.Query().Get("options"))
+		return &add, nil
+	}
+
 	// Parse the URL query parameters
 	err := req.ParseForm()
 	if err != nil {
@@ -146,6 +174,122 @@ func ParseAdd(req *http.Request) (*Add, error) {
 	return &add, nil
 }
 
+// Delete represents a valid /pks/delete request content and parameters.
+type Delete struct {
+	// Keytext contains the armored public keys to be deleted.
+	Keytext string
+
+	// Keysig contains an armored detached signature over Keytext, made by
+	// one of the server's administrator keys.
+	Keysig string
+}
+
+func ParseDelete(req *http.Request) (*Delete, error) {
+	if req.Method != "POST" {
+		return nil, errgo.Newf("invalid HTTP method: %s", req.Method)
+	}
+
+	var del Delete
+	err := req.ParseForm()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	del.Keytext = req.Form.Get("keytext")
+	if del.Keytext == "" {
+		return nil, errgo.Newf("missing required parameter: keytext")
+	}
+	del.Keysig = req.Form.Get("keysig")
+	if del.Keysig == "" {
+		return nil, errgo.Newf("missing required parameter: keysig")
+	}
+
+	return &del, nil
+}
+
+// Verify contains the token of a /pks/verify request, which confirms that
+// an email address may be published.
+type Verify struct {
+	Token string
+}
+
+func ParseVerify(req *http.Request) (*Verify, error) {
+	err := req.ParseForm()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	var v Verify
+	v.Token = req.Form.Get("token")
+	if v.Token == "" {
+		return nil, errgo.Newf("missing required parameter: token")
+	}
+	return &v, nil
+}
+
+// TakedownRequest contains the parameters of a /pks/takedown/challenge or
+// /pks/takedown/email request, which begin the removal of a key by its owner.
+type TakedownRequest struct {
+	// Fingerprint is the lower case fingerprint of the key to be removed.
+	Fingerprint string
+
+	// Email is the address to which a takedown link is to be mailed.
+	Email string
+}
+
+func ParseTakedownRequest(req *http.Request) (*TakedownRequest, error) {
+	if req.Method != "POST" {
+		return nil, errgo.Newf("invalid HTTP method: %s", req.Method)
+	}
+	err := req.ParseForm()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	var tr TakedownRequest
+	fp := strings.ToLower(strings.TrimPrefix(req.Form.Get("fingerprint"), "0x"))
+	if fp == "" {
+		return nil, errgo.Newf("missing required parameter: fingerprint")
+	} else if _, err := hex.DecodeString(fp); err != nil || len(fp) != fingerprintKeyIDLen {
+		return nil, errgo.Newf("invalid fingerprint %q", req.Form.Get("fingerprint"))
+	}
+	tr.Fingerprint = fp
+	tr.Email = req.Form.Get("email")
+	return &tr, nil
+}
+
+// Takedown contains the proof of control of a /pks/takedown request: either
+// a token mailed to an address of the key, or a challenge with a detached
+// signature over it made by the key.
+type Takedown struct {
+	Token string
+
+	Challenge string
+	Keysig    string
+}
+
+func ParseTakedown(req *http.Request) (*Takedown, error) {
+	err := req.ParseForm()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	var td Takedown
+	td.Token = req.Form.Get("token")
+	if td.Token != "" {
+		return &td, nil
+	}
+	td.Challenge = req.Form.Get("challenge")
+	if td.Challenge == "" {
+		return nil, errgo.Newf("missing required parameter: token or challenge")
+	}
+	td.Keysig = req.Form.Get("keysig")
+	if td.Keysig == "" {
+		return nil, errgo.Newf("missing required parameter: keysig")
+	}
+	return &td, nil
+}
+
 type HashQuery struct {
 	Digests []string
 }
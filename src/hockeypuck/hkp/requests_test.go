@@ -145,6 +145,26 @@ func (s *RequestsSuite) TestAddOptions(c *gc.C) {
 	c.Assert(add.Options[OptionNotModifiable], gc.Equals, false)
 }
 
+func (s *RequestsSuite) TestAddBinary(c *gc.C) {
+	req, err := http.NewRequest("POST", "/pks/add?options=nm,dry-run", bytes.NewBufferString("\x99\x01\x0d"))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/pgp-keys")
+	add, err := ParseAdd(req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(add.Keytext, gc.Equals, "\x99\x01\x0d")
+	c.Assert(add.Binary, gc.Equals, true)
+	c.Assert(add.Options[OptionNotModifiable], gc.Equals, true)
+	c.Assert(add.Options[OptionDryRun], gc.Equals, true)
+
+	// Armored keys may be posted the same way.
+	req, err = http.NewRequest("POST", "/pks/add", bytes.NewBufferString("-----BEGIN PGP PUBLIC KEY BLOCK-----\n"))
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Content-Type", "application/pgp-keys; charset=us-ascii")
+	add, err = ParseAdd(req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(add.Binary, gc.Equals, false)
+}
+
 func (s *RequestsSuite) TestAddMissingKey(c *gc.C) {
 	// here's my key. wait, i forgot it.
 	testUrl, err := url.Parse("/pks/add")
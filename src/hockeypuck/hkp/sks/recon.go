@@ -19,6 +19,7 @@ package sks
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -56,6 +57,7 @@ type Peer struct {
 	ptree            recon.PrefixTree
 	http             *http.Client
 	keyReaderOptions []openpgp.KeyReaderOption
+	upsertOptions    []storage.UpsertOption
 
 	path  string
 	stats *Stats
@@ -105,6 +107,12 @@ func NewPeer(st storage.Storage, path string, s *recon.Settings, opts []openpgp.
 	return sksPeer, nil
 }
 
+// SetUpsertOptions sets the options with which keys recovered from peers
+// are merged into storage. It must be called before the peer is started.
+func (p *Peer) SetUpsertOptions(opts []storage.UpsertOption) {
+	p.upsertOptions = opts
+}
+
 func (p *Peer) log(label string) *log.Entry {
 	return p.logFields(label, log.Fields{})
 }
@@ -230,6 +238,8 @@ func (r *Peer) updateDigests(change storage.KeyChange) error {
 }
 
 func (r *Peer) handleRecovery() error {
+	// Recovery in progress is abandoned when the peer is stopped.
+	ctx := r.t.Context(nil)
 	for {
 		select {
 		case <-r.t.Dying():
@@ -237,7 +247,7 @@ func (r *Peer) handleRecovery() error {
 		case rcvr := <-r.peer.RecoverChan:
 			func() {
 				defer close(rcvr.Done)
-				if err := r.requestRecovered(rcvr); err != nil {
+				if err := r.requestRecovered(ctx, rcvr); err != nil {
 					r.logAddr(RECON, rcvr.RemoteAddr).Errorf("recovery completed with errors: %v", err)
 				}
 			}()
@@ -245,10 +255,13 @@ func (r *Peer) handleRecovery() error {
 	}
 }
 
-func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
+func (r *Peer) requestRecovered(ctx context.Context, rcvr *recon.Recover) error {
 	items := rcvr.RemoteElements
 	errCount := 0
 	for len(items) > 0 {
+		if err := ctx.Err(); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
 		// Chunk requests to keep the hashquery message size and peer load reasonable.
 		chunksize := requestChunkSize
 		if chunksize > len(items) {
@@ -257,7 +270,7 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 		chunk := items[:chunksize]
 		items = items[chunksize:]
 
-		err := r.requestChunk(rcvr, chunk)
+		err := r.requestChunk(ctx, rcvr, chunk)
 		if err != nil {
 			r.logAddr(RECON, rcvr.RemoteAddr).Errorf("failed to request chunk of %d keys: %v", len(chunk), err)
 			errCount += 1
@@ -269,7 +282,7 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 	return nil
 }
 
-func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
+func (r *Peer) requestChunk(ctx context.Context, rcvr *recon.Recover, chunk []cf.Zp) error {
 	var remoteAddr string
 	remoteAddr, err := rcvr.HkpAddr()
 	if err != nil {
@@ -298,7 +311,12 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 	}
 
 	url := fmt.Sprintf("http://%s/pks/hashquery", remoteAddr)
-	resp, err := r.http.Post(url, "sks/hashquery", bytes.NewReader(hqBuf.Bytes()))
+	req, err := http.NewRequest("POST", url, bytes.NewReader(hqBuf.Bytes()))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "sks/hashquery")
+	resp, err := r.http.Do(req.WithContext(ctx))
 	if err != nil {
 		return errgo.NoteMask(err, "failed to query hashes")
 	}
@@ -329,6 +347,7 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 		fields.Data["inserted"] = summary.inserted
 		fields.Data["updated"] = summary.updated
 		fields.Data["unchanged"] = summary.unchanged
+		fields.Data["rejected"] = summary.rejected
 		fields.Infof("upsert")
 	}()
 	for i := 0; i < nkeys; i++ {
@@ -343,9 +362,12 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 		}
 		r.logAddr(RECON, rcvr.RemoteAddr).Debugf("key# %d: %d bytes", i+1, keyLen)
 		// Merge locally
-		res, err := r.upsertKeys(rcvr, keyBuf.Bytes())
-		if err != nil {
+		res, err := r.upsertKeys(ctx, rcvr, keyBuf.Bytes())
+		if ctx.Err() != nil {
+			return errgo.Mask(ctx.Err(), errgo.Any)
+		} else if err != nil {
 			r.logAddr(RECON, rcvr.RemoteAddr).Errorf("cannot upsert: %v", err)
+			continue
 		}
 		summary.add(res)
 	}
@@ -358,15 +380,17 @@ type upsertResult struct {
 	inserted  int
 	updated   int
 	unchanged int
+	rejected  int
 }
 
 func (r *upsertResult) add(r2 *upsertResult) {
 	r.inserted += r2.inserted
 	r.updated += r2.updated
 	r.unchanged += r2.unchanged
+	r.rejected += r2.rejected
 }
 
-func (r *Peer) upsertKeys(rcvr *recon.Recover, buf []byte) (*upsertResult, error) {
+func (r *Peer) upsertKeys(ctx context.Context, rcvr *recon.Recover, buf []byte) (*upsertResult, error) {
 	kr := openpgp.NewKeyReader(bytes.NewBuffer(buf), r.keyReaderOptions...)
 	keys, err := kr.Read()
 	if err != nil {
@@ -378,8 +402,12 @@ func (r *Peer) upsertKeys(rcvr *recon.Recover, buf []byte) (*upsertResult, error
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
-		keyChange, err := storage.UpsertKey(r.storage, key)
-		if err != nil {
+		keyChange, err := storage.UpsertKeyContext(ctx, r.storage, key, r.upsertOptions...)
+		if cause := errgo.Cause(err); cause == openpgp.ErrKeyRejected || cause == storage.ErrKeySuppressed {
+			r.logAddr(RECON, rcvr.RemoteAddr).Debugf("rejected key %q: %v", key.Fingerprint(), err)
+			result.rejected++
+			continue
+		} else if err != nil {
 			return nil, errgo.Mask(err)
 		}
 		r.logAddr(RECON, rcvr.RemoteAddr).Debug(keyChange)
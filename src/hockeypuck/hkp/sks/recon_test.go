@@ -18,7 +18,9 @@
 package sks
 
 import (
-	"testing"
+	"bytes"
+	"context"
+	stdtesting "testing"
 	"time"
 
 	gc "gopkg.in/check.v1"
@@ -26,9 +28,11 @@ import (
 	"hockeypuck/conflux/recon"
 	"hockeypuck/hkp/storage"
 	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
 )
 
-func Test(t *testing.T) { gc.TestingT(t) }
+func Test(t *stdtesting.T) { gc.TestingT(t) }
 
 type SksSuite struct {
 	peer *Peer
@@ -66,4 +70,23 @@ func (s *SksSuite) TestPeerStats(c *gc.C) {
 	c.Assert(s.peer.stats.Hourly[thisHour].Updated, gc.Equals, 1)
 	c.Assert(s.peer.stats.Daily[thisDay].Inserted, gc.Equals, 1)
 	c.Assert(s.peer.stats.Daily[thisDay].Updated, gc.Equals, 1)
+
+	s.peer.updateDigests(storage.KeyRemoved{Digest: "cafebabe"})
+	c.Assert(s.peer.stats.Total, gc.Equals, 0)
+	c.Assert(s.peer.stats.Hourly[thisHour].Removed, gc.Equals, 1)
+	c.Assert(s.peer.stats.Daily[thisDay].Removed, gc.Equals, 1)
+}
+
+func (s *SksSuite) TestUpsertKeysPolicy(c *gc.C) {
+	s.peer.SetUpsertOptions([]storage.UpsertOption{storage.KeyPolicy(openpgp.MinRSABits(4096))})
+	var buf bytes.Buffer
+	for _, name := range []string{"alice_unsigned.asc", "tails.asc"} {
+		keys := openpgp.MustReadArmorKeys(testing.MustInput(name))
+		err := openpgp.WritePackets(&buf, keys[0])
+		c.Assert(err, gc.IsNil)
+	}
+	// Keys the policy rejects are skipped, without failing the rest.
+	result, err := s.peer.upsertKeys(context.Background(), &recon.Recover{}, buf.Bytes())
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.DeepEquals, &upsertResult{inserted: 1, rejected: 1})
 }
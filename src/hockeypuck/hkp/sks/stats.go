@@ -30,6 +30,7 @@ import (
 type LoadStat struct {
 	Inserted int
 	Updated  int
+	Removed  int
 }
 
 type LoadStatMap map[time.Time]*LoadStat
@@ -69,6 +70,8 @@ func (m LoadStatMap) update(t time.Time, kc storage.KeyChange) {
 		ls.Inserted++
 	case storage.KeyReplaced:
 		ls.Updated++
+	case storage.KeyRemoved:
+		ls.Removed++
 	}
 }
 
@@ -121,6 +124,8 @@ func (s *Stats) Update(kc storage.KeyChange) {
 	switch kc.(type) {
 	case storage.KeyAdded:
 		s.Total++
+	case storage.KeyRemoved:
+		s.Total--
 	}
 }
 
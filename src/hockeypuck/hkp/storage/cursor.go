@@ -0,0 +1,158 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// KeyringOrder selects the order in which a KeyringCursor visits keyrings.
+type KeyringOrder int
+
+const (
+	// ByRFingerprint visits keyrings in ascending RFingerprint order.
+	ByRFingerprint KeyringOrder = iota
+
+	// ByMTime visits keyrings in ascending modification time order, oldest
+	// first. Keyrings modified at the same time are visited in RFingerprint
+	// order.
+	ByMTime
+)
+
+func (o KeyringOrder) String() string {
+	switch o {
+	case ByRFingerprint:
+		return "rfingerprint"
+	case ByMTime:
+		return "mtime"
+	}
+	return "unknown"
+}
+
+// Checkpoint marks a position in an iteration over keyrings. Iteration
+// resumed from a checkpoint starts with the keyring following it; the zero
+// Checkpoint starts from the beginning.
+type Checkpoint struct {
+	RFingerprint string    `json:"rfingerprint"`
+	MTime        time.Time `json:"mtime"`
+}
+
+// IsZero returns whether the checkpoint marks the start of iteration.
+func (cp Checkpoint) IsZero() bool {
+	return cp.RFingerprint == "" && cp.MTime.IsZero()
+}
+
+// CheckpointOf returns the checkpoint following the given keyring.
+func CheckpointOf(kr *Keyring) Checkpoint {
+	return Checkpoint{RFingerprint: kr.RFingerprint, MTime: kr.MTime}
+}
+
+// KeyringCursor iterates over stored keyrings. Records which cannot be read
+// as keyrings are logged and skipped, and the checkpoint moves past them. It
+// must be closed when no longer needed.
+type KeyringCursor interface {
+	io.Closer
+
+	// Next advances the cursor to the next keyring. It returns false when
+	// there are no more keyrings, or when iteration stopped due to an error.
+	Next() bool
+
+	// Keyring returns the keyring at the cursor's current position.
+	Keyring() *Keyring
+
+	// Checkpoint returns a checkpoint from which iteration may be resumed
+	// after the current keyring.
+	Checkpoint() Checkpoint
+
+	// Err returns the error which stopped iteration, if any.
+	Err() error
+}
+
+// BatchFetcher returns the batch of keyrings following a checkpoint, and the
+// checkpoint following the last record it read. The records read may include
+// some which could not be read as keyrings and were skipped, so the batch may
+// be empty even though more records follow. The returned checkpoint is zero
+// when there are no more records.
+type BatchFetcher func(Checkpoint) ([]*Keyring, Checkpoint, error)
+
+type batchCursor struct {
+	fetch BatchFetcher
+	cp    Checkpoint
+	next  Checkpoint
+	batch []*Keyring
+	cur   *Keyring
+	done  bool
+	err   error
+}
+
+// NewBatchCursor returns a KeyringCursor which reads keyrings in batches
+// from fetch, starting after the given checkpoint. Only one batch is held in
+// memory at a time.
+func NewBatchCursor(from Checkpoint, fetch BatchFetcher) KeyringCursor {
+	return &batchCursor{fetch: fetch, cp: from, next: from}
+}
+
+func (c *batchCursor) Next() bool {
+	for len(c.batch) == 0 && !c.done {
+		c.batch, c.next, c.err = c.fetch(c.next)
+		if c.err != nil || c.next.IsZero() {
+			c.done = true
+		}
+	}
+	if len(c.batch) == 0 || c.err != nil {
+		c.cur = nil
+		return false
+	}
+	c.cur, c.batch = c.batch[0], c.batch[1:]
+	c.cp = CheckpointOf(c.cur)
+	return true
+}
+
+func (c *batchCursor) Keyring() *Keyring { return c.cur }
+
+func (c *batchCursor) Checkpoint() Checkpoint { return c.cp }
+
+func (c *batchCursor) Err() error { return c.err }
+
+func (c *batchCursor) Close() error {
+	c.batch, c.cur, c.done = nil, nil, true
+	return nil
+}
+
+// KeyringDigest is the digest recorded for a stored keyring.
+type KeyringDigest struct {
+	RFingerprint string
+	Digest       string
+}
+
+// DigestCursor iterates over the digests of stored keyrings, without reading
+// their key material. It must be closed when no longer needed.
+type DigestCursor interface {
+	io.Closer
+
+	// Next advances the cursor to the next digest. It returns false when
+	// there are no more digests, or when iteration stopped due to an error.
+	Next() bool
+
+	// Digest returns the digest at the cursor's current position.
+	Digest() KeyringDigest
+
+	// Err returns the error which stopped iteration, if any.
+	Err() error
+}
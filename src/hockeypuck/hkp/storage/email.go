@@ -0,0 +1,113 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/openpgp"
+)
+
+// NormalizeEmail returns the canonical form of an email address, in which
+// exact email matches are indexed and searched. The local part is converted
+// to Unicode NFC and lower case, and the domain to lower case IDNA ASCII form.
+func NormalizeEmail(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	at := strings.LastIndex(addr, "@")
+	if at < 1 || at == len(addr)-1 {
+		return "", errgo.Newf("invalid email address %q", addr)
+	}
+	local := strings.ToLower(norm.NFC.String(addr[:at]))
+	if strings.IndexFunc(local, unicode.IsSpace) >= 0 {
+		return "", errgo.Newf("invalid email address %q", addr)
+	}
+	domain, err := idna.Lookup.ToASCII(norm.NFC.String(addr[at+1:]))
+	if err != nil {
+		return "", errgo.Notef(err, "invalid email address %q", addr)
+	}
+	return local + "@" + strings.ToLower(domain), nil
+}
+
+// ParseEmail returns the normalized email address in a user ID of the usual
+// form "Name <address>", or of a user ID consisting only of an address.
+func ParseEmail(uid string) (string, bool) {
+	addr, ok := uidAddress(uid)
+	if !ok {
+		return "", false
+	}
+	email, err := NormalizeEmail(addr)
+	if err != nil {
+		return "", false
+	}
+	return email, true
+}
+
+// uidAddress returns the email address in a user ID as it was written.
+func uidAddress(uid string) (string, bool) {
+	if lbr, rbr := strings.LastIndex(uid, "<"), strings.LastIndex(uid, ">"); lbr != -1 && rbr > lbr {
+		return uid[lbr+1 : rbr], true
+	} else if strings.ContainsAny(uid, "<> ") {
+		return "", false
+	}
+	return uid, true
+}
+
+// Emails returns the normalized email addresses in the user IDs of the given
+// key, without repetition.
+func Emails(key *openpgp.PrimaryKey) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, uid := range key.UserIDs {
+		email, ok := ParseEmail(uid.Keywords)
+		if ok && !seen[email] {
+			seen[email] = true
+			result = append(result, email)
+		}
+	}
+	return result
+}
+
+// CertifiedEmails returns the normalized email addresses in the user IDs of
+// the given key which have a valid self-certification and have not been
+// revoked, without repetition. Only these user IDs are known to have been
+// made by the key holder.
+func CertifiedEmails(key *openpgp.PrimaryKey) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, uid := range key.UserIDs {
+		email, ok := ParseEmail(uid.Keywords)
+		if !ok || seen[email] {
+			continue
+		}
+		selfSigs, _ := uid.SigInfo(key)
+		if len(selfSigs.Certifications) == 0 {
+			continue
+		}
+		if _, revoked := selfSigs.RevokedSince(); revoked {
+			continue
+		}
+		seen[email] = true
+		result = append(result, email)
+	}
+	return result
+}
@@ -18,6 +18,7 @@
 package mock
 
 import (
+	"context"
 	"time"
 
 	"hockeypuck/openpgp"
@@ -53,22 +54,39 @@ type resolverFunc func([]string) ([]string, error)
 type modifiedSinceFunc func(time.Time) ([]string, error)
 type fetchKeysFunc func([]string) ([]*openpgp.PrimaryKey, error)
 type fetchKeyringsFunc func([]string) ([]*storage.Keyring, error)
+type iterKeyringsFunc func(storage.KeyringOrder, storage.Checkpoint) (storage.KeyringCursor, error)
 type insertFunc func([]*openpgp.PrimaryKey) (int, error)
 type updateFunc func(*openpgp.PrimaryKey, string, string) error
+type deleteFunc func(string) (string, error)
 type renotifyAllFunc func() error
+type uidStatesFunc func([]string) (map[string][]storage.UIDStatus, error)
+type setUIDStateFunc func(string, storage.UIDStatus) error
+type suppressFunc func(string) error
+type changesFunc func(string, int) ([]storage.Change, error)
 
 type Storage struct {
 	Recorder
-	close_        closeFunc
-	matchMD5      resolverFunc
-	resolve       resolverFunc
-	matchKeyword  resolverFunc
-	modifiedSince modifiedSinceFunc
-	fetchKeys     fetchKeysFunc
-	fetchKeyrings fetchKeyringsFunc
-	insert        insertFunc
-	update        updateFunc
-	renotifyAll   renotifyAllFunc
+	close_         closeFunc
+	matchMD5       resolverFunc
+	resolve        resolverFunc
+	matchKeyword   resolverFunc
+	matchEmail     resolverFunc
+	matchWKD       resolverFunc
+	modifiedSince  modifiedSinceFunc
+	fetchKeys      fetchKeysFunc
+	fetchKeyrings  fetchKeyringsFunc
+	iterKeyrings   iterKeyringsFunc
+	insert         insertFunc
+	update         updateFunc
+	delete         deleteFunc
+	renotifyAll    renotifyAllFunc
+	uidStates      uidStatesFunc
+	setUIDState    setUIDStateFunc
+	suppress       suppressFunc
+	suppressed     resolverFunc
+	unsuppress     suppressFunc
+	listSuppressed func() ([]string, error)
+	changes        changesFunc
 
 	notified []func(storage.KeyChange) error
 }
@@ -81,6 +99,8 @@ func Resolve(f resolverFunc) Option  { return func(m *Storage) { m.resolve = f }
 func MatchKeyword(f resolverFunc) Option {
 	return func(m *Storage) { m.matchKeyword = f }
 }
+func MatchEmail(f resolverFunc) Option { return func(m *Storage) { m.matchEmail = f } }
+func MatchWKD(f resolverFunc) Option   { return func(m *Storage) { m.matchWKD = f } }
 func ModifiedSince(f modifiedSinceFunc) Option {
 	return func(m *Storage) { m.modifiedSince = f }
 }
@@ -88,9 +108,22 @@ func FetchKeys(f fetchKeysFunc) Option { return func(m *Storage) { m.fetchKeys =
 func FetchKeyrings(f fetchKeyringsFunc) Option {
 	return func(m *Storage) { m.fetchKeyrings = f }
 }
+func IterKeyrings(f iterKeyringsFunc) Option {
+	return func(m *Storage) { m.iterKeyrings = f }
+}
 func Insert(f insertFunc) Option           { return func(m *Storage) { m.insert = f } }
 func Update(f updateFunc) Option           { return func(m *Storage) { m.update = f } }
+func Delete(f deleteFunc) Option           { return func(m *Storage) { m.delete = f } }
 func RenotifyAll(f renotifyAllFunc) Option { return func(m *Storage) { m.renotifyAll = f } }
+func UIDStates(f uidStatesFunc) Option     { return func(m *Storage) { m.uidStates = f } }
+func SetUIDState(f setUIDStateFunc) Option { return func(m *Storage) { m.setUIDState = f } }
+func Suppress(f suppressFunc) Option       { return func(m *Storage) { m.suppress = f } }
+func Suppressed(f resolverFunc) Option     { return func(m *Storage) { m.suppressed = f } }
+func Unsuppress(f suppressFunc) Option     { return func(m *Storage) { m.unsuppress = f } }
+func Changes(f changesFunc) Option         { return func(m *Storage) { m.changes = f } }
+func ListSuppressed(f func() ([]string, error)) Option {
+	return func(m *Storage) { m.listSuppressed = f }
+}
 
 func NewStorage(options ...Option) *Storage {
 	m := &Storage{}
@@ -108,6 +141,9 @@ func (m *Storage) Close() error {
 	return nil
 }
 func (m *Storage) MatchMD5(s []string) ([]string, error) {
+	return m.MatchMD5Context(context.Background(), s)
+}
+func (m *Storage) MatchMD5Context(_ context.Context, s []string) ([]string, error) {
 	m.record("MatchMD5", s)
 	if m.matchMD5 != nil {
 		return m.matchMD5(s)
@@ -115,13 +151,39 @@ func (m *Storage) MatchMD5(s []string) ([]string, error) {
 	return nil, nil
 }
 func (m *Storage) Resolve(s []string) ([]string, error) {
+	return m.ResolveContext(context.Background(), s)
+}
+func (m *Storage) ResolveContext(_ context.Context, s []string) ([]string, error) {
 	m.record("Resolve", s)
 	if m.resolve != nil {
 		return m.resolve(s)
 	}
 	return nil, nil
 }
+func (m *Storage) MatchEmail(s []string) ([]string, error) {
+	return m.MatchEmailContext(context.Background(), s)
+}
+func (m *Storage) MatchEmailContext(_ context.Context, s []string) ([]string, error) {
+	m.record("MatchEmail", s)
+	if m.matchEmail != nil {
+		return m.matchEmail(s)
+	}
+	return nil, nil
+}
+func (m *Storage) MatchWKD(s []string) ([]string, error) {
+	return m.MatchWKDContext(context.Background(), s)
+}
+func (m *Storage) MatchWKDContext(_ context.Context, s []string) ([]string, error) {
+	m.record("MatchWKD", s)
+	if m.matchWKD != nil {
+		return m.matchWKD(s)
+	}
+	return nil, nil
+}
 func (m *Storage) MatchKeyword(s []string) ([]string, error) {
+	return m.MatchKeywordContext(context.Background(), s)
+}
+func (m *Storage) MatchKeywordContext(_ context.Context, s []string) ([]string, error) {
 	m.record("MatchKeyword", s)
 	if m.matchKeyword != nil {
 		return m.matchKeyword(s)
@@ -129,6 +191,9 @@ func (m *Storage) MatchKeyword(s []string) ([]string, error) {
 	return nil, nil
 }
 func (m *Storage) ModifiedSince(t time.Time) ([]string, error) {
+	return m.ModifiedSinceContext(context.Background(), t)
+}
+func (m *Storage) ModifiedSinceContext(_ context.Context, t time.Time) ([]string, error) {
 	m.record("ModifiedSince", t)
 	if m.modifiedSince != nil {
 		return m.modifiedSince(t)
@@ -136,6 +201,9 @@ func (m *Storage) ModifiedSince(t time.Time) ([]string, error) {
 	return nil, nil
 }
 func (m *Storage) FetchKeys(s []string) ([]*openpgp.PrimaryKey, error) {
+	return m.FetchKeysContext(context.Background(), s)
+}
+func (m *Storage) FetchKeysContext(_ context.Context, s []string) ([]*openpgp.PrimaryKey, error) {
 	m.record("FetchKeys", s)
 	if m.fetchKeys != nil {
 		return m.fetchKeys(s)
@@ -143,13 +211,41 @@ func (m *Storage) FetchKeys(s []string) ([]*openpgp.PrimaryKey, error) {
 	return nil, nil
 }
 func (m *Storage) FetchKeyrings(s []string) ([]*storage.Keyring, error) {
+	return m.FetchKeyringsContext(context.Background(), s)
+}
+func (m *Storage) FetchKeyringsContext(_ context.Context, s []string) ([]*storage.Keyring, error) {
 	m.record("FetchKeyrings", s)
 	if m.fetchKeyrings != nil {
 		return m.fetchKeyrings(s)
 	}
+	if m.fetchKeys != nil {
+		// Keyrings of the keys given by the FetchKeys option, without
+		// timestamps.
+		keys, err := m.fetchKeys(s)
+		if err != nil {
+			return nil, err
+		}
+		var result []*storage.Keyring
+		for _, key := range keys {
+			result = append(result, &storage.Keyring{PrimaryKey: key, Digest: key.MD5})
+		}
+		return result, nil
+	}
 	return nil, nil
 }
+func (m *Storage) IterKeyrings(_ context.Context, order storage.KeyringOrder, from storage.Checkpoint) (storage.KeyringCursor, error) {
+	m.record("IterKeyrings", order, from)
+	if m.iterKeyrings != nil {
+		return m.iterKeyrings(order, from)
+	}
+	return storage.NewBatchCursor(from, func(storage.Checkpoint) ([]*storage.Keyring, storage.Checkpoint, error) {
+		return nil, storage.Checkpoint{}, nil
+	}), nil
+}
 func (m *Storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
+	return m.InsertContext(context.Background(), keys)
+}
+func (m *Storage) InsertContext(_ context.Context, keys []*openpgp.PrimaryKey) (int, error) {
 	m.record("Insert", keys)
 	if m.insert != nil {
 		return m.insert(keys)
@@ -157,12 +253,25 @@ func (m *Storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
 	return 0, nil
 }
 func (m *Storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
+	return m.UpdateContext(context.Background(), key, lastID, lastMD5)
+}
+func (m *Storage) UpdateContext(_ context.Context, key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
 	m.record("Update", key)
 	if m.update != nil {
 		return m.update(key, lastID, lastMD5)
 	}
 	return nil
 }
+func (m *Storage) Delete(rfp string) (string, error) {
+	return m.DeleteContext(context.Background(), rfp)
+}
+func (m *Storage) DeleteContext(_ context.Context, rfp string) (string, error) {
+	m.record("Delete", rfp)
+	if m.delete != nil {
+		return m.delete(rfp)
+	}
+	return "", nil
+}
 func (m *Storage) Subscribe(f func(storage.KeyChange) error) {
 	m.notified = append(m.notified, f)
 }
@@ -182,3 +291,52 @@ func (m *Storage) RenotifyAll() error {
 	}
 	return nil
 }
+func (m *Storage) UIDStates(_ context.Context, rfps []string) (map[string][]storage.UIDStatus, error) {
+	m.record("UIDStates", rfps)
+	if m.uidStates != nil {
+		return m.uidStates(rfps)
+	}
+	return nil, nil
+}
+func (m *Storage) SetUIDState(_ context.Context, rfp string, status storage.UIDStatus) error {
+	m.record("SetUIDState", rfp, status)
+	if m.setUIDState != nil {
+		return m.setUIDState(rfp, status)
+	}
+	return nil
+}
+func (m *Storage) Suppress(_ context.Context, rfp string) error {
+	m.record("Suppress", rfp)
+	if m.suppress != nil {
+		return m.suppress(rfp)
+	}
+	return nil
+}
+func (m *Storage) Suppressed(_ context.Context, rfps []string) ([]string, error) {
+	m.record("Suppressed", rfps)
+	if m.suppressed != nil {
+		return m.suppressed(rfps)
+	}
+	return nil, nil
+}
+func (m *Storage) Unsuppress(_ context.Context, rfp string) error {
+	m.record("Unsuppress", rfp)
+	if m.unsuppress != nil {
+		return m.unsuppress(rfp)
+	}
+	return nil
+}
+func (m *Storage) ListSuppressed(_ context.Context) ([]string, error) {
+	m.record("ListSuppressed")
+	if m.listSuppressed != nil {
+		return m.listSuppressed()
+	}
+	return nil, nil
+}
+func (m *Storage) Changes(_ context.Context, cursor string, limit int) ([]storage.Change, error) {
+	m.record("Changes", cursor, limit)
+	if m.changes != nil {
+		return m.changes(cursor, limit)
+	}
+	return nil, nil
+}
@@ -18,20 +18,35 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"gopkg.in/errgo.v1"
 
+	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
 )
 
 var ErrKeyNotFound = errors.New("key not found")
 
 func IsNotFound(err error) bool {
-	return err == ErrKeyNotFound
+	return errgo.Cause(err) == ErrKeyNotFound
+}
+
+// ErrConflict is returned by an Updater when the stored key no longer matches
+// the digest the update was based on.
+var ErrConflict = errors.New("key update conflict")
+
+// ErrKeySuppressed is returned when storing a key which has been taken down
+// by its owner.
+var ErrKeySuppressed = errors.New("key suppressed")
+
+func IsConflict(err error) bool {
+	return errgo.Cause(err) == ErrConflict
 }
 
 type Keyring struct {
@@ -39,6 +54,11 @@ type Keyring struct {
 
 	CTime time.Time
 	MTime time.Time
+
+	// Digest is the MD5 digest recorded for the keyring in storage. It is
+	// the digest known to recon peers, and may differ from the digest of
+	// PrimaryKey if the key was stored by an older version.
+	Digest string
 }
 
 // Storage defines the API that is needed to implement a complete storage
@@ -46,7 +66,11 @@ type Keyring struct {
 type Storage interface {
 	io.Closer
 	Queryer
+	QueryerContext
 	Updater
+	UpdaterContext
+	Deleter
+	DeleterContext
 	Notifier
 }
 
@@ -57,9 +81,11 @@ type Queryer interface {
 	// The MD5 is calculated using the "SKS method".
 	MatchMD5([]string) ([]string, error)
 
-	// Resolve returns the matching RFingerprint IDs for the given public key IDs.
-	// Key IDs are typically short (8 hex digits), long (16 digits) or full (40 digits).
-	// Matches are made against key IDs and subkey IDs.
+	// Resolve returns the matching RFingerprint IDs for the given reversed
+	// public key IDs. Key IDs are typically short (8 hex digits), long (16
+	// digits) or full (40 digits, 32 for v3 keys or 64 for v6 keys). Matches
+	// are made against fingerprints, key IDs and subkey IDs, including v3 and
+	// v6 key IDs, and every matching primary key is returned once.
 	Resolve([]string) ([]string, error)
 
 	// MatchKeyword returns the matching RFingerprint IDs for the given keyword search.
@@ -67,6 +93,15 @@ type Queryer interface {
 	// different implementations.
 	MatchKeyword([]string) ([]string, error)
 
+	// MatchEmail returns the RFingerprint IDs of keys having a user ID with
+	// exactly the given email addresses, which must be normalized with
+	// NormalizeEmail.
+	MatchEmail([]string) ([]string, error)
+
+	// MatchWKD returns the RFingerprint IDs of keys having a user ID with the
+	// given Web Key Directory addresses, as returned by ParseWKDAddress.
+	MatchWKD([]string) ([]string, error)
+
 	// ModifiedSince returns matching RFingerprint IDs for keyrings modified
 	// since the given time.
 	ModifiedSince(time.Time) ([]string, error)
@@ -76,6 +111,25 @@ type Queryer interface {
 
 	// FetchKeyrings returns the keyring records matching the given RFingerprint slice.
 	FetchKeyrings([]string) ([]*Keyring, error)
+
+	// IterKeyrings returns a cursor over all stored keyrings in the given
+	// order, starting after the given checkpoint. The cursor stops with the
+	// context's error once the context is done.
+	IterKeyrings(ctx context.Context, order KeyringOrder, from Checkpoint) (KeyringCursor, error)
+}
+
+// QueryerContext defines variants of the Queryer methods which accept a
+// context. Backends should abandon work in progress and return the context's
+// error once it is cancelled or its deadline passes.
+type QueryerContext interface {
+	MatchMD5Context(context.Context, []string) ([]string, error)
+	ResolveContext(context.Context, []string) ([]string, error)
+	MatchKeywordContext(context.Context, []string) ([]string, error)
+	MatchEmailContext(context.Context, []string) ([]string, error)
+	MatchWKDContext(context.Context, []string) ([]string, error)
+	ModifiedSinceContext(context.Context, time.Time) ([]string, error)
+	FetchKeysContext(context.Context, []string) ([]*openpgp.PrimaryKey, error)
+	FetchKeyringsContext(context.Context, []string) ([]*Keyring, error)
 }
 
 // Inserter defines the storage API for inserting key material.
@@ -86,16 +140,169 @@ type Inserter interface {
 	Insert([]*openpgp.PrimaryKey) (int, error)
 }
 
+// KeyringImporter is implemented by storage which can restore keyring records
+// exactly as they were stored elsewhere, such as when migrating between
+// backends.
+type KeyringImporter interface {
+
+	// ImportKeyrings stores the given keyrings, preserving their creation and
+	// modification times and their digests, where set, if they are not
+	// already stored. Keyrings are not otherwise modified, and listeners are
+	// not notified. Keyrings already stored are reported as duplicates in an
+	// InsertError.
+	ImportKeyrings(ctx context.Context, keyrings []*Keyring) (int, error)
+}
+
+// DigestIterator is implemented by storage which can iterate over the digests
+// of stored keyrings without reading the keyrings themselves, such as to
+// build a recon prefix tree.
+type DigestIterator interface {
+
+	// IterDigests returns a cursor over the digests of all stored keyrings,
+	// in no particular order. The cursor stops with the context's error once
+	// the context is done.
+	IterDigests(ctx context.Context) (DigestCursor, error)
+}
+
+// UIDState is the publication state of an email address in the user IDs of a
+// key, on servers which only serve user IDs whose addresses are verified.
+type UIDState string
+
+const (
+	// UIDUnpublished addresses have not been verified. Addresses without a
+	// recorded state are unpublished.
+	UIDUnpublished UIDState = "unpublished"
+
+	// UIDPending addresses have been sent a verification token.
+	UIDPending UIDState = "pending"
+
+	// UIDPublished addresses have been verified and may be served.
+	UIDPublished UIDState = "published"
+)
+
+// UIDStatus records the publication state of an email address on a key, and
+// when it was set.
+type UIDStatus struct {
+	Email    string
+	State    UIDState
+	Modified time.Time
+}
+
+// UIDPublisher is implemented by storage which can record the publication
+// state of the email addresses of each key.
+type UIDPublisher interface {
+
+	// UIDStates returns the recorded states of the email addresses of the
+	// keys matching the given RFingerprints, by RFingerprint. Keys without
+	// recorded states are omitted.
+	UIDStates(ctx context.Context, rfps []string) (map[string][]UIDStatus, error)
+
+	// SetUIDState records the state of an email address on the key matching
+	// the given RFingerprint, replacing any previous state. Recording
+	// UIDUnpublished removes the record. ErrKeyNotFound is returned if no
+	// such key is stored.
+	SetUIDState(ctx context.Context, rfp string, status UIDStatus) error
+}
+
+// Suppressor is implemented by storage which can record keys that have been
+// taken down by their owners, so that they are not stored again when they are
+// received from peers or uploaded.
+type Suppressor interface {
+
+	// Suppress records that the key matching the given RFingerprint must not
+	// be stored again. It does not remove the key if it is stored.
+	Suppress(ctx context.Context, rfp string) error
+
+	// Suppressed returns those of the given RFingerprints which have been
+	// suppressed.
+	Suppressed(ctx context.Context, rfps []string) ([]string, error)
+
+	// Unsuppress allows the key matching the given RFingerprint to be stored
+	// again. It does not restore the key.
+	Unsuppress(ctx context.Context, rfp string) error
+
+	// ListSuppressed returns every RFingerprint which has been suppressed,
+	// so that they can be carried over to other storage.
+	ListSuppressed(ctx context.Context) ([]string, error)
+}
+
+// ChangeType identifies the kind of change made to a stored key.
+type ChangeType string
+
+const (
+	ChangeAdded    ChangeType = "added"
+	ChangeReplaced ChangeType = "replaced"
+	ChangeRemoved  ChangeType = "removed"
+)
+
+// Change is a change made to a stored key, as recorded by a ChangeLogger.
+type Change struct {
+	// Cursor identifies the change in the log, so that it can be read from
+	// after it.
+	Cursor string
+
+	RFingerprint string
+	Type         ChangeType
+
+	// OldDigest is the digest of the key before the change. It is empty for
+	// keys added.
+	OldDigest string
+
+	// NewDigest is the digest of the key after the change. It is empty for
+	// keys removed.
+	NewDigest string
+
+	Time time.Time
+}
+
+// ErrInvalidCursor is returned by a ChangeLogger given a cursor it did not
+// issue.
+var ErrInvalidCursor = errors.New("invalid change cursor")
+
+// ChangeLogger is implemented by storage which records a log of the changes
+// made to keys by inserting, updating and deleting them, including keys
+// loaded in bulk. Keys imported with a KeyringImporter, which restores them
+// as they were, are not logged.
+type ChangeLogger interface {
+	// Changes returns up to limit changes recorded after the one with the
+	// given cursor, oldest first. An empty cursor reads from the start of
+	// the log.
+	Changes(ctx context.Context, cursor string, limit int) ([]Change, error)
+}
+
 // Updater defines the storage API for writing key material.
 type Updater interface {
 	Inserter
 
 	// Update updates the stored PrimaryKey with the given contents, if the current
 	// contents of the key in storage matches the given digest. If it does not
-	// match, the update should be retried again later.
+	// match, an error with cause ErrConflict is returned and nothing is
+	// changed; the caller should re-fetch, merge and retry.
 	Update(pubkey *openpgp.PrimaryKey, priorID string, priorMD5 string) error
 }
 
+// UpdaterContext defines variants of the Inserter and Updater methods which
+// accept a context.
+type UpdaterContext interface {
+	InsertContext(context.Context, []*openpgp.PrimaryKey) (int, error)
+	UpdateContext(ctx context.Context, pubkey *openpgp.PrimaryKey, priorID string, priorMD5 string) error
+}
+
+// Deleter defines the storage API for removing key material.
+type Deleter interface {
+
+	// Delete removes the public key matching the given RFingerprint, along
+	// with any subkey references to it. The MD5 digest of the removed key is
+	// returned. ErrKeyNotFound is returned if no such key is stored.
+	Delete(rfp string) (string, error)
+}
+
+// DeleterContext defines a variant of the Deleter method which accepts a
+// context.
+type DeleterContext interface {
+	DeleteContext(ctx context.Context, rfp string) (string, error)
+}
+
 type Notifier interface {
 	// Subscribe registers a key change callback function.
 	Subscribe(func(KeyChange) error)
@@ -116,6 +323,10 @@ type KeyChange interface {
 type KeyAdded struct {
 	ID     string
 	Digest string
+
+	// RFingerprint identifies the key added. It is not set when listeners
+	// are renotified of all keys, which are not changes to them.
+	RFingerprint string
 }
 
 func (ka KeyAdded) InsertDigests() []string {
@@ -135,6 +346,8 @@ type KeyReplaced struct {
 	OldDigest string
 	NewID     string
 	NewDigest string
+
+	RFingerprint string
 }
 
 func (kr KeyReplaced) InsertDigests() []string {
@@ -149,6 +362,25 @@ func (kr KeyReplaced) String() string {
 	return fmt.Sprintf("key 0x%s with hash %s replaced key 0x%s with hash %s", kr.NewID, kr.NewDigest, kr.OldID, kr.OldDigest)
 }
 
+type KeyRemoved struct {
+	ID     string
+	Digest string
+
+	RFingerprint string
+}
+
+func (kr KeyRemoved) InsertDigests() []string {
+	return nil
+}
+
+func (kr KeyRemoved) RemoveDigests() []string {
+	return []string{kr.Digest}
+}
+
+func (kr KeyRemoved) String() string {
+	return fmt.Sprintf("key 0x%s with hash %s removed", kr.ID, kr.Digest)
+}
+
 type KeyNotChanged struct {
 	ID     string
 	Digest string
@@ -179,6 +411,27 @@ func Duplicates(err error) []*openpgp.PrimaryKey {
 	return insertErr.Duplicates
 }
 
+// V3RKeyID returns the reversed key ID of the given key if it cannot be
+// matched by fingerprint prefix, as is the case for v3 keys and for v6 keys,
+// whose key IDs lead their fingerprints. Otherwise it returns an empty
+// string.
+func V3RKeyID(key *openpgp.PrimaryKey) string {
+	if strings.HasPrefix(key.RFingerprint, key.RKeyID) {
+		return ""
+	}
+	return key.RKeyID
+}
+
+// SubKeyRKeyID returns the reversed key ID of the given subkey if it cannot
+// be matched by fingerprint prefix, as is the case for v6 subkeys. Otherwise
+// it returns an empty string.
+func SubKeyRKeyID(subKey *openpgp.SubKey) string {
+	if strings.HasPrefix(subKey.RFingerprint, subKey.RKeyID) {
+		return ""
+	}
+	return subKey.RKeyID
+}
+
 func firstMatch(results []*openpgp.PrimaryKey, match string) (*openpgp.PrimaryKey, error) {
 	for _, key := range results {
 		if key.RFingerprint == match {
@@ -188,16 +441,277 @@ func firstMatch(results []*openpgp.PrimaryKey, match string) (*openpgp.PrimaryKe
 	return nil, ErrKeyNotFound
 }
 
-func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err error) {
+// maxUpsertAttempts limits how many times UpsertKey will re-fetch and merge a
+// key that is being concurrently modified before giving up.
+const maxUpsertAttempts = 5
+
+type upsertOptions struct {
+	notModifiable  bool
+	honourNoModify bool
+	dryRun         bool
+	rejected       *openpgp.Unowned
+	diff           *openpgp.KeyDiff
+	certPolicy     *openpgp.CertPolicy
+	keyPolicy      openpgp.KeyPolicy
+}
+
+// UpsertOption modifies how a key is upserted.
+type UpsertOption func(*upsertOptions)
+
+// NotModifiable treats the key as if its holder had set the keyserver
+// no-modify preference, as requested by the HKP "nm" option.
+func NotModifiable() UpsertOption {
+	return func(o *upsertOptions) { o.notModifiable = true }
+}
+
+// HonourNoModify only takes material self-signed by the key holder when
+// either the given or the stored key carries the keyserver no-modify
+// preference.
+func HonourNoModify() UpsertOption {
+	return func(o *upsertOptions) { o.honourNoModify = true }
+}
+
+// DryRun works out the change the upsert would make, without storing it.
+func DryRun() UpsertOption {
+	return func(o *upsertOptions) { o.dryRun = true }
+}
+
+// Diff sets the given KeyDiff to the material the upsert adds to the stored
+// key.
+func Diff(diff *openpgp.KeyDiff) UpsertOption {
+	return func(o *upsertOptions) { o.diff = diff }
+}
+
+// Rejected adds the material withheld from a key which may not be modified
+// to the given Unowned.
+func Rejected(rejected *openpgp.Unowned) UpsertOption {
+	return func(o *upsertOptions) { o.rejected = rejected }
+}
+
+// CertPolicy drops the third-party certifications the given policy does
+// not allow, from both the given and the merged key. Those dropped from the
+// given key are added to the Rejected material.
+func CertPolicy(policy *openpgp.CertPolicy) UpsertOption {
+	return func(o *upsertOptions) { o.certPolicy = policy }
+}
+
+// KeyPolicy refuses to store a key which the given policy rejects. The
+// policy is checked against the key as it would be stored, so an update is
+// refused if the merged key would be rejected, unless the stored key is
+// already rejected and the update only adds signatures to it, such as
+// revocations. The error returned has cause openpgp.ErrKeyRejected.
+func KeyPolicy(policy openpgp.KeyPolicy) UpsertOption {
+	return func(o *upsertOptions) { o.keyPolicy = policy }
+}
+
+// ApplyCertPolicy drops the third-party certifications the given policy does
+// not allow from the key, looking up their issuers in storage if the policy
+// requires it. It returns the certifications dropped. Issuers are resolved in
+// one call, but it is still done as keys are stored rather than served; see
+// openpgp.CertPolicy.WithoutLookups.
+func ApplyCertPolicy(ctx context.Context, storage Storage, policy *openpgp.CertPolicy, key *openpgp.PrimaryKey) ([]*openpgp.Signature, error) {
+	dropped, err := policy.Apply(key, func(rkeyids []string) (map[string]bool, error) {
+		rfps, err := storage.ResolveContext(ctx, rkeyids)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		// A v4 key ID ends its fingerprint, and a v6 key ID begins it.
+		found := make(map[string]bool)
+		for _, rfp := range rfps {
+			if len(rfp) >= 16 {
+				found[rfp[:16]] = true
+			}
+			if len(rfp) == 64 {
+				found[rfp[48:]] = true
+			}
+		}
+		known := make(map[string]bool)
+		for _, rkeyid := range rkeyids {
+			known[rkeyid] = found[strings.ToLower(rkeyid)]
+		}
+		return known, nil
+	})
+	return dropped, errgo.Mask(err, errgo.Any)
+}
+
+// UpsertKey inserts the given public key, or merges it into the stored key if
+// one already exists. Concurrent modifications of the same key are resolved by
+// re-fetching and merging again, up to maxUpsertAttempts times. Keys which
+// have been suppressed are not stored, and the error returned has cause
+// ErrKeySuppressed.
+func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey, options ...UpsertOption) (KeyChange, error) {
+	return UpsertKeyContext(context.Background(), storage, pubkey, options...)
+}
+
+// UpsertKeyContext is like UpsertKey, but gives up once the given context is
+// done.
+func UpsertKeyContext(ctx context.Context, storage Storage, pubkey *openpgp.PrimaryKey, options ...UpsertOption) (kc KeyChange, err error) {
+	var opts upsertOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	for i := 0; i < maxUpsertAttempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		kc, err = upsertKey(ctx, storage, pubkey, &opts)
+		if !IsConflict(err) {
+			return kc, err
+		}
+	}
+	return nil, errgo.NoteMask(err, fmt.Sprintf("upsert key %q failed after %d attempts", pubkey.RFingerprint, maxUpsertAttempts), errgo.Is(ErrConflict))
+}
+
+// dropUnowned removes the material the key holder has not signed from
+// pubkey, if it may not be modified by others.
+func dropUnowned(pubkey, lastKey *openpgp.PrimaryKey, opts *upsertOptions) error {
+	noModify := opts.notModifiable || opts.honourNoModify &&
+		(openpgp.NoModify(pubkey) || lastKey != nil && openpgp.NoModify(lastKey))
+	if !noModify {
+		return nil
+	}
+	unowned, err := openpgp.DropUnowned(pubkey)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if unowned.Len() > 0 {
+		log.Debugf("withheld %d packets from no-modify key %q", unowned.Len(), pubkey.Fingerprint())
+	}
+	if opts.rejected != nil {
+		opts.rejected.Append(unowned)
+	}
+	return nil
+}
+
+// applyCertPolicy drops the certifications the policy does not allow from
+// key, and returns them.
+func applyCertPolicy(ctx context.Context, storage Storage, key *openpgp.PrimaryKey, opts *upsertOptions) ([]*openpgp.Signature, error) {
+	if opts.certPolicy == nil {
+		return nil, nil
+	}
+	dropped, err := ApplyCertPolicy(ctx, storage, opts.certPolicy, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if len(dropped) > 0 {
+		log.Debugf("dropped %d certifications from key %q by policy", len(dropped), key.Fingerprint())
+	}
+	return dropped, nil
+}
+
+// checkKeyPolicy checks the key that would be stored against the key policy.
+func checkKeyPolicy(key *openpgp.PrimaryKey, opts *upsertOptions) error {
+	if opts.keyPolicy == nil {
+		return nil
+	}
+	err := opts.keyPolicy.Check(key)
+	if err != nil {
+		log.Debugf("key %q rejected by policy: %v", key.Fingerprint(), err)
+		return errgo.Mask(err, errgo.Is(openpgp.ErrKeyRejected))
+	}
+	return nil
+}
+
+// grandfathered returns whether the given signatures, added to key, may be
+// stored though the key does not satisfy the key policy, as when it was
+// stored before the policy was. Its holder may still revoke it or its parts,
+// and renew them with self-signatures which the policy accepts on their own.
+// Nothing else may be added.
+func grandfathered(key *openpgp.PrimaryKey, sigs []*openpgp.Signature, policy openpgp.KeyPolicy) bool {
+	pending := make(map[string]bool)
+	for _, sig := range sigs {
+		pending[sig.UUID] = true
+	}
+	revocations := func(selfSigs *openpgp.SelfSigs) {
+		for _, checkSig := range selfSigs.Revocations {
+			delete(pending, checkSig.Signature.UUID)
+		}
+	}
+	// bindings exempts the certifications which the policy accepts as the
+	// only binding of their target to the primary key.
+	bindings := func(selfSigs *openpgp.SelfSigs, bound func(*openpgp.Signature) *openpgp.PrimaryKey) {
+		for _, checkSig := range selfSigs.Certifications {
+			if pending[checkSig.Signature.UUID] && policy.Check(bound(checkSig.Signature)) == nil {
+				delete(pending, checkSig.Signature.UUID)
+			}
+		}
+	}
+
+	selfSigs, _ := key.SigInfo()
+	revocations(selfSigs)
+	for _, uid := range key.UserIDs {
+		selfSigs, _ := uid.SigInfo(key)
+		revocations(selfSigs)
+		bindings(selfSigs, func(sig *openpgp.Signature) *openpgp.PrimaryKey {
+			bound := *uid
+			bound.Signatures = []*openpgp.Signature{sig}
+			return &openpgp.PrimaryKey{PublicKey: key.PublicKey, UserIDs: []*openpgp.UserID{&bound}}
+		})
+	}
+	for _, uat := range key.UserAttributes {
+		selfSigs, _ := uat.SigInfo(key)
+		revocations(selfSigs)
+		bindings(selfSigs, func(sig *openpgp.Signature) *openpgp.PrimaryKey {
+			bound := *uat
+			bound.Signatures = []*openpgp.Signature{sig}
+			return &openpgp.PrimaryKey{PublicKey: key.PublicKey, UserAttributes: []*openpgp.UserAttribute{&bound}}
+		})
+	}
+	for _, subKey := range key.SubKeys {
+		selfSigs, _ := subKey.SigInfo(key)
+		revocations(selfSigs)
+		bindings(selfSigs, func(sig *openpgp.Signature) *openpgp.PrimaryKey {
+			bound := *subKey
+			bound.Signatures = []*openpgp.Signature{sig}
+			return &openpgp.PrimaryKey{PublicKey: key.PublicKey, SubKeys: []*openpgp.SubKey{&bound}}
+		})
+	}
+	return len(pending) == 0
+}
+
+func upsertKey(ctx context.Context, storage Storage, pubkey *openpgp.PrimaryKey, opts *upsertOptions) (KeyChange, error) {
+	if suppressor, ok := storage.(Suppressor); ok {
+		suppressed, err := suppressor.Suppressed(ctx, []string{pubkey.RFingerprint})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if len(suppressed) > 0 {
+			return nil, errgo.WithCausef(nil, ErrKeySuppressed, "key %q has been taken down", pubkey.Fingerprint())
+		}
+	}
 	var lastKey *openpgp.PrimaryKey
-	lastKeys, err := storage.FetchKeys([]string{pubkey.RFingerprint})
+	lastKeys, err := storage.FetchKeysContext(ctx, []string{pubkey.RFingerprint})
 	if err == nil {
 		// match primary fingerprint -- someone might have reused a subkey somewhere
 		lastKey, err = firstMatch(lastKeys, pubkey.RFingerprint)
 	}
 	if IsNotFound(err) {
-		_, err = storage.Insert([]*openpgp.PrimaryKey{pubkey})
+		err = dropUnowned(pubkey, nil, opts)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		dropped, err := applyCertPolicy(ctx, storage, pubkey, opts)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if opts.rejected != nil {
+			opts.rejected.Signatures = append(opts.rejected.Signatures, dropped...)
+		}
+		err = checkKeyPolicy(pubkey, opts)
 		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(openpgp.ErrKeyRejected))
+		}
+		if opts.diff != nil {
+			*opts.diff = *openpgp.Diff(nil, pubkey)
+		}
+		if opts.dryRun {
+			return KeyAdded{ID: pubkey.KeyID(), Digest: pubkey.MD5}, nil
+		}
+		_, err = storage.InsertContext(ctx, []*openpgp.PrimaryKey{pubkey})
+		if len(Duplicates(err)) > 0 {
+			// Inserted by someone else since we looked; merge into theirs.
+			return nil, errgo.WithCausef(err, ErrConflict, "concurrent insert of %q", pubkey.RFingerprint)
+		} else if err != nil {
 			return nil, errgo.Mask(err)
 		}
 		return KeyAdded{ID: pubkey.KeyID(), Digest: pubkey.MD5}, nil
@@ -208,16 +722,57 @@ func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err e
 	if pubkey.UUID != lastKey.UUID {
 		return nil, errgo.Newf("upsert key %q lookup failed, found mismatch %q", pubkey.UUID, lastKey.UUID)
 	}
+	err = dropUnowned(pubkey, lastKey, opts)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	added := openpgp.Diff(lastKey, pubkey)
+	storedRejected := opts.keyPolicy != nil && opts.keyPolicy.Check(lastKey) != nil
 	lastID := lastKey.KeyID()
 	lastMD5 := lastKey.MD5
 	err = openpgp.Merge(lastKey, pubkey)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	// The policy limits the certifications already stored as well as those
+	// added, so it is applied once, to the merged key. Only those added are
+	// reported.
+	dropped, err := applyCertPolicy(ctx, storage, lastKey, opts)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if len(dropped) > 0 {
+		isDropped := make(map[string]bool)
+		for _, sig := range dropped {
+			isDropped[sig.UUID] = true
+		}
+		var sigs []*openpgp.Signature
+		for _, sig := range added.Signatures {
+			if !isDropped[sig.UUID] {
+				sigs = append(sigs, sig)
+			} else if opts.rejected != nil {
+				opts.rejected.Signatures = append(opts.rejected.Signatures, sig)
+			}
+		}
+		added.Signatures = sigs
+	}
+	if opts.diff != nil {
+		*opts.diff = *added
+	}
+	exempt := storedRejected && len(added.Signatures) == added.Len() &&
+		grandfathered(pubkey, added.Signatures, opts.keyPolicy)
 	if lastMD5 != lastKey.MD5 {
-		err = storage.Update(lastKey, lastID, lastMD5)
-		if err != nil {
-			return nil, errgo.Mask(err)
+		if !exempt {
+			err = checkKeyPolicy(lastKey, opts)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Is(openpgp.ErrKeyRejected))
+			}
+		}
+		if !opts.dryRun {
+			err = storage.UpdateContext(ctx, lastKey, lastID, lastMD5)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Is(ErrConflict))
+			}
 		}
 		return KeyReplaced{OldID: lastID, OldDigest: lastMD5, NewID: lastKey.KeyID(), NewDigest: lastKey.MD5}, nil
 	}
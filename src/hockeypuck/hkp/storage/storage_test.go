@@ -0,0 +1,469 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage_test
+
+import (
+	"context"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type StorageSuite struct{}
+
+var _ = gc.Suite(&StorageSuite{})
+
+func mustInputKey(c *gc.C, name string) *openpgp.PrimaryKey {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput(name))
+	c.Assert(keys, gc.HasLen, 1)
+	return keys[0]
+}
+
+func (*StorageSuite) TestUpsertRetriesConflict(c *gc.C) {
+	signed := mustInputKey(c, "alice_signed.asc")
+	var conflicts int
+	m := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{mustInputKey(c, "alice_unsigned.asc")}, nil
+		}),
+		mock.Update(func(*openpgp.PrimaryKey, string, string) error {
+			if conflicts < 2 {
+				conflicts++
+				return errgo.WithCausef(nil, storage.ErrConflict, "")
+			}
+			return nil
+		}),
+	)
+	kc, err := storage.UpsertKey(m, signed)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(m.MethodCount("FetchKeys"), gc.Equals, 3)
+	c.Assert(m.MethodCount("Update"), gc.Equals, 3)
+}
+
+func (*StorageSuite) TestUpsertGivesUpOnConflict(c *gc.C) {
+	signed := mustInputKey(c, "alice_signed.asc")
+	m := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{mustInputKey(c, "alice_unsigned.asc")}, nil
+		}),
+		mock.Update(func(*openpgp.PrimaryKey, string, string) error {
+			return errgo.WithCausef(nil, storage.ErrConflict, "")
+		}),
+	)
+	_, err := storage.UpsertKey(m, signed)
+	c.Assert(storage.IsConflict(err), gc.Equals, true)
+	c.Assert(m.MethodCount("Update") > 1, gc.Equals, true)
+}
+
+func (*StorageSuite) TestUpsertConcurrentInsert(c *gc.C) {
+	signed := mustInputKey(c, "alice_signed.asc")
+	var fetched bool
+	m := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			if !fetched {
+				fetched = true
+				return nil, nil
+			}
+			return []*openpgp.PrimaryKey{mustInputKey(c, "alice_unsigned.asc")}, nil
+		}),
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+			return 0, storage.InsertError{Duplicates: keys}
+		}),
+	)
+	kc, err := storage.UpsertKey(m, signed)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(m.MethodCount("Insert"), gc.Equals, 1)
+	c.Assert(m.MethodCount("Update"), gc.Equals, 1)
+}
+
+func (*StorageSuite) TestUpsertNoModify(c *gc.C) {
+	newStorage := func() *mock.Storage {
+		return mock.NewStorage(
+			mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+				return []*openpgp.PrimaryKey{mustInputKey(c, "alice_unsigned.asc")}, nil
+			}),
+		)
+	}
+
+	// Alice has asked that her key not be modified by others, so the
+	// third-party certification is withheld.
+	var rejected openpgp.Unowned
+	m := newStorage()
+	kc, err := storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), storage.HonourNoModify(), storage.Rejected(&rejected))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyNotChanged{})
+	c.Assert(m.MethodCount("Update"), gc.Equals, 0)
+	c.Assert(rejected.Signatures, gc.HasLen, 1)
+	c.Assert(rejected.Signatures[0].RIssuerKeyID, gc.Equals, "5bf04676d10aea26")
+
+	// The "nm" option applies regardless of the key's preferences.
+	rejected = openpgp.Unowned{}
+	m = newStorage()
+	kc, err = storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), storage.NotModifiable(), storage.Rejected(&rejected))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyNotChanged{})
+	c.Assert(rejected.Len(), gc.Equals, 1)
+}
+
+func (*StorageSuite) TestUpsertCertPolicy(c *gc.C) {
+	newStorage := func(stored string, issuers ...string) *mock.Storage {
+		return mock.NewStorage(
+			mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+				return []*openpgp.PrimaryKey{mustInputKey(c, stored)}, nil
+			}),
+			mock.Resolve(func([]string) ([]string, error) {
+				return issuers, nil
+			}),
+		)
+	}
+	policy := storage.CertPolicy(&openpgp.CertPolicy{KnownIssuersOnly: true})
+
+	// The certification's issuer is not stored, so it is rejected.
+	var rejected openpgp.Unowned
+	m := newStorage("alice_unsigned.asc")
+	kc, err := storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), policy, storage.Rejected(&rejected))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyNotChanged{})
+	c.Assert(m.MethodCount("Resolve"), gc.Equals, 1)
+	c.Assert(rejected.Signatures, gc.HasLen, 1)
+	c.Assert(rejected.Signatures[0].RIssuerKeyID, gc.Equals, "5bf04676d10aea26")
+
+	// The reversed fingerprint of a stored key begins with the reversed
+	// key ID of the issuer.
+	rejected = openpgp.Unowned{}
+	m = newStorage("alice_unsigned.asc", "5bf04676d10aea26a0f3a4dbb41ff4e1c5d6e7f8")
+	kc, err = storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), policy, storage.Rejected(&rejected))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(m.MethodCount("Resolve"), gc.Equals, 1)
+	c.Assert(rejected.Len(), gc.Equals, 0)
+
+	// Certifications already stored are dropped too.
+	rejected = openpgp.Unowned{}
+	m = newStorage("alice_signed.asc")
+	kc, err = storage.UpsertKey(m, mustInputKey(c, "alice_unsigned.asc"), policy, storage.Rejected(&rejected))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(kc.(storage.KeyReplaced).NewDigest, gc.Equals, mustInputKey(c, "alice_unsigned.asc").MD5)
+	c.Assert(m.MethodCount("Resolve"), gc.Equals, 1)
+	c.Assert(rejected.Len(), gc.Equals, 0)
+}
+
+func (*StorageSuite) TestUpsertKeyPolicy(c *gc.C) {
+	policy := storage.KeyPolicy(openpgp.MinRSABits(4096))
+
+	m := mock.NewStorage()
+	_, err := storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), policy)
+	c.Assert(err, gc.ErrorMatches, "RSA key .* has 2048 bits, fewer than 4096")
+	c.Assert(errgo.Cause(err), gc.Equals, openpgp.ErrKeyRejected)
+	c.Assert(m.MethodCount("Insert"), gc.Equals, 0)
+
+	// A key stored before the policy was may still be revoked.
+	m = mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			key := mustInputKey(c, "lp1195901_2.asc")
+			for _, subKey := range key.SubKeys {
+				var sigs []*openpgp.Signature
+				for _, sig := range subKey.Signatures {
+					if sig.SigType != 0x28 {
+						sigs = append(sigs, sig)
+					}
+				}
+				subKey.Signatures = sigs
+			}
+			key.MD5 = ""
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	kc, err := storage.UpsertKey(m, mustInputKey(c, "lp1195901_2.asc"), storage.KeyPolicy(openpgp.MinRSABits(2048)))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(m.MethodCount("Update"), gc.Equals, 1)
+
+	// And renewed by self-signatures which the policy accepts on their own.
+	m = mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			key := mustInputKey(c, "0ff16c87.asc")
+			var sigs []*openpgp.Signature
+			for _, sig := range key.UserIDs[0].Signatures {
+				if sig.RIssuerKeyID != key.RKeyID {
+					sigs = append(sigs, sig)
+				}
+			}
+			key.UserIDs[0].Signatures, key.MD5 = sigs, ""
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	kc, err = storage.UpsertKey(m, mustInputKey(c, "0ff16c87.asc"), storage.KeyPolicy(openpgp.MaxUserIDs(1)))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(m.MethodCount("Update"), gc.Equals, 1)
+
+	// But not by those which the policy rejects, such as a new SHA-1
+	// binding.
+	m = mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			key := mustInputKey(c, "alice_unsigned.asc")
+			key.SubKeys[0].Signatures, key.MD5 = nil, ""
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	_, err = storage.UpsertKey(m, mustInputKey(c, "alice_unsigned.asc"), storage.KeyPolicy(openpgp.RejectSHA1Bindings()))
+	c.Assert(err, gc.ErrorMatches, ".* is only bound by SHA-1 signatures")
+	c.Assert(errgo.Cause(err), gc.Equals, openpgp.ErrKeyRejected)
+	c.Assert(m.MethodCount("Update"), gc.Equals, 0)
+
+	// Nor may it gain certifications by others.
+	m = mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{mustInputKey(c, "alice_unsigned.asc")}, nil
+		}),
+	)
+	_, err = storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), policy)
+	c.Assert(errgo.Cause(err), gc.Equals, openpgp.ErrKeyRejected)
+	c.Assert(m.MethodCount("Update"), gc.Equals, 0)
+
+	// Nor a subkey.
+	m = mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			key := mustInputKey(c, "alice_unsigned.asc")
+			// The key's digest no longer matches without its subkey.
+			key.SubKeys, key.MD5 = nil, ""
+			return []*openpgp.PrimaryKey{key}, nil
+		}),
+	)
+	_, err = storage.UpsertKey(m, mustInputKey(c, "alice_unsigned.asc"), policy)
+	c.Assert(errgo.Cause(err), gc.Equals, openpgp.ErrKeyRejected)
+	c.Assert(m.MethodCount("Update"), gc.Equals, 0)
+
+	// A key which passes may not be changed so that it does not.
+	m = mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{mustInputKey(c, "alice_unsigned.asc")}, nil
+		}),
+	)
+	uncertified := storage.KeyPolicy(openpgp.KeyPolicyFunc(func(key *openpgp.PrimaryKey) error {
+		if len(key.UserIDs[0].Signatures) > 1 {
+			return errgo.WithCausef(nil, openpgp.ErrKeyRejected, "key is certified")
+		}
+		return nil
+	}))
+	_, err = storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), uncertified)
+	c.Assert(errgo.Cause(err), gc.Equals, openpgp.ErrKeyRejected)
+	c.Assert(m.MethodCount("Update"), gc.Equals, 0)
+
+	// Nothing is refused when nothing changes.
+	kc, err = storage.UpsertKey(m, mustInputKey(c, "alice_unsigned.asc"), policy)
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyNotChanged{})
+}
+
+func (*StorageSuite) TestUpsertDryRun(c *gc.C) {
+	var diff openpgp.KeyDiff
+	m := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{mustInputKey(c, "alice_unsigned.asc")}, nil
+		}),
+	)
+	kc, err := storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), storage.DryRun(), storage.Diff(&diff))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyReplaced{})
+	c.Assert(diff.Signatures, gc.HasLen, 1)
+	c.Assert(m.MethodCount("Update"), gc.Equals, 0)
+
+	m = mock.NewStorage()
+	kc, err = storage.UpsertKey(m, mustInputKey(c, "alice_signed.asc"), storage.DryRun(), storage.Diff(&diff))
+	c.Assert(err, gc.IsNil)
+	c.Assert(kc, gc.FitsTypeOf, storage.KeyAdded{})
+	c.Assert(diff.UserIDs, gc.HasLen, 1)
+	c.Assert(m.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (*StorageSuite) TestUpsertCanceled(c *gc.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := mock.NewStorage()
+	_, err := storage.UpsertKeyContext(ctx, m, mustInputKey(c, "alice_signed.asc"))
+	c.Assert(errgo.Cause(err), gc.Equals, context.Canceled)
+	c.Assert(m.Calls, gc.HasLen, 0)
+}
+
+func (*StorageSuite) TestUpsertSuppressed(c *gc.C) {
+	key := mustInputKey(c, "alice_signed.asc")
+	m := mock.NewStorage(
+		mock.Suppressed(func(rfps []string) ([]string, error) {
+			c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+			return rfps, nil
+		}),
+	)
+	_, err := storage.UpsertKey(m, key)
+	c.Assert(errgo.Cause(err), gc.Equals, storage.ErrKeySuppressed)
+	c.Assert(m.MethodCount("FetchKeys"), gc.Equals, 0)
+	c.Assert(m.MethodCount("Insert"), gc.Equals, 0)
+}
+
+func (*StorageSuite) TestBatchCursor(c *gc.C) {
+	var keyrings []*storage.Keyring
+	for _, rfp := range []string{"a1", "b2", "c3", "d4", "e5"} {
+		keyrings = append(keyrings, &storage.Keyring{PrimaryKey: &openpgp.PrimaryKey{
+			PublicKey: openpgp.PublicKey{RFingerprint: rfp},
+		}})
+	}
+	var fetches int
+	fetch := func(cp storage.Checkpoint) ([]*storage.Keyring, storage.Checkpoint, error) {
+		fetches++
+		var batch []*storage.Keyring
+		var next storage.Checkpoint
+		for _, kr := range keyrings {
+			if kr.RFingerprint > cp.RFingerprint && len(batch) < 2 {
+				batch = append(batch, kr)
+				next = storage.CheckpointOf(kr)
+			}
+		}
+		return batch, next, nil
+	}
+
+	cur := storage.NewBatchCursor(storage.Checkpoint{}, fetch)
+	var rfps []string
+	for len(rfps) < 3 && cur.Next() {
+		rfps = append(rfps, cur.Keyring().RFingerprint)
+	}
+	c.Assert(cur.Err(), gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"a1", "b2", "c3"})
+	cp := cur.Checkpoint()
+	c.Assert(cur.Close(), gc.IsNil)
+	c.Assert(cp.RFingerprint, gc.Equals, "c3")
+
+	// Resuming continues after the checkpointed keyring.
+	cur = storage.NewBatchCursor(cp, fetch)
+	rfps = nil
+	for cur.Next() {
+		rfps = append(rfps, cur.Keyring().RFingerprint)
+	}
+	c.Assert(cur.Err(), gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"d4", "e5"})
+	c.Assert(fetches, gc.Equals, 4)
+}
+
+func (*StorageSuite) TestBatchCursorSkipped(c *gc.C) {
+	// The backend skips every record of the second batch, but iteration
+	// continues past them.
+	batches := map[string][]string{
+		"":   {"a1", "b2"},
+		"b2": {},
+		"d4": {"e5"},
+	}
+	nexts := map[string]string{"": "b2", "b2": "d4", "d4": "e5", "e5": ""}
+	cur := storage.NewBatchCursor(storage.Checkpoint{}, func(cp storage.Checkpoint) ([]*storage.Keyring, storage.Checkpoint, error) {
+		var batch []*storage.Keyring
+		for _, rfp := range batches[cp.RFingerprint] {
+			batch = append(batch, &storage.Keyring{PrimaryKey: &openpgp.PrimaryKey{
+				PublicKey: openpgp.PublicKey{RFingerprint: rfp},
+			}})
+		}
+		return batch, storage.Checkpoint{RFingerprint: nexts[cp.RFingerprint]}, nil
+	})
+	var rfps []string
+	for cur.Next() {
+		rfps = append(rfps, cur.Keyring().RFingerprint)
+	}
+	c.Assert(cur.Err(), gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"a1", "b2", "e5"})
+}
+
+func (*StorageSuite) TestBatchCursorError(c *gc.C) {
+	cur := storage.NewBatchCursor(storage.Checkpoint{}, func(storage.Checkpoint) ([]*storage.Keyring, storage.Checkpoint, error) {
+		return nil, storage.Checkpoint{}, errgo.New("boom")
+	})
+	c.Assert(cur.Next(), gc.Equals, false)
+	c.Assert(cur.Err(), gc.ErrorMatches, "boom")
+	c.Assert(cur.Next(), gc.Equals, false)
+}
+
+func (*StorageSuite) TestNormalizeEmail(c *gc.C) {
+	for _, t := range []struct {
+		addr, email string
+	}{
+		{"alice@example.com", "alice@example.com"},
+		{"Alice@EXAMPLE.com", "alice@example.com"},
+		{" alice@example.com ", "alice@example.com"},
+		{"alíce@example.com", "alíce@example.com"},
+		{"alice@bücher.example", "alice@xn--bcher-kva.example"},
+		{"alice@BÜCHER.example", "alice@xn--bcher-kva.example"},
+	} {
+		email, err := storage.NormalizeEmail(t.addr)
+		c.Assert(err, gc.IsNil, gc.Commentf("%q", t.addr))
+		c.Check(email, gc.Equals, t.email, gc.Commentf("%q", t.addr))
+	}
+	for _, addr := range []string{"", "alice", "@example.com", "alice@", "al ice@example.com"} {
+		_, err := storage.NormalizeEmail(addr)
+		c.Check(err, gc.NotNil, gc.Commentf("%q", addr))
+	}
+}
+
+func (*StorageSuite) TestParseEmail(c *gc.C) {
+	for _, t := range []struct {
+		uid, email string
+		ok         bool
+	}{
+		{"alice <Alice@Example.com>", "alice@example.com", true},
+		{"alice@example.com", "alice@example.com", true},
+		{"<alice@example.com>", "alice@example.com", true},
+		{"alice (example.com)", "", false},
+		{"alice example.com", "", false},
+		{"alice", "", false},
+	} {
+		email, ok := storage.ParseEmail(t.uid)
+		c.Check(ok, gc.Equals, t.ok, gc.Commentf("%q", t.uid))
+		c.Check(email, gc.Equals, t.email, gc.Commentf("%q", t.uid))
+	}
+	c.Assert(storage.Emails(mustInputKey(c, "alice_unsigned.asc")), gc.DeepEquals, []string{"alice@example.com"})
+}
+
+func (*StorageSuite) TestParseWKDAddress(c *gc.C) {
+	// Test vector from draft-koch-openpgp-webkey-service.
+	c.Assert(storage.WKDHash("Joe.Doe"), gc.Equals, "iy9q119eutrkn8s1mk4r39qejnbu3n5q")
+	for _, t := range []struct {
+		uid, wkd string
+		ok       bool
+	}{
+		{"Joe Doe <Joe.Doe@Example.ORG>", "iy9q119eutrkn8s1mk4r39qejnbu3n5q@example.org", true},
+		{"joe.doe@example.org", "iy9q119eutrkn8s1mk4r39qejnbu3n5q@example.org", true},
+		{"joe.doe@bücher.example", "iy9q119eutrkn8s1mk4r39qejnbu3n5q@xn--bcher-kva.example", true},
+		{"alice (example.com)", "", false},
+		{"@example.com", "", false},
+		{"alice", "", false},
+	} {
+		wkd, ok := storage.ParseWKDAddress(t.uid)
+		c.Check(ok, gc.Equals, t.ok, gc.Commentf("%q", t.uid))
+		c.Check(wkd, gc.Equals, t.wkd, gc.Commentf("%q", t.uid))
+	}
+	c.Assert(storage.WKDAddresses(mustInputKey(c, "alice_unsigned.asc")), gc.DeepEquals,
+		[]string{storage.WKDHash("alice") + "@example.com"})
+}
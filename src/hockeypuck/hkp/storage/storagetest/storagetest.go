@@ -0,0 +1,151 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package storagetest holds tests which every storage backend should pass.
+// Backends run each of them from their own suites, on an empty storage.
+package storagetest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+// newServer serves HKP requests from the given storage.
+func newServer(c *gc.C, st storage.Storage) *httptest.Server {
+	r := httprouter.New()
+	handler, err := hkp.NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	return httptest.NewServer(r)
+}
+
+func addKey(c *gc.C, srv *httptest.Server, keyname string) {
+	keytext, err := ioutil.ReadAll(testing.MustInput(keyname))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+	_, err = ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+}
+
+// ResolveV3 tests that a v3 key is resolved by its fingerprint and by its
+// key IDs, which do not end its fingerprint, until it is deleted.
+func ResolveV3(c *gc.C, st storage.Storage) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("0xd46b7c827be290fe4d1f9291b1ebc61a.asc"))
+	c.Assert(keys, gc.HasLen, 1)
+	key := keys[0]
+	c.Assert(storage.V3RKeyID(key), gc.Equals, key.RKeyID)
+	_, err := st.Insert(keys)
+	c.Assert(err, gc.IsNil)
+
+	for _, keyid := range []string{key.RFingerprint, key.RKeyID, key.RShortID} {
+		rfps, err := st.Resolve([]string{keyid})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint}, gc.Commentf("keyid=%s", keyid))
+	}
+
+	_, err = st.Delete(key.RFingerprint)
+	c.Assert(err, gc.IsNil)
+	rfps, err := st.Resolve([]string{key.RKeyID})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+// MatchEmail tests that keys are matched by exactly the email addresses of
+// their user IDs, ignoring case, until they are deleted.
+func MatchEmail(c *gc.C, st storage.Storage) {
+	srv := newServer(c, st)
+	defer srv.Close()
+	addKey(c, srv, "alice_unsigned.asc")
+	addKey(c, srv, "revok_orig.asc")
+
+	rfps, err := st.MatchEmail([]string{"alice@example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+	keys, err := st.FetchKeys(rfps)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "alice <alice@example.com>")
+
+	rfps, err = st.MatchEmail([]string{"alice@example.org", "example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&exact=on&search=Test%40Example.COM")
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	keys = openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "Test Test <test@example.com>")
+
+	_, err = st.Delete(keys[0].RFingerprint)
+	c.Assert(err, gc.IsNil)
+	rfps, err = st.MatchEmail([]string{"test@example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+// V6 tests that a v6 key is looked up by the key IDs and fingerprints of
+// its primary key and subkey, and by its email address.
+func V6(c *gc.C, st storage.Storage) {
+	srv := newServer(c, st)
+	defer srv.Close()
+	addKey(c, srv, "v6_ed25519.asc")
+
+	for _, search := range []string{
+		// short, long and full fingerprint key IDs match
+		"0x7c17e35e", "0x84c130617c17e35e",
+		"0x84c130617c17e35e8bb4523ff0b386800dfc2d0b30a219ec4015f5043d177693",
+		// and so do those of the subkey
+		"0x4254da2a", "0x8c84f9804254da2a",
+		"0x8c84f9804254da2a7e0c44c54a72b3c711c892bd61c669752576e1b2adc8c933",
+		// email addresses match
+		"v6@example.org"} {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=" + search)
+		comment := gc.Commentf("search=%s", search)
+		c.Assert(err, gc.IsNil, comment)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, comment)
+
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].Fingerprint(), gc.Equals, "84c130617c17e35e8bb4523ff0b386800dfc2d0b30a219ec4015f5043d177693")
+		c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+		c.Assert(keys[0].SubKeys, gc.HasLen, 1)
+		c.Assert(keys[0].Parsed, gc.Equals, true)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"crypto/sha1"
+	"strings"
+
+	"golang.org/x/net/idna"
+
+	"hockeypuck/openpgp"
+)
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// zbase32 encodes the given bytes in z-base-32, most significant bits first
+// and without padding.
+func zbase32(buf []byte) string {
+	var sb strings.Builder
+	var acc uint
+	var bits uint
+	for _, b := range buf {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[(acc>>bits)&0x1f])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[(acc<<(5-bits))&0x1f])
+	}
+	return sb.String()
+}
+
+// WKDHash returns the Web Key Directory hash of the local part of an email
+// address: the z-base-32 encoded SHA-1 digest of the local part, with ASCII
+// letters mapped to lower case.
+func WKDHash(local string) string {
+	lower := []byte(local)
+	for i, c := range lower {
+		if 'A' <= c && c <= 'Z' {
+			lower[i] = c + 'a' - 'A'
+		}
+	}
+	digest := sha1.Sum(lower)
+	return zbase32(digest[:])
+}
+
+// ParseWKDAddress returns the Web Key Directory address of the email address
+// in a user ID, in which it is indexed. This is the WKD hash of the local
+// part and the lower case IDNA ASCII form of the domain, joined by "@".
+func ParseWKDAddress(uid string) (string, bool) {
+	addr, ok := uidAddress(strings.TrimSpace(uid))
+	if !ok {
+		return "", false
+	}
+	at := strings.LastIndex(addr, "@")
+	if at < 1 || at == len(addr)-1 {
+		return "", false
+	}
+	domain, err := idna.Lookup.ToASCII(addr[at+1:])
+	if err != nil {
+		return "", false
+	}
+	return WKDHash(addr[:at]) + "@" + strings.ToLower(domain), true
+}
+
+// WKDAddresses returns the Web Key Directory addresses of the user IDs of the
+// given key, without repetition.
+func WKDAddresses(key *openpgp.PrimaryKey) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, uid := range key.UserIDs {
+		addr, ok := ParseWKDAddress(uid.Keywords)
+		if ok && !seen[addr] {
+			seen[addr] = true
+			result = append(result, addr)
+		}
+	}
+	return result
+}
@@ -0,0 +1,507 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package takedown removes keys at the request of their owners, once they
+// have proven control of the key, or of an email address in its user IDs.
+package takedown
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/verify"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+var (
+	// ErrInvalidToken is returned when a takedown token or challenge is
+	// malformed or has expired.
+	ErrInvalidToken = errors.New("invalid takedown token")
+
+	// ErrUnauthorized is returned when the requester has not proven control
+	// of the key.
+	ErrUnauthorized = errors.New("takedown not authorized")
+
+	// ErrTooSoon is returned when a takedown link is requested for an
+	// address which has been sent one within the mail interval.
+	ErrTooSoon = errors.New("takedown link sent recently")
+)
+
+// DefaultTokenTTL is how long takedown tokens and challenges remain valid by
+// default.
+const DefaultTokenTTL = time.Hour
+
+// DefaultMailInterval is how long to wait by default before sending another
+// takedown link to the same address.
+const DefaultMailInterval = 15 * time.Minute
+
+// Methods by which key owners prove control, as recorded in the audit log.
+const (
+	MethodSignature = "signature"
+	MethodEmail     = "email"
+)
+
+// AuditRecord describes a takedown in the audit log.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Fingerprint string    `json:"fingerprint"`
+	Digest      string    `json:"digest"`
+	Method      string    `json:"method"`
+	Email       string    `json:"email,omitempty"`
+	RemoteAddr  string    `json:"remoteAddr,omitempty"`
+}
+
+// Remover takes down keys once their owners have proven control of them.
+// Removed keys are deleted from storage, which withdraws them from
+// reconciliation, and suppressed if the storage supports it, so that they
+// are not recovered from peers or uploaded again. The suppression can be
+// lifted with hockeypuck-unsuppress.
+type Remover struct {
+	storage storage.Storage
+
+	secret   []byte
+	baseURL  string
+	from     string
+	sender   verify.MailSender
+	tokenTTL time.Duration
+
+	mailInterval time.Duration
+	sentMu       sync.Mutex
+	sent         map[string]time.Time
+
+	auditMu sync.Mutex
+	audit   io.Writer
+
+	now func() time.Time
+}
+
+type Option func(r *Remover) error
+
+// Secret sets the key with which tokens and challenges are authenticated. It
+// must be kept private, and shared by every server using the same storage.
+func Secret(secret string) Option {
+	return func(r *Remover) error {
+		r.secret = []byte(secret)
+		return nil
+	}
+}
+
+// BaseURL sets the public URL of the server, under which takedown links are
+// made.
+func BaseURL(baseURL string) Option {
+	return func(r *Remover) error {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return errgo.Notef(err, "invalid base URL %q", baseURL)
+		} else if u.Scheme == "" || u.Host == "" {
+			return errgo.Newf("invalid base URL %q: must be absolute", baseURL)
+		}
+		r.baseURL = strings.TrimSuffix(baseURL, "/")
+		return nil
+	}
+}
+
+// From sets the sender address of takedown messages.
+func From(from string) Option {
+	return func(r *Remover) error {
+		r.from = from
+		return nil
+	}
+}
+
+// Sender sets how takedown messages are delivered. Takedown by email is only
+// offered if a sender is set.
+func Sender(sender verify.MailSender) Option {
+	return func(r *Remover) error {
+		r.sender = sender
+		return nil
+	}
+}
+
+// TokenTTL sets how long takedown tokens and challenges remain valid.
+func TokenTTL(ttl time.Duration) Option {
+	return func(r *Remover) error {
+		r.tokenTTL = ttl
+		return nil
+	}
+}
+
+// MailInterval sets how long to wait before sending another takedown link to
+// the same address, so that the server cannot be used to flood an address
+// with mail. A zero interval sends a link on every request.
+func MailInterval(d time.Duration) Option {
+	return func(r *Remover) error {
+		r.mailInterval = d
+		return nil
+	}
+}
+
+// AuditLog sets where a JSON AuditRecord is written for each takedown, one
+// per line.
+func AuditLog(w io.Writer) Option {
+	return func(r *Remover) error {
+		r.audit = w
+		return nil
+	}
+}
+
+// NewRemover returns a Remover for keys in the given storage.
+func NewRemover(st storage.Storage, options ...Option) (*Remover, error) {
+	r := &Remover{
+		storage:      st,
+		tokenTTL:     DefaultTokenTTL,
+		mailInterval: DefaultMailInterval,
+		sent:         make(map[string]time.Time),
+		now:          time.Now,
+	}
+	for _, option := range options {
+		err := option(r)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	switch {
+	case len(r.secret) == 0:
+		return nil, errgo.New("takedown secret not configured")
+	case r.sender != nil && r.baseURL == "":
+		return nil, errgo.New("takedown base URL not configured")
+	case r.sender != nil && r.from == "":
+		return nil, errgo.New("takedown sender address not configured")
+	case r.tokenTTL <= 0:
+		return nil, errgo.Newf("invalid takedown token TTL %v", r.tokenTTL)
+	case r.mailInterval < 0:
+		return nil, errgo.Newf("invalid takedown mail interval %v", r.mailInterval)
+	}
+	if _, ok := st.(storage.Suppressor); !ok {
+		log.Warning("storage cannot suppress keys, taken down keys may be recovered from peers")
+	}
+	return r, nil
+}
+
+// EmailEnabled returns whether owners may prove control of a key by email.
+func (r *Remover) EmailEnabled() bool {
+	return r.sender != nil
+}
+
+const (
+	purposeChallenge = "challenge"
+	purposeEmail     = "email"
+)
+
+// claims are the contents of a takedown token or challenge.
+type claims struct {
+	Purpose      string `json:"purpose"`
+	RFingerprint string `json:"rfp"`
+	Email        string `json:"email,omitempty"`
+	Issued       int64  `json:"iat"`
+	Expires      int64  `json:"exp"`
+}
+
+func (r *Remover) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (r *Remover) newToken(c *claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(r.mac(payload)), nil
+}
+
+func (r *Remover) parseToken(token, purpose string) (*claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrInvalidToken, "malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrInvalidToken, "malformed token")
+	}
+	if !hmac.Equal(sig, r.mac(payload)) {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "bad token signature")
+	}
+	var c claims
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrInvalidToken, "malformed token")
+	}
+	if c.Purpose != purpose {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "not a takedown %s", purpose)
+	}
+	if r.now().Unix() >= c.Expires {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "token expired")
+	}
+	return &c, nil
+}
+
+func (r *Remover) fetchKey(ctx context.Context, rfp string) (*openpgp.PrimaryKey, error) {
+	keys, err := r.storage.FetchKeysContext(ctx, []string{rfp})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	for _, key := range keys {
+		if key.RFingerprint == rfp {
+			return key, nil
+		}
+	}
+	return nil, errgo.WithCausef(nil, storage.ErrKeyNotFound, "rfp=%q", rfp)
+}
+
+// Challenge returns a challenge for the stored key with the given
+// fingerprint. Its owner takes it down by making a detached signature over
+// the challenge with the key, and passing both to RemoveSigned before the
+// challenge expires.
+func (r *Remover) Challenge(ctx context.Context, fingerprint string) (string, error) {
+	rfp := openpgp.Reverse(strings.ToLower(fingerprint))
+	_, err := r.fetchKey(ctx, rfp)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	now := r.now()
+	return r.newToken(&claims{
+		Purpose:      purposeChallenge,
+		RFingerprint: rfp,
+		Issued:       now.Unix(),
+		Expires:      now.Add(r.tokenTTL).Unix(),
+	})
+}
+
+// RemoveSigned takes down the key for which the given challenge was issued,
+// if sigtext is an armored detached signature over the challenge made by
+// that key or one of its valid subkeys, which may be version 6 keys. The
+// fingerprint of the removed key is returned.
+func (r *Remover) RemoveSigned(ctx context.Context, challenge, sigtext, remoteAddr string) (string, error) {
+	// Signatures are checked over the challenge as given, but the newline
+	// added when saving it to a file is tolerated.
+	c, err := r.parseToken(strings.TrimSpace(challenge), purposeChallenge)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(ErrInvalidToken))
+	}
+	key, err := r.fetchKey(ctx, c.RFingerprint)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(key, []byte(challenge), strings.NewReader(sigtext))
+	if err != nil {
+		return "", errgo.WithCausef(err, ErrUnauthorized, "challenge signature verification failed")
+	}
+	return r.remove(ctx, &AuditRecord{
+		Fingerprint: key.Fingerprint(),
+		Method:      MethodSignature,
+		RemoteAddr:  remoteAddr,
+	})
+}
+
+// RequestToken mails a takedown link for the stored key with the given
+// fingerprint to the given email address, which must be in one of its user
+// IDs. Anyone may add a user ID to a key, so only those self-certified by
+// the key, and not revoked, are considered. Only one link is sent to each
+// address within the mail interval, for any key; further requests return
+// ErrTooSoon.
+func (r *Remover) RequestToken(ctx context.Context, fingerprint, email string) error {
+	if r.sender == nil {
+		return errgo.New("takedown by email not enabled")
+	}
+	email, err := storage.NormalizeEmail(email)
+	if err != nil {
+		return errgo.WithCausef(err, ErrUnauthorized, "invalid email address")
+	}
+	rfp := openpgp.Reverse(strings.ToLower(fingerprint))
+	key, err := r.fetchKey(ctx, rfp)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var found bool
+	for _, keyEmail := range storage.CertifiedEmails(key) {
+		if keyEmail == email {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errgo.WithCausef(nil, ErrUnauthorized, "%q is not an address of the key", email)
+	}
+	now := r.now()
+	if !r.reserveMail(email, now) {
+		return errgo.WithCausef(nil, ErrTooSoon, "a takedown link was sent to %q recently, try again later", email)
+	}
+	token, err := r.newToken(&claims{
+		Purpose:      purposeEmail,
+		RFingerprint: rfp,
+		Email:        email,
+		Issued:       now.Unix(),
+		Expires:      now.Add(r.tokenTTL).Unix(),
+	})
+	if err != nil {
+		r.releaseMail(email, now)
+		return errgo.Mask(err)
+	}
+	err = r.sender.SendMail(r.from, []string{email}, r.message(key, email, token, now))
+	if err != nil {
+		r.releaseMail(email, now)
+		return errgo.Notef(err, "cannot send takedown link to %q", email)
+	}
+	log.WithFields(log.Fields{
+		"fp":    key.Fingerprint(),
+		"email": email,
+	}).Info("takedown requested")
+	return nil
+}
+
+// reserveMail records that a takedown link is being sent to the given
+// address at the given time, returning false if one was sent within the mail
+// interval. Reservations which have lapsed are forgotten.
+func (r *Remover) reserveMail(email string, now time.Time) bool {
+	if r.mailInterval == 0 {
+		return true
+	}
+	r.sentMu.Lock()
+	defer r.sentMu.Unlock()
+	for addr, t := range r.sent {
+		if now.Sub(t) >= r.mailInterval {
+			delete(r.sent, addr)
+		}
+	}
+	if _, ok := r.sent[email]; ok {
+		return false
+	}
+	r.sent[email] = now
+	return true
+}
+
+// releaseMail forgets the reservation made by reserveMail for a message which
+// could not be sent, so that it may be requested again.
+func (r *Remover) releaseMail(email string, now time.Time) {
+	r.sentMu.Lock()
+	defer r.sentMu.Unlock()
+	if r.sent[email].Equal(now) {
+		delete(r.sent, email)
+	}
+}
+
+func (r *Remover) message(key *openpgp.PrimaryKey, email, token string, now time.Time) []byte {
+	fp := strings.ToUpper(key.Fingerprint())
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", r.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", email)
+	fmt.Fprintf(&msg, "Subject: Remove OpenPGP key %s\r\n", fp)
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Removal of the OpenPGP key %s, which has a user ID for\r\n", fp)
+	fmt.Fprintf(&msg, "%s, was requested from %s.\r\n\r\n", email, r.baseURL)
+	fmt.Fprintf(&msg, "To remove the key, follow this link before %s:\r\n\r\n",
+		now.Add(r.tokenTTL).UTC().Format(time.RFC1123))
+	fmt.Fprintf(&msg, "%s/pks/takedown?token=%s\r\n\r\n", r.baseURL, token)
+	fmt.Fprintf(&msg, "If you did not request this, you can ignore this message and the\r\n")
+	fmt.Fprintf(&msg, "key will not be removed.\r\n")
+	return msg.Bytes()
+}
+
+// ParseToken returns the fingerprint of the key and the email address for
+// which the given takedown token was mailed, if it is authentic and has not
+// expired.
+func (r *Remover) ParseToken(token string) (fingerprint string, email string, _ error) {
+	c, err := r.parseToken(token, purposeEmail)
+	if err != nil {
+		return "", "", errgo.Mask(err, errgo.Is(ErrInvalidToken))
+	}
+	return openpgp.Reverse(c.RFingerprint), c.Email, nil
+}
+
+// RemoveByToken takes down the key for which the given takedown token was
+// mailed. The fingerprint of the removed key is returned.
+func (r *Remover) RemoveByToken(ctx context.Context, token, remoteAddr string) (string, error) {
+	c, err := r.parseToken(token, purposeEmail)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(ErrInvalidToken))
+	}
+	return r.remove(ctx, &AuditRecord{
+		Fingerprint: openpgp.Reverse(c.RFingerprint),
+		Method:      MethodEmail,
+		Email:       c.Email,
+		RemoteAddr:  remoteAddr,
+	})
+}
+
+// remove suppresses and deletes a key, and records it in the audit log. The
+// key is suppressed first so that it cannot be recovered from a peer before
+// it is deleted. ErrKeyNotFound is returned if the key is no longer stored,
+// in which case it has already been taken down.
+func (r *Remover) remove(ctx context.Context, rec *AuditRecord) (string, error) {
+	rfp := openpgp.Reverse(rec.Fingerprint)
+	if suppressor, ok := r.storage.(storage.Suppressor); ok {
+		err := suppressor.Suppress(ctx, rfp)
+		if err != nil {
+			return "", errgo.Mask(err, errgo.Any)
+		}
+	}
+	digest, err := r.storage.DeleteContext(ctx, rfp)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	rec.Time = r.now().UTC()
+	rec.Digest = digest
+	r.writeAudit(rec)
+	return rec.Fingerprint, nil
+}
+
+func (r *Remover) writeAudit(rec *AuditRecord) {
+	log.WithFields(log.Fields{
+		"fp":         rec.Fingerprint,
+		"digest":     rec.Digest,
+		"method":     rec.Method,
+		"email":      rec.Email,
+		"remoteAddr": rec.RemoteAddr,
+	}).Info("takedown")
+	if r.audit == nil {
+		return
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("takedown: cannot encode audit record: %v", err)
+		return
+	}
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+	_, err = r.audit.Write(append(buf, '\n'))
+	if err != nil {
+		log.Errorf("takedown: cannot write audit record for %q: %v", rec.Fingerprint, err)
+	}
+}
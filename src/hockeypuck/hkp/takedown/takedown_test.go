@@ -0,0 +1,300 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package takedown
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type testSender struct {
+	to   []string
+	msgs []string
+	err  error
+}
+
+func (s *testSender) SendMail(from string, to []string, msg []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.to = append(s.to, to...)
+	s.msgs = append(s.msgs, string(msg))
+	return nil
+}
+
+var testEntityConfig = &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+
+func newTestEntity(c *gc.C, name string) (*xopenpgp.Entity, *openpgp.PrimaryKey) {
+	entity, err := xopenpgp.NewEntity(name, "", name+"@example.com", testEntityConfig)
+	c.Assert(err, gc.IsNil)
+	err = entity.SelfSign(testEntityConfig)
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	err = entity.Serialize(&buf)
+	c.Assert(err, gc.IsNil)
+	keys := openpgp.MustReadKeys(&buf)
+	c.Assert(keys, gc.HasLen, 1)
+	return entity, keys[0]
+}
+
+func sign(c *gc.C, entity *xopenpgp.Entity, text string) string {
+	var sig bytes.Buffer
+	err := xopenpgp.ArmoredDetachSign(&sig, entity, strings.NewReader(text), nil)
+	c.Assert(err, gc.IsNil)
+	return sig.String()
+}
+
+type TakedownSuite struct {
+	entity     *xopenpgp.Entity
+	key        *openpgp.PrimaryKey
+	deleted    []string
+	suppressed []string
+	storage    *mock.Storage
+	sender     *testSender
+	audit      bytes.Buffer
+	remover    *Remover
+	now        time.Time
+}
+
+var _ = gc.Suite(&TakedownSuite{})
+
+func (s *TakedownSuite) SetUpTest(c *gc.C) {
+	s.entity, s.key = newTestEntity(c, "owner")
+	s.deleted = nil
+	s.suppressed = nil
+	s.storage = mock.NewStorage(
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			if len(rfps) == 1 && rfps[0] == s.key.RFingerprint && len(s.deleted) == 0 {
+				return []*openpgp.PrimaryKey{s.key}, nil
+			}
+			return nil, nil
+		}),
+		mock.Delete(func(rfp string) (string, error) {
+			if rfp != s.key.RFingerprint || len(s.deleted) > 0 {
+				return "", storage.ErrKeyNotFound
+			}
+			s.deleted = append(s.deleted, rfp)
+			return s.key.MD5, nil
+		}),
+		mock.Suppress(func(rfp string) error {
+			s.suppressed = append(s.suppressed, rfp)
+			return nil
+		}),
+	)
+	s.sender = &testSender{}
+	s.audit.Reset()
+	var err error
+	s.remover, err = NewRemover(s.storage,
+		Secret("sekrit"),
+		BaseURL("https://keys.example.com"),
+		From("keyserver@example.com"),
+		Sender(s.sender),
+		AuditLog(&s.audit),
+	)
+	c.Assert(err, gc.IsNil)
+	s.now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.remover.now = func() time.Time { return s.now }
+}
+
+func (s *TakedownSuite) auditRecords(c *gc.C) []AuditRecord {
+	var records []AuditRecord
+	dec := json.NewDecoder(&s.audit)
+	for dec.More() {
+		var rec AuditRecord
+		c.Assert(dec.Decode(&rec), gc.IsNil)
+		records = append(records, rec)
+	}
+	return records
+}
+
+func (s *TakedownSuite) TestNewRemover(c *gc.C) {
+	_, err := NewRemover(s.storage)
+	c.Assert(err, gc.ErrorMatches, "takedown secret not configured")
+	_, err = NewRemover(s.storage, Secret("sekrit"), Sender(s.sender))
+	c.Assert(err, gc.ErrorMatches, "takedown base URL not configured")
+
+	r, err := NewRemover(s.storage, Secret("sekrit"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(r.EmailEnabled(), gc.Equals, false)
+	c.Assert(s.remover.EmailEnabled(), gc.Equals, true)
+}
+
+func (s *TakedownSuite) TestRemoveSigned(c *gc.C) {
+	ctx := context.Background()
+	challenge, err := s.remover.Challenge(ctx, strings.ToUpper(s.key.Fingerprint()))
+	c.Assert(err, gc.IsNil)
+
+	// The challenge must be signed by the key itself.
+	other, _ := newTestEntity(c, "other")
+	_, err = s.remover.RemoveSigned(ctx, challenge, sign(c, other, challenge), "192.0.2.1:1234")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrUnauthorized)
+	c.Assert(s.deleted, gc.HasLen, 0)
+
+	// The signature must be over the challenge issued.
+	_, err = s.remover.RemoveSigned(ctx, challenge, sign(c, s.entity, "something else"), "192.0.2.1:1234")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrUnauthorized)
+	c.Assert(s.deleted, gc.HasLen, 0)
+
+	// A trailing newline, as when the challenge was saved to a file, is
+	// tolerated.
+	signed := challenge + "\n"
+	fp, err := s.remover.RemoveSigned(ctx, signed, sign(c, s.entity, signed), "192.0.2.1:1234")
+	c.Assert(err, gc.IsNil)
+	c.Assert(fp, gc.Equals, s.key.Fingerprint())
+	c.Assert(s.suppressed, gc.DeepEquals, []string{s.key.RFingerprint})
+	c.Assert(s.deleted, gc.DeepEquals, []string{s.key.RFingerprint})
+
+	c.Assert(s.auditRecords(c), gc.DeepEquals, []AuditRecord{{
+		Time:        s.now,
+		Fingerprint: s.key.Fingerprint(),
+		Digest:      s.key.MD5,
+		Method:      MethodSignature,
+		RemoteAddr:  "192.0.2.1:1234",
+	}})
+}
+
+func (s *TakedownSuite) TestRemoveSignedV6(c *gc.C) {
+	ctx := context.Background()
+	s.key = openpgp.MustReadArmorKeys(testing.MustInput("rfc9580_v6.asc"))[0]
+	challenge, err := s.remover.Challenge(ctx, s.key.Fingerprint())
+	c.Assert(err, gc.IsNil)
+
+	sigtext := testing.MustDetachSignV6(testing.RFC9580V6Seed, testing.RFC9580V6Fingerprint, s.now, []byte(challenge))
+	fp, err := s.remover.RemoveSigned(ctx, challenge, sigtext, "192.0.2.1:1234")
+	c.Assert(err, gc.IsNil)
+	c.Assert(fp, gc.Equals, testing.RFC9580V6Fingerprint)
+	c.Assert(s.deleted, gc.DeepEquals, []string{s.key.RFingerprint})
+}
+
+func (s *TakedownSuite) TestChallengeInvalid(c *gc.C) {
+	ctx := context.Background()
+	_, err := s.remover.Challenge(ctx, "0000000000000000000000000000000000000000")
+	c.Assert(storage.IsNotFound(err), gc.Equals, true)
+
+	challenge, err := s.remover.Challenge(ctx, s.key.Fingerprint())
+	c.Assert(err, gc.IsNil)
+	s.now = s.now.Add(DefaultTokenTTL)
+	_, err = s.remover.RemoveSigned(ctx, challenge, sign(c, s.entity, challenge), "")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+
+	// Challenges are not takedown tokens.
+	_, err = s.remover.RemoveByToken(ctx, challenge, "")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+	c.Assert(s.deleted, gc.HasLen, 0)
+	c.Assert(s.audit.Len(), gc.Equals, 0)
+}
+
+var tokenRE = regexp.MustCompile(`/pks/takedown\?token=(\S+)`)
+
+func (s *TakedownSuite) TestRequestTokenUncertifiedUserID(c *gc.C) {
+	// Anyone can add a user ID to a key, but only its owner can certify it.
+	uid, err := openpgp.ParseUserID(&packet.OpaquePacket{
+		Tag:      13,
+		Contents: []byte("mallory <mallory@evil.example>"),
+	}, s.key.UUID)
+	c.Assert(err, gc.IsNil)
+	s.key.UserIDs = append(s.key.UserIDs, uid)
+
+	err = s.remover.RequestToken(context.Background(), s.key.Fingerprint(), "mallory@evil.example")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrUnauthorized)
+	c.Assert(s.sender.msgs, gc.HasLen, 0)
+	c.Assert(s.deleted, gc.HasLen, 0)
+}
+
+func (s *TakedownSuite) TestRequestTokenInterval(c *gc.C) {
+	ctx := context.Background()
+	s.sender.err = errgo.New("relay down")
+	err := s.remover.RequestToken(ctx, s.key.Fingerprint(), "owner@example.com")
+	c.Assert(err, gc.ErrorMatches, `cannot send takedown link to "owner@example.com": relay down`)
+
+	// A link which could not be sent may be requested again at once.
+	s.sender.err = nil
+	err = s.remover.RequestToken(ctx, s.key.Fingerprint(), "owner@example.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.sender.msgs, gc.HasLen, 1)
+
+	// But one which was sent may not, however the address is written.
+	s.now = s.now.Add(DefaultMailInterval - time.Second)
+	err = s.remover.RequestToken(ctx, s.key.Fingerprint(), "OWNER@example.com")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrTooSoon)
+	c.Assert(s.sender.msgs, gc.HasLen, 1)
+
+	s.now = s.now.Add(time.Second)
+	err = s.remover.RequestToken(ctx, s.key.Fingerprint(), "owner@example.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.sender.msgs, gc.HasLen, 2)
+}
+
+func (s *TakedownSuite) TestRemoveByToken(c *gc.C) {
+	ctx := context.Background()
+	err := s.remover.RequestToken(ctx, s.key.Fingerprint(), "someone@example.com")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrUnauthorized)
+	c.Assert(s.sender.msgs, gc.HasLen, 0)
+
+	err = s.remover.RequestToken(ctx, s.key.Fingerprint(), "Owner@Example.COM")
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.sender.to, gc.DeepEquals, []string{"owner@example.com"})
+	m := tokenRE.FindStringSubmatch(s.sender.msgs[0])
+	c.Assert(m, gc.HasLen, 2)
+	token := m[1]
+
+	fp, email, err := s.remover.ParseToken(token)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fp, gc.Equals, s.key.Fingerprint())
+	c.Assert(email, gc.Equals, "owner@example.com")
+
+	// Tokens are not challenges.
+	_, err = s.remover.RemoveSigned(ctx, token, sign(c, s.entity, token), "")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+
+	fp, err = s.remover.RemoveByToken(ctx, token, "192.0.2.1:1234")
+	c.Assert(err, gc.IsNil)
+	c.Assert(fp, gc.Equals, s.key.Fingerprint())
+	c.Assert(s.deleted, gc.DeepEquals, []string{s.key.RFingerprint})
+
+	// Once taken down, the key is gone.
+	_, err = s.remover.RemoveByToken(ctx, token, "192.0.2.1:1234")
+	c.Assert(storage.IsNotFound(err), gc.Equals, true)
+
+	c.Assert(s.auditRecords(c), gc.DeepEquals, []AuditRecord{{
+		Time:        s.now,
+		Fingerprint: s.key.Fingerprint(),
+		Digest:      s.key.MD5,
+		Method:      MethodEmail,
+		Email:       "owner@example.com",
+		RemoteAddr:  "192.0.2.1:1234",
+	}})
+}
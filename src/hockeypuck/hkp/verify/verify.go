@@ -0,0 +1,466 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package verify publishes the user IDs of keys only once their email
+// addresses have been verified, by mailing a token to each address.
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/hkp/pks"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// ErrInvalidToken is returned when a verification token is malformed, has
+// expired or has already been used.
+var ErrInvalidToken = errors.New("invalid verification token")
+
+// DefaultTokenTTL is how long a verification token remains valid by default.
+const DefaultTokenTTL = 24 * time.Hour
+
+// MailSender delivers verification messages.
+type MailSender interface {
+	SendMail(from string, to []string, msg []byte) error
+}
+
+type smtpSender struct {
+	host string
+	auth smtp.Auth
+}
+
+func (s *smtpSender) SendMail(from string, to []string, msg []byte) error {
+	return smtp.SendMail(s.host, s.auth, from, to, msg)
+}
+
+// NewSMTPSender returns a MailSender which relays messages through the
+// configured SMTP server, authenticating if a user is configured.
+func NewSMTPSender(config pks.SMTPConfig) (MailSender, error) {
+	host := config.Host
+	if host == "" {
+		host = pks.DefaultSMTPHost
+	}
+	var auth smtp.Auth
+	if config.User != "" {
+		authHost, _, err := net.SplitHostPort(host)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		auth = smtp.PlainAuth(config.ID, config.User, config.Password, authHost)
+	}
+	return &smtpSender{host: host, auth: auth}, nil
+}
+
+// Verifier tracks the verification of the email addresses of stored keys,
+// and removes unverified user IDs from keys before they are served.
+type Verifier struct {
+	storage   storage.Storage
+	publisher storage.UIDPublisher
+
+	secret   []byte
+	baseURL  string
+	from     string
+	sender   MailSender
+	tokenTTL time.Duration
+
+	now func() time.Time
+}
+
+type Option func(v *Verifier) error
+
+// Secret sets the key with which tokens are authenticated. It must be kept
+// private, and shared by every server using the same storage.
+func Secret(secret string) Option {
+	return func(v *Verifier) error {
+		v.secret = []byte(secret)
+		return nil
+	}
+}
+
+// BaseURL sets the public URL of the server, under which verification links
+// are made.
+func BaseURL(baseURL string) Option {
+	return func(v *Verifier) error {
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			return errgo.Notef(err, "invalid base URL %q", baseURL)
+		} else if u.Scheme == "" || u.Host == "" {
+			return errgo.Newf("invalid base URL %q: must be absolute", baseURL)
+		}
+		v.baseURL = strings.TrimSuffix(baseURL, "/")
+		return nil
+	}
+}
+
+// From sets the sender address of verification messages.
+func From(from string) Option {
+	return func(v *Verifier) error {
+		v.from = from
+		return nil
+	}
+}
+
+// Sender sets how verification messages are delivered.
+func Sender(sender MailSender) Option {
+	return func(v *Verifier) error {
+		v.sender = sender
+		return nil
+	}
+}
+
+// TokenTTL sets how long verification tokens remain valid. Addresses are not
+// mailed again until their previous token has expired.
+func TokenTTL(ttl time.Duration) Option {
+	return func(v *Verifier) error {
+		v.tokenTTL = ttl
+		return nil
+	}
+}
+
+// NewVerifier returns a Verifier for keys in the given storage, which must
+// implement storage.UIDPublisher.
+func NewVerifier(st storage.Storage, options ...Option) (*Verifier, error) {
+	publisher, ok := st.(storage.UIDPublisher)
+	if !ok {
+		return nil, errgo.New("storage does not support user ID verification")
+	}
+	v := &Verifier{
+		storage:   st,
+		publisher: publisher,
+		tokenTTL:  DefaultTokenTTL,
+		now:       time.Now,
+	}
+	for _, option := range options {
+		err := option(v)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	switch {
+	case len(v.secret) == 0:
+		return nil, errgo.New("verification secret not configured")
+	case v.baseURL == "":
+		return nil, errgo.New("verification base URL not configured")
+	case v.from == "":
+		return nil, errgo.New("verification sender address not configured")
+	case v.sender == nil:
+		return nil, errgo.New("verification mail sender not configured")
+	case v.tokenTTL <= 0:
+		return nil, errgo.Newf("invalid verification token TTL %v", v.tokenTTL)
+	}
+	return v, nil
+}
+
+// claims are the contents of a verification token. A token is only valid
+// while the address is pending with the state recorded at Issued.
+//
+// Upload tokens identify a key to which verification of addresses may be
+// requested, and are not valid for verification.
+type claims struct {
+	RFingerprint string `json:"rfp"`
+	Email        string `json:"email,omitempty"`
+	Upload       bool   `json:"upload,omitempty"`
+	Issued       int64  `json:"iat"`
+	Expires      int64  `json:"exp"`
+}
+
+func (v *Verifier) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (v *Verifier) newToken(c *claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(v.mac(payload)), nil
+}
+
+func (v *Verifier) parseToken(token string, upload bool) (*claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrInvalidToken, "malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrInvalidToken, "malformed token")
+	}
+	if !hmac.Equal(sig, v.mac(payload)) {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "bad token signature")
+	}
+	var c claims
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrInvalidToken, "malformed token")
+	}
+	if c.Upload != upload {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "wrong kind of token")
+	}
+	if v.now().Unix() >= c.Expires {
+		return nil, errgo.WithCausef(nil, ErrInvalidToken, "token expired")
+	}
+	return &c, nil
+}
+
+// ParseToken returns the fingerprint of the key and the email address for
+// which the given token was issued, if it is authentic and has not expired.
+func (v *Verifier) ParseToken(token string) (fingerprint string, email string, _ error) {
+	c, err := v.parseToken(token, false)
+	if err != nil {
+		return "", "", errgo.Mask(err, errgo.Is(ErrInvalidToken))
+	}
+	return openpgp.Reverse(c.RFingerprint), c.Email, nil
+}
+
+// UploadToken returns a token identifying the given uploaded key, with which
+// the uploader may request verification of its addresses until it expires.
+func (v *Verifier) UploadToken(key *openpgp.PrimaryKey) (string, error) {
+	now := v.now()
+	token, err := v.newToken(&claims{
+		RFingerprint: key.RFingerprint,
+		Upload:       true,
+		Issued:       now.Unix(),
+		Expires:      now.Add(v.tokenTTL).Unix(),
+	})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return token, nil
+}
+
+// ParseUploadToken returns the fingerprint of the key for which the given
+// upload token was issued, if it is authentic and has not expired.
+func (v *Verifier) ParseUploadToken(token string) (fingerprint string, _ error) {
+	c, err := v.parseToken(token, true)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(ErrInvalidToken))
+	}
+	return openpgp.Reverse(c.RFingerprint), nil
+}
+
+func (v *Verifier) statuses(ctx context.Context, rfp string) (map[string]storage.UIDStatus, error) {
+	states, err := v.publisher.UIDStates(ctx, []string{rfp})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	result := make(map[string]storage.UIDStatus)
+	for _, status := range states[rfp] {
+		result[status.Email] = status
+	}
+	return result, nil
+}
+
+// States returns the publication state of each email address in the user
+// IDs of the given stored key.
+func (v *Verifier) States(ctx context.Context, key *openpgp.PrimaryKey) (map[string]storage.UIDState, error) {
+	statuses, err := v.statuses(ctx, key.RFingerprint)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	result := make(map[string]storage.UIDState)
+	for _, email := range storage.Emails(key) {
+		if status, ok := statuses[email]; ok {
+			result[email] = status.State
+		} else {
+			result[email] = storage.UIDUnpublished
+		}
+	}
+	return result, nil
+}
+
+// RequestVerification mails a token to each email address of the given
+// stored key which is neither published nor awaiting verification, and
+// returns the addresses mailed. Only the addresses of user IDs self-certified
+// by the key, and not revoked, are mailed; if emails are given, only those
+// among them are.
+func (v *Verifier) RequestVerification(ctx context.Context, key *openpgp.PrimaryKey, emails ...string) ([]string, error) {
+	statuses, err := v.statuses(ctx, key.RFingerprint)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	requested := make(map[string]bool)
+	for _, email := range emails {
+		requested[email] = true
+	}
+	// Tokens record the pending time in seconds, and some backends store
+	// no more than that.
+	now := v.now().Truncate(time.Second)
+	var sent []string
+	for _, email := range storage.CertifiedEmails(key) {
+		if len(requested) > 0 && !requested[email] {
+			continue
+		}
+		if status, ok := statuses[email]; ok {
+			if status.State == storage.UIDPublished {
+				continue
+			} else if status.State == storage.UIDPending && now.Before(status.Modified.Add(v.tokenTTL)) {
+				continue
+			}
+		}
+		err = v.publisher.SetUIDState(ctx, key.RFingerprint, storage.UIDStatus{
+			Email:    email,
+			State:    storage.UIDPending,
+			Modified: now,
+		})
+		if err != nil {
+			return sent, errgo.Mask(err, errgo.Any)
+		}
+		token, err := v.newToken(&claims{
+			RFingerprint: key.RFingerprint,
+			Email:        email,
+			Issued:       now.Unix(),
+			Expires:      now.Add(v.tokenTTL).Unix(),
+		})
+		if err != nil {
+			return sent, errgo.Mask(err)
+		}
+		err = v.sender.SendMail(v.from, []string{email}, v.message(key, email, token, now))
+		if err != nil {
+			// Mail again on the next upload, rather than once the token
+			// would have expired.
+			v.publisher.SetUIDState(ctx, key.RFingerprint, storage.UIDStatus{
+				Email: email,
+				State: storage.UIDUnpublished,
+			})
+			return sent, errgo.Notef(err, "cannot send verification to %q", email)
+		}
+		log.WithFields(log.Fields{
+			"fp":    key.Fingerprint(),
+			"email": email,
+		}).Info("verification requested")
+		sent = append(sent, email)
+	}
+	return sent, nil
+}
+
+func (v *Verifier) message(key *openpgp.PrimaryKey, email, token string, now time.Time) []byte {
+	fp := strings.ToUpper(key.Fingerprint())
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", v.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", email)
+	fmt.Fprintf(&msg, "Subject: Verify %s for OpenPGP key %s\r\n", email, fp)
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "An OpenPGP key with a user ID for %s was uploaded to %s.\r\n\r\n", email, v.baseURL)
+	fmt.Fprintf(&msg, "To publish this address with the key %s, follow this link before %s:\r\n\r\n",
+		fp, now.Add(v.tokenTTL).UTC().Format(time.RFC1123))
+	fmt.Fprintf(&msg, "%s/pks/verify?token=%s\r\n\r\n", v.baseURL, token)
+	fmt.Fprintf(&msg, "If you did not upload this key, you can ignore this message and the\r\n")
+	fmt.Fprintf(&msg, "address will not be published.\r\n")
+	return msg.Bytes()
+}
+
+// Verify publishes the email address for which the given token was issued,
+// and returns the fingerprint of its key and the address. A token is only
+// valid until it expires or the address changes state, so it can only be
+// used once.
+func (v *Verifier) Verify(ctx context.Context, token string) (fingerprint string, email string, _ error) {
+	c, err := v.parseToken(token, false)
+	if err != nil {
+		return "", "", errgo.Mask(err, errgo.Is(ErrInvalidToken))
+	}
+	statuses, err := v.statuses(ctx, c.RFingerprint)
+	if err != nil {
+		return "", "", errgo.Mask(err, errgo.Any)
+	}
+	status, ok := statuses[c.Email]
+	if !ok || status.State != storage.UIDPending || status.Modified.Unix() != c.Issued {
+		return "", "", errgo.WithCausef(nil, ErrInvalidToken, "token already used or superseded")
+	}
+	err = v.publisher.SetUIDState(ctx, c.RFingerprint, storage.UIDStatus{
+		Email:    c.Email,
+		State:    storage.UIDPublished,
+		Modified: v.now(),
+	})
+	if storage.IsNotFound(err) {
+		return "", "", errgo.WithCausef(err, ErrInvalidToken, "key no longer stored")
+	} else if err != nil {
+		return "", "", errgo.Mask(err, errgo.Any)
+	}
+	fingerprint = openpgp.Reverse(c.RFingerprint)
+	log.WithFields(log.Fields{
+		"fp":    fingerprint,
+		"email": c.Email,
+	}).Info("verified")
+	return fingerprint, c.Email, nil
+}
+
+// Filter removes the user IDs of the given keys whose email addresses are
+// not published. User IDs without an email address are removed too, since
+// they cannot be verified.
+func (v *Verifier) Filter(ctx context.Context, keys []*openpgp.PrimaryKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	rfps := make([]string, len(keys))
+	for i, key := range keys {
+		rfps[i] = key.RFingerprint
+	}
+	states, err := v.publisher.UIDStates(ctx, rfps)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for _, key := range keys {
+		published := make(map[string]bool)
+		for _, status := range states[key.RFingerprint] {
+			if status.State == storage.UIDPublished {
+				published[status.Email] = true
+			}
+		}
+		var uids []*openpgp.UserID
+		for _, uid := range key.UserIDs {
+			if email, ok := storage.ParseEmail(uid.Keywords); ok && published[email] {
+				uids = append(uids, uid)
+			}
+		}
+		if len(uids) == len(key.UserIDs) {
+			continue
+		}
+		// Keep the digest in step with the user IDs served, since it
+		// identifies the key's content to clients.
+		key.UserIDs = uids
+		key.MD5, err = openpgp.SksDigest(key, md5.New())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
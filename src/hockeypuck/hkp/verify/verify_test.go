@@ -0,0 +1,295 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package verify
+
+import (
+	"context"
+	"crypto/md5"
+	"regexp"
+	stdtesting "testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp/packet"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type message struct {
+	from string
+	to   []string
+	body string
+}
+
+type testSender struct {
+	sent []message
+	err  error
+}
+
+func (s *testSender) SendMail(from string, to []string, msg []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, message{from: from, to: to, body: string(msg)})
+	return nil
+}
+
+var tokenRE = regexp.MustCompile(`/pks/verify\?token=([^\s]+)`)
+
+func (s *testSender) lastToken(c *gc.C) string {
+	c.Assert(s.sent, gc.Not(gc.HasLen), 0)
+	m := tokenRE.FindStringSubmatch(s.sent[len(s.sent)-1].body)
+	c.Assert(m, gc.HasLen, 2)
+	return m[1]
+}
+
+type VerifySuite struct {
+	states   map[string]map[string]storage.UIDStatus
+	storage  *mock.Storage
+	sender   *testSender
+	verifier *Verifier
+	now      time.Time
+}
+
+var _ = gc.Suite(&VerifySuite{})
+
+func (s *VerifySuite) SetUpTest(c *gc.C) {
+	s.states = make(map[string]map[string]storage.UIDStatus)
+	s.storage = mock.NewStorage(
+		mock.UIDStates(func(rfps []string) (map[string][]storage.UIDStatus, error) {
+			result := make(map[string][]storage.UIDStatus)
+			for _, rfp := range rfps {
+				for _, status := range s.states[rfp] {
+					result[rfp] = append(result[rfp], status)
+				}
+			}
+			return result, nil
+		}),
+		mock.SetUIDState(func(rfp string, status storage.UIDStatus) error {
+			if s.states[rfp] == nil {
+				s.states[rfp] = make(map[string]storage.UIDStatus)
+			}
+			if status.State == storage.UIDUnpublished {
+				delete(s.states[rfp], status.Email)
+			} else {
+				s.states[rfp][status.Email] = status
+			}
+			return nil
+		}),
+	)
+	s.sender = &testSender{}
+	var err error
+	s.verifier, err = NewVerifier(s.storage,
+		Secret("sekrit"),
+		BaseURL("https://keys.example.com/"),
+		From("keyserver@example.com"),
+		Sender(s.sender),
+	)
+	c.Assert(err, gc.IsNil)
+	s.now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.verifier.now = func() time.Time { return s.now }
+}
+
+func mustInputKey(c *gc.C, name string) *openpgp.PrimaryKey {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput(name))
+	c.Assert(keys, gc.HasLen, 1)
+	return keys[0]
+}
+
+func (s *VerifySuite) TestNewVerifier(c *gc.C) {
+	_, err := NewVerifier(s.storage, BaseURL("https://keys.example.com"), From("a@example.com"), Sender(s.sender))
+	c.Assert(err, gc.ErrorMatches, "verification secret not configured")
+	_, err = NewVerifier(s.storage, Secret("sekrit"), BaseURL("keys.example.com"))
+	c.Assert(err, gc.ErrorMatches, `invalid base URL "keys.example.com": must be absolute`)
+}
+
+func (s *VerifySuite) TestVerify(c *gc.C) {
+	ctx := context.Background()
+	key := mustInputKey(c, "alice_signed.asc")
+
+	sent, err := s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.DeepEquals, []string{"alice@example.com"})
+	c.Assert(s.sender.sent, gc.HasLen, 1)
+	c.Assert(s.sender.sent[0].from, gc.Equals, "keyserver@example.com")
+	c.Assert(s.sender.sent[0].to, gc.DeepEquals, []string{"alice@example.com"})
+	c.Assert(s.sender.sent[0].body, gc.Matches, `(?s).*https://keys\.example\.com/pks/verify\?token=.*`)
+	token := s.sender.lastToken(c)
+
+	states, err := s.verifier.States(ctx, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.DeepEquals, map[string]storage.UIDState{"alice@example.com": storage.UIDPending})
+
+	// Pending addresses are not mailed again until their token expires.
+	sent, err = s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.HasLen, 0)
+
+	fp, email, err := s.verifier.ParseToken(token)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fp, gc.Equals, key.Fingerprint())
+	c.Assert(email, gc.Equals, "alice@example.com")
+
+	fp, email, err = s.verifier.Verify(ctx, token)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fp, gc.Equals, key.Fingerprint())
+	c.Assert(email, gc.Equals, "alice@example.com")
+	states, err = s.verifier.States(ctx, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.DeepEquals, map[string]storage.UIDState{"alice@example.com": storage.UIDPublished})
+
+	// Tokens can only be used once.
+	_, _, err = s.verifier.Verify(ctx, token)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+
+	// Published addresses are not mailed again.
+	s.now = s.now.Add(2 * DefaultTokenTTL)
+	sent, err = s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.HasLen, 0)
+}
+
+func (s *VerifySuite) TestUncertifiedUserID(c *gc.C) {
+	key := mustInputKey(c, "alice_signed.asc")
+	// Anyone can add a user ID to a key, but only its holder can certify it.
+	uid, err := openpgp.ParseUserID(&packet.OpaquePacket{
+		Tag:      13,
+		Contents: []byte("mallory <mallory@evil.example>"),
+	}, key.UUID)
+	c.Assert(err, gc.IsNil)
+	key.UserIDs = append(key.UserIDs, uid)
+
+	sent, err := s.verifier.RequestVerification(context.Background(), key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.DeepEquals, []string{"alice@example.com"})
+	c.Assert(s.sender.sent, gc.HasLen, 1)
+	c.Assert(s.sender.sent[0].to, gc.DeepEquals, []string{"alice@example.com"})
+}
+
+func (s *VerifySuite) TestTokenExpired(c *gc.C) {
+	ctx := context.Background()
+	key := mustInputKey(c, "alice_signed.asc")
+	_, err := s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.IsNil)
+	token := s.sender.lastToken(c)
+
+	s.now = s.now.Add(DefaultTokenTTL)
+	_, _, err = s.verifier.Verify(ctx, token)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+
+	// A new token is sent once the previous one has expired, and the old
+	// one is superseded.
+	sent, err := s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.HasLen, 1)
+	newToken := s.sender.lastToken(c)
+	s.now = s.now.Add(time.Hour)
+	_, _, err = s.verifier.Verify(ctx, newToken)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *VerifySuite) TestTokenForged(c *gc.C) {
+	ctx := context.Background()
+	key := mustInputKey(c, "alice_signed.asc")
+	_, err := s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.IsNil)
+	token := s.sender.lastToken(c)
+
+	other, err := NewVerifier(s.storage,
+		Secret("other"), BaseURL("https://keys.example.com"), From("a@example.com"), Sender(s.sender))
+	c.Assert(err, gc.IsNil)
+	other.now = s.verifier.now
+	for _, token := range []string{"", "junk", token + "x", token[1:]} {
+		_, _, err = s.verifier.Verify(ctx, token)
+		c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken, gc.Commentf("token=%q", token))
+	}
+	_, _, err = other.Verify(ctx, token)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+	c.Assert(s.storage.MethodCount("SetUIDState"), gc.Equals, 1)
+}
+
+func (s *VerifySuite) TestUploadToken(c *gc.C) {
+	ctx := context.Background()
+	key := mustInputKey(c, "e68e311d.asc")
+	token, err := s.verifier.UploadToken(key)
+	c.Assert(err, gc.IsNil)
+	fp, err := s.verifier.ParseUploadToken(token)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fp, gc.Equals, key.Fingerprint())
+
+	// Upload tokens cannot be used to verify addresses, nor verification
+	// tokens to request verification.
+	_, _, err = s.verifier.Verify(ctx, token)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+	sent, err := s.verifier.RequestVerification(ctx, key, "cmars@cmarstech.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.DeepEquals, []string{"cmars@cmarstech.com"})
+	_, err = s.verifier.ParseUploadToken(s.sender.lastToken(c))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+
+	s.now = s.now.Add(DefaultTokenTTL)
+	_, err = s.verifier.ParseUploadToken(token)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrInvalidToken)
+}
+
+func (s *VerifySuite) TestSendFailed(c *gc.C) {
+	ctx := context.Background()
+	key := mustInputKey(c, "alice_signed.asc")
+	s.sender.err = errgo.New("relay refused")
+	_, err := s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.ErrorMatches, `cannot send verification to "alice@example.com": relay refused`)
+
+	// The address may be mailed again straight away.
+	s.sender.err = nil
+	sent, err := s.verifier.RequestVerification(ctx, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.HasLen, 1)
+}
+
+func (s *VerifySuite) TestFilter(c *gc.C) {
+	ctx := context.Background()
+	keys := []*openpgp.PrimaryKey{
+		mustInputKey(c, "e68e311d.asc"),
+		mustInputKey(c, "alice_signed.asc"),
+	}
+	c.Assert(keys[0].UserIDs, gc.HasLen, 2)
+	digest := keys[0].MD5
+	s.states[keys[0].RFingerprint] = map[string]storage.UIDStatus{
+		"cmars@cmarstech.com":          {Email: "cmars@cmarstech.com", State: storage.UIDPublished},
+		"casey.marshall@canonical.com": {Email: "casey.marshall@canonical.com", State: storage.UIDPending},
+	}
+
+	err := s.verifier.Filter(ctx, keys)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "Casey Marshall <cmars@cmarstech.com>")
+	c.Assert(keys[1].UserIDs, gc.HasLen, 0)
+
+	// The digests follow the user IDs removed.
+	c.Assert(keys[0].MD5, gc.Not(gc.Equals), digest)
+	want, err := openpgp.SksDigest(keys[0], md5.New())
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, want)
+}
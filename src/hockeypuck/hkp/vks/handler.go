@@ -0,0 +1,611 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package vks implements the Verifying Keyserver (VKS) API, as served by
+// keys.openpgp.org, on top of Hockeypuck's key storage.
+package vks
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/verify"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const (
+	keyIDLen         = 16
+	fingerprintLen   = 40
+	v6FingerprintLen = 64
+)
+
+var (
+	errInvalidFingerprint = errgo.New("invalid fingerprint")
+	errInvalidKeyID       = errgo.New("invalid key ID")
+	errEmailNotAvailable  = errgo.New("email search is not available")
+	errVerifyNotAvailable = errgo.New("email verification is not available")
+)
+
+// Status is the publication state of an email address in an uploaded key.
+type Status string
+
+const (
+	StatusUnpublished Status = "unpublished"
+	StatusPublished   Status = "published"
+	StatusRevoked     Status = "revoked"
+	StatusPending     Status = "pending"
+)
+
+// UploadRequest is the JSON body of a /vks/v1/upload request.
+type UploadRequest struct {
+	Keytext string `json:"keytext"`
+}
+
+// UploadResponse is the JSON response to a successful /vks/v1/upload or
+// /vks/v1/request-verify request. The token is only issued when email
+// addresses are verified, for use in /vks/v1/request-verify requests.
+type UploadResponse struct {
+	KeyFingerprint string            `json:"key_fpr"`
+	Status         map[string]Status `json:"status"`
+	Token          string            `json:"token,omitempty"`
+}
+
+// RequestVerifyRequest is the JSON body of a /vks/v1/request-verify
+// request, asking for the given addresses of an uploaded key to be verified.
+// Messages are only written in English, whatever the locale.
+type RequestVerifyRequest struct {
+	Token     string   `json:"token"`
+	Addresses []string `json:"addresses"`
+	Locale    []string `json:"locale,omitempty"`
+}
+
+// ErrorResponse is the JSON response to a failed /vks/v1/upload or
+// /vks/v1/request-verify request.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type Handler struct {
+	storage storage.Storage
+
+	selfSignedOnly    bool
+	attestedCertsOnly bool
+	fingerprintOnly   bool
+
+	verifier *verify.Verifier
+
+	lookupTimeout time.Duration
+	uploadTimeout time.Duration
+
+	honourNoModify bool
+	certPolicy     *openpgp.CertPolicy
+	keyPolicy      openpgp.KeyPolicy
+
+	keyReaderOptions []openpgp.KeyReaderOption
+}
+
+type HandlerOption func(h *Handler) error
+
+// SelfSignedOnly only serves keys with valid self-signatures.
+func SelfSignedOnly(selfSignedOnly bool) HandlerOption {
+	return func(h *Handler) error {
+		h.selfSignedOnly = selfSignedOnly
+		return nil
+	}
+}
+
+// AttestedCertsOnly only serves the third-party certifications of user IDs
+// and user attributes which the key holder has attested.
+func AttestedCertsOnly(attestedCertsOnly bool) HandlerOption {
+	return func(h *Handler) error {
+		h.attestedCertsOnly = attestedCertsOnly
+		return nil
+	}
+}
+
+// FingerprintOnly refuses lookups by email address.
+func FingerprintOnly(fingerprintOnly bool) HandlerOption {
+	return func(h *Handler) error {
+		h.fingerprintOnly = fingerprintOnly
+		return nil
+	}
+}
+
+// Verifier only serves user IDs whose email addresses have been verified
+// with the given Verifier, which is asked to verify the addresses of
+// uploaded keys chosen with /vks/v1/request-verify.
+func Verifier(verifier *verify.Verifier) HandlerOption {
+	return func(h *Handler) error {
+		h.verifier = verifier
+		return nil
+	}
+}
+
+// LookupTimeout limits the time spent in storage answering a lookup. Zero
+// means no limit other than the client's connection.
+func LookupTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.lookupTimeout = timeout
+		return nil
+	}
+}
+
+// UploadTimeout limits the time spent in storage handling an upload.
+func UploadTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.uploadTimeout = timeout
+		return nil
+	}
+}
+
+// HonourNoModify only accepts material self-signed by the key holder into
+// keys which carry the keyserver no-modify preference.
+func HonourNoModify(honour bool) HandlerOption {
+	return func(h *Handler) error {
+		h.honourNoModify = honour
+		return nil
+	}
+}
+
+// CertPolicy limits the third-party certifications accepted into keys, and
+// served from them, with the given policy. The issuers of certifications are
+// only checked as keys are added, not as they are served.
+func CertPolicy(policy *openpgp.CertPolicy) HandlerOption {
+	return func(h *Handler) error {
+		h.certPolicy = policy
+		return nil
+	}
+}
+
+// KeyPolicy rejects uploaded keys which the given policy does not accept.
+func KeyPolicy(policy openpgp.KeyPolicy) HandlerOption {
+	return func(h *Handler) error {
+		h.keyPolicy = policy
+		return nil
+	}
+}
+
+func KeyReaderOptions(opts []openpgp.KeyReaderOption) HandlerOption {
+	return func(h *Handler) error {
+		h.keyReaderOptions = opts
+		return nil
+	}
+}
+
+func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, error) {
+	h := &Handler{
+		storage: storage,
+	}
+	for _, option := range options {
+		err := option(h)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return h, nil
+}
+
+func (h *Handler) Register(r *httprouter.Router) {
+	r.GET("/vks/v1/by-fingerprint/:fingerprint", h.ByFingerprint)
+	r.GET("/vks/v1/by-keyid/:keyid", h.ByKeyID)
+	r.GET("/vks/v1/by-email/:email", h.ByEmail)
+	r.POST("/vks/v1/upload", h.Upload)
+	r.POST("/vks/v1/request-verify", h.RequestVerify)
+}
+
+// requestContext returns a context for storage operations on behalf of the
+// given request. It is cancelled when the client goes away, or once timeout
+// elapses if non-zero.
+func requestContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+func httpError(w http.ResponseWriter, statusCode int, err error) {
+	if statusCode != http.StatusNotFound {
+		log.Errorf("HTTP %d: %v", statusCode, errgo.Details(err))
+	}
+	http.Error(w, http.StatusText(statusCode), statusCode)
+}
+
+// storageError responds to a failed storage operation, telling the client
+// to try again later if the operation timed out.
+func storageError(ctx context.Context, w http.ResponseWriter, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		httpError(w, http.StatusServiceUnavailable, errgo.Notef(err, "storage timeout"))
+		return
+	}
+	httpError(w, http.StatusInternalServerError, err)
+}
+
+// jsonError responds to a failed upload with a VKS JSON error document.
+func jsonError(w http.ResponseWriter, statusCode int, err error) {
+	log.Errorf("HTTP %d: %v", statusCode, errgo.Details(err))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(&ErrorResponse{Error: errgo.Cause(err).Error()})
+}
+
+// parseHex returns the reversed, lower case form of a hexadecimal key ID or
+// fingerprint of the given length, as used in storage.
+func parseHex(s string, n int) (string, bool) {
+	s = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	if len(s) != n {
+		return "", false
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", false
+	}
+	return openpgp.Reverse(s), true
+}
+
+// ByFingerprint serves the key with the given primary or subkey fingerprint.
+func (h *Handler) ByFingerprint(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rfp, ok := parseHex(ps.ByName("fingerprint"), fingerprintLen)
+	if !ok {
+		rfp, ok = parseHex(ps.ByName("fingerprint"), v6FingerprintLen)
+	}
+	if !ok {
+		httpError(w, http.StatusBadRequest, errInvalidFingerprint)
+		return
+	}
+	h.lookup(w, r, "", func(ctx context.Context) ([]string, error) {
+		return h.storage.ResolveContext(ctx, []string{rfp})
+	})
+}
+
+// ByKeyID serves the keys with the given 64-bit primary or subkey ID.
+func (h *Handler) ByKeyID(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rkeyid, ok := parseHex(ps.ByName("keyid"), keyIDLen)
+	if !ok {
+		httpError(w, http.StatusBadRequest, errInvalidKeyID)
+		return
+	}
+	h.lookup(w, r, "", func(ctx context.Context) ([]string, error) {
+		return h.storage.ResolveContext(ctx, []string{rkeyid})
+	})
+}
+
+// ByEmail serves the keys with a user ID of exactly the given email address.
+func (h *Handler) ByEmail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if h.fingerprintOnly {
+		httpError(w, http.StatusBadRequest, errEmailNotAvailable)
+		return
+	}
+	email, err := storage.NormalizeEmail(ps.ByName("email"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, errgo.Notef(err, "invalid email address"))
+		return
+	}
+	h.lookup(w, r, email, func(ctx context.Context) ([]string, error) {
+		return h.storage.MatchEmailContext(ctx, []string{email})
+	})
+}
+
+// lookup serves the keys found by resolve. If the keys were found by email
+// address, only keys on which that address is published are served.
+func (h *Handler) lookup(w http.ResponseWriter, r *http.Request, email string, resolve func(context.Context) ([]string, error)) {
+	ctx, cancel := requestContext(r, h.lookupTimeout)
+	defer cancel()
+
+	rfps, err := resolve(ctx)
+	if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+	if len(rfps) == 0 {
+		httpError(w, http.StatusNotFound, errgo.New("not found"))
+		return
+	}
+	keys, err := h.storage.FetchKeysContext(ctx, rfps)
+	if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+	if h.verifier != nil {
+		err = h.verifier.Filter(ctx, keys)
+		if err != nil {
+			storageError(ctx, w, errgo.Mask(err))
+			return
+		}
+	}
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		if err := openpgp.ValidSelfSigned(key, h.selfSignedOnly); err != nil {
+			log.Debugf("vks: not serving %q: %v", key.Fingerprint(), err)
+			continue
+		}
+		if h.attestedCertsOnly {
+			if _, err := openpgp.DropUnattested(key); err != nil {
+				storageError(ctx, w, errgo.Mask(err))
+				return
+			}
+		}
+		if policy := h.certPolicy.WithoutLookups(); policy != nil {
+			if _, err := policy.Apply(key, nil); err != nil {
+				storageError(ctx, w, errgo.Mask(err))
+				return
+			}
+		}
+		if email != "" && !hasEmail(key, email) {
+			continue
+		}
+		// Drop malformed packets, since these break GPG imports.
+		var others []*openpgp.Packet
+		for _, other := range key.Others {
+			if !other.Malformed {
+				others = append(others, other)
+			}
+		}
+		key.Others = others
+		result = append(result, key)
+		log.WithFields(log.Fields{
+			"fp":     key.Fingerprint(),
+			"length": key.Length,
+		}).Info("vks lookup")
+	}
+	if len(result) == 0 {
+		httpError(w, http.StatusNotFound, errgo.New("not found"))
+		return
+	}
+
+	if wantsBinary(r) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for _, key := range result {
+			err = openpgp.WritePackets(w, key)
+			if err != nil {
+				log.Errorf("vks: error writing key %q: %v", key.Fingerprint(), err)
+				return
+			}
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys; charset=utf-8")
+	err = openpgp.WriteArmoredPackets(w, result)
+	if err != nil {
+		log.Errorf("vks: error writing armored keys: %v", err)
+	}
+	_, err = w.Write([]byte("\n"))
+	if err != nil {
+		log.Errorf("vks: failed to write trailing newline: %v", err)
+	}
+}
+
+func hasEmail(key *openpgp.PrimaryKey, email string) bool {
+	for _, uid := range key.UserIDs {
+		if uidEmail, ok := storage.ParseEmail(uid.Keywords); ok && uidEmail == email {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsBinary returns whether the client asked for keys in binary packet
+// format rather than ASCII armor.
+func wantsBinary(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+			if strings.EqualFold(mediaType, "application/octet-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upload adds or updates the single armored key in the request, responding
+// with the publication status of each of its email addresses, and a token
+// with which their verification may be requested.
+func (h *Handler) Upload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req UploadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, errgo.Notef(err, "invalid upload request"))
+		return
+	}
+	if req.Keytext == "" {
+		jsonError(w, http.StatusBadRequest, errgo.New("missing required parameter: keytext"))
+		return
+	}
+	armorBlock, err := armor.Decode(bytes.NewBufferString(req.Keytext))
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, errgo.Notef(err, "invalid keytext"))
+		return
+	}
+	keys, err := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...).Read()
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, errgo.Notef(err, "invalid keytext"))
+		return
+	}
+	if len(keys) != 1 {
+		jsonError(w, http.StatusBadRequest, errgo.Newf("expected a single key, got %d", len(keys)))
+		return
+	}
+	key := keys[0]
+	// Uploads are checked as HKP adds are.
+	_, err = openpgp.SanitizeKey(key)
+	if errgo.Cause(err) == openpgp.ErrNoSelfSignature {
+		jsonError(w, http.StatusUnprocessableEntity, errgo.Mask(err))
+		return
+	} else if err != nil {
+		jsonError(w, http.StatusBadRequest, errgo.Notef(err, "invalid keytext"))
+		return
+	}
+
+	ctx, cancel := requestContext(r, h.uploadTimeout)
+	defer cancel()
+	var upsertOptions []storage.UpsertOption
+	if h.honourNoModify {
+		upsertOptions = append(upsertOptions, storage.HonourNoModify())
+	}
+	if h.certPolicy != nil {
+		upsertOptions = append(upsertOptions, storage.CertPolicy(h.certPolicy))
+	}
+	if h.keyPolicy != nil {
+		upsertOptions = append(upsertOptions, storage.KeyPolicy(h.keyPolicy))
+	}
+	change, err := storage.UpsertKeyContext(ctx, h.storage, key, upsertOptions...)
+	if err != nil {
+		if cause := errgo.Cause(err); cause == openpgp.ErrKeyRejected || cause == storage.ErrKeySuppressed {
+			jsonError(w, http.StatusUnprocessableEntity, errgo.Mask(err))
+		} else if ctx.Err() == context.DeadlineExceeded {
+			jsonError(w, http.StatusServiceUnavailable, errgo.Notef(err, "storage timeout"))
+		} else {
+			jsonError(w, http.StatusInternalServerError, errgo.Mask(err))
+		}
+		return
+	}
+	log.WithFields(log.Fields{
+		"fp":     key.Fingerprint(),
+		"change": change,
+	}).Info("vks upload")
+
+	var token string
+	if h.verifier != nil {
+		token, err = h.verifier.UploadToken(key)
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, errgo.Mask(err))
+			return
+		}
+	}
+	h.uploadResponse(ctx, w, key, token)
+}
+
+// RequestVerify mails verification tokens to the requested email addresses
+// of the key for which the upload token in the request was issued,
+// responding as Upload does.
+func (h *Handler) RequestVerify(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.verifier == nil {
+		jsonError(w, http.StatusBadRequest, errVerifyNotAvailable)
+		return
+	}
+	var req RequestVerifyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, errgo.Notef(err, "invalid verification request"))
+		return
+	}
+	if req.Token == "" {
+		jsonError(w, http.StatusBadRequest, errgo.New("missing required parameter: token"))
+		return
+	}
+	if len(req.Addresses) == 0 {
+		jsonError(w, http.StatusBadRequest, errgo.New("missing required parameter: addresses"))
+		return
+	}
+	fp, err := h.verifier.ParseUploadToken(req.Token)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, errgo.Mask(err, errgo.Is(verify.ErrInvalidToken)))
+		return
+	}
+
+	ctx, cancel := requestContext(r, h.uploadTimeout)
+	defer cancel()
+	keys, err := h.storage.FetchKeysContext(ctx, []string{openpgp.Reverse(fp)})
+	if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	} else if len(keys) == 0 {
+		jsonError(w, http.StatusBadRequest, errgo.WithCausef(nil, verify.ErrInvalidToken, "key no longer stored"))
+		return
+	}
+	key := keys[0]
+	status := emailStatus(key)
+	var emails []string
+	for _, address := range req.Addresses {
+		email, err := storage.NormalizeEmail(address)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, errgo.Notef(err, "invalid email address"))
+			return
+		}
+		if _, ok := status[email]; !ok {
+			jsonError(w, http.StatusBadRequest, errgo.Newf("email address %q not found in key", address))
+			return
+		}
+		emails = append(emails, email)
+	}
+	_, err = h.verifier.RequestVerification(ctx, key, emails...)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, errgo.Notef(err, "verification request failed"))
+		return
+	}
+	h.uploadResponse(ctx, w, key, req.Token)
+}
+
+// uploadResponse responds with the publication status of each email address
+// of the given key, and the token with which their verification may be
+// requested.
+func (h *Handler) uploadResponse(ctx context.Context, w http.ResponseWriter, key *openpgp.PrimaryKey, token string) {
+	status := emailStatus(key)
+	if h.verifier != nil {
+		states, err := h.verifier.States(ctx, key)
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, errgo.Mask(err))
+			return
+		}
+		// Storage states are named as VKS statuses are.
+		for email, state := range states {
+			if status[email] != StatusRevoked {
+				status[email] = Status(state)
+			}
+		}
+	}
+	result := UploadResponse{
+		KeyFingerprint: strings.ToUpper(key.Fingerprint()),
+		Status:         status,
+		Token:          token,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&result)
+}
+
+// emailStatus returns the publication status of each email address in the
+// user IDs of the given key. An address is revoked only if every user ID
+// bearing it has been revoked.
+func emailStatus(key *openpgp.PrimaryKey) map[string]Status {
+	result := make(map[string]Status)
+	for _, uid := range key.UserIDs {
+		email, ok := storage.ParseEmail(uid.Keywords)
+		if !ok {
+			continue
+		}
+		selfSigs, _ := uid.SigInfo(key)
+		if _, revoked := selfSigs.RevokedSince(); revoked {
+			if _, seen := result[email]; !seen {
+				result[email] = StatusRevoked
+			}
+			continue
+		}
+		result[email] = StatusPublished
+	}
+	return result
+}
@@ -0,0 +1,399 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package vks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/hkp/verify"
+)
+
+const (
+	aliceFP    = "10FE8CF1B483F7525039AA2A361BC1F023E0DCCA"
+	aliceRFP   = "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	aliceKeyID = "361BC1F023E0DCCA"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type HandlerSuite struct {
+	storage *mock.Storage
+	srv     *httptest.Server
+}
+
+var _ = gc.Suite(&HandlerSuite{})
+
+func (s *HandlerSuite) SetUpTest(c *gc.C) {
+	s.storage = mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			if len(keys) == 1 && (keys[0] == aliceRFP || keys[0] == aliceRFP[:16]) {
+				return []string{aliceRFP}, nil
+			}
+			return nil, nil
+		}),
+		mock.MatchEmail(func(emails []string) ([]string, error) {
+			if len(emails) == 1 && emails[0] == "alice@example.com" {
+				return []string{aliceRFP}, nil
+			}
+			return nil, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			if len(keys) == 1 && keys[0] == aliceRFP {
+				return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+			}
+			return nil, nil
+		}),
+	)
+	s.srv = s.newServer(c)
+}
+
+func (s *HandlerSuite) newServer(c *gc.C, options ...HandlerOption) *httptest.Server {
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, options...)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	return httptest.NewServer(r)
+}
+
+func (s *HandlerSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *HandlerSuite) get(c *gc.C, path string, accept string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", s.srv.URL+path, nil)
+	c.Assert(err, gc.IsNil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+	return res, body
+}
+
+func (s *HandlerSuite) TestLookupArmored(c *gc.C) {
+	for _, path := range []string{
+		"/vks/v1/by-fingerprint/" + aliceFP,
+		"/vks/v1/by-keyid/" + aliceKeyID,
+		"/vks/v1/by-email/alice@example.com",
+		"/vks/v1/by-email/Alice%40EXAMPLE.com",
+	} {
+		res, body := s.get(c, path, "")
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("path=%s", path))
+		c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/pgp-keys; charset=utf-8")
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(body))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].RFingerprint, gc.Equals, aliceRFP)
+	}
+	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 2)
+	c.Assert(s.storage.MethodCount("MatchEmail"), gc.Equals, 2)
+	c.Assert(s.storage.MethodCount("MatchKeyword"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestLookupBinary(c *gc.C) {
+	res, body := s.get(c, "/vks/v1/by-fingerprint/"+aliceFP, "application/octet-stream")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/octet-stream")
+	keys := openpgp.MustReadKeys(bytes.NewBuffer(body))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].RFingerprint, gc.Equals, aliceRFP)
+}
+
+func (s *HandlerSuite) TestLookupNotFound(c *gc.C) {
+	for _, path := range []string{
+		"/vks/v1/by-fingerprint/0000000000000000000000000000000000000000",
+		// v6 fingerprints are SHA-256 digests.
+		"/vks/v1/by-fingerprint/0000000000000000000000000000000000000000000000000000000000000000",
+		"/vks/v1/by-keyid/0000000000000000",
+		"/vks/v1/by-email/bob@example.com",
+	} {
+		res, _ := s.get(c, path, "")
+		c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound, gc.Commentf("path=%s", path))
+	}
+}
+
+func (s *HandlerSuite) TestLookupInvalid(c *gc.C) {
+	for _, path := range []string{
+		"/vks/v1/by-fingerprint/" + aliceKeyID,
+		"/vks/v1/by-fingerprint/" + aliceFP[:38] + "ZZ",
+		"/vks/v1/by-keyid/23E0DCCA",
+		"/vks/v1/by-keyid/%25%25%25%25%25%25%25%25%25%25%25%25%25%25%25%25",
+		"/vks/v1/by-email/alice",
+	} {
+		res, _ := s.get(c, path, "")
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("path=%s", path))
+	}
+	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("MatchEmail"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestEmailDisabled(c *gc.C) {
+	srv := s.newServer(c, FingerprintOnly(true))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/vks/v1/by-email/alice@example.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(s.storage.MethodCount("MatchEmail"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestAttestedCertsOnly(c *gc.C) {
+	const bob, carol = "8a540eb0b84d8c4f", "dda31aed3596b178"
+	const fp = "9b061a183e702093696f9c8d8ff6cc0e4aac8393"
+	s.storage = mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{openpgp.Reverse(fp)}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("attested.asc")), nil
+		}),
+	)
+	lookup := func(options ...HandlerOption) map[string]bool {
+		srv := s.newServer(c, options...)
+		defer srv.Close()
+		res, err := http.Get(srv.URL + "/vks/v1/by-fingerprint/" + strings.ToUpper(fp))
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		keys := openpgp.MustReadArmorKeys(res.Body)
+		c.Assert(keys, gc.HasLen, 1)
+		issuers := make(map[string]bool)
+		for _, sig := range keys[0].UserIDs[0].Signatures {
+			issuers[sig.IssuerKeyID()] = true
+		}
+		return issuers
+	}
+	c.Assert(lookup(), gc.DeepEquals, map[string]bool{"390207e381a160b9": true, bob: true, carol: true})
+	c.Assert(lookup(AttestedCertsOnly(true)), gc.DeepEquals, map[string]bool{"390207e381a160b9": true, bob: true})
+}
+
+func (s *HandlerSuite) upload(c *gc.C, body []byte) (*http.Response, []byte) {
+	res, err := http.Post(s.srv.URL+"/vks/v1/upload", "application/json", bytes.NewBuffer(body))
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	doc, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/json")
+	return res, doc
+}
+
+func (s *HandlerSuite) TestUpload(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	body, err := json.Marshal(&UploadRequest{Keytext: string(keytext)})
+	c.Assert(err, gc.IsNil)
+
+	res, doc := s.upload(c, body)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var uploadRes UploadResponse
+	err = json.Unmarshal(doc, &uploadRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(uploadRes.KeyFingerprint, gc.Equals, aliceFP)
+	c.Assert(uploadRes.Status, gc.DeepEquals, map[string]Status{
+		"alice@example.com": StatusPublished,
+	})
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestUploadInvalid(c *gc.C) {
+	var keyring bytes.Buffer
+	err := openpgp.WriteArmoredPackets(&keyring, append(
+		openpgp.MustReadArmorKeys(testing.MustInput("e68e311d.asc")),
+		openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))...))
+	c.Assert(err, gc.IsNil)
+	body, err := json.Marshal(&UploadRequest{Keytext: keyring.String()})
+	c.Assert(err, gc.IsNil)
+
+	for _, body := range [][]byte{
+		[]byte(`{"keytext":`),
+		[]byte(`{}`),
+		[]byte(`{"keytext":"not a key"}`),
+		body,
+	} {
+		res, doc := s.upload(c, body)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("body=%s", body))
+		var errRes ErrorResponse
+		err = json.Unmarshal(doc, &errRes)
+		c.Assert(err, gc.IsNil)
+		c.Assert(errRes.Error, gc.Not(gc.Equals), "")
+	}
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestUploadNoSelfSignature(c *gc.C) {
+	unsigned := openpgp.MustReadArmorKeys(testing.MustInput("d7346e26.asc"))
+	c.Assert(unsigned, gc.HasLen, 1)
+	unsigned[0].UserIDs = nil
+	unsigned[0].UserAttributes = nil
+	unsigned[0].SubKeys = nil
+	var keytext bytes.Buffer
+	err := openpgp.WriteArmoredPackets(&keytext, unsigned)
+	c.Assert(err, gc.IsNil)
+	body, err := json.Marshal(&UploadRequest{Keytext: keytext.String()})
+	c.Assert(err, gc.IsNil)
+
+	res, doc := s.upload(c, body)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnprocessableEntity)
+	var errRes ErrorResponse
+	err = json.Unmarshal(doc, &errRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(errRes.Error, gc.Matches, "key .* has no valid self-signature")
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+	c.Assert(s.storage.MethodCount("Update"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestUploadKeyPolicy(c *gc.C) {
+	srv := s.newServer(c, KeyPolicy(openpgp.MinRSABits(8192)))
+	defer srv.Close()
+	keytext, err := ioutil.ReadAll(testing.MustInput("tails.asc"))
+	c.Assert(err, gc.IsNil)
+	body, err := json.Marshal(&UploadRequest{Keytext: string(keytext)})
+	c.Assert(err, gc.IsNil)
+
+	res, err := http.Post(srv.URL+"/vks/v1/upload", "application/json", bytes.NewBuffer(body))
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusUnprocessableEntity)
+	var errRes ErrorResponse
+	err = json.NewDecoder(res.Body).Decode(&errRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(errRes.Error, gc.Matches, "RSA key .* has 4096 bits, fewer than 8192")
+	c.Assert(s.storage.MethodCount("Insert"), gc.Equals, 0)
+}
+
+type testSender struct {
+	to []string
+}
+
+func (s *testSender) SendMail(from string, to []string, msg []byte) error {
+	s.to = append(s.to, to...)
+	return nil
+}
+
+func (s *HandlerSuite) requestVerify(c *gc.C, req *RequestVerifyRequest) (*http.Response, []byte) {
+	body, err := json.Marshal(req)
+	c.Assert(err, gc.IsNil)
+	res, err := http.Post(s.srv.URL+"/vks/v1/request-verify", "application/json", bytes.NewBuffer(body))
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	doc, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/json")
+	return res, doc
+}
+
+func (s *HandlerSuite) TestRequestVerify(c *gc.C) {
+	states := make(map[string]storage.UIDStatus)
+	s.storage = mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{aliceRFP}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			if len(keys) == 1 && keys[0] == aliceRFP {
+				return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+			}
+			return nil, nil
+		}),
+		mock.UIDStates(func(rfps []string) (map[string][]storage.UIDStatus, error) {
+			result := make(map[string][]storage.UIDStatus)
+			for _, status := range states {
+				result[aliceRFP] = append(result[aliceRFP], status)
+			}
+			return result, nil
+		}),
+		mock.SetUIDState(func(rfp string, status storage.UIDStatus) error {
+			states[status.Email] = status
+			return nil
+		}),
+	)
+	sender := &testSender{}
+	verifier, err := verify.NewVerifier(s.storage,
+		verify.Secret("sekrit"),
+		verify.BaseURL("https://keys.example.com"),
+		verify.From("keyserver@example.com"),
+		verify.Sender(sender),
+	)
+	c.Assert(err, gc.IsNil)
+	s.srv.Close()
+	s.srv = s.newServer(c, Verifier(verifier))
+
+	// Addresses are not mailed until their verification is requested with
+	// the upload token.
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	body, err := json.Marshal(&UploadRequest{Keytext: string(keytext)})
+	c.Assert(err, gc.IsNil)
+	res, doc := s.upload(c, body)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var uploadRes UploadResponse
+	err = json.Unmarshal(doc, &uploadRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(uploadRes.Status, gc.DeepEquals, map[string]Status{
+		"alice@example.com": StatusUnpublished,
+	})
+	c.Assert(uploadRes.Token, gc.Not(gc.Equals), "")
+	c.Assert(sender.to, gc.HasLen, 0)
+
+	for _, req := range []*RequestVerifyRequest{
+		{Addresses: []string{"alice@example.com"}},
+		{Token: "junk", Addresses: []string{"alice@example.com"}},
+		{Token: uploadRes.Token},
+		{Token: uploadRes.Token, Addresses: []string{"mallory@example.com"}},
+	} {
+		res, _ = s.requestVerify(c, req)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("%+v", req))
+	}
+	c.Assert(sender.to, gc.HasLen, 0)
+
+	res, doc = s.requestVerify(c, &RequestVerifyRequest{
+		Token:     uploadRes.Token,
+		Addresses: []string{"Alice@Example.COM"},
+	})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var verifyRes UploadResponse
+	err = json.Unmarshal(doc, &verifyRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(verifyRes, gc.DeepEquals, UploadResponse{
+		KeyFingerprint: aliceFP,
+		Status:         map[string]Status{"alice@example.com": StatusPending},
+		Token:          uploadRes.Token,
+	})
+	c.Assert(sender.to, gc.DeepEquals, []string{"alice@example.com"})
+}
+
+func (s *HandlerSuite) TestRequestVerifyNotAvailable(c *gc.C) {
+	res, _ := s.requestVerify(c, &RequestVerifyRequest{Token: "junk", Addresses: []string{"alice@example.com"}})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+}
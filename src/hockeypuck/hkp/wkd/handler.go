@@ -0,0 +1,274 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package wkd serves the OpenPGP Web Key Directory, as specified in
+// draft-koch-openpgp-webkey-service, for configured mail domains from
+// Hockeypuck's key storage.
+package wkd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/idna"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/verify"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// advancedPrefix is the host name prefix under which the advanced method
+// serves a domain's directory.
+const advancedPrefix = "openpgpkey."
+
+var errNotFound = errgo.New("not found")
+
+type Handler struct {
+	storage storage.Storage
+
+	domains map[string]bool
+	policy  string
+
+	verifier *verify.Verifier
+
+	lookupTimeout time.Duration
+}
+
+type HandlerOption func(h *Handler) error
+
+// Domains sets the mail domains for which keys are served. Requests for
+// other domains are not found.
+func Domains(domains []string) HandlerOption {
+	return func(h *Handler) error {
+		for _, domain := range domains {
+			ascii, err := idna.Lookup.ToASCII(strings.TrimSpace(domain))
+			if err != nil || ascii == "" {
+				return errgo.Notef(err, "invalid WKD domain %q", domain)
+			}
+			h.domains[strings.ToLower(ascii)] = true
+		}
+		return nil
+	}
+}
+
+// Policy sets the content of the policy file served for each domain. An
+// empty policy file is served by default.
+func Policy(policy string) HandlerOption {
+	return func(h *Handler) error {
+		h.policy = policy
+		return nil
+	}
+}
+
+// Verifier only serves user IDs whose email addresses have been verified
+// with the given Verifier.
+func Verifier(verifier *verify.Verifier) HandlerOption {
+	return func(h *Handler) error {
+		h.verifier = verifier
+		return nil
+	}
+}
+
+// LookupTimeout limits the time spent in storage answering a lookup. Zero
+// means no limit other than the client's connection.
+func LookupTimeout(timeout time.Duration) HandlerOption {
+	return func(h *Handler) error {
+		h.lookupTimeout = timeout
+		return nil
+	}
+}
+
+func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, error) {
+	h := &Handler{
+		storage: storage,
+		domains: make(map[string]bool),
+	}
+	for _, option := range options {
+		err := option(h)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return h, nil
+}
+
+// Register serves the directory under /.well-known/openpgpkey/. The direct
+// and advanced methods share a prefix, so a single route matches both.
+func (h *Handler) Register(r *httprouter.Router) {
+	r.GET("/.well-known/openpgpkey/*path", h.Get)
+	r.HEAD("/.well-known/openpgpkey/*path", h.Get)
+}
+
+// requestContext returns a context for storage operations on behalf of the
+// given request. It is cancelled when the client goes away, or once timeout
+// elapses if non-zero.
+func requestContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+func httpError(w http.ResponseWriter, statusCode int, err error) {
+	if statusCode != http.StatusNotFound {
+		log.Errorf("HTTP %d: %v", statusCode, errgo.Details(err))
+	}
+	http.Error(w, http.StatusText(statusCode), statusCode)
+}
+
+// storageError responds to a failed storage operation, telling the client
+// to try again later if the operation timed out.
+func storageError(ctx context.Context, w http.ResponseWriter, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		httpError(w, http.StatusServiceUnavailable, errgo.Notef(err, "storage timeout"))
+		return
+	}
+	httpError(w, http.StatusInternalServerError, err)
+}
+
+// requestHost returns the lower case host name the request was made to,
+// without any port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// parsePath returns the mail domain and the file within its directory
+// requested by the given path. With the direct method, the path is the file
+// and the domain is the request host; with the advanced method, the domain
+// leads the path and the request host is "openpgpkey." followed by it.
+func (h *Handler) parsePath(r *http.Request, path string) (domain, file string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	host := requestHost(r)
+	switch {
+	case len(parts) == 3 && parts[1] == "hu", len(parts) == 2 && parts[1] == "policy":
+		domain = strings.ToLower(parts[0])
+		if host != advancedPrefix+domain {
+			return "", "", false
+		}
+		file = strings.Join(parts[1:], "/")
+	case len(parts) == 2 && parts[0] == "hu", len(parts) == 1 && parts[0] == "policy":
+		domain, file = host, strings.Join(parts, "/")
+	default:
+		return "", "", false
+	}
+	return domain, file, h.domains[domain]
+}
+
+// Get serves a file from the directory of a configured domain: the policy
+// file, or the keys for a hashed local part under "hu/".
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	domain, file, ok := h.parsePath(r, ps.ByName("path"))
+	if !ok {
+		httpError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if file == "policy" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(h.policy))
+		return
+	}
+	h.lookup(w, r, strings.TrimPrefix(file, "hu/")+"@"+domain)
+}
+
+// lookup serves the keys having a user ID with the given WKD address,
+// minimised to the matching user IDs and their self-signatures.
+func (h *Handler) lookup(w http.ResponseWriter, r *http.Request, addr string) {
+	ctx, cancel := requestContext(r, h.lookupTimeout)
+	defer cancel()
+
+	rfps, err := h.storage.MatchWKDContext(ctx, []string{addr})
+	if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+	if len(rfps) == 0 {
+		httpError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	keys, err := h.storage.FetchKeysContext(ctx, rfps)
+	if err != nil {
+		storageError(ctx, w, errgo.Mask(err))
+		return
+	}
+	if h.verifier != nil {
+		err = h.verifier.Filter(ctx, keys)
+		if err != nil {
+			storageError(ctx, w, errgo.Mask(err))
+			return
+		}
+	}
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		err := minimise(key, addr)
+		if err != nil {
+			log.Debugf("wkd: not serving %q: %v", key.Fingerprint(), err)
+			continue
+		}
+		if len(key.UserIDs) == 0 {
+			continue
+		}
+		result = append(result, key)
+		log.WithFields(log.Fields{
+			"fp":     key.Fingerprint(),
+			"length": key.Length,
+		}).Info("wkd lookup")
+	}
+	if len(result) == 0 {
+		httpError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	for _, key := range result {
+		err = openpgp.WritePackets(w, key)
+		if err != nil {
+			log.Errorf("wkd: error writing key %q: %v", key.Fingerprint(), err)
+			return
+		}
+	}
+}
+
+// minimise strips the given key down to the self-signed user IDs with the
+// given WKD address, dropping user attributes, third-party certifications
+// and unparsed packets.
+func minimise(key *openpgp.PrimaryKey, addr string) error {
+	var userIDs []*openpgp.UserID
+	for _, uid := range key.UserIDs {
+		if uidAddr, ok := storage.ParseWKDAddress(uid.Keywords); ok && uidAddr == addr {
+			uid.Others = nil
+			userIDs = append(userIDs, uid)
+		}
+	}
+	key.UserIDs = userIDs
+	key.UserAttributes = nil
+	key.Others = nil
+	for _, subKey := range key.SubKeys {
+		subKey.Others = nil
+	}
+	return openpgp.ValidSelfSigned(key, true)
+}
@@ -0,0 +1,155 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package wkd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+)
+
+const caseyRFP = "d113e86ebae6324d2fa392ff64a66194a1b6c7d8"
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type HandlerSuite struct {
+	storage *mock.Storage
+	srv     *httptest.Server
+}
+
+var _ = gc.Suite(&HandlerSuite{})
+
+var caseyWKD = storage.WKDHash("cmars") + "@cmarstech.com"
+
+func (s *HandlerSuite) SetUpTest(c *gc.C) {
+	s.storage = mock.NewStorage(
+		mock.MatchWKD(func(wkds []string) ([]string, error) {
+			if len(wkds) == 1 && wkds[0] == caseyWKD {
+				return []string{caseyRFP}, nil
+			}
+			return nil, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			if len(rfps) == 1 && rfps[0] == caseyRFP {
+				return openpgp.MustReadArmorKeys(testing.MustInput("e68e311d.asc")), nil
+			}
+			return nil, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, Domains([]string{"CMARSTECH.com"}), Policy("protocol-version: 18\n"))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	s.srv = httptest.NewServer(r)
+}
+
+func (s *HandlerSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *HandlerSuite) get(c *gc.C, host, path string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", s.srv.URL+"/.well-known/openpgpkey/"+path, nil)
+	c.Assert(err, gc.IsNil)
+	req.Host = host
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+	return res, body
+}
+
+func (s *HandlerSuite) TestNewHandler(c *gc.C) {
+	_, err := NewHandler(s.storage, Domains([]string{"example.com", ""}))
+	c.Assert(err, gc.ErrorMatches, `invalid WKD domain "".*`)
+}
+
+func (s *HandlerSuite) TestLookup(c *gc.C) {
+	hash := storage.WKDHash("cmars")
+	for _, t := range []struct {
+		host, path string
+	}{
+		{"cmarstech.com", "hu/" + hash},
+		{"CMARSTECH.com:8443", "hu/" + hash + "?l=cmars"},
+		{"openpgpkey.cmarstech.com", "cmarstech.com/hu/" + hash},
+	} {
+		res, body := s.get(c, t.host, t.path)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s %s", t.host, t.path))
+		c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/octet-stream")
+
+		// Only the matching user ID and its self-signatures are served.
+		keys := openpgp.MustReadKeys(bytes.NewBuffer(body))
+		c.Assert(keys, gc.HasLen, 1)
+		key := keys[0]
+		c.Assert(key.RFingerprint, gc.Equals, caseyRFP)
+		c.Assert(key.UserIDs, gc.HasLen, 1)
+		c.Assert(key.UserIDs[0].Keywords, gc.Equals, "Casey Marshall <cmars@cmarstech.com>")
+		c.Assert(key.UserAttributes, gc.HasLen, 0)
+		for _, sig := range key.UserIDs[0].Signatures {
+			c.Assert(sig.RIssuerKeyID, gc.Equals, key.RKeyID)
+		}
+	}
+	c.Assert(s.storage.MethodCount("MatchWKD"), gc.Equals, 3)
+}
+
+func (s *HandlerSuite) TestLookupNotFound(c *gc.C) {
+	hash := storage.WKDHash("cmars")
+	for _, t := range []struct {
+		host, path string
+	}{
+		// Unknown local part.
+		{"cmarstech.com", "hu/" + storage.WKDHash("alice")},
+		// Domain not configured.
+		{"canonical.com", "hu/" + storage.WKDHash("casey.marshall")},
+		{"openpgpkey.canonical.com", "canonical.com/hu/" + storage.WKDHash("casey.marshall")},
+		// Advanced method requests must be made to the openpgpkey host.
+		{"cmarstech.com", "cmarstech.com/hu/" + hash},
+		{"cmarstech.com", "hu"},
+		{"cmarstech.com", "hu/" + hash + "/x"},
+	} {
+		res, _ := s.get(c, t.host, t.path)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound, gc.Commentf("%s %s", t.host, t.path))
+	}
+	c.Assert(s.storage.MethodCount("MatchWKD"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestPolicy(c *gc.C) {
+	for _, t := range []struct {
+		host, path string
+	}{
+		{"cmarstech.com", "policy"},
+		{"openpgpkey.cmarstech.com", "cmarstech.com/policy"},
+	} {
+		res, body := s.get(c, t.host, t.path)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s %s", t.host, t.path))
+		c.Assert(string(body), gc.Equals, "protocol-version: 18\n")
+	}
+	res, _ := s.get(c, "canonical.com", "policy")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
@@ -25,6 +25,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gopkg.in/errgo.v1"
 	"hockeypuck/hkp/jsonhkp"
@@ -54,16 +55,20 @@ type MRFormat struct{}
 
 var mrFormat = &MRFormat{}
 
+// Write writes the machine-readable index of draft-shaw-openpgp-hkp,
+// section 5.2. Revoked and expired keys and user IDs are listed with their
+// flags set, rather than left out, so that clients can tell their users.
+// Keys are never disabled on this server, so the "d" flag is not used.
+//
+// For vindex requests, each user ID and user attribute is followed by a sig
+// line for each of its signatures:
+//
+//	sig:<issuer key ID>:<creation date>:<expiration date>:<signature type>
 func (*MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "text/plain")
 
 	fmt.Fprintf(w, "info:1:%d\n", len(keys))
 	for _, key := range keys {
-		selfsigs, _ := key.SigInfo()
-		if !selfsigs.Valid() {
-			continue
-		}
-
 		var keyID string
 		if l.Fingerprint {
 			keyID = key.Fingerprint()
@@ -72,25 +77,128 @@ func (*MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.Primary
 		}
 		keyID = strings.ToUpper(keyID)
 
-		expiresAt, _ := selfsigs.ExpiresAt()
-
-		fmt.Fprintf(w, "pub:%s:%d:%d:%d:%s:\n", keyID, key.Algorithm, key.BitLen,
-			key.Creation.Unix(), mrTimeString(expiresAt))
+		selfsigs, _ := key.SigInfo()
+		_, revoked := selfsigs.RevokedSince()
+		expiresAt := keyExpiresAt(key)
+		fmt.Fprintf(w, "pub:%s:%d:%d:%d:%s:%s\n", keyID, key.Algorithm, key.BitLen,
+			key.Creation.Unix(), mrTimeString(expiresAt), mrFlags(revoked, expiresAt))
 
 		for _, uid := range key.UserIDs {
 			selfsigs, _ := uid.SigInfo(key)
-			validSince, ok := selfsigs.ValidSince()
+			creation, expiresAt, flags, ok := mrSelfSigs(selfsigs)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "uid:%s:%s:%s:%s\n", mrEscape(uid.Keywords),
+				mrTimeString(creation), mrTimeString(expiresAt), flags)
+			if l.Op == OperationVIndex {
+				writeMRSigs(w, uid.Signatures, selfsigs)
+			}
+		}
+		for _, uat := range key.UserAttributes {
+			selfsigs, _ := uat.SigInfo(key)
+			creation, expiresAt, flags, ok := mrSelfSigs(selfsigs)
 			if !ok {
 				continue
 			}
-			expiresAt, _ := selfsigs.ExpiresAt()
-			fmt.Fprintf(w, "uid:%s:%d:%s:\n", strings.Replace(uid.Keywords, ":", "%3a", -1),
-				validSince.Unix(), mrTimeString(expiresAt))
+			fmt.Fprintf(w, "uat:%d:%s:%s:%s\n", len(uat.Images),
+				mrTimeString(creation), mrTimeString(expiresAt), flags)
+			if l.Op == OperationVIndex {
+				writeMRSigs(w, uat.Signatures, selfsigs)
+			}
 		}
 	}
 	return nil
 }
 
+// keyExpiresAt returns when the key expires according to the key expiration
+// time of the latest self-signature on its primary user ID, or else on its
+// first user ID which has one. The time is zero if the key does not expire,
+// including when it has been renewed without an expiration.
+func keyExpiresAt(key *openpgp.PrimaryKey) time.Time {
+	var result time.Time
+	var found bool
+	for _, uid := range key.UserIDs {
+		selfsigs, _ := uid.SigInfo(key)
+		if len(selfsigs.Certifications) == 0 {
+			continue
+		}
+		_, primary := selfsigs.PrimarySince()
+		if found && !primary {
+			continue
+		}
+		result, _ = selfsigs.KeyExpiresAt()
+		found = true
+		if primary {
+			break
+		}
+	}
+	return result
+}
+
+// mrSelfSigs returns the creation and expiration times and the flags of a
+// user ID or user attribute, given its self-signatures. ok is false if it
+// has no valid self-signature.
+func mrSelfSigs(selfsigs *openpgp.SelfSigs) (creation, expiresAt time.Time, flags string, ok bool) {
+	_, revoked := selfsigs.RevokedSince()
+	if !revoked && len(selfsigs.Certifications) == 0 {
+		return creation, expiresAt, "", false
+	}
+	if validSince, ok := selfsigs.ValidSince(); ok {
+		creation = validSince
+	} else if len(selfsigs.Certifications) > 0 {
+		creation = selfsigs.Certifications[0].Signature.Creation
+	}
+	if len(selfsigs.Certifications) > 0 {
+		// The latest self-signature supersedes earlier ones, so a user ID
+		// renewed without an expiration no longer expires.
+		expiresAt = selfsigs.Certifications[0].Signature.Expiration
+	}
+	return creation, expiresAt, mrFlags(revoked, expiresAt), true
+}
+
+func mrFlags(revoked bool, expiresAt time.Time) string {
+	var flags string
+	if revoked {
+		flags += "r"
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		flags += "e"
+	}
+	return flags
+}
+
+// writeMRSigs writes a sig line for each of the given signatures, other than
+// self-signatures which failed to verify.
+func writeMRSigs(w http.ResponseWriter, sigs []*openpgp.Signature, selfsigs *openpgp.SelfSigs) {
+	invalid := make(map[*openpgp.Signature]bool)
+	for _, checkSig := range selfsigs.Errors {
+		invalid[checkSig.Signature] = true
+	}
+	for _, sig := range sigs {
+		if invalid[sig] {
+			continue
+		}
+		fmt.Fprintf(w, "sig:%s:%s:%s:%02x\n", strings.ToUpper(sig.IssuerKeyID()),
+			mrTimeString(sig.Creation), mrTimeString(sig.Expiration), sig.SigType)
+	}
+}
+
+// mrEscape percent-escapes the characters of s which are not 7-bit safe, as
+// well as ':' and '%'.
+func mrEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x7f || c == ':' || c == '%' {
+			fmt.Fprintf(&b, "%%%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
 type HTMLFormat struct {
 	t *template.Template
 }
@@ -0,0 +1,1285 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package leveldbhkp provides an embedded HKP storage backend, for keyservers
+// which do not warrant running a separate database server.
+package leveldbhkp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/errgo.v1"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const (
+	maxInsertErrors = 100
+	maxResults      = 100
+)
+
+// The database holds a record for each key, and index entries which refer
+// back to it by RFingerprint.
+var (
+	// key/<rfingerprint> -> keyDoc
+	keyPrefix = []byte("key/")
+	// md5/<md5> -> rfingerprint
+	md5Prefix = []byte("md5/")
+	// subkey/<rsubfp> -> rfingerprint
+	subkeyPrefix = []byte("subkey/")
+	// keyid/<rkeyid>\x00<rfingerprint> -> empty, for v3 and v6 keys and v6
+	// subkeys only
+	keyidPrefix = []byte("keyid/")
+	// email/<normalized email>\x00<rfingerprint> -> empty
+	emailPrefix = []byte("email/")
+	// wkd/<wkd address>\x00<rfingerprint> -> empty
+	wkdPrefix = []byte("wkd/")
+	// keyword/<keyword>\x00<rfingerprint> -> empty
+	keywordPrefix = []byte("keyword/")
+	// mtime/<big-endian unix nanoseconds><rfingerprint> -> empty
+	mtimePrefix = []byte("mtime/")
+	// uidstate/<rfingerprint>\x00<normalized email> -> uidStateDoc
+	uidStatePrefix = []byte("uidstate/")
+	// suppressed/<rfingerprint> -> empty
+	suppressedPrefix = []byte("suppressed/")
+	// change/<big-endian sequence number> -> changeDoc
+	changePrefix = []byte("change/")
+)
+
+type storage struct {
+	db *leveldb.DB
+
+	// wmu serializes writers, so that updates can be made conditional on
+	// the currently stored contents.
+	wmu sync.Mutex
+
+	// changeSeq is the sequence number of the last change logged. It is
+	// guarded by wmu.
+	changeSeq uint64
+
+	mu        sync.Mutex
+	listeners []func(hkpstorage.KeyChange) error
+}
+
+var _ hkpstorage.Storage = (*storage)(nil)
+var _ hkpstorage.KeyringImporter = (*storage)(nil)
+var _ hkpstorage.UIDPublisher = (*storage)(nil)
+var _ hkpstorage.Suppressor = (*storage)(nil)
+var _ hkpstorage.ChangeLogger = (*storage)(nil)
+var _ hkpstorage.DigestIterator = (*storage)(nil)
+
+// Open returns embedded storage kept in the LevelDB database at the given
+// path, which is created if it does not already exist.
+func Open(path string) (hkpstorage.Storage, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open %q", path)
+	}
+	return New(db)
+}
+
+// New returns an embedded storage implementation for an HKP service, using
+// the given LevelDB database.
+func New(db *leveldb.DB) (hkpstorage.Storage, error) {
+	st := &storage{db: db}
+	iter := db.NewIterator(util.BytesPrefix(changePrefix), nil)
+	if iter.Last() {
+		st.changeSeq = binary.BigEndian.Uint64(iter.Key()[len(changePrefix):])
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return st, nil
+}
+
+func (st *storage) Close() error {
+	return st.db.Close()
+}
+
+type keyDoc struct {
+	RFingerprint string   `json:"rfingerprint"`
+	CTime        int64    `json:"ctime"`
+	MTime        int64    `json:"mtime"`
+	MD5          string   `json:"md5"`
+	Packets      []byte   `json:"packets"`
+	Keywords     []string `json:"keywords"`
+	SubKeys      []string `json:"subkeys"`
+	RKeyID       string   `json:"rkeyid,omitempty"`
+	SubKeyIDs    []string `json:"subkeyids,omitempty"`
+	Emails       []string `json:"emails,omitempty"`
+	WKD          []string `json:"wkd,omitempty"`
+}
+
+// uidStateDoc is the record of the publication state of an email address.
+type uidStateDoc struct {
+	State string `json:"state"`
+	MTime int64  `json:"mtime"`
+}
+
+// changeDoc is the record of a change in the log.
+type changeDoc struct {
+	RFingerprint string `json:"rfingerprint"`
+	Type         string `json:"type"`
+	OldMD5       string `json:"oldMD5,omitempty"`
+	NewMD5       string `json:"newMD5,omitempty"`
+	Time         int64  `json:"time"`
+}
+
+func (doc *keyDoc) keyring() (*hkpstorage.Keyring, error) {
+	key, err := readOneKey(doc.Packets, doc.RFingerprint)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	} else if key == nil {
+		return nil, nil
+	}
+	return &hkpstorage.Keyring{
+		PrimaryKey: key,
+		CTime:      time.Unix(0, doc.CTime).UTC(),
+		MTime:      time.Unix(0, doc.MTime).UTC(),
+		Digest:     doc.MD5,
+	}, nil
+}
+
+func prefixed(prefix []byte, parts ...string) []byte {
+	k := append([]byte(nil), prefix...)
+	for _, part := range parts {
+		k = append(k, part...)
+	}
+	return k
+}
+
+func keyKey(rfp string) []byte        { return prefixed(keyPrefix, rfp) }
+func md5Key(md5 string) []byte        { return prefixed(md5Prefix, md5) }
+func subkeyKey(rsubfp string) []byte  { return prefixed(subkeyPrefix, rsubfp) }
+func suppressedKey(rfp string) []byte { return prefixed(suppressedPrefix, rfp) }
+
+func keyidKey(rkeyid, rfp string) []byte {
+	return prefixed(keyidPrefix, rkeyid, "\x00", rfp)
+}
+
+func emailKey(email, rfp string) []byte {
+	return prefixed(emailPrefix, email, "\x00", rfp)
+}
+
+func keywordKey(keyword, rfp string) []byte {
+	return prefixed(keywordPrefix, keyword, "\x00", rfp)
+}
+
+func wkdKey(addr, rfp string) []byte {
+	return prefixed(wkdPrefix, addr, "\x00", rfp)
+}
+
+func uidStateKey(rfp, email string) []byte {
+	return prefixed(uidStatePrefix, rfp, "\x00", email)
+}
+
+func mtimeKey(mtime int64, rfp string) []byte {
+	var buf [8]byte
+	if mtime < 0 {
+		mtime = 0
+	}
+	binary.BigEndian.PutUint64(buf[:], uint64(mtime))
+	return prefixed(mtimePrefix, string(buf[:]), rfp)
+}
+
+func changeKey(seq uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	return prefixed(changePrefix, string(buf[:]))
+}
+
+// unixNano returns t in nanoseconds since the epoch, treating the zero time
+// as the epoch.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// after returns the smallest key which sorts after k.
+func after(k []byte) []byte {
+	return append(append([]byte(nil), k...), 0)
+}
+
+func (st *storage) getDoc(rfp string) (*keyDoc, error) {
+	buf, err := st.db.Get(keyKey(rfp), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, errgo.WithCausef(nil, hkpstorage.ErrKeyNotFound, "rfp=%q", rfp)
+	} else if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var doc keyDoc
+	err = json.Unmarshal(buf, &doc)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid record for rfp=%q", rfp)
+	}
+	return &doc, nil
+}
+
+func (st *storage) MatchMD5(md5s []string) ([]string, error) {
+	return st.MatchMD5Context(context.Background(), md5s)
+}
+
+func (st *storage) MatchMD5Context(ctx context.Context, md5s []string) ([]string, error) {
+	var result []string
+	for _, md5 := range md5s {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		rfp, err := st.db.Get(md5Key(strings.ToLower(md5)), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, string(rfp))
+	}
+	return result, nil
+}
+
+// Resolve implements storage.Storage.
+func (st *storage) Resolve(keyids []string) ([]string, error) {
+	return st.ResolveContext(context.Background(), keyids)
+}
+
+func (st *storage) ResolveContext(ctx context.Context, keyids []string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	for _, keyid := range keyids {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		keyid = strings.ToLower(keyid)
+		if keyid == "" {
+			// An empty prefix would match every key.
+			continue
+		}
+		var matches []string
+		for _, scan := range []struct {
+			prefix []byte
+			rfp    func(k, v []byte) string
+		}{{
+			keyKey(keyid), func(k, _ []byte) string { return string(k[len(keyPrefix):]) },
+		}, {
+			prefixed(keyidPrefix, keyid), func(k, _ []byte) string {
+				return string(k[bytes.IndexByte(k, 0)+1:])
+			},
+		}, {
+			subkeyKey(keyid), func(_, v []byte) string { return string(v) },
+		}} {
+			rfps, err := st.scanPrefix(scan.prefix, scan.rfp)
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			matches = append(matches, rfps...)
+		}
+		for _, rfp := range matches {
+			if !seen[rfp] && len(result) < maxResults {
+				seen[rfp] = true
+				result = append(result, rfp)
+			}
+		}
+	}
+	return result, nil
+}
+
+// scanPrefix returns the RFingerprints extracted by f from up to maxResults
+// records having the given key prefix.
+func (st *storage) scanPrefix(prefix []byte, f func(k, v []byte) string) ([]string, error) {
+	var result []string
+	iter := st.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() && len(result) < maxResults {
+		result = append(result, f(iter.Key(), iter.Value()))
+	}
+	return result, errgo.Mask(iter.Error())
+}
+
+// MatchEmail implements storage.Storage.
+func (st *storage) MatchEmail(emails []string) ([]string, error) {
+	return st.MatchEmailContext(context.Background(), emails)
+}
+
+func (st *storage) MatchEmailContext(ctx context.Context, emails []string) ([]string, error) {
+	var result []string
+	for _, email := range emails {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		prefix := prefixed(emailPrefix, email, "\x00")
+		rfps, err := st.scanPrefix(prefix, func(k, _ []byte) string {
+			return string(k[len(prefix):])
+		})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, rfps...)
+	}
+	return result, nil
+}
+
+// MatchWKD implements storage.Storage.
+func (st *storage) MatchWKD(addrs []string) ([]string, error) {
+	return st.MatchWKDContext(context.Background(), addrs)
+}
+
+func (st *storage) MatchWKDContext(ctx context.Context, addrs []string) ([]string, error) {
+	var result []string
+	for _, addr := range addrs {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		prefix := prefixed(wkdPrefix, addr, "\x00")
+		rfps, err := st.scanPrefix(prefix, func(k, _ []byte) string {
+			return string(k[len(prefix):])
+		})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, rfps...)
+	}
+	return result, nil
+}
+
+// MatchKeyword implements storage.Storage.
+//
+// Each search term matches the keys which have all of the words in the term
+// as keywords. Unlike the PostgreSQL backend, words are not stemmed.
+func (st *storage) MatchKeyword(search []string) ([]string, error) {
+	return st.MatchKeywordContext(context.Background(), search)
+}
+
+func (st *storage) MatchKeywordContext(ctx context.Context, search []string) ([]string, error) {
+	var result []string
+	for _, term := range search {
+		var matches map[string]bool
+		for _, word := range searchWords(term) {
+			if err := ctx.Err(); err != nil {
+				return nil, errgo.Mask(err, errgo.Any)
+			}
+			prefix := prefixed(keywordPrefix, word, "\x00")
+			next := make(map[string]bool)
+			iter := st.db.NewIterator(util.BytesPrefix(prefix), nil)
+			for iter.Next() {
+				rfp := string(iter.Key()[len(prefix):])
+				if matches == nil || matches[rfp] {
+					next[rfp] = true
+				}
+			}
+			iter.Release()
+			if err := iter.Error(); err != nil {
+				return nil, errgo.Mask(err)
+			}
+			matches = next
+			if len(matches) == 0 {
+				break
+			}
+		}
+		for rfp := range matches {
+			if len(result) >= maxResults {
+				break
+			}
+			result = append(result, rfp)
+		}
+	}
+	return result, nil
+}
+
+func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
+	return st.ModifiedSinceContext(context.Background(), t)
+}
+
+func (st *storage) ModifiedSinceContext(ctx context.Context, t time.Time) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	// Most recently modified first, as in the other backends.
+	iter := st.db.NewIterator(&util.Range{
+		Start: mtimeKey(unixNano(t)+1, ""),
+		Limit: util.BytesPrefix(mtimePrefix).Limit,
+	}, nil)
+	defer iter.Release()
+	var result []string
+	for ok := iter.Last(); ok && len(result) < maxResults; ok = iter.Prev() {
+		result = append(result, string(iter.Key()[len(mtimePrefix)+8:]))
+	}
+	return result, errgo.Mask(iter.Error())
+}
+
+func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	return st.FetchKeysContext(context.Background(), rfps)
+}
+
+func (st *storage) FetchKeysContext(ctx context.Context, rfps []string) ([]*openpgp.PrimaryKey, error) {
+	keyrings, err := st.FetchKeyringsContext(ctx, rfps)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, kr := range keyrings {
+		result = append(result, kr.PrimaryKey)
+	}
+	return result, nil
+}
+
+func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
+	return st.FetchKeyringsContext(context.Background(), rfps)
+}
+
+func (st *storage) FetchKeyringsContext(ctx context.Context, rfps []string) ([]*hkpstorage.Keyring, error) {
+	var result []*hkpstorage.Keyring
+	seen := make(map[string]bool)
+	for _, rfp := range rfps {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		rfp = strings.ToLower(rfp)
+		if seen[rfp] {
+			continue
+		}
+		seen[rfp] = true
+		doc, err := st.getDoc(rfp)
+		if hkpstorage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		kr, err := doc.keyring()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		} else if kr == nil {
+			continue
+		}
+		result = append(result, kr)
+	}
+	return result, nil
+}
+
+// IterKeyrings implements storage.Storage.
+//
+// The cursor reads from a consistent snapshot of the database taken when it
+// was created.
+func (st *storage) IterKeyrings(ctx context.Context, order hkpstorage.KeyringOrder, from hkpstorage.Checkpoint) (hkpstorage.KeyringCursor, error) {
+	var r *util.Range
+	switch order {
+	case hkpstorage.ByRFingerprint:
+		r = util.BytesPrefix(keyPrefix)
+		if from.RFingerprint != "" {
+			r.Start = after(keyKey(from.RFingerprint))
+		}
+	case hkpstorage.ByMTime:
+		r = util.BytesPrefix(mtimePrefix)
+		if !from.IsZero() {
+			r.Start = after(mtimeKey(unixNano(from.MTime), from.RFingerprint))
+		}
+	default:
+		return nil, errgo.Newf("unsupported keyring order %v", order)
+	}
+	snap, err := st.db.GetSnapshot()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &keyringCursor{
+		ctx:   ctx,
+		order: order,
+		snap:  snap,
+		iter:  snap.NewIterator(r, nil),
+		cp:    from,
+	}, nil
+}
+
+type keyringCursor struct {
+	ctx   context.Context
+	order hkpstorage.KeyringOrder
+	snap  *leveldb.Snapshot
+	iter  iterator.Iterator
+	cur   *hkpstorage.Keyring
+	cp    hkpstorage.Checkpoint
+	err   error
+}
+
+func (c *keyringCursor) Next() bool {
+	c.cur = nil
+	if c.err != nil {
+		return false
+	}
+	for c.iter.Next() {
+		if err := c.ctx.Err(); err != nil {
+			c.err = errgo.Mask(err, errgo.Any)
+			return false
+		}
+		buf := c.iter.Value()
+		if c.order == hkpstorage.ByMTime {
+			rfp := string(c.iter.Key()[len(mtimePrefix)+8:])
+			var err error
+			buf, err = c.snap.Get(keyKey(rfp), nil)
+			if err == leveldb.ErrNotFound {
+				continue
+			} else if err != nil {
+				c.err = errgo.Mask(err)
+				return false
+			}
+		}
+		var doc keyDoc
+		err := json.Unmarshal(buf, &doc)
+		if err != nil {
+			log.Warningf("skipping unreadable keyring at %q: %v", c.iter.Key(), err)
+			c.skip()
+			continue
+		}
+		kr, err := doc.keyring()
+		if err != nil {
+			log.Warningf("skipping unreadable keyring rfp=%q: %v", doc.RFingerprint, err)
+			c.skip()
+			continue
+		} else if kr == nil {
+			continue
+		}
+		c.cur = kr
+		c.cp = hkpstorage.CheckpointOf(kr)
+		return true
+	}
+	if err := c.iter.Error(); err != nil {
+		c.err = errgo.Mask(err)
+	}
+	return false
+}
+
+// skip moves the checkpoint past the unreadable record at the iterator's
+// position, so that iteration resumed from it does not read the record again.
+func (c *keyringCursor) skip() {
+	k := c.iter.Key()
+	switch c.order {
+	case hkpstorage.ByRFingerprint:
+		c.cp = hkpstorage.Checkpoint{RFingerprint: string(k[len(keyPrefix):])}
+	case hkpstorage.ByMTime:
+		mtime := int64(binary.BigEndian.Uint64(k[len(mtimePrefix):]))
+		c.cp = hkpstorage.Checkpoint{
+			RFingerprint: string(k[len(mtimePrefix)+8:]),
+			MTime:        time.Unix(0, mtime).UTC(),
+		}
+	}
+}
+
+func (c *keyringCursor) Keyring() *hkpstorage.Keyring { return c.cur }
+
+func (c *keyringCursor) Checkpoint() hkpstorage.Checkpoint { return c.cp }
+
+func (c *keyringCursor) Err() error { return c.err }
+
+func (c *keyringCursor) Close() error {
+	c.iter.Release()
+	c.snap.Release()
+	return nil
+}
+
+// IterDigests implements storage.DigestIterator. Digests are read in digest
+// order from the digest index, from a consistent snapshot of the database
+// taken when the cursor was created.
+func (st *storage) IterDigests(ctx context.Context) (hkpstorage.DigestCursor, error) {
+	snap, err := st.db.GetSnapshot()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &digestCursor{
+		ctx:  ctx,
+		snap: snap,
+		iter: snap.NewIterator(util.BytesPrefix(md5Prefix), nil),
+	}, nil
+}
+
+type digestCursor struct {
+	ctx  context.Context
+	snap *leveldb.Snapshot
+	iter iterator.Iterator
+	cur  hkpstorage.KeyringDigest
+	err  error
+}
+
+func (c *digestCursor) Next() bool {
+	c.cur = hkpstorage.KeyringDigest{}
+	if c.err != nil {
+		return false
+	}
+	if !c.iter.Next() {
+		c.err = errgo.Mask(c.iter.Error())
+		return false
+	}
+	if err := c.ctx.Err(); err != nil {
+		c.err = errgo.Mask(err, errgo.Any)
+		return false
+	}
+	c.cur = hkpstorage.KeyringDigest{
+		RFingerprint: string(c.iter.Value()),
+		Digest:       string(c.iter.Key()[len(md5Prefix):]),
+	}
+	return true
+}
+
+func (c *digestCursor) Digest() hkpstorage.KeyringDigest { return c.cur }
+
+func (c *digestCursor) Err() error { return c.err }
+
+func (c *digestCursor) Close() error {
+	c.iter.Release()
+	c.snap.Release()
+	return nil
+}
+
+func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
+	kr := openpgp.NewKeyReader(bytes.NewBuffer(b))
+	keys, err := kr.Read()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	} else if len(keys) > 1 {
+		return nil, errgo.Newf("multiple keys in keyring: %v, %v", keys[0].Fingerprint(), keys[1].Fingerprint())
+	}
+	if keys[0].RFingerprint != rfingerprint {
+		return nil, errgo.Newf("RFingerprint mismatch: expected=%q got=%q",
+			rfingerprint, keys[0].RFingerprint)
+	}
+	return keys[0], nil
+}
+
+// newDoc returns a record of the given key, modified at the given time.
+func newDoc(key *openpgp.PrimaryKey, now time.Time) (*keyDoc, error) {
+	openpgp.Sort(key)
+
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot serialize rfp=%q", key.RFingerprint)
+	}
+	return &keyDoc{
+		RFingerprint: key.RFingerprint,
+		CTime:        now.UnixNano(),
+		MTime:        now.UnixNano(),
+		MD5:          key.MD5,
+		Packets:      buf.Bytes(),
+		Keywords:     keywords(key),
+		SubKeys:      subkeys(key),
+		RKeyID:       hkpstorage.V3RKeyID(key),
+		SubKeyIDs:    subkeyIDs(key),
+		Emails:       hkpstorage.Emails(key),
+		WKD:          hkpstorage.WKDAddresses(key),
+	}, nil
+}
+
+// putDoc adds writes to the batch which store the given record and its index
+// entries. Subkeys which already refer to another key are left alone.
+func (st *storage) putDoc(batch *leveldb.Batch, doc *keyDoc) error {
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	batch.Put(keyKey(doc.RFingerprint), buf)
+	batch.Put(md5Key(doc.MD5), []byte(doc.RFingerprint))
+	batch.Put(mtimeKey(doc.MTime, doc.RFingerprint), nil)
+	if doc.RKeyID != "" {
+		batch.Put(keyidKey(doc.RKeyID, doc.RFingerprint), nil)
+	}
+	for _, rkeyid := range doc.SubKeyIDs {
+		batch.Put(keyidKey(rkeyid, doc.RFingerprint), nil)
+	}
+	for _, keyword := range doc.Keywords {
+		batch.Put(keywordKey(keyword, doc.RFingerprint), nil)
+	}
+	for _, email := range doc.Emails {
+		batch.Put(emailKey(email, doc.RFingerprint), nil)
+	}
+	for _, addr := range doc.WKD {
+		batch.Put(wkdKey(addr, doc.RFingerprint), nil)
+	}
+	for _, rsubfp := range doc.SubKeys {
+		// The first key stored with a subkey keeps it. An update re-puts the
+		// subkeys its record already owns, which deleteIndexes may have
+		// removed earlier in the same batch.
+		rfp, err := st.db.Get(subkeyKey(rsubfp), nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return errgo.Mask(err)
+		}
+		if err == leveldb.ErrNotFound || string(rfp) == doc.RFingerprint {
+			batch.Put(subkeyKey(rsubfp), []byte(doc.RFingerprint))
+		}
+	}
+	return nil
+}
+
+// deleteIndexes adds writes to the batch which remove the index entries of
+// the given record. Subkeys are only removed if they refer to it.
+func (st *storage) deleteIndexes(batch *leveldb.Batch, doc *keyDoc) error {
+	batch.Delete(md5Key(doc.MD5))
+	batch.Delete(mtimeKey(doc.MTime, doc.RFingerprint))
+	if doc.RKeyID != "" {
+		batch.Delete(keyidKey(doc.RKeyID, doc.RFingerprint))
+	}
+	for _, rkeyid := range doc.SubKeyIDs {
+		batch.Delete(keyidKey(rkeyid, doc.RFingerprint))
+	}
+	for _, keyword := range doc.Keywords {
+		batch.Delete(keywordKey(keyword, doc.RFingerprint))
+	}
+	for _, email := range doc.Emails {
+		batch.Delete(emailKey(email, doc.RFingerprint))
+	}
+	for _, addr := range doc.WKD {
+		batch.Delete(wkdKey(addr, doc.RFingerprint))
+	}
+	for _, rsubfp := range doc.SubKeys {
+		rfp, err := st.db.Get(subkeyKey(rsubfp), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return errgo.Mask(err)
+		}
+		if string(rfp) == doc.RFingerprint {
+			batch.Delete(subkeyKey(rsubfp))
+		}
+	}
+	return nil
+}
+
+// putChange adds a write to the batch which records the given change in the
+// log. The caller must hold wmu.
+func (st *storage) putChange(batch *leveldb.Batch, doc *changeDoc) error {
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	st.changeSeq++
+	batch.Put(changeKey(st.changeSeq), buf)
+	return nil
+}
+
+func (st *storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
+	return st.InsertContext(context.Background(), keys)
+}
+
+func (st *storage) InsertContext(ctx context.Context, keys []*openpgp.PrimaryKey) (int, error) {
+	var n int
+	var result hkpstorage.InsertError
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			result.Errors = append(result.Errors, errgo.Mask(err, errgo.Any))
+			return n, result
+		}
+		if count, max := len(result.Errors), maxInsertErrors; count > max {
+			result.Errors = append(result.Errors, errgo.Newf("too many insert errors (%d > %d), bailing...", count, max))
+			return n, result
+		}
+
+		if isDuplicate, err := st.insertKey(key); err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		} else if isDuplicate {
+			result.Duplicates = append(result.Duplicates, key)
+			continue
+		}
+
+		st.Notify(hkpstorage.KeyAdded{
+			ID:           key.KeyID(),
+			Digest:       key.MD5,
+			RFingerprint: key.RFingerprint,
+		})
+		n++
+	}
+
+	if len(result.Duplicates) > 0 || len(result.Errors) > 0 {
+		return n, result
+	}
+	return n, nil
+}
+
+func (st *storage) insertKey(key *openpgp.PrimaryKey) (isDuplicate bool, _ error) {
+	doc, err := newDoc(key, time.Now())
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return st.insertDoc(doc, true)
+}
+
+// insertDoc stores the given record if its key is not already stored, and
+// optionally records its addition in the change log.
+func (st *storage) insertDoc(doc *keyDoc, logChange bool) (isDuplicate bool, _ error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	ok, err := st.db.Has(keyKey(doc.RFingerprint), nil)
+	if err != nil {
+		return false, errgo.Mask(err)
+	} else if ok {
+		return true, nil
+	}
+	var batch leveldb.Batch
+	err = st.putDoc(&batch, doc)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if logChange {
+		err = st.putChange(&batch, &changeDoc{
+			RFingerprint: doc.RFingerprint,
+			Type:         string(hkpstorage.ChangeAdded),
+			NewMD5:       doc.MD5,
+			Time:         doc.MTime,
+		})
+		if err != nil {
+			return false, errgo.Mask(err)
+		}
+	}
+	err = st.db.Write(&batch, nil)
+	if err != nil {
+		return false, errgo.Notef(err, "cannot insert rfp=%q", doc.RFingerprint)
+	}
+	return false, nil
+}
+
+// ImportKeyrings implements storage.KeyringImporter.
+func (st *storage) ImportKeyrings(ctx context.Context, keyrings []*hkpstorage.Keyring) (int, error) {
+	var n int
+	var result hkpstorage.InsertError
+	for _, kr := range keyrings {
+		if err := ctx.Err(); err != nil {
+			result.Errors = append(result.Errors, errgo.Mask(err, errgo.Any))
+			return n, result
+		}
+		if count, max := len(result.Errors), maxInsertErrors; count > max {
+			result.Errors = append(result.Errors, errgo.Newf("too many insert errors (%d > %d), bailing...", count, max))
+			return n, result
+		}
+
+		doc, err := newDoc(kr.PrimaryKey, kr.MTime)
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		doc.CTime = kr.CTime.UnixNano()
+		if kr.Digest != "" {
+			doc.MD5 = kr.Digest
+		}
+		if isDuplicate, err := st.insertDoc(doc, false); err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		} else if isDuplicate {
+			result.Duplicates = append(result.Duplicates, kr.PrimaryKey)
+			continue
+		}
+		n++
+	}
+
+	if len(result.Duplicates) > 0 || len(result.Errors) > 0 {
+		return n, result
+	}
+	return n, nil
+}
+
+func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
+	return st.UpdateContext(context.Background(), key, lastID, lastMD5)
+}
+
+func (st *storage) UpdateContext(ctx context.Context, key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
+	if err := ctx.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	doc, err := newDoc(key, time.Now())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	err = func() error {
+		st.wmu.Lock()
+		defer st.wmu.Unlock()
+
+		lastDoc, err := st.getDoc(key.RFingerprint)
+		if hkpstorage.IsNotFound(err) || (err == nil && lastDoc.MD5 != lastMD5) {
+			return errgo.WithCausef(nil, hkpstorage.ErrConflict,
+				"failed to update rfp=%q, didn't match lastMD5=%q", key.RFingerprint, lastMD5)
+		} else if err != nil {
+			return errgo.Mask(err)
+		}
+		doc.CTime = lastDoc.CTime
+
+		var batch leveldb.Batch
+		err = st.deleteIndexes(&batch, lastDoc)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = st.putDoc(&batch, doc)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		err = st.putChange(&batch, &changeDoc{
+			RFingerprint: doc.RFingerprint,
+			Type:         string(hkpstorage.ChangeReplaced),
+			OldMD5:       lastDoc.MD5,
+			NewMD5:       doc.MD5,
+			Time:         doc.MTime,
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(st.db.Write(&batch, nil))
+	}()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(hkpstorage.ErrConflict))
+	}
+
+	st.Notify(hkpstorage.KeyReplaced{
+		OldID:     lastID,
+		OldDigest: lastMD5,
+		NewID:     key.KeyID(),
+		NewDigest: key.MD5,
+
+		RFingerprint: key.RFingerprint,
+	})
+	return nil
+}
+
+func (st *storage) Delete(rfp string) (string, error) {
+	return st.DeleteContext(context.Background(), rfp)
+}
+
+func (st *storage) DeleteContext(ctx context.Context, rfp string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	rfp = strings.ToLower(rfp)
+
+	doc, err := func() (*keyDoc, error) {
+		st.wmu.Lock()
+		defer st.wmu.Unlock()
+
+		doc, err := st.getDoc(rfp)
+		if err != nil {
+			return nil, errgo.Mask(err, hkpstorage.IsNotFound)
+		}
+		var batch leveldb.Batch
+		err = st.deleteIndexes(&batch, doc)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		batch.Delete(keyKey(rfp))
+		iter := st.db.NewIterator(util.BytesPrefix(prefixed(uidStatePrefix, rfp, "\x00")), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		err = st.putChange(&batch, &changeDoc{
+			RFingerprint: rfp,
+			Type:         string(hkpstorage.ChangeRemoved),
+			OldMD5:       doc.MD5,
+			Time:         time.Now().UnixNano(),
+		})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return doc, errgo.Mask(st.db.Write(&batch, nil))
+	}()
+	if err != nil {
+		return "", errgo.Mask(err, hkpstorage.IsNotFound)
+	}
+
+	st.Notify(hkpstorage.KeyRemoved{
+		ID:           keyID(rfp),
+		Digest:       doc.MD5,
+		RFingerprint: rfp,
+	})
+	return doc.MD5, nil
+}
+
+// UIDStates implements storage.UIDPublisher.
+func (st *storage) UIDStates(ctx context.Context, rfps []string) (map[string][]hkpstorage.UIDStatus, error) {
+	result := make(map[string][]hkpstorage.UIDStatus)
+	for _, rfp := range rfps {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		prefix := prefixed(uidStatePrefix, rfp, "\x00")
+		iter := st.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			var doc uidStateDoc
+			err := json.Unmarshal(iter.Value(), &doc)
+			if err != nil {
+				iter.Release()
+				return nil, errgo.Notef(err, "invalid user ID state for rfp=%q", rfp)
+			}
+			result[rfp] = append(result[rfp], hkpstorage.UIDStatus{
+				Email:    string(iter.Key()[len(prefix):]),
+				State:    hkpstorage.UIDState(doc.State),
+				Modified: time.Unix(0, doc.MTime).UTC(),
+			})
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return result, nil
+}
+
+// SetUIDState implements storage.UIDPublisher.
+func (st *storage) SetUIDState(ctx context.Context, rfp string, status hkpstorage.UIDStatus) error {
+	if err := ctx.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	buf, err := json.Marshal(&uidStateDoc{
+		State: string(status.State),
+		MTime: unixNano(status.Modified),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	ok, err := st.db.Has(keyKey(rfp), nil)
+	if err != nil {
+		return errgo.Mask(err)
+	} else if !ok {
+		return errgo.WithCausef(nil, hkpstorage.ErrKeyNotFound, "rfp=%q", rfp)
+	}
+	if status.State == hkpstorage.UIDUnpublished {
+		return errgo.Mask(st.db.Delete(uidStateKey(rfp, status.Email), nil))
+	}
+	return errgo.Mask(st.db.Put(uidStateKey(rfp, status.Email), buf, nil))
+}
+
+// Suppress implements storage.Suppressor.
+func (st *storage) Suppress(ctx context.Context, rfp string) error {
+	if err := ctx.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(st.db.Put(suppressedKey(strings.ToLower(rfp)), nil, nil))
+}
+
+// Unsuppress implements storage.Suppressor.
+func (st *storage) Unsuppress(ctx context.Context, rfp string) error {
+	if err := ctx.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(st.db.Delete(suppressedKey(strings.ToLower(rfp)), nil))
+}
+
+// Suppressed implements storage.Suppressor.
+func (st *storage) Suppressed(ctx context.Context, rfps []string) ([]string, error) {
+	var result []string
+	for _, rfp := range rfps {
+		if err := ctx.Err(); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		rfp = strings.ToLower(rfp)
+		ok, err := st.db.Has(suppressedKey(rfp), nil)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		} else if ok {
+			result = append(result, rfp)
+		}
+	}
+	return result, nil
+}
+
+// ListSuppressed implements storage.Suppressor.
+func (st *storage) ListSuppressed(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var result []string
+	iter := st.db.NewIterator(util.BytesPrefix(suppressedPrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		result = append(result, string(iter.Key()[len(suppressedPrefix):]))
+	}
+	return result, errgo.Mask(iter.Error())
+}
+
+// Changes implements storage.ChangeLogger. Cursors are change sequence
+// numbers.
+func (st *storage) Changes(ctx context.Context, cursor string, limit int) ([]hkpstorage.Change, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	var seq uint64
+	if cursor != "" {
+		var err error
+		seq, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, errgo.WithCausef(nil, hkpstorage.ErrInvalidCursor, "cursor=%q", cursor)
+		}
+	}
+	iter := st.db.NewIterator(&util.Range{
+		Start: changeKey(seq + 1),
+		Limit: util.BytesPrefix(changePrefix).Limit,
+	}, nil)
+	defer iter.Release()
+	var result []hkpstorage.Change
+	for len(result) < limit && iter.Next() {
+		var doc changeDoc
+		err := json.Unmarshal(iter.Value(), &doc)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid change record")
+		}
+		result = append(result, hkpstorage.Change{
+			Cursor:       strconv.FormatUint(binary.BigEndian.Uint64(iter.Key()[len(changePrefix):]), 10),
+			RFingerprint: doc.RFingerprint,
+			Type:         hkpstorage.ChangeType(doc.Type),
+			OldDigest:    doc.OldMD5,
+			NewDigest:    doc.NewMD5,
+			Time:         time.Unix(0, doc.Time).UTC(),
+		})
+	}
+	return result, errgo.Mask(iter.Error())
+}
+
+// keyID returns the long key ID for the given RFingerprint.
+func keyID(rfp string) string {
+	if len(rfp) > 16 {
+		rfp = rfp[:16]
+	}
+	return openpgp.Reverse(rfp)
+}
+
+func isWordSeparator(r rune) bool {
+	if !utf8.ValidRune(r) {
+		return true
+	}
+	if unicode.IsLetter(r) || unicode.IsNumber(r) {
+		return false
+	}
+	return true
+}
+
+// keywords returns a slice of searchable tokens extracted
+// from the given UserID packet keywords string.
+func keywords(key *openpgp.PrimaryKey) []string {
+	m := make(map[string]bool)
+	for _, uid := range key.UserIDs {
+		s := strings.ToLower(uid.Keywords)
+		lbr, rbr := strings.Index(s, "<"), strings.LastIndex(s, ">")
+		if lbr != -1 && rbr > lbr {
+			email := s[lbr+1 : rbr]
+			m[email] = true
+
+			parts := strings.SplitN(email, "@", 2)
+			if len(parts) > 1 {
+				username, domain := parts[0], parts[1]
+				m[username] = true
+				m[domain] = true
+			}
+		}
+		if lbr != -1 {
+			s = s[:lbr]
+		}
+		for _, field := range strings.FieldsFunc(s, isWordSeparator) {
+			m[field] = true
+		}
+	}
+	var result []string
+	for k := range m {
+		if k != "" {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+// searchWords returns the keywords which must all match for the given
+// search term.
+func searchWords(term string) []string {
+	var result []string
+	for _, part := range strings.Fields(strings.ToLower(term)) {
+		part = strings.TrimSuffix(strings.TrimPrefix(part, "<"), ">")
+		if strings.Contains(part, "@") || strings.Contains(part, ".") {
+			result = append(result, part)
+			continue
+		}
+		result = append(result, strings.FieldsFunc(part, isWordSeparator)...)
+	}
+	return result
+}
+
+func subkeys(key *openpgp.PrimaryKey) []string {
+	var result []string
+	for _, subkey := range key.SubKeys {
+		result = append(result, subkey.RFingerprint)
+	}
+	return result
+}
+
+// subkeyIDs returns the reversed key IDs of the subkeys which cannot be
+// matched by fingerprint prefix, as for v6 subkeys.
+func subkeyIDs(key *openpgp.PrimaryKey) []string {
+	var result []string
+	for _, subkey := range key.SubKeys {
+		if rkeyid := hkpstorage.SubKeyRKeyID(subkey); rkeyid != "" {
+			result = append(result, rkeyid)
+		}
+	}
+	return result
+}
+
+func (st *storage) Subscribe(f func(hkpstorage.KeyChange) error) {
+	st.mu.Lock()
+	st.listeners = append(st.listeners, f)
+	st.mu.Unlock()
+}
+
+func (st *storage) Notify(change hkpstorage.KeyChange) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	log.Debugf("%v", change)
+	for _, f := range st.listeners {
+		// TODO: log error notifying listener?
+		f(change)
+	}
+	return nil
+}
+
+func (st *storage) RenotifyAll() error {
+	iter := st.db.NewIterator(util.BytesPrefix(keyPrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var doc keyDoc
+		err := json.Unmarshal(iter.Value(), &doc)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		st.Notify(hkpstorage.KeyAdded{ID: keyID(doc.RFingerprint), Digest: doc.MD5})
+	}
+	return errgo.Mask(iter.Error())
+}
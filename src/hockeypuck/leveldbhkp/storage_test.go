@@ -0,0 +1,669 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package leveldbhkp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	stdtesting "testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/syndtr/goleveldb/leveldb"
+	ldbstorage "github.com/syndtr/goleveldb/leveldb/storage"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"hockeypuck/testing"
+
+	"hockeypuck/hkp"
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/storagetest"
+	"hockeypuck/openpgp"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type S struct {
+	storage *storage
+	srv     *httptest.Server
+}
+
+var _ = gc.Suite(&S{})
+
+func (s *S) SetUpTest(c *gc.C) {
+	db, err := leveldb.Open(ldbstorage.NewMemStorage(), nil)
+	c.Assert(err, gc.IsNil)
+	st, err := New(db)
+	c.Assert(err, gc.IsNil)
+	s.storage = st.(*storage)
+
+	r := httprouter.New()
+	handler, err := hkp.NewHandler(s.storage)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	s.srv = httptest.NewServer(r)
+}
+
+func (s *S) TearDownTest(c *gc.C) {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+	if s.storage != nil {
+		s.storage.Close()
+	}
+}
+
+func (s *S) addKey(c *gc.C, keyname string) {
+	keytext, err := ioutil.ReadAll(testing.MustInput(keyname))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(s.srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	defer res.Body.Close()
+	_, err = ioutil.ReadAll(res.Body)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *S) allKeyrings(c *gc.C, order hkpstorage.KeyringOrder, from hkpstorage.Checkpoint) []*hkpstorage.Keyring {
+	cur, err := s.storage.IterKeyrings(context.Background(), order, from)
+	c.Assert(err, gc.IsNil)
+	defer cur.Close()
+	var result []*hkpstorage.Keyring
+	for cur.Next() {
+		result = append(result, cur.Keyring())
+	}
+	c.Assert(cur.Err(), gc.IsNil)
+	return result
+}
+
+func (s *S) TestMD5(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=hget&search=da84f40d830a7be2a3c0b7f2e146bfaa")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	s.addKey(c, "sksdigest.asc")
+
+	keyrings := s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(keyrings, gc.HasLen, 1)
+	c.Assert(keyrings[0].MD5, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
+
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=hget&search=da84f40d830a7be2a3c0b7f2e146bfaa")
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].ShortID(), gc.Equals, "ce353cf4")
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "Jenny Ondioline <jennyo@transient.net>")
+}
+
+func (s *S) TestAddDuplicates(c *gc.C) {
+	for i := 0; i < 10; i++ {
+		s.addKey(c, "sksdigest.asc")
+	}
+
+	keyrings := s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(keyrings, gc.HasLen, 1)
+	c.Assert(keyrings[0].MD5, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
+}
+
+func (s *S) TestResolve(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x44a2d1db")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	s.addKey(c, "uat.asc")
+
+	// Should match
+	for _, search := range []string{
+		// short, long and full fingerprint key IDs match
+		"0x44a2d1db", "0xf79362da44a2d1db", "0x81279eee7ec89fb781702adaf79362da44a2d1db",
+
+		// subkeys
+		"0xdb769d16cdb9ad53", "0xe9ebaf4195c1826c", "0x6cdc23d76cba8ca9",
+
+		// full fingerprint subkeys
+		"0xb62a1252f26aebafee124e1fdb769d16cdb9ad53",
+		"0x5b28eca0cc5033df4f00038be9ebaf4195c1826c",
+		"0x313988d090243bb576b88b4f6cdc23d76cba8ca9",
+
+		// contiguous words, usernames, domains and email addresses match
+		"casey", "marshall", "casey+marshall", "cAseY+MArSHaLL",
+		"casey.marshall@gmail.com", "casey.marshall@gazzang.com",
+		"casey.marshall", "gmail.com",
+
+		// full textual IDs match
+		"Casey+Marshall+<casey.marshall@gmail.com>"} {
+		comment := gc.Commentf("search=%s", search)
+		res, err = http.Get(s.srv.URL + "/pks/lookup?op=get&search=" + search)
+		c.Assert(err, gc.IsNil, comment)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, comment)
+
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].ShortID(), gc.Equals, "44a2d1db")
+		c.Assert(keys[0].UserIDs, gc.HasLen, 2)
+		c.Assert(keys[0].UserAttributes, gc.HasLen, 1)
+		c.Assert(keys[0].UserIDs[0].Keywords, gc.Equals, "Casey Marshall <casey.marshall@gazzang.com>")
+	}
+
+	// Shouldn't match any of these
+	for _, search := range []string{
+		"0xdeadbeef", "0xce353cf4", "0xd1db", "44a2d1db", "0xadaf79362da44a2d1db",
+		"alice@example.com", "bob@example.com", "com", "casey+alice"} {
+		comment := gc.Commentf("search=%s", search)
+		res, err = http.Get(s.srv.URL + "/pks/lookup?op=get&search=" + search)
+		c.Assert(err, gc.IsNil, comment)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound, comment)
+	}
+
+	// An empty key ID is not a prefix of every key.
+	rfps, err := s.storage.Resolve([]string{""})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *S) TestResolveCollision(c *gc.C) {
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"subkey_collision/pubkey.asc", "subkey_collision/subkey.asc"} {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+	_, err := s.storage.Insert(keys)
+	c.Assert(err, gc.NotNil) // The collision files repeat a key.
+
+	for _, keyid := range []string{"8a7558a6cd80ea04", "cd80ea04"} {
+		rfps, err := s.storage.Resolve([]string{openpgp.Reverse(keyid)})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.HasLen, 2, gc.Commentf("keyid=%s", keyid))
+		c.Assert(rfps[0], gc.Not(gc.Equals), rfps[1])
+	}
+}
+
+func (s *S) TestResolveV3(c *gc.C) { storagetest.ResolveV3(c, s.storage) }
+
+func (s *S) TestMatchEmail(c *gc.C) { storagetest.MatchEmail(c, s.storage) }
+
+func (s *S) TestMatchWKD(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	s.addKey(c, "revok_orig.asc")
+	alice := hkpstorage.WKDHash("alice") + "@example.com"
+
+	rfps, err := s.storage.MatchWKD([]string{alice})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	// The index is kept when the key is updated.
+	s.addKey(c, "alice_signed.asc")
+	rfps, err = s.storage.MatchWKD([]string{alice, hkpstorage.WKDHash("alice") + "@example.org"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	_, err = s.storage.Delete(rfps[0])
+	c.Assert(err, gc.IsNil)
+	rfps, err = s.storage.MatchWKD([]string{alice})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *S) TestUIDStates(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	rfp := "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	mtime := time.Unix(1577836800, 0)
+
+	states, err := s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.HasLen, 0)
+
+	for _, state := range []hkpstorage.UIDState{hkpstorage.UIDPending, hkpstorage.UIDPublished} {
+		err = s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{
+			Email: "alice@example.com", State: state, Modified: mtime,
+		})
+		c.Assert(err, gc.IsNil)
+		states, err = s.storage.UIDStates(ctx, []string{rfp, "0000000000000000000000000000000000000000"})
+		c.Assert(err, gc.IsNil)
+		c.Assert(states, gc.HasLen, 1)
+		c.Assert(states[rfp], gc.HasLen, 1)
+		c.Assert(states[rfp][0].Email, gc.Equals, "alice@example.com")
+		c.Assert(states[rfp][0].State, gc.Equals, state)
+		c.Assert(states[rfp][0].Modified.Equal(mtime), gc.Equals, true)
+	}
+
+	err = s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{Email: "alice@example.com", State: hkpstorage.UIDUnpublished})
+	c.Assert(err, gc.IsNil)
+	states, err = s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.HasLen, 0)
+
+	err = s.storage.SetUIDState(ctx, "0000000000000000000000000000000000000000", hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPublished, Modified: mtime,
+	})
+	c.Assert(hkpstorage.IsNotFound(err), gc.Equals, true)
+
+	// Deleting a key forgets its user ID states.
+	err = s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPublished, Modified: mtime,
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = s.storage.Delete(rfp)
+	c.Assert(err, gc.IsNil)
+	s.addKey(c, "alice_unsigned.asc")
+	states, err = s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.HasLen, 0)
+}
+
+func (s *S) TestMerge(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	s.addKey(c, "alice_signed.asc")
+
+	keyrings := s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(keyrings, gc.HasLen, 1)
+	c.Assert(keyrings[0].MTime.After(keyrings[0].CTime), gc.Equals, true)
+
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=alice@example.com")
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].ShortID(), gc.Equals, "23e0dcca")
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs[0].Signatures, gc.HasLen, 2)
+
+	// The replaced digest no longer matches.
+	rfps, err := s.storage.MatchMD5([]string{keyrings[0].MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+	unsigned := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))
+	rfps, err = s.storage.MatchMD5([]string{unsigned[0].MD5})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *S) TestEd25519(c *gc.C) {
+	s.addKey(c, "e68e311d.asc")
+
+	for _, search := range []string{
+		// short, long and full fingerprint key IDs match
+		"0xe68e311d", "0x8d7c6b1a49166a46ff293af2d4236eabe68e311d",
+		// contiguous words and email addresses match
+		"casey", "marshall", "casey+marshall", "cAseY+MArSHaLL",
+		"cmars@cmarstech.com", "casey.marshall@canonical.com"} {
+		res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=" + search)
+		comment := gc.Commentf("search=%s", search)
+		c.Assert(err, gc.IsNil, comment)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, comment)
+
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].ShortID(), gc.Equals, "e68e311d")
+		c.Assert(keys[0].UserIDs, gc.HasLen, 2)
+		c.Assert(keys[0].Parsed, gc.Equals, true)
+	}
+}
+
+func (s *S) TestV6(c *gc.C) { storagetest.V6(c, s.storage) }
+
+func (s *S) TestUpdateConflict(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+
+	keyrings := s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(keyrings, gc.HasLen, 1)
+	key := keyrings[0].PrimaryKey
+	lastMD5 := key.MD5
+	signed := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+	c.Assert(signed, gc.HasLen, 1)
+	err := openpgp.Merge(key, signed[0])
+	c.Assert(err, gc.IsNil)
+
+	err = s.storage.Update(key, key.KeyID(), "00000000000000000000000000000000")
+	c.Assert(hkpstorage.IsConflict(err), gc.Equals, true)
+
+	err = s.storage.Update(key, key.KeyID(), lastMD5)
+	c.Assert(err, gc.IsNil)
+	keyrings = s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(keyrings[0].MD5, gc.Equals, key.MD5)
+}
+
+func (s *S) TestUpdateResolveSubkey(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+
+	keyrings := s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(keyrings, gc.HasLen, 1)
+	key := keyrings[0].PrimaryKey
+	c.Assert(key.SubKeys, gc.HasLen, 1)
+	rsubfp := key.SubKeys[0].RFingerprint
+	rfps, err := s.storage.Resolve([]string{rsubfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+
+	lastMD5 := key.MD5
+	err = openpgp.Merge(key, openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0])
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Update(key, key.KeyID(), lastMD5)
+	c.Assert(err, gc.IsNil)
+
+	// The subkey still resolves to the updated key.
+	rfps, err = s.storage.Resolve([]string{rsubfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint})
+}
+
+func (s *S) TestDelete(c *gc.C) {
+	s.addKey(c, "uat.asc")
+	s.addKey(c, "alice_unsigned.asc")
+
+	var removed []string
+	s.storage.Subscribe(func(kc hkpstorage.KeyChange) error {
+		removed = append(removed, kc.RemoveDigests()...)
+		return nil
+	})
+
+	rfps, err := s.storage.Resolve([]string{openpgp.Reverse("44a2d1db")})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+	md5, err := s.storage.Delete(rfps[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(removed, gc.DeepEquals, []string{md5})
+
+	_, err = s.storage.Delete(rfps[0])
+	c.Assert(hkpstorage.IsNotFound(err), gc.Equals, true)
+
+	for _, search := range []string{"0x44a2d1db", "0xdb769d16cdb9ad53", "casey"} {
+		res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=" + search)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound, gc.Commentf("search=%s", search))
+	}
+	c.Assert(s.allKeyrings(c, hkpstorage.ByMTime, hkpstorage.Checkpoint{}), gc.HasLen, 1)
+}
+
+func (s *S) TestSuppress(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	rfp := "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+
+	suppressed, err := s.storage.Suppressed(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+
+	err = s.storage.Suppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Suppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	suppressed, err = s.storage.Suppressed(ctx, []string{rfp, "0000000000000000000000000000000000000000"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.DeepEquals, []string{rfp})
+	suppressed, err = s.storage.ListSuppressed(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.DeepEquals, []string{rfp})
+
+	// Suppressed keys are not stored again once deleted.
+	_, err = s.storage.Delete(rfp)
+	c.Assert(err, gc.IsNil)
+	s.addKey(c, "alice_signed.asc")
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	// Until the suppression is lifted.
+	err = s.storage.Unsuppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Unsuppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	suppressed, err = s.storage.Suppressed(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+	suppressed, err = s.storage.ListSuppressed(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+	s.addKey(c, "alice_signed.asc")
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *S) TestModifiedSince(c *gc.C) {
+	start := time.Now()
+	s.addKey(c, "uat.asc")
+	s.addKey(c, "alice_unsigned.asc")
+
+	rfps, err := s.storage.ModifiedSince(start.Add(-time.Second))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 2)
+	// Most recently modified first.
+	c.Assert(rfps[0], gc.Equals, openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca"))
+
+	rfps, err = s.storage.ModifiedSince(time.Now())
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *S) TestIterKeyrings(c *gc.C) {
+	for _, name := range []string{"alice_unsigned.asc", "uat.asc", "e68e311d.asc"} {
+		s.addKey(c, name)
+	}
+
+	for _, order := range []hkpstorage.KeyringOrder{hkpstorage.ByRFingerprint, hkpstorage.ByMTime} {
+		comment := gc.Commentf("order=%v", order)
+		all := s.allKeyrings(c, order, hkpstorage.Checkpoint{})
+		c.Assert(all, gc.HasLen, 3, comment)
+		for _, kr := range all {
+			c.Assert(kr.Digest, gc.Equals, kr.MD5, comment)
+		}
+		for i := 1; i < len(all); i++ {
+			if order == hkpstorage.ByRFingerprint {
+				c.Assert(all[i-1].RFingerprint < all[i].RFingerprint, gc.Equals, true, comment)
+			} else {
+				c.Assert(all[i-1].MTime.After(all[i].MTime), gc.Equals, false, comment)
+			}
+		}
+
+		resumed := s.allKeyrings(c, order, hkpstorage.CheckpointOf(all[0]))
+		c.Assert(resumed, gc.HasLen, 2, comment)
+		c.Assert(resumed[0].RFingerprint, gc.Equals, all[1].RFingerprint, comment)
+		c.Assert(resumed[1].RFingerprint, gc.Equals, all[2].RFingerprint, comment)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cur, err := s.storage.IterKeyrings(ctx, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(err, gc.IsNil)
+	defer cur.Close()
+	c.Assert(cur.Next(), gc.Equals, true)
+	cancel()
+	c.Assert(cur.Next(), gc.Equals, false)
+	c.Assert(cur.Err(), gc.NotNil)
+}
+
+func (s *S) TestIterKeyringsUnreadable(c *gc.C) {
+	for _, name := range []string{"alice_unsigned.asc", "uat.asc", "e68e311d.asc"} {
+		s.addKey(c, name)
+	}
+	all := s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(all, gc.HasLen, 3)
+
+	// Store the packets of one key in the record of another, so that it
+	// cannot be read.
+	docs := make([]keyDoc, 2)
+	for i := range docs {
+		buf, err := s.storage.db.Get(keyKey(all[i].RFingerprint), nil)
+		c.Assert(err, gc.IsNil)
+		c.Assert(json.Unmarshal(buf, &docs[i]), gc.IsNil)
+	}
+	docs[1].Packets = docs[0].Packets
+	buf, err := json.Marshal(docs[1])
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.storage.db.Put(keyKey(all[1].RFingerprint), buf, nil), gc.IsNil)
+
+	for _, order := range []hkpstorage.KeyringOrder{hkpstorage.ByRFingerprint, hkpstorage.ByMTime} {
+		comment := gc.Commentf("order=%v", order)
+		rfps := make(map[string]bool)
+		for _, kr := range s.allKeyrings(c, order, hkpstorage.Checkpoint{}) {
+			rfps[kr.RFingerprint] = true
+		}
+		c.Assert(rfps, gc.DeepEquals, map[string]bool{
+			all[0].RFingerprint: true, all[2].RFingerprint: true,
+		}, comment)
+	}
+
+	// Iteration resumed after the unreadable record does not read it again.
+	cur, err := s.storage.IterKeyrings(context.Background(), hkpstorage.ByRFingerprint, hkpstorage.CheckpointOf(all[0]))
+	c.Assert(err, gc.IsNil)
+	defer cur.Close()
+	c.Assert(cur.Next(), gc.Equals, true)
+	c.Assert(cur.Keyring().RFingerprint, gc.Equals, all[2].RFingerprint)
+	c.Assert(cur.Next(), gc.Equals, false)
+	c.Assert(cur.Err(), gc.IsNil)
+	c.Assert(cur.Checkpoint().RFingerprint, gc.Equals, all[2].RFingerprint)
+}
+
+func (s *S) TestIterDigests(c *gc.C) {
+	for _, name := range []string{"alice_unsigned.asc", "uat.asc", "e68e311d.asc"} {
+		s.addKey(c, name)
+	}
+	want := make(map[string]string)
+	for _, kr := range s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{}) {
+		want[kr.RFingerprint] = kr.Digest
+	}
+
+	cur, err := s.storage.IterDigests(context.Background())
+	c.Assert(err, gc.IsNil)
+	defer cur.Close()
+	got := make(map[string]string)
+	for cur.Next() {
+		got[cur.Digest().RFingerprint] = cur.Digest().Digest
+	}
+	c.Assert(cur.Err(), gc.IsNil)
+	c.Assert(got, gc.DeepEquals, want)
+}
+
+func (s *S) TestImportKeyrings(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(keys, gc.HasLen, 1)
+	ctime := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	kr := &hkpstorage.Keyring{PrimaryKey: keys[0], CTime: ctime, MTime: mtime}
+
+	var added int
+	s.storage.Subscribe(func(change hkpstorage.KeyChange) error {
+		added++
+		return nil
+	})
+	n, err := s.storage.ImportKeyrings(context.Background(), []*hkpstorage.Keyring{kr})
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(added, gc.Equals, 0)
+
+	all := s.allKeyrings(c, hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(all, gc.HasLen, 1)
+	c.Assert(all[0].MD5, gc.Equals, keys[0].MD5)
+	c.Assert(all[0].CTime.Equal(ctime), gc.Equals, true)
+	c.Assert(all[0].MTime.Equal(mtime), gc.Equals, true)
+
+	n, err = s.storage.ImportKeyrings(context.Background(), []*hkpstorage.Keyring{kr})
+	c.Assert(n, gc.Equals, 0)
+	ie, ok := err.(hkpstorage.InsertError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(ie.Duplicates, gc.HasLen, 1)
+}
+
+func (s *S) TestRenotifyAll(c *gc.C) {
+	s.addKey(c, "uat.asc")
+	s.addKey(c, "alice_unsigned.asc")
+
+	var digests []string
+	s.storage.Subscribe(func(kc hkpstorage.KeyChange) error {
+		digests = append(digests, kc.InsertDigests()...)
+		return nil
+	})
+	err := s.storage.RenotifyAll()
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.HasLen, 2)
+}
+
+func (s *S) TestChanges(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	s.addKey(c, "alice_signed.asc")
+	rfp := openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	_, err := s.storage.Delete(rfp)
+	c.Assert(err, gc.IsNil)
+
+	changes, err := s.storage.Changes(ctx, "", 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.HasLen, 3)
+	for _, change := range changes {
+		c.Assert(change.RFingerprint, gc.Equals, rfp)
+	}
+	c.Assert(changes[0].Type, gc.Equals, hkpstorage.ChangeAdded)
+	c.Assert(changes[0].OldDigest, gc.Equals, "")
+	c.Assert(changes[1].Type, gc.Equals, hkpstorage.ChangeReplaced)
+	c.Assert(changes[1].OldDigest, gc.Equals, changes[0].NewDigest)
+	c.Assert(changes[2].Type, gc.Equals, hkpstorage.ChangeRemoved)
+	c.Assert(changes[2].OldDigest, gc.Equals, changes[1].NewDigest)
+	c.Assert(changes[2].NewDigest, gc.Equals, "")
+
+	page, err := s.storage.Changes(ctx, changes[0].Cursor, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(page, gc.DeepEquals, changes[1:2])
+	page, err = s.storage.Changes(ctx, changes[2].Cursor, 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(page, gc.HasLen, 0)
+
+	_, err = s.storage.Changes(ctx, "bogus", 100)
+	c.Assert(errgo.Cause(err), gc.Equals, hkpstorage.ErrInvalidCursor)
+
+	// Keys imported in bulk are not logged.
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("uat.asc"))
+	_, err = s.storage.ImportKeyrings(ctx, []*hkpstorage.Keyring{{PrimaryKey: keys[0], MTime: time.Now()}})
+	c.Assert(err, gc.IsNil)
+	page, err = s.storage.Changes(ctx, changes[2].Cursor, 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(page, gc.HasLen, 0)
+
+	// The log continues where it left off when reopened.
+	st, err := New(s.storage.db)
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.(*storage).changeSeq, gc.Equals, s.storage.changeSeq)
+}
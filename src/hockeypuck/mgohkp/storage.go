@@ -19,6 +19,8 @@ package mgohkp
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"strings"
 	"sync"
 	"time"
@@ -37,6 +39,9 @@ import (
 const (
 	defaultDBName         = "hkp"
 	defaultCollectionName = "keys"
+	maxResolveResults     = 100
+	maxEmailResults       = 100
+	keyringBatchSize      = 500
 )
 
 type storage struct {
@@ -48,6 +53,17 @@ type storage struct {
 }
 
 var _ hkpstorage.Storage = (*storage)(nil)
+var _ hkpstorage.KeyringImporter = (*storage)(nil)
+var _ hkpstorage.UIDPublisher = (*storage)(nil)
+var _ hkpstorage.Suppressor = (*storage)(nil)
+var _ hkpstorage.ChangeLogger = (*storage)(nil)
+var _ hkpstorage.DigestIterator = (*storage)(nil)
+
+// changeLogLag is how long a change must have been logged before it is read
+// from the log. Change IDs are allocated by clients, so a change read as soon
+// as it is visible could be followed by one with a lower ID from another
+// server, which a reader holding its cursor would miss.
+var changeLogLag = 5 * time.Second
 
 // Option defines a function that can configure the storage.
 type Option func(*storage) error
@@ -111,6 +127,18 @@ func (st *storage) createIndexes() error {
 		Unique: true,
 	}, {
 		Key: []string{"mtime"},
+	}, {
+		Key:    []string{"rkeyid"},
+		Sparse: true,
+	}, {
+		Key:    []string{"subkeyids"},
+		Sparse: true,
+	}, {
+		Key:        []string{"emails"},
+		Background: true,
+	}, {
+		Key:        []string{"wkd"},
+		Background: true,
 	}, {
 		Key:        []string{"keywords"},
 		Background: true,
@@ -133,6 +161,26 @@ func (st *storage) c() (*mgo.Session, *mgo.Collection) {
 	return session, session.DB(st.dbName).C(st.collectionName)
 }
 
+// cContext is like c, but returns the context's error if it is already done,
+// and bounds socket operations on the session by the context's deadline. The
+// mgo driver cannot interrupt an operation in progress, so cancellation is
+// only observed between operations.
+func (st *storage) cContext(ctx context.Context) (*mgo.Session, *mgo.Collection, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Any)
+	}
+	session, c := st.c()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			session.Close()
+			return nil, nil, errgo.Mask(context.DeadlineExceeded, errgo.Any)
+		}
+		session.SetSocketTimeout(timeout)
+	}
+	return session, c, nil
+}
+
 type keyDoc struct {
 	RFingerprint string   `bson:"rfingerprint"`
 	CTime        int64    `bson:"ctime"`
@@ -141,10 +189,41 @@ type keyDoc struct {
 	Packets      []byte   `bson:"packets"`
 	Keywords     []string `bson:"keywords"`
 	SubKeys      []string `bson:"subkeys"`
+
+	// RKeyID is only set for v3 and v6 keys, whose key IDs do not end
+	// their fingerprints.
+	RKeyID string `bson:"rkeyid,omitempty"`
+
+	// SubKeyIDs holds the reversed key IDs of v6 subkeys, which likewise
+	// cannot be matched by fingerprint.
+	SubKeyIDs []string `bson:"subkeyids,omitempty"`
+
+	// Emails holds the normalized email addresses of the key's user IDs.
+	Emails []string `bson:"emails,omitempty"`
+
+	// WKD holds the Web Key Directory addresses of the key's user IDs.
+	WKD []string `bson:"wkd,omitempty"`
+
+	// UIDStates records the publication states of the key's email
+	// addresses. Updates to the key leave it alone.
+	UIDStates []uidStateDoc `bson:"uidstates,omitempty"`
+}
+
+type uidStateDoc struct {
+	Email string `bson:"email"`
+	State string `bson:"state"`
+	MTime int64  `bson:"mtime"`
 }
 
 func (st *storage) MatchMD5(md5s []string) ([]string, error) {
-	session, c := st.c()
+	return st.MatchMD5Context(context.Background(), md5s)
+}
+
+func (st *storage) MatchMD5Context(ctx context.Context, md5s []string) ([]string, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
 	defer session.Close()
 
 	for i := range md5s {
@@ -158,7 +237,7 @@ func (st *storage) MatchMD5(md5s []string) ([]string, error) {
 	for iter.Next(&doc) {
 		result = append(result, doc.RFingerprint)
 	}
-	err := iter.Close()
+	err = iter.Close()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -167,50 +246,63 @@ func (st *storage) MatchMD5(md5s []string) ([]string, error) {
 
 // Resolve implements storage.Storage.
 //
-// Only v4 key IDs are resolved by this backend. v3 short and long key IDs
-// currently won't match.
+// v3 keys are only indexed by key ID when they are inserted or updated, so
+// those stored by earlier versions may only be found by fingerprint until
+// they next change.
 func (st *storage) Resolve(keyids []string) ([]string, error) {
-	session, c := st.c()
-	defer session.Close()
+	return st.ResolveContext(context.Background(), keyids)
+}
 
-	for i := range keyids {
-		keyids[i] = strings.ToLower(keyids[i])
+func (st *storage) ResolveContext(ctx context.Context, keyids []string) ([]string, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
 	}
-
-	var result []string
-	var doc keyDoc
+	defer session.Close()
 
 	var regexes []interface{}
 	for _, keyid := range keyids {
-		regexes = append(regexes, bson.RegEx{Pattern: "^" + keyid})
-	}
-
-	if len(regexes) > 0 {
-		iter := c.Find(bson.D{{Name: "rfingerprint", Value: bson.D{{Name: "$in", Value: regexes}}}}).Iter()
-		for iter.Next(&doc) {
-			result = append(result, doc.RFingerprint)
-		}
-		err := iter.Close()
-		if err != nil && err != mgo.ErrNotFound {
-			return nil, errgo.Mask(err)
-		}
-
-		iter = c.Find(bson.D{{Name: "subkeys", Value: bson.D{{Name: "$elemMatch", Value: bson.D{{Name: "$in", Value: regexes}}}}}}).Iter()
-		for iter.Next(&doc) {
-			result = append(result, doc.SubKeys...)
+		keyid = strings.ToLower(keyid)
+		if keyid == "" {
+			// An empty prefix would match every key.
+			continue
 		}
-		err = iter.Close()
-		if err != nil && err != mgo.ErrNotFound {
-			return nil, errgo.Mask(err)
+		if _, err := hex.DecodeString(keyid); err != nil {
+			return nil, errgo.Notef(err, "invalid key ID %q", keyid)
 		}
-
+		regexes = append(regexes, bson.RegEx{Pattern: "^" + keyid})
+	}
+	if len(regexes) == 0 {
+		return nil, nil
 	}
 
+	var result []string
+	var doc keyDoc
+	iter := c.Find(bson.D{{Name: "$or", Value: []bson.D{
+		{{Name: "rfingerprint", Value: bson.D{{Name: "$in", Value: regexes}}}},
+		{{Name: "rkeyid", Value: bson.D{{Name: "$in", Value: regexes}}}},
+		{{Name: "subkeys", Value: bson.D{{Name: "$in", Value: regexes}}}},
+		{{Name: "subkeyids", Value: bson.D{{Name: "$in", Value: regexes}}}},
+	}}}).Select(bson.D{{Name: "rfingerprint", Value: 1}}).Limit(maxResolveResults).Iter()
+	for iter.Next(&doc) {
+		result = append(result, doc.RFingerprint)
+	}
+	err = iter.Close()
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Mask(err)
+	}
 	return result, nil
 }
 
 func (st *storage) MatchKeyword(keywords []string) ([]string, error) {
-	session, c := st.c()
+	return st.MatchKeywordContext(context.Background(), keywords)
+}
+
+func (st *storage) MatchKeywordContext(ctx context.Context, keywords []string) ([]string, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
 	defer session.Close()
 
 	// Split these on spaces, to support multiple-word searches.
@@ -231,7 +323,104 @@ func (st *storage) MatchKeyword(keywords []string) ([]string, error) {
 	for iter.Next(&doc) {
 		result = append(result, doc.RFingerprint)
 	}
-	err := iter.Close()
+	err = iter.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// MatchEmail implements storage.Storage.
+//
+// Keys with indexed emails are matched exactly by the query. Keys stored
+// before emails were indexed are found by their keywords, which include the
+// lower-cased email address, and then checked for an exact match; those which
+// cannot be read are skipped.
+func (st *storage) MatchEmail(emails []string) ([]string, error) {
+	return st.MatchEmailContext(context.Background(), emails)
+}
+
+func (st *storage) MatchEmailContext(ctx context.Context, emails []string) ([]string, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	want := make(map[string]bool)
+	var keywords []string
+	for _, email := range emails {
+		want[email] = true
+		keywords = append(keywords, strings.ToLower(email))
+	}
+	matches := func(found []string) bool {
+		for _, email := range found {
+			if want[email] {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Keyword matches may not be exact, so the number of results is limited
+	// after they have been checked rather than in the query.
+	var result []string
+	iter := c.Find(bson.D{{Name: "$or", Value: []bson.D{
+		{{Name: "emails", Value: bson.D{{Name: "$in", Value: emails}}}},
+		{
+			{Name: "emails", Value: bson.D{{Name: "$exists", Value: false}}},
+			{Name: "keywords", Value: bson.D{{Name: "$in", Value: keywords}}},
+		},
+	}}}).Iter()
+	for len(result) < maxEmailResults {
+		var doc keyDoc
+		if !iter.Next(&doc) {
+			break
+		}
+		if doc.Emails == nil {
+			pubkey, err := readOneKey(doc.Packets, doc.RFingerprint)
+			if err != nil {
+				log.Warningf("skipping unreadable key rfp=%q: %v", doc.RFingerprint, err)
+				continue
+			} else if pubkey == nil {
+				continue
+			}
+			if !matches(hkpstorage.Emails(pubkey)) {
+				continue
+			}
+		}
+		result = append(result, doc.RFingerprint)
+	}
+	err = iter.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// MatchWKD implements storage.Storage.
+//
+// Web Key Directory addresses cannot be derived from keywords, so keys stored
+// before they were indexed are only found once they are next updated.
+func (st *storage) MatchWKD(wkds []string) ([]string, error) {
+	return st.MatchWKDContext(context.Background(), wkds)
+}
+
+func (st *storage) MatchWKDContext(ctx context.Context, wkds []string) ([]string, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	var result []string
+	var doc keyDoc
+	iter := c.Find(bson.D{{Name: "wkd", Value: bson.D{{Name: "$in", Value: wkds}}}}).
+		Select(bson.D{{Name: "rfingerprint", Value: 1}}).Limit(100).Iter()
+	for iter.Next(&doc) {
+		result = append(result, doc.RFingerprint)
+	}
+	err = iter.Close()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -239,7 +428,14 @@ func (st *storage) MatchKeyword(keywords []string) ([]string, error) {
 }
 
 func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
-	session, c := st.c()
+	return st.ModifiedSinceContext(context.Background(), t)
+}
+
+func (st *storage) ModifiedSinceContext(ctx context.Context, t time.Time) ([]string, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
 	defer session.Close()
 
 	var result []string
@@ -249,7 +445,7 @@ func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
 	for iter.Next(&doc) {
 		result = append(result, doc.RFingerprint)
 	}
-	err := iter.Close()
+	err = iter.Close()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -257,7 +453,14 @@ func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
 }
 
 func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
-	session, c := st.c()
+	return st.FetchKeysContext(context.Background(), rfps)
+}
+
+func (st *storage) FetchKeysContext(ctx context.Context, rfps []string) ([]*openpgp.PrimaryKey, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
 	defer session.Close()
 
 	for i := range rfps {
@@ -277,7 +480,7 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 		fps[pubkey.RFingerprint] = true
 		result = append(result, pubkey)
 	}
-	err := iter.Close()
+	err = iter.Close()
 	if err != nil && err != mgo.ErrNotFound {
 		return nil, errgo.Mask(err)
 	}
@@ -304,7 +507,14 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 }
 
 func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
-	session, c := st.c()
+	return st.FetchKeyringsContext(context.Background(), rfps)
+}
+
+func (st *storage) FetchKeyringsContext(ctx context.Context, rfps []string) ([]*hkpstorage.Keyring, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
 	defer session.Close()
 
 	for i := range rfps {
@@ -324,15 +534,156 @@ func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
 			PrimaryKey: pubkey,
 			CTime:      time.Unix(doc.CTime, 0),
 			MTime:      time.Unix(doc.MTime, 0),
+			Digest:     doc.MD5,
 		})
 	}
-	err := iter.Close()
+	err = iter.Close()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return result, nil
 }
 
+// IterKeyrings implements storage.Storage.
+func (st *storage) IterKeyrings(ctx context.Context, order hkpstorage.KeyringOrder, from hkpstorage.Checkpoint) (hkpstorage.KeyringCursor, error) {
+	var q bson.D
+	var sort []string
+	switch order {
+	case hkpstorage.ByRFingerprint:
+		q = bson.D{{Name: "rfingerprint", Value: bson.D{{Name: "$gt", Value: from.RFingerprint}}}}
+		sort = []string{"rfingerprint"}
+	case hkpstorage.ByMTime:
+		mtime := from.MTime.Unix()
+		q = bson.D{{Name: "$or", Value: []bson.D{
+			{{Name: "mtime", Value: bson.D{{Name: "$gt", Value: mtime}}}},
+			{{Name: "mtime", Value: mtime}, {Name: "rfingerprint", Value: bson.D{{Name: "$gt", Value: from.RFingerprint}}}},
+		}}}
+		sort = []string{"mtime", "rfingerprint"}
+	default:
+		return nil, errgo.Newf("unsupported keyring order %v", order)
+	}
+
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	iter := c.Find(q).Sort(sort...).Batch(keyringBatchSize).Iter()
+	return &keyringCursor{ctx: ctx, session: session, iter: iter, cp: from}, nil
+}
+
+type keyringCursor struct {
+	ctx     context.Context
+	session *mgo.Session
+	iter    *mgo.Iter
+	cur     *hkpstorage.Keyring
+	cp      hkpstorage.Checkpoint
+	err     error
+}
+
+func (c *keyringCursor) Next() bool {
+	c.cur = nil
+	if c.err != nil {
+		return false
+	}
+	if err := c.ctx.Err(); err != nil {
+		c.err = errgo.Mask(err, errgo.Any)
+		return false
+	}
+	var doc keyDoc
+	for c.iter.Next(&doc) {
+		pubkey, err := readOneKey(doc.Packets, doc.RFingerprint)
+		if err != nil {
+			// Move past the record, so that iteration resumed from the
+			// checkpoint does not read it again.
+			log.Warningf("skipping unreadable keyring rfp=%q: %v", doc.RFingerprint, err)
+			c.cp = hkpstorage.Checkpoint{RFingerprint: doc.RFingerprint, MTime: time.Unix(doc.MTime, 0)}
+			continue
+		} else if pubkey == nil {
+			continue
+		}
+		c.cur = &hkpstorage.Keyring{
+			PrimaryKey: pubkey,
+			CTime:      time.Unix(doc.CTime, 0),
+			MTime:      time.Unix(doc.MTime, 0),
+			Digest:     doc.MD5,
+		}
+		c.cp = hkpstorage.CheckpointOf(c.cur)
+		return true
+	}
+	if err := c.iter.Err(); err != nil {
+		c.err = errgo.Mask(err)
+	}
+	return false
+}
+
+func (c *keyringCursor) Keyring() *hkpstorage.Keyring { return c.cur }
+
+func (c *keyringCursor) Checkpoint() hkpstorage.Checkpoint { return c.cp }
+
+func (c *keyringCursor) Err() error { return c.err }
+
+func (c *keyringCursor) Close() error {
+	err := c.iter.Close()
+	c.session.Close()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// IterDigests implements storage.DigestIterator. Only the fingerprints and
+// digests of key documents are read.
+func (st *storage) IterDigests(ctx context.Context) (hkpstorage.DigestCursor, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	iter := c.Find(nil).Select(bson.D{{Name: "rfingerprint", Value: 1}, {Name: "md5", Value: 1}}).
+		Batch(keyringBatchSize).Iter()
+	return &digestCursor{ctx: ctx, session: session, iter: iter}, nil
+}
+
+type digestCursor struct {
+	ctx     context.Context
+	session *mgo.Session
+	iter    *mgo.Iter
+	cur     hkpstorage.KeyringDigest
+	err     error
+}
+
+func (c *digestCursor) Next() bool {
+	c.cur = hkpstorage.KeyringDigest{}
+	if c.err != nil {
+		return false
+	}
+	if err := c.ctx.Err(); err != nil {
+		c.err = errgo.Mask(err, errgo.Any)
+		return false
+	}
+	var doc keyDoc
+	if !c.iter.Next(&doc) {
+		if err := c.iter.Err(); err != nil {
+			c.err = errgo.Mask(err)
+		}
+		return false
+	}
+	c.cur = hkpstorage.KeyringDigest{RFingerprint: doc.RFingerprint, Digest: doc.MD5}
+	return true
+}
+
+func (c *digestCursor) Digest() hkpstorage.KeyringDigest { return c.cur }
+
+func (c *digestCursor) Err() error { return c.err }
+
+func (c *digestCursor) Close() error {
+	err := c.iter.Close()
+	c.session.Close()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
 func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
 	kr := openpgp.NewKeyReader(bytes.NewBuffer(b))
 	keys, err := kr.Read()
@@ -352,33 +703,31 @@ func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
 }
 
 func (st *storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
-	session, c := st.c()
+	return st.InsertContext(context.Background(), keys)
+}
+
+func (st *storage) InsertContext(ctx context.Context, keys []*openpgp.PrimaryKey) (int, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
 	defer session.Close()
 
 	var n int
 	var result hkpstorage.InsertError
 	for _, key := range keys {
-		openpgp.Sort(key)
-
-		var buf bytes.Buffer
-		err := openpgp.WritePackets(&buf, key)
-		if err != nil {
-			result.Errors = append(result.Errors, errgo.Notef(err, "cannot serialize rfp=%q", key.RFingerprint))
-			continue
+		if err := ctx.Err(); err != nil {
+			result.Errors = append(result.Errors, errgo.Mask(err, errgo.Any))
+			return n, result
 		}
-
 		now := time.Now().Unix()
-		doc := keyDoc{
-			CTime:        now,
-			MTime:        now,
-			RFingerprint: key.RFingerprint,
-			MD5:          key.MD5,
-			Keywords:     keywords(key),
-			Packets:      buf.Bytes(),
-			SubKeys:      subkeys(key),
+		doc, err := newKeyDoc(key, now, now)
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
 		}
 
-		err = c.Insert(&doc)
+		err = c.Insert(doc)
 		if err != nil {
 			if mgo.IsDup(err) {
 				result.Duplicates = append(result.Duplicates, key)
@@ -387,9 +736,11 @@ func (st *storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
 			}
 			continue
 		}
+		st.logChange(session, key.RFingerprint, hkpstorage.ChangeAdded, "", key.MD5)
 		st.Notify(hkpstorage.KeyAdded{
-			ID:     key.KeyID(),
-			Digest: key.MD5,
+			ID:           key.KeyID(),
+			Digest:       key.MD5,
+			RFingerprint: key.RFingerprint,
 		})
 		n++
 	}
@@ -400,7 +751,76 @@ func (st *storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
 	return n, nil
 }
 
+// ImportKeyrings implements storage.KeyringImporter.
+func (st *storage) ImportKeyrings(ctx context.Context, keyrings []*hkpstorage.Keyring) (int, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	var n int
+	var result hkpstorage.InsertError
+	for _, kr := range keyrings {
+		if err := ctx.Err(); err != nil {
+			result.Errors = append(result.Errors, errgo.Mask(err, errgo.Any))
+			return n, result
+		}
+		doc, err := newKeyDoc(kr.PrimaryKey, kr.CTime.Unix(), kr.MTime.Unix())
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		if kr.Digest != "" {
+			doc.MD5 = kr.Digest
+		}
+
+		err = c.Insert(doc)
+		if err != nil {
+			if mgo.IsDup(err) {
+				result.Duplicates = append(result.Duplicates, kr.PrimaryKey)
+			} else {
+				result.Errors = append(result.Errors, errgo.Notef(err, "cannot insert rfp=%q", kr.RFingerprint))
+			}
+			continue
+		}
+		n++
+	}
+
+	if len(result.Duplicates) > 0 || len(result.Errors) > 0 {
+		return n, result
+	}
+	return n, nil
+}
+
+func newKeyDoc(key *openpgp.PrimaryKey, ctime, mtime int64) (*keyDoc, error) {
+	openpgp.Sort(key)
+
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot serialize rfp=%q", key.RFingerprint)
+	}
+	return &keyDoc{
+		CTime:        ctime,
+		MTime:        mtime,
+		RFingerprint: key.RFingerprint,
+		MD5:          key.MD5,
+		Keywords:     keywords(key),
+		Packets:      buf.Bytes(),
+		SubKeys:      subkeys(key),
+		RKeyID:       hkpstorage.V3RKeyID(key),
+		SubKeyIDs:    subkeyIDs(key),
+		Emails:       hkpstorage.Emails(key),
+		WKD:          hkpstorage.WKDAddresses(key),
+	}, nil
+}
+
 func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
+	return st.UpdateContext(context.Background(), key, lastID, lastMD5)
+}
+
+func (st *storage) UpdateContext(ctx context.Context, key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
 	openpgp.Sort(key)
 
 	var buf bytes.Buffer
@@ -410,38 +830,328 @@ func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string
 	}
 
 	now := time.Now().Unix()
-	update := bson.D{{Name: "$set", Value: bson.D{
+	set := bson.D{
 		{Name: "mtime", Value: now},
 		{Name: "md5", Value: key.MD5},
 		{Name: "keywords", Value: keywords(key)},
 		{Name: "packets", Value: buf.Bytes()},
 		{Name: "subkeys", Value: subkeys(key)},
-	}}}
+		{Name: "subkeyids", Value: subkeyIDs(key)},
+		{Name: "emails", Value: hkpstorage.Emails(key)},
+		{Name: "wkd", Value: hkpstorage.WKDAddresses(key)},
+	}
+	if rkeyid := hkpstorage.V3RKeyID(key); rkeyid != "" {
+		set = append(set, bson.DocElem{Name: "rkeyid", Value: rkeyid})
+	}
+	update := bson.D{{Name: "$set", Value: set}}
 
-	session, c := st.c()
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
 	defer session.Close()
 
 	var doc keyDoc
-	info, err := c.Find(bson.D{{Name: "md5", Value: lastMD5}}).Apply(mgo.Change{
+	info, err := c.Find(bson.D{
+		{Name: "rfingerprint", Value: key.RFingerprint},
+		{Name: "md5", Value: lastMD5},
+	}).Apply(mgo.Change{
 		Update: update,
 	}, &doc)
-	if err != nil {
+	if err == mgo.ErrNotFound || (err == nil && info.Updated == 0) {
+		return errgo.WithCausef(nil, hkpstorage.ErrConflict,
+			"failed to update rfp=%q, didn't match lastMD5=%q", key.RFingerprint, lastMD5)
+	} else if err != nil {
 		return errgo.Mask(err)
 	}
-	if info.Updated == 0 {
-		return errgo.Newf("failed to update md5=%q, didn't match lastMD5=%q",
-			key.MD5, lastMD5)
-	}
 
+	st.logChange(session, key.RFingerprint, hkpstorage.ChangeReplaced, lastMD5, key.MD5)
 	st.Notify(hkpstorage.KeyReplaced{
 		OldID:     lastID,
 		OldDigest: lastMD5,
 		NewID:     key.KeyID(),
 		NewDigest: key.MD5,
+
+		RFingerprint: key.RFingerprint,
+	})
+	return nil
+}
+
+func (st *storage) Delete(rfp string) (string, error) {
+	return st.DeleteContext(context.Background(), rfp)
+}
+
+func (st *storage) DeleteContext(ctx context.Context, rfp string) (string, error) {
+	rfp = strings.ToLower(rfp)
+
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	var doc keyDoc
+	_, err = c.Find(bson.D{{Name: "rfingerprint", Value: rfp}}).Apply(mgo.Change{
+		Remove: true,
+	}, &doc)
+	if err == mgo.ErrNotFound {
+		return "", errgo.WithCausef(nil, hkpstorage.ErrKeyNotFound, "rfp=%q", rfp)
+	} else if err != nil {
+		return "", errgo.Mask(err)
+	}
+
+	st.logChange(session, rfp, hkpstorage.ChangeRemoved, doc.MD5, "")
+	st.Notify(hkpstorage.KeyRemoved{
+		ID:           keyID(rfp),
+		Digest:       doc.MD5,
+		RFingerprint: rfp,
 	})
+	return doc.MD5, nil
+}
+
+// UIDStates implements storage.UIDPublisher.
+func (st *storage) UIDStates(ctx context.Context, rfps []string) (map[string][]hkpstorage.UIDStatus, error) {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	result := make(map[string][]hkpstorage.UIDStatus)
+	iter := c.Find(bson.D{
+		{Name: "rfingerprint", Value: bson.D{{Name: "$in", Value: rfps}}},
+		{Name: "uidstates", Value: bson.D{{Name: "$exists", Value: true}}},
+	}).Select(bson.D{
+		{Name: "rfingerprint", Value: 1},
+		{Name: "uidstates", Value: 1},
+	}).Iter()
+	for {
+		var doc keyDoc
+		if !iter.Next(&doc) {
+			break
+		}
+		for _, state := range doc.UIDStates {
+			result[doc.RFingerprint] = append(result[doc.RFingerprint], hkpstorage.UIDStatus{
+				Email:    state.Email,
+				State:    hkpstorage.UIDState(state.State),
+				Modified: time.Unix(state.MTime, 0).UTC(),
+			})
+		}
+	}
+	err = iter.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// SetUIDState implements storage.UIDPublisher. The previous state is removed
+// before the new one is added, so a concurrent reader may briefly see
+// neither.
+func (st *storage) SetUIDState(ctx context.Context, rfp string, status hkpstorage.UIDStatus) error {
+	session, c, err := st.cContext(ctx)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	err = c.Update(bson.D{{Name: "rfingerprint", Value: rfp}}, bson.D{{Name: "$pull", Value: bson.D{
+		{Name: "uidstates", Value: bson.D{{Name: "email", Value: status.Email}}},
+	}}})
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, hkpstorage.ErrKeyNotFound, "rfp=%q", rfp)
+	} else if err != nil {
+		return errgo.Mask(err)
+	}
+	if status.State == hkpstorage.UIDUnpublished {
+		return nil
+	}
+	err = c.Update(bson.D{{Name: "rfingerprint", Value: rfp}}, bson.D{{Name: "$push", Value: bson.D{
+		{Name: "uidstates", Value: uidStateDoc{
+			Email: status.Email,
+			State: string(status.State),
+			MTime: status.Modified.Unix(),
+		}},
+	}}})
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, hkpstorage.ErrKeyNotFound, "rfp=%q", rfp)
+	}
+	return errgo.Mask(err)
+}
+
+// suppressed returns the collection recording suppressed keys, named after
+// the key collection.
+func (st *storage) suppressed(session *mgo.Session) *mgo.Collection {
+	return session.DB(st.dbName).C(st.collectionName + "_suppressed")
+}
+
+// Suppress implements storage.Suppressor.
+func (st *storage) Suppress(ctx context.Context, rfp string) error {
+	session, _, err := st.cContext(ctx)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	rfp = strings.ToLower(rfp)
+	_, err = st.suppressed(session).UpsertId(rfp, bson.D{{Name: "$setOnInsert", Value: bson.D{
+		{Name: "ctime", Value: time.Now().Unix()},
+	}}})
+	return errgo.Mask(err)
+}
+
+// Unsuppress implements storage.Suppressor.
+func (st *storage) Unsuppress(ctx context.Context, rfp string) error {
+	session, _, err := st.cContext(ctx)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	err = st.suppressed(session).RemoveId(strings.ToLower(rfp))
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Mask(err)
+	}
 	return nil
 }
 
+// Suppressed implements storage.Suppressor.
+func (st *storage) Suppressed(ctx context.Context, rfps []string) ([]string, error) {
+	session, _, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	var lower []string
+	for _, rfp := range rfps {
+		lower = append(lower, strings.ToLower(rfp))
+	}
+	var result []string
+	iter := st.suppressed(session).Find(bson.D{
+		{Name: "_id", Value: bson.D{{Name: "$in", Value: lower}}},
+	}).Iter()
+	for {
+		var doc struct {
+			RFingerprint string `bson:"_id"`
+		}
+		if !iter.Next(&doc) {
+			break
+		}
+		result = append(result, doc.RFingerprint)
+	}
+	err = iter.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// ListSuppressed implements storage.Suppressor.
+func (st *storage) ListSuppressed(ctx context.Context) ([]string, error) {
+	session, _, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	var result []string
+	iter := st.suppressed(session).Find(nil).Sort("_id").Iter()
+	for {
+		var doc struct {
+			RFingerprint string `bson:"_id"`
+		}
+		if !iter.Next(&doc) {
+			break
+		}
+		result = append(result, doc.RFingerprint)
+	}
+	err = iter.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// changes returns the collection logging key changes, named after the key
+// collection.
+func (st *storage) changes(session *mgo.Session) *mgo.Collection {
+	return session.DB(st.dbName).C(st.collectionName + "_changes")
+}
+
+type changeDoc struct {
+	ID           bson.ObjectId `bson:"_id"`
+	RFingerprint string        `bson:"rfingerprint"`
+	Change       string        `bson:"change"`
+	OldMD5       string        `bson:"oldmd5,omitempty"`
+	NewMD5       string        `bson:"newmd5,omitempty"`
+	CTime        int64         `bson:"ctime"`
+}
+
+// logChange records a change to the given key in the change log. MongoDB
+// cannot make this atomic with the change itself, so a failure to log it is
+// reported but does not fail the change.
+func (st *storage) logChange(session *mgo.Session, rfp string, change hkpstorage.ChangeType, oldMD5, newMD5 string) {
+	err := st.changes(session).Insert(&changeDoc{
+		ID:           bson.NewObjectId(),
+		RFingerprint: rfp,
+		Change:       string(change),
+		OldMD5:       oldMD5,
+		NewMD5:       newMD5,
+		CTime:        time.Now().Unix(),
+	})
+	if err != nil {
+		log.Errorf("cannot log %s change to rfp=%q: %v", change, rfp, err)
+	}
+}
+
+// Changes implements storage.ChangeLogger. Cursors are change ObjectIds in
+// hex.
+func (st *storage) Changes(ctx context.Context, cursor string, limit int) ([]hkpstorage.Change, error) {
+	if cursor != "" && !bson.IsObjectIdHex(cursor) {
+		return nil, errgo.WithCausef(nil, hkpstorage.ErrInvalidCursor, "cursor=%q", cursor)
+	}
+	session, _, err := st.cContext(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer session.Close()
+
+	idRange := bson.D{{Name: "$lt", Value: bson.NewObjectIdWithTime(time.Now().Add(-changeLogLag))}}
+	if cursor != "" {
+		idRange = append(idRange, bson.DocElem{Name: "$gt", Value: bson.ObjectIdHex(cursor)})
+	}
+	var result []hkpstorage.Change
+	iter := st.changes(session).Find(bson.D{{Name: "_id", Value: idRange}}).Sort("_id").Limit(limit).Iter()
+	for {
+		var doc changeDoc
+		if !iter.Next(&doc) {
+			break
+		}
+		result = append(result, hkpstorage.Change{
+			Cursor:       doc.ID.Hex(),
+			RFingerprint: doc.RFingerprint,
+			Type:         hkpstorage.ChangeType(doc.Change),
+			OldDigest:    doc.OldMD5,
+			NewDigest:    doc.NewMD5,
+			Time:         time.Unix(doc.CTime, 0).UTC(),
+		})
+	}
+	err = iter.Close()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// keyID returns the long key ID for the given RFingerprint.
+func keyID(rfp string) string {
+	if len(rfp) > 16 {
+		rfp = rfp[:16]
+	}
+	return openpgp.Reverse(rfp)
+}
+
 // keywords returns a slice of searchable tokens extracted
 // from the given UserID packet keywords string.
 func keywords(key *openpgp.PrimaryKey) []string {
@@ -482,6 +1192,18 @@ func subkeys(key *openpgp.PrimaryKey) []string {
 	return result
 }
 
+// subkeyIDs returns the reversed key IDs of the subkeys which cannot be
+// matched by fingerprint prefix, as for v6 subkeys.
+func subkeyIDs(key *openpgp.PrimaryKey) []string {
+	var result []string
+	for _, subkey := range key.SubKeys {
+		if rkeyid := hkpstorage.SubKeyRKeyID(subkey); rkeyid != "" {
+			result = append(result, rkeyid)
+		}
+	}
+	return result
+}
+
 func (st *storage) Subscribe(f func(hkpstorage.KeyChange) error) {
 	st.mu.Lock()
 	st.listeners = append(st.listeners, f)
@@ -19,20 +19,26 @@ package mgohkp
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	stdtesting "testing"
+	"time"
 
 	"github.com/facebookgo/mgotest"
 	"github.com/julienschmidt/httprouter"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"hockeypuck/hkp"
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/storagetest"
 	"hockeypuck/openpgp"
 	"hockeypuck/testing"
 )
@@ -132,6 +138,36 @@ func (s *MgoSuite) TestAddDuplicates(c *gc.C) {
 	c.Assert(n, gc.Equals, 1)
 }
 
+func (s *MgoSuite) TestResolveV3(c *gc.C) { storagetest.ResolveV3(c, s.storage) }
+
+func (s *MgoSuite) TestResolveV6(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("v6_ed25519.asc"))
+	c.Assert(keys, gc.HasLen, 1)
+	key := keys[0]
+	_, err := s.storage.Insert(keys)
+	c.Assert(err, gc.IsNil)
+
+	subKey := key.SubKeys[0]
+	for _, keyid := range []string{key.RFingerprint, key.RKeyID, key.RShortID, subKey.RFingerprint, subKey.RKeyID, subKey.RShortID} {
+		rfps, err := s.storage.Resolve([]string{keyid})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.DeepEquals, []string{key.RFingerprint}, gc.Commentf("keyid=%s", keyid))
+	}
+}
+
+func (s *MgoSuite) TestResolveCollision(c *gc.C) {
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"subkey_collision/pubkey.asc", "subkey_collision/subkey.asc"} {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+	s.storage.Insert(keys)
+
+	rfps, err := s.storage.Resolve([]string{openpgp.Reverse("8a7558a6cd80ea04")})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 2)
+	c.Assert(rfps[0], gc.Not(gc.Equals), rfps[1])
+}
+
 func (s *MgoSuite) TestResolve(c *gc.C) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x44a2d1db")
 	c.Assert(err, gc.IsNil)
@@ -181,6 +217,170 @@ func (s *MgoSuite) TestResolve(c *gc.C) {
 	}
 }
 
+func (s *MgoSuite) TestMatchEmail(c *gc.C) { storagetest.MatchEmail(c, s.storage) }
+
+func (s *MgoSuite) TestMatchEmailKeywords(c *gc.C) {
+	session, coll := s.storage.c()
+	defer session.Close()
+	// Keys whose emails only match by keyword are not counted towards the
+	// limit, and legacy keys which cannot be read are skipped.
+	for i := 0; i < 150; i++ {
+		err := coll.Insert(&keyDoc{
+			RFingerprint: fmt.Sprintf("%040x", i),
+			Keywords:     []string{"alice@example.com"},
+			Emails:       []string{"alice@example.org"},
+		})
+		c.Assert(err, gc.IsNil)
+	}
+	err := coll.Insert(&keyDoc{
+		RFingerprint: fmt.Sprintf("%040x", 150),
+		Packets:      []byte("not a key"),
+		Keywords:     []string{"alice@example.com"},
+	})
+	c.Assert(err, gc.IsNil)
+	s.addKey(c, "alice_unsigned.asc")
+
+	rfps, err := s.storage.MatchEmail([]string{"alice@example.com"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+}
+
+func (s *MgoSuite) TestV6(c *gc.C) { storagetest.V6(c, s.storage) }
+
+func (s *MgoSuite) TestMatchWKD(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	s.addKey(c, "revok_orig.asc")
+	alice := hkpstorage.WKDHash("alice") + "@example.com"
+
+	rfps, err := s.storage.MatchWKD([]string{alice})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	// The index is kept when the key is updated.
+	s.addKey(c, "alice_signed.asc")
+	rfps, err = s.storage.MatchWKD([]string{alice, hkpstorage.WKDHash("alice") + "@example.org"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	_, err = s.storage.Delete(rfps[0])
+	c.Assert(err, gc.IsNil)
+	rfps, err = s.storage.MatchWKD([]string{alice})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *MgoSuite) TestUIDStates(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	rfp := "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	mtime := time.Unix(1577836800, 0)
+
+	err := s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPending, Modified: mtime,
+	})
+	c.Assert(err, gc.IsNil)
+	states, err := s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states[rfp], gc.HasLen, 1)
+	c.Assert(states[rfp][0].State, gc.Equals, hkpstorage.UIDPending)
+	c.Assert(states[rfp][0].Modified.Equal(mtime), gc.Equals, true)
+
+	err = s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPublished, Modified: mtime,
+	})
+	c.Assert(err, gc.IsNil)
+	states, err = s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states[rfp], gc.HasLen, 1)
+	c.Assert(states[rfp][0].State, gc.Equals, hkpstorage.UIDPublished)
+
+	err = s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{Email: "alice@example.com", State: hkpstorage.UIDUnpublished})
+	c.Assert(err, gc.IsNil)
+	states, err = s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.HasLen, 0)
+
+	err = s.storage.SetUIDState(ctx, "0000000000000000000000000000000000000000", hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPublished, Modified: mtime,
+	})
+	c.Assert(hkpstorage.IsNotFound(err), gc.Equals, true)
+}
+
+func (s *MgoSuite) TestSuppress(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	rfp := "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+
+	suppressed, err := s.storage.Suppressed(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+
+	err = s.storage.Suppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Suppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	suppressed, err = s.storage.Suppressed(ctx, []string{rfp, "0000000000000000000000000000000000000000"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.DeepEquals, []string{rfp})
+	suppressed, err = s.storage.ListSuppressed(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.DeepEquals, []string{rfp})
+
+	// Suppressed keys are not stored again once deleted.
+	_, err = s.storage.Delete(rfp)
+	c.Assert(err, gc.IsNil)
+	s.addKey(c, "alice_signed.asc")
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	// Until the suppression is lifted.
+	err = s.storage.Unsuppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Unsuppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	suppressed, err = s.storage.Suppressed(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+	suppressed, err = s.storage.ListSuppressed(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+	s.addKey(c, "alice_signed.asc")
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *MgoSuite) TestChanges(c *gc.C) {
+	defer func(lag time.Duration) { changeLogLag = lag }(changeLogLag)
+	changeLogLag = -time.Minute
+
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	s.addKey(c, "alice_signed.asc")
+	rfp := openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	_, err := s.storage.Delete(rfp)
+	c.Assert(err, gc.IsNil)
+
+	changes, err := s.storage.Changes(ctx, "", 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.HasLen, 3)
+	c.Assert(changes[0].Type, gc.Equals, hkpstorage.ChangeAdded)
+	c.Assert(changes[1].Type, gc.Equals, hkpstorage.ChangeReplaced)
+	c.Assert(changes[1].OldDigest, gc.Equals, changes[0].NewDigest)
+	c.Assert(changes[2].Type, gc.Equals, hkpstorage.ChangeRemoved)
+	c.Assert(changes[2].OldDigest, gc.Equals, changes[1].NewDigest)
+
+	page, err := s.storage.Changes(ctx, changes[0].Cursor, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(page, gc.DeepEquals, changes[1:2])
+
+	_, err = s.storage.Changes(ctx, "bogus", 100)
+	c.Assert(errgo.Cause(err), gc.Equals, hkpstorage.ErrInvalidCursor)
+}
+
 func (s *MgoSuite) TestMerge(c *gc.C) {
 	s.addKey(c, "alice_unsigned.asc")
 	s.addKey(c, "alice_signed.asc")
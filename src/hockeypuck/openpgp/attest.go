@@ -0,0 +1,201 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"crypto"
+	"encoding/binary"
+
+	"gopkg.in/errgo.v1"
+)
+
+// attestationSigType is the type of an Attested Key Signature, by which the
+// key holder lists the third-party certifications of a user ID or user
+// attribute which they want distributed with it
+// (draft-ietf-openpgp-rfc4880bis-10 §5.2.1). Only the latest attestation
+// counts, so the holder withdraws certifications by attesting fewer.
+const attestationSigType = 0x16
+
+// confirmationDigest returns the digest by which attestations refer to the
+// signature packet with the given body: that of the packet without its
+// unhashed subpackets, as hashed by a third-party confirmation signature
+// (RFC 4880 §5.2.4).
+func confirmationDigest(h crypto.Hash, contents []byte) ([]byte, error) {
+	sig, err := parseRawSignature(contents)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	body := append([]byte(nil), sig.hashed...)
+	if sig.Version == 6 {
+		body = append(body, 0, 0, 0, 0)
+	} else {
+		body = append(body, 0, 0)
+	}
+	body = append(body, sig.left16[:]...)
+	if sig.Version == 6 {
+		body = append(body, byte(len(sig.Salt)))
+		body = append(body, sig.Salt...)
+	}
+	body = append(body, sig.Material...)
+
+	d := h.New()
+	var header [5]byte
+	header[0] = 0x88
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	d.Write(header[:])
+	d.Write(body)
+	return d.Sum(nil), nil
+}
+
+// attestedDigests returns the digests of the certifications listed by an
+// attestation signature, and the hash which computed them.
+func (sig *Signature) attestedDigests() (crypto.Hash, [][]byte, error) {
+	op, err := sig.opaquePacket()
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	s, err := parseRawSignature(op.Contents)
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	if s.Hash == 0 || !s.Hash.Available() {
+		return 0, nil, errgo.Newf("unsupported hash algorithm %d", s.HashAlgo)
+	}
+	var list []byte
+	for _, sp := range s.HashedSubpackets {
+		if sp.Type == attestedCertificationsSubpacket {
+			list = append(list, sp.Contents...)
+		}
+	}
+	size := s.Hash.Size()
+	if len(list)%size != 0 {
+		return 0, nil, errgo.Newf("attested certifications are not a list of %d-octet digests", size)
+	}
+	var digests [][]byte
+	for ; len(list) > 0; list = list[size:] {
+		digests = append(digests, list[:size])
+	}
+	return s.Hash, digests, nil
+}
+
+// hasAttestation returns whether any of sigs is an attestation by key, which
+// saves checking the self-signatures of the many keys without any.
+func hasAttestation(key *PrimaryKey, sigs []*Signature) bool {
+	for _, sig := range sigs {
+		if sig.SigType == attestationSigType && sig.issuedBy(&key.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// attested returns the third-party certifications among sigs attested by
+// the latest of the valid attestations in ss. Attestations made at the same
+// time are combined.
+func attested(key *PrimaryKey, ss *SelfSigs, sigs []*Signature) []*Signature {
+	digests := make(map[crypto.Hash]map[string]bool)
+	for _, checkSig := range ss.Attestations {
+		if !checkSig.Signature.Creation.Equal(ss.Attestations[0].Signature.Creation) {
+			break
+		}
+		h, list, err := checkSig.Signature.attestedDigests()
+		if err != nil {
+			continue
+		}
+		if digests[h] == nil {
+			digests[h] = make(map[string]bool)
+		}
+		for _, digest := range list {
+			digests[h][string(digest)] = true
+		}
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+	var result []*Signature
+	for _, sig := range sigs {
+		if sig.issuedBy(&key.PublicKey) {
+			continue
+		}
+		op, err := sig.opaquePacket()
+		if err != nil {
+			continue
+		}
+		for h, set := range digests {
+			if digest, err := confirmationDigest(h, op.Contents); err == nil && set[string(digest)] {
+				result = append(result, sig)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// AttestedCerts returns the third-party certifications of the user ID which
+// the key holder has attested.
+func (uid *UserID) AttestedCerts(key *PrimaryKey) []*Signature {
+	if !hasAttestation(key, uid.Signatures) {
+		return nil
+	}
+	ss, _ := uid.SigInfo(key)
+	return attested(key, ss, uid.Signatures)
+}
+
+// AttestedCerts returns the third-party certifications of the user attribute
+// which the key holder has attested.
+func (uat *UserAttribute) AttestedCerts(key *PrimaryKey) []*Signature {
+	if !hasAttestation(key, uat.Signatures) {
+		return nil
+	}
+	ss, _ := uat.SigInfo(key)
+	return attested(key, ss, uat.Signatures)
+}
+
+// DropUnattested removes the third-party certifications of user IDs and user
+// attributes which the key holder has not attested, following the
+// first-party-attested third-party certification model: only the holder
+// decides which certifications are distributed with their key. It returns
+// the certifications removed.
+func DropUnattested(key *PrimaryKey) ([]*Signature, error) {
+	var dropped []*Signature
+	keep := func(sigs, attested []*Signature) []*Signature {
+		ok := make(map[*Signature]bool)
+		for _, sig := range attested {
+			ok[sig] = true
+		}
+		var result []*Signature
+		for _, sig := range sigs {
+			if sig.issuedBy(&key.PublicKey) || ok[sig] {
+				result = append(result, sig)
+			} else {
+				dropped = append(dropped, sig)
+			}
+		}
+		return result
+	}
+	for _, uid := range key.UserIDs {
+		uid.Signatures = keep(uid.Signatures, uid.AttestedCerts(key))
+	}
+	for _, uat := range key.UserAttributes {
+		uat.Signatures = keep(uat.Signatures, uat.AttestedCerts(key))
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	return dropped, key.updateMD5()
+}
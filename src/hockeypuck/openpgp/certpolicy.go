@@ -0,0 +1,162 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"sort"
+
+	"gopkg.in/errgo.v1"
+)
+
+// CertPolicy limits the third-party certifications kept on the user IDs and
+// user attributes of a key. Anyone may certify a key, so without such limits
+// a key may be flooded with certifications until it is too large to use.
+// Self-signatures are never dropped.
+type CertPolicy struct {
+	// MaxPerUserID is the most third-party certifications kept on each
+	// user ID and user attribute, newest first. Zero means no limit.
+	MaxPerUserID int
+
+	// NewestPerIssuer keeps only the newest certification by each issuer
+	// on each user ID and user attribute.
+	NewestPerIssuer bool
+
+	// KnownIssuersOnly drops certifications whose issuer is not a known
+	// key, as reported by the IssuerLookup given to Apply. Certifications
+	// which do not name their issuer are dropped, as are those older than
+	// the newest thousand on a user ID or user attribute, which are not
+	// examined.
+	KnownIssuersOnly bool
+}
+
+// WithoutLookups returns the part of the policy which can be applied without
+// looking up issuers, or nil if there is none.
+func (p *CertPolicy) WithoutLookups() *CertPolicy {
+	if p == nil || p.MaxPerUserID <= 0 && !p.NewestPerIssuer {
+		return nil
+	}
+	return &CertPolicy{
+		MaxPerUserID:    p.MaxPerUserID,
+		NewestPerIssuer: p.NewestPerIssuer,
+	}
+}
+
+// IssuerLookup reports which of the keys with the given reversed key IDs
+// are known.
+type IssuerLookup func(rkeyids []string) (map[string]bool, error)
+
+// maxCertsExamined is the most third-party certifications on each user ID
+// and user attribute whose issuers are looked up, newest first. Older ones
+// are dropped unexamined, so that a flooded key costs no more to check than
+// any other.
+const maxCertsExamined = 1000
+
+// Apply removes the third-party certifications the policy does not allow
+// from the key, and returns them. Issuers are only looked up if the policy
+// requires it, all at once.
+func (p *CertPolicy) Apply(key *PrimaryKey, known IssuerLookup) ([]*Signature, error) {
+	if p.KnownIssuersOnly && known == nil {
+		return nil, errgo.New("known issuers policy requires an issuer lookup")
+	}
+	var targets []*[]*Signature
+	for _, uid := range key.UserIDs {
+		targets = append(targets, &uid.Signatures)
+	}
+	for _, uat := range key.UserAttributes {
+		targets = append(targets, &uat.Signatures)
+	}
+	f := &certFilter{policy: p, key: key}
+	if p.KnownIssuersOnly {
+		var rkeyids []string
+		seen := make(map[string]bool)
+		for _, sigs := range targets {
+			for _, sig := range f.certs(*sigs) {
+				if sig.RIssuerKeyID != "" && !seen[sig.RIssuerKeyID] {
+					seen[sig.RIssuerKeyID] = true
+					rkeyids = append(rkeyids, sig.RIssuerKeyID)
+				}
+			}
+		}
+		if len(rkeyids) > 0 {
+			var err error
+			f.known, err = known(rkeyids)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot look up issuers")
+			}
+		}
+	}
+	for _, sigs := range targets {
+		*sigs = f.filter(*sigs)
+	}
+	if len(f.dropped) == 0 {
+		return nil, nil
+	}
+	return f.dropped, key.updateMD5()
+}
+
+type certFilter struct {
+	policy  *CertPolicy
+	key     *PrimaryKey
+	known   map[string]bool
+	dropped []*Signature
+}
+
+// certs returns the third-party certifications among sigs which the policy
+// examines, newest first.
+func (f *certFilter) certs(sigs []*Signature) []*Signature {
+	var certs []*Signature
+	for _, sig := range sigs {
+		if !sig.issuedBy(&f.key.PublicKey) {
+			certs = append(certs, sig)
+		}
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		return certs[i].Creation.After(certs[j].Creation)
+	})
+	if f.policy.KnownIssuersOnly && len(certs) > maxCertsExamined {
+		certs = certs[:maxCertsExamined]
+	}
+	return certs
+}
+
+// filter returns the signatures the policy keeps, in their original order.
+func (f *certFilter) filter(sigs []*Signature) []*Signature {
+	keep := make(map[*Signature]bool)
+	issuers := make(map[string]bool)
+	for _, sig := range f.certs(sigs) {
+		if f.policy.MaxPerUserID > 0 && len(keep) >= f.policy.MaxPerUserID {
+			break
+		}
+		if f.policy.NewestPerIssuer && issuers[sig.RIssuerKeyID] {
+			continue
+		}
+		issuers[sig.RIssuerKeyID] = true
+		if !f.policy.KnownIssuersOnly || f.known[sig.RIssuerKeyID] {
+			keep[sig] = true
+		}
+	}
+	var result []*Signature
+	for _, sig := range sigs {
+		if sig.issuedBy(&f.key.PublicKey) || keep[sig] {
+			result = append(result, sig)
+		} else {
+			f.dropped = append(f.dropped, sig)
+		}
+	}
+	return result
+}
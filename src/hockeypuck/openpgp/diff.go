@@ -0,0 +1,63 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+// KeyDiff holds the material which one key has and another does not.
+type KeyDiff struct {
+	Signatures     []*Signature
+	UserIDs        []*UserID
+	UserAttributes []*UserAttribute
+	SubKeys        []*SubKey
+	Others         []*Packet
+}
+
+// Len returns the number of packets in the difference.
+func (d *KeyDiff) Len() int {
+	return len(d.Signatures) + len(d.UserIDs) + len(d.UserAttributes) + len(d.SubKeys) + len(d.Others)
+}
+
+// Diff returns the material in key which is not in base, which is what
+// merging key into base would add to it. If base is nil, all of key is
+// returned.
+func Diff(base, key *PrimaryKey) *KeyDiff {
+	known := make(map[string]bool)
+	if base != nil {
+		for _, node := range base.contents() {
+			known[node.uuid()] = true
+		}
+	}
+	d := &KeyDiff{}
+	for _, node := range key.contents() {
+		if known[node.uuid()] {
+			continue
+		}
+		switch p := node.(type) {
+		case *Signature:
+			d.Signatures = append(d.Signatures, p)
+		case *UserID:
+			d.UserIDs = append(d.UserIDs, p)
+		case *UserAttribute:
+			d.UserAttributes = append(d.UserAttributes, p)
+		case *SubKey:
+			d.SubKeys = append(d.SubKeys, p)
+		case *Packet:
+			d.Others = append(d.Others, p)
+		}
+	}
+	return d
+}
@@ -191,8 +191,24 @@ type OpaqueKeyReader struct {
 	maxKeyLen    int
 	maxPacketLen int
 	blacklist    map[string]bool
+	dropped      func(fp string, reason DropReason)
 }
 
+// DropReason describes why key material was dropped while reading it.
+type DropReason string
+
+const (
+	// DropBlacklisted is given for keys on the blacklist.
+	DropBlacklisted = DropReason("blacklisted")
+
+	// DropKeyTooLarge is given for keys longer than the maximum key length.
+	DropKeyTooLarge = DropReason("too-large")
+
+	// DropPacketTooLarge is given for packets longer than the maximum packet
+	// length. The rest of the key is still read.
+	DropPacketTooLarge = DropReason("packet-too-large")
+)
+
 type KeyReaderOption func(*OpaqueKeyReader) error
 
 func NewOpaqueKeyReader(r io.Reader, options ...KeyReaderOption) (*OpaqueKeyReader, error) {
@@ -229,6 +245,22 @@ func Blacklist(blacklist []string) KeyReaderOption {
 	}
 }
 
+// Dropped calls f with the fingerprint of the key and the reason whenever
+// key material is dropped while reading it. The fingerprint is empty for
+// packets which do not belong to any key.
+func Dropped(f func(fp string, reason DropReason)) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.dropped = f
+		return nil
+	}
+}
+
+func (r *OpaqueKeyReader) drop(fp string, reason DropReason) {
+	if r.dropped != nil {
+		r.dropped(fp, reason)
+	}
+}
+
 func (r *OpaqueKeyReader) Read() ([]*OpaqueKeyring, error) {
 	or := packet.NewOpaqueReader(r.r)
 	var op *packet.OpaquePacket
@@ -246,6 +278,17 @@ PARSE:
 					"length": packetLen,
 					"max":    r.maxPacketLen,
 				}).Warn("dropped packet")
+				if op.Tag == 6 {
+					// The rest of the key is dropped with it, rather than
+					// taken for part of the key before.
+					if current != nil {
+						result = append(result, current)
+					}
+					current = nil
+					currentKeyLen = 0
+					currentFingerprint = ""
+				}
+				r.drop(currentFingerprint, DropPacketTooLarge)
 				continue
 			}
 		}
@@ -268,6 +311,7 @@ PARSE:
 					log.WithFields(log.Fields{
 						"fp": fp,
 					}).Warn("blacklisted key")
+					r.drop(fp, DropBlacklisted)
 					continue PARSE
 				}
 			}
@@ -293,6 +337,7 @@ PARSE:
 					"max":    r.maxKeyLen,
 					"fp":     currentFingerprint,
 				}).Warn("dropped key, max length exceeded")
+				r.drop(currentFingerprint, DropKeyTooLarge)
 				current = nil
 				currentKeyLen = 0
 				currentFingerprint = ""
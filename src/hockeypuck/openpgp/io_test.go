@@ -23,7 +23,9 @@ import (
 	"io"
 	"io/ioutil"
 	"sort"
+	"strings"
 	stdtesting "testing"
+	"time"
 
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
@@ -268,19 +270,144 @@ func (s *SamplePacketSuite) TestMalformedSignatures(c *gc.C) {
 }
 
 func (s *SamplePacketSuite) TestECCSelfSigs(c *gc.C) {
-	keys := MustInputAscKeys("ecc_keys.asc")
-	c.Assert(keys, gc.HasLen, 6)
-	for i, key := range keys {
-		ss, _ := key.SigInfo()
-		c.Assert(ss.Errors, gc.HasLen, 0, gc.Commentf("errors in key #%d: %+v", i, ss.Errors))
-		c.Assert(ss.Valid(), gc.Equals, true, gc.Commentf("invalid key #%d", i))
-		c.Assert(key.UserIDs, gc.HasLen, 1)
-		ss, _ = key.UserIDs[0].SigInfo(key)
-		c.Assert(ss.Errors, gc.HasLen, 0, gc.Commentf("errors in key #%d: %+v", i, ss.Errors))
-		c.Assert(ss.Valid(), gc.Equals, true, gc.Commentf("invalid key #%d", i))
+	for _, tc := range []struct {
+		name string
+		n    int
+	}{
+		// EdDSA, ECDSA and ECDH keys of RFC 6637.
+		{"ecc_keys.asc", 6},
+		// Ed25519 and X25519 keys of RFC 9580, and an EdDSA key with an X25519
+		// subkey.
+		{"ecc_keys_rfc9580.asc", 2},
+		// v6 ECDSA keys over the NIST and Brainpool curves, with X25519
+		// subkeys.
+		{"ecc_keys_v6.asc", 6},
+	} {
+		keys := MustInputAscKeys(tc.name)
+		c.Assert(keys, gc.HasLen, tc.n)
+		for i, key := range keys {
+			comment := gc.Commentf("%s key #%d", tc.name, i)
+			ss, _ := key.SigInfo()
+			c.Assert(ss.Errors, gc.HasLen, 0, comment)
+			c.Assert(ss.Valid(), gc.Equals, true, comment)
+			c.Assert(key.UserIDs, gc.HasLen, 1)
+			ss, _ = key.UserIDs[0].SigInfo(key)
+			c.Assert(ss.Errors, gc.HasLen, 0, comment)
+			c.Assert(ss.Valid(), gc.Equals, true, comment)
+			c.Assert(key.SubKeys, gc.HasLen, 1)
+			ss, _ = key.SubKeys[0].SigInfo(key)
+			c.Assert(ss.Errors, gc.HasLen, 0, comment)
+			c.Assert(ss.Certifications, gc.HasLen, 1, comment)
+
+			// Nothing is stripped when only self-signatures are kept.
+			err := ValidSelfSigned(key, true)
+			c.Assert(err, gc.IsNil)
+			c.Assert(key.UserIDs, gc.HasLen, 1, comment)
+			c.Assert(key.SubKeys, gc.HasLen, 1, comment)
+		}
+	}
+}
+
+func (s *SamplePacketSuite) TestRawVerifyECC(c *gc.C) {
+	// Self-signatures which golang.org/x/crypto/openpgp verifies are also
+	// verified by this package, except over secp256k1.
+	for i, key := range MustInputAscKeys("ecc_keys.asc") {
+		if key.ShortID() == "9cd29c52" {
+			continue
+		}
+		comment := gc.Commentf("key #%d", i)
+		uid := key.UserIDs[0]
+		for _, sig := range uid.Signatures {
+			err := key.verifyRawSelfSig(sig, func(w io.Writer) {
+				writePrefixed(w, 0xb4, []byte(uid.Keywords))
+			})
+			c.Assert(err, gc.IsNil, comment)
+			err = key.verifyRawSelfSig(sig, func(w io.Writer) {
+				writePrefixed(w, 0xb4, []byte(uid.Keywords+"!"))
+			})
+			c.Assert(err, gc.NotNil, comment)
+		}
+		subkey, err := key.SubKeys[0].opaquePacket()
+		c.Assert(err, gc.IsNil)
+		for _, sig := range key.SubKeys[0].Signatures {
+			err := key.verifyRawSelfSig(sig, func(w io.Writer) {
+				writeKeyPacket(w, subkey.Contents)
+			})
+			c.Assert(err, gc.IsNil, comment)
+		}
 	}
 }
 
+func (s *SamplePacketSuite) TestV6Key(c *gc.C) {
+	// The sample v6 certificate of RFC 9580 §A.3.
+	key := MustInputAscKey("rfc9580_v6.asc")
+	c.Assert(key.Fingerprint(), gc.Equals, "cb186c4f0609a697e4d52dfa6c722b0c1f1e27c18a56708f6525ec27bad9acc9")
+	c.Assert(key.KeyID(), gc.Equals, "cb186c4f0609a697")
+	c.Assert(key.ShortID(), gc.Equals, "0609a697")
+	c.Assert(key.Algorithm, gc.Equals, 27)
+	c.Assert(key.BitLen, gc.Equals, 256)
+	c.Assert(key.Creation, gc.Equals, time.Unix(1669824483, 0))
+	c.Assert(key.Others, gc.HasLen, 0)
+	c.Assert(key.Signatures, gc.HasLen, 1)
+	c.Assert(key.Signatures[0].SigType, gc.Equals, 0x1f)
+	c.Assert(key.Signatures[0].IssuerKeyID(), gc.Equals, "cb186c4f0609a697")
+	c.Assert(key.verifyPublicKeySelfSig(&key.PublicKey, key.Signatures[0]), gc.IsNil)
+
+	c.Assert(key.SubKeys, gc.HasLen, 1)
+	c.Assert(key.SubKeys[0].Fingerprint(), gc.Equals, "12c83f1e706f6308fe151a417743a1f033790e93e9978488d1db378da9930885")
+	c.Assert(key.SubKeys[0].Algorithm, gc.Equals, 25)
+	ss, _ := key.SubKeys[0].SigInfo(key)
+	c.Assert(ss.Errors, gc.HasLen, 0)
+	c.Assert(ss.Certifications, gc.HasLen, 1)
+	c.Assert(SelfSigned(key), gc.Equals, true)
+}
+
+func (s *SamplePacketSuite) TestV6SelfSigs(c *gc.C) {
+	key := MustInputAscKey("v6_ed25519.asc")
+	c.Assert(key.QualifiedFingerprint(), gc.Equals, "ed25519256/84c130617c17e35e8bb4523ff0b386800dfc2d0b30a219ec4015f5043d177693")
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	ss, _ := key.UserIDs[0].SigInfo(key)
+	c.Assert(ss.Errors, gc.HasLen, 0)
+	c.Assert(ss.Valid(), gc.Equals, true)
+	c.Assert(key.UserIDs[0].Signatures[0].Primary, gc.Equals, true)
+	ss, _ = key.SubKeys[0].SigInfo(key)
+	c.Assert(ss.Errors, gc.HasLen, 0)
+	c.Assert(ss.Valid(), gc.Equals, true)
+
+	// A v6 signature fails to verify over the wrong user ID.
+	uid := *key.UserIDs[0]
+	uid.Packet.Packet = append([]byte(nil), uid.Packet.Packet...)
+	uid.Packet.Packet[len(uid.Packet.Packet)-1] ^= 1
+	c.Assert(key.verifyUserIDSelfSig(&uid, uid.Signatures[0]), gc.NotNil)
+}
+
+func (s *SamplePacketSuite) TestCheckDetachedSignatureV6(c *gc.C) {
+	key := MustInputAscKey("rfc9580_v6.asc")
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := []byte("remove this key")
+	sig := testing.MustDetachSignV6(testing.RFC9580V6Seed, testing.RFC9580V6Fingerprint, created, data)
+	checked, err := CheckArmoredDetachedSignature(key, data, bytes.NewBufferString(sig))
+	c.Assert(err, gc.IsNil)
+	c.Assert(checked.Creation.Equal(created), gc.Equals, true)
+	c.Assert(checked.IssuerKeyID(), gc.Equals, key.KeyID())
+
+	_, err = CheckArmoredDetachedSignature(key, []byte("remove another key"), bytes.NewBufferString(sig))
+	c.Assert(err, gc.ErrorMatches, "signature hash does not match")
+
+	// Signatures are only accepted from the key they name as issuer.
+	other := MustInputAscKey("v6_ed25519.asc")
+	_, err = CheckArmoredDetachedSignature(other, data, bytes.NewBufferString(sig))
+	c.Assert(err, gc.ErrorMatches, `signature not made by key "84c1.*"`)
+
+	// A signature naming the key as issuer, but made by another.
+	forged := testing.MustDetachSignV6(strings.Repeat("11", 32), testing.RFC9580V6Fingerprint, created, data)
+	_, err = CheckArmoredDetachedSignature(key, data, bytes.NewBufferString(forged))
+	c.Assert(err, gc.ErrorMatches, "Ed25519 verification failure")
+
+	_, err = CheckArmoredDetachedSignature(key, data, bytes.NewBufferString("not a signature"))
+	c.Assert(err, gc.ErrorMatches, "invalid armored signature: .*")
+}
+
 func (s *SamplePacketSuite) TestMaxKeyLen(c *gc.C) {
 	keys, err := ReadArmorKeys(testing.MustInput("e68e311d.asc"))
 	c.Assert(err, gc.IsNil)
@@ -336,6 +463,31 @@ func (s *SamplePacketSuite) TestBlacklist(c *gc.C) {
 	c.Assert(keys, gc.HasLen, 0)
 }
 
+func (s *SamplePacketSuite) TestDropped(c *gc.C) {
+	type drop struct {
+		fp     string
+		reason DropReason
+	}
+	var drops []drop
+	dropped := Dropped(func(fp string, reason DropReason) {
+		drops = append(drops, drop{fp, reason})
+	})
+	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"), MaxPacketLen(2048), dropped)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), MaxKeyLen(2048), dropped)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), Blacklist([]string{"81279eee7ec89fb781702adaf79362da44a2d1db"}), dropped)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+	c.Assert(drops, gc.DeepEquals, []drop{
+		{"81279eee7ec89fb781702adaf79362da44a2d1db", DropPacketTooLarge},
+		{"81279eee7ec89fb781702adaf79362da44a2d1db", DropKeyTooLarge},
+		{"81279eee7ec89fb781702adaf79362da44a2d1db", DropBlacklisted},
+	})
+}
+
 func (s *SamplePacketSuite) TestKeyLength(c *gc.C) {
 	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"))
 	c.Assert(err, gc.IsNil)
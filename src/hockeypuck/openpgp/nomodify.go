@@ -0,0 +1,185 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+const (
+	keyserverPrefsSubpacket = 23
+
+	// keyserverNoModifyFlag is the first octet of the key server
+	// preferences by which a key holder asks that the key only be modified
+	// by themselves or a key server administrator (RFC 4880 §5.2.3.17).
+	keyserverNoModifyFlag = 0x80
+)
+
+// keyserverNoModify returns whether the hashed subpackets of the given
+// version 4 signature packet body set the no-modify key server preference.
+func keyserverNoModify(body []byte) bool {
+	if len(body) < 6 || body[0] != 4 {
+		return false
+	}
+	n := int(body[4])<<8 | int(body[5])
+	if len(body) < 6+n {
+		return false
+	}
+	subpackets, err := parseSubpackets(body[6 : 6+n])
+	if err != nil {
+		return false
+	}
+	return hasKeyserverNoModify(subpackets)
+}
+
+// hasKeyserverNoModify returns whether the given hashed subpackets set the
+// no-modify key server preference.
+func hasKeyserverNoModify(subpackets []subpacket) bool {
+	for _, sp := range subpackets {
+		if sp.Type == keyserverPrefsSubpacket && len(sp.Contents) > 0 && sp.Contents[0]&keyserverNoModifyFlag != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NoModify returns whether the holder of the given key has asked that it
+// only be modified by themselves, in the latest valid self-certification of
+// any user ID or in the latest direct-key self-signature.
+func NoModify(key *PrimaryKey) bool {
+	for _, uid := range key.UserIDs {
+		ss, _ := uid.SigInfo(key)
+		if len(ss.Certifications) > 0 && ss.Certifications[0].Signature.KeyserverNoModify {
+			return true
+		}
+	}
+	var latest *Signature
+	for _, sig := range key.Signatures {
+		if sig.SigType != 0x1f || !sig.issuedBy(&key.PublicKey) {
+			continue
+		}
+		if latest != nil && !sig.Creation.After(latest.Creation) {
+			continue
+		}
+		if key.verifyPublicKeySelfSig(&key.PublicKey, sig) == nil {
+			latest = sig
+		}
+	}
+	return latest != nil && latest.KeyserverNoModify
+}
+
+// Unowned holds the material removed from a key by DropUnowned.
+type Unowned struct {
+	// Signatures are the third-party and invalid signatures removed from
+	// the key and its remaining user IDs, user attributes and subkeys.
+	Signatures []*Signature
+
+	UserIDs        []*UserID
+	UserAttributes []*UserAttribute
+	SubKeys        []*SubKey
+	Others         []*Packet
+}
+
+// Len returns the number of packets removed, not counting the signatures
+// on removed user IDs, user attributes and subkeys.
+func (u *Unowned) Len() int {
+	return len(u.Signatures) + len(u.UserIDs) + len(u.UserAttributes) + len(u.SubKeys) + len(u.Others)
+}
+
+// Append adds the material in other to u.
+func (u *Unowned) Append(other *Unowned) {
+	u.Signatures = append(u.Signatures, other.Signatures...)
+	u.UserIDs = append(u.UserIDs, other.UserIDs...)
+	u.UserAttributes = append(u.UserAttributes, other.UserAttributes...)
+	u.SubKeys = append(u.SubKeys, other.SubKeys...)
+	u.Others = append(u.Others, other.Others...)
+}
+
+// ownSigs returns the valid self-signatures among sigs, given the results of
+// checking them, and adds the rest to u.
+func (u *Unowned) ownSigs(sigs []*Signature, ss *SelfSigs, others []*Signature) []*Signature {
+	removed := make(map[*Signature]bool)
+	for _, sig := range others {
+		removed[sig] = true
+	}
+	for _, cs := range ss.Errors {
+		removed[cs.Signature] = true
+	}
+	var result []*Signature
+	for _, sig := range sigs {
+		if removed[sig] {
+			u.Signatures = append(u.Signatures, sig)
+		} else {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
+
+// DropUnowned removes everything from the key that its holder has not
+// signed: third-party and invalid signatures, user IDs, user attributes and
+// subkeys without a valid self-signature, and unrecognized packets. It
+// returns the material removed.
+func DropUnowned(key *PrimaryKey) (*Unowned, error) {
+	u := &Unowned{}
+
+	ss, others := key.SigInfo()
+	key.Signatures = u.ownSigs(key.Signatures, ss, others)
+	u.Others = append(u.Others, key.Others...)
+	key.Others = nil
+
+	var userIDs []*UserID
+	for _, uid := range key.UserIDs {
+		ss, others := uid.SigInfo(key)
+		if len(ss.Certifications) == 0 && len(ss.Revocations) == 0 {
+			u.UserIDs = append(u.UserIDs, uid)
+			continue
+		}
+		uid.Signatures = u.ownSigs(uid.Signatures, ss, others)
+		u.Others = append(u.Others, uid.Others...)
+		uid.Others = nil
+		userIDs = append(userIDs, uid)
+	}
+	key.UserIDs = userIDs
+
+	var userAttributes []*UserAttribute
+	for _, uat := range key.UserAttributes {
+		ss, others := uat.SigInfo(key)
+		if len(ss.Certifications) == 0 && len(ss.Revocations) == 0 {
+			u.UserAttributes = append(u.UserAttributes, uat)
+			continue
+		}
+		uat.Signatures = u.ownSigs(uat.Signatures, ss, others)
+		u.Others = append(u.Others, uat.Others...)
+		uat.Others = nil
+		userAttributes = append(userAttributes, uat)
+	}
+	key.UserAttributes = userAttributes
+
+	var subKeys []*SubKey
+	for _, subKey := range key.SubKeys {
+		ss, others := subKey.SigInfo(key)
+		if len(ss.Certifications) == 0 && len(ss.Revocations) == 0 {
+			u.SubKeys = append(u.SubKeys, subKey)
+			continue
+		}
+		subKey.Signatures = u.ownSigs(subKey.Signatures, ss, others)
+		u.Others = append(u.Others, subKey.Others...)
+		subKey.Others = nil
+		subKeys = append(subKeys, subKey)
+	}
+	key.SubKeys = subKeys
+
+	return u, key.updateMD5()
+}
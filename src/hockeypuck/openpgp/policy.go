@@ -0,0 +1,214 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"errors"
+	"regexp"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ErrKeyRejected is the cause of the errors by which a KeyPolicy rejects
+// keys. Their messages give the reason.
+var ErrKeyRejected = errors.New("key rejected by policy")
+
+// KeyPolicy decides which keys are accepted into storage.
+type KeyPolicy interface {
+	// Check returns nil if the key is accepted, or else an error with cause
+	// ErrKeyRejected giving the reason.
+	Check(key *PrimaryKey) error
+}
+
+// KeyPolicyFunc adapts a function to a KeyPolicy.
+type KeyPolicyFunc func(key *PrimaryKey) error
+
+// Check implements KeyPolicy.
+func (f KeyPolicyFunc) Check(key *PrimaryKey) error {
+	return f(key)
+}
+
+// KeyPolicies accepts the keys which all of its policies accept.
+type KeyPolicies []KeyPolicy
+
+// Check implements KeyPolicy, giving the reason of the first policy which
+// rejects the key.
+func (ps KeyPolicies) Check(key *PrimaryKey) error {
+	for _, p := range ps {
+		if err := p.Check(key); err != nil {
+			return errgo.Mask(err, errgo.Is(ErrKeyRejected))
+		}
+	}
+	return nil
+}
+
+func rejectf(format string, args ...interface{}) error {
+	return errgo.WithCausef(nil, ErrKeyRejected, format, args...)
+}
+
+// publicKeys returns the primary key and subkeys of key.
+func publicKeys(key *PrimaryKey) []*PublicKey {
+	result := []*PublicKey{&key.PublicKey}
+	for _, subKey := range key.SubKeys {
+		result = append(result, &subKey.PublicKey)
+	}
+	return result
+}
+
+// MinRSABits rejects keys with RSA primary keys or subkeys of fewer than the
+// given number of bits.
+func MinRSABits(bits int) KeyPolicy {
+	return KeyPolicyFunc(func(key *PrimaryKey) error {
+		for _, pk := range publicKeys(key) {
+			if AlgorithmName(pk.Algorithm) == "rsa" && pk.BitLen < bits {
+				return rejectf("RSA key %s has %d bits, fewer than %d", pk.KeyID(), pk.BitLen, bits)
+			}
+		}
+		return nil
+	})
+}
+
+// knownAlgorithms lists the public key algorithms by name, as given by
+// AlgorithmName.
+var knownAlgorithms = map[string]bool{
+	"rsa": true, "elg": true, "dsa": true, "ecdh": true, "ecdsa": true, "eddsa": true,
+	"x25519": true, "x448": true, "ed25519": true, "ed448": true,
+}
+
+// AllowedAlgorithms rejects keys with primary keys or subkeys using public
+// key algorithms other than those named, as by AlgorithmName.
+func AllowedAlgorithms(names ...string) (KeyPolicy, error) {
+	allowed := make(map[string]bool)
+	for _, name := range names {
+		if !knownAlgorithms[name] {
+			return nil, errgo.Newf("unknown public key algorithm %q", name)
+		}
+		allowed[name] = true
+	}
+	return KeyPolicyFunc(func(key *PrimaryKey) error {
+		for _, pk := range publicKeys(key) {
+			if name := AlgorithmName(pk.Algorithm); !allowed[name] {
+				return rejectf("key %s uses algorithm %s, which is not allowed", pk.KeyID(), name)
+			}
+		}
+		return nil
+	}), nil
+}
+
+// MaxUserIDs rejects keys with more than the given number of user IDs.
+func MaxUserIDs(n int) KeyPolicy {
+	return KeyPolicyFunc(func(key *PrimaryKey) error {
+		if len(key.UserIDs) > n {
+			return rejectf("key has %d user IDs, more than %d", len(key.UserIDs), n)
+		}
+		return nil
+	})
+}
+
+// sha1HashAlgorithm is the OpenPGP identifier of SHA-1 (RFC 9580 §9.5).
+const sha1HashAlgorithm = 2
+
+// hashAlgorithm returns the OpenPGP hash algorithm of the signature.
+func (sig *Signature) hashAlgorithm() (int, bool) {
+	op, err := sig.opaquePacket()
+	if err != nil {
+		return 0, false
+	}
+	c := op.Contents
+	switch {
+	case len(c) > 3 && (c[0] == 4 || c[0] == 6):
+		return int(c[3]), true
+	case len(c) > 16 && (c[0] == 2 || c[0] == 3):
+		return int(c[16]), true
+	}
+	return 0, false
+}
+
+// onlySHA1 returns whether all of the given verified self-signatures use
+// SHA-1, and there is at least one.
+func onlySHA1(checkSigs []*CheckSig) bool {
+	for _, checkSig := range checkSigs {
+		if h, ok := checkSig.Signature.hashAlgorithm(); !ok || h != sha1HashAlgorithm {
+			return false
+		}
+	}
+	return len(checkSigs) > 0
+}
+
+// RejectSHA1Bindings rejects keys with user IDs, user attributes or subkeys
+// which are only bound to the key by SHA-1 self-signatures, since these can
+// be forged by chosen-prefix collisions. Only self-signatures which verify
+// are considered, so that a bogus signature claiming the key as its issuer
+// cannot lift the rejection. Revoked targets are not bound, and so not
+// rejected.
+func RejectSHA1Bindings() KeyPolicy {
+	return KeyPolicyFunc(func(key *PrimaryKey) error {
+		for _, uid := range key.UserIDs {
+			if selfSigs, _ := uid.SigInfo(key); onlySHA1(selfSigs.Certifications) {
+				return rejectf("user ID %q is only bound by SHA-1 signatures", uid.Keywords)
+			}
+		}
+		for i, uat := range key.UserAttributes {
+			if selfSigs, _ := uat.SigInfo(key); onlySHA1(selfSigs.Certifications) {
+				return rejectf("user attribute %d is only bound by SHA-1 signatures", i)
+			}
+		}
+		for _, subKey := range key.SubKeys {
+			if selfSigs, _ := subKey.SigInfo(key); onlySHA1(selfSigs.Certifications) {
+				return rejectf("subkey %s is only bound by SHA-1 signatures", subKey.KeyID())
+			}
+		}
+		return nil
+	})
+}
+
+// DenyUserIDs rejects keys with a user ID matching any of the given regular
+// expressions.
+func DenyUserIDs(patterns ...string) (KeyPolicy, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid user ID pattern %q", pattern)
+		}
+		res = append(res, re)
+	}
+	return KeyPolicyFunc(func(key *PrimaryKey) error {
+		for _, uid := range key.UserIDs {
+			for _, re := range res {
+				if re.MatchString(uid.Keywords) {
+					return rejectf("user ID %q matches denied pattern %q", uid.Keywords, re)
+				}
+			}
+		}
+		return nil
+	}), nil
+}
+
+// MaxUserAttributeLen rejects keys with a user attribute packet longer than
+// the given number of octets.
+func MaxUserAttributeLen(n int) KeyPolicy {
+	return KeyPolicyFunc(func(key *PrimaryKey) error {
+		for i, uat := range key.UserAttributes {
+			if len(uat.Packet.Packet) > n {
+				return rejectf("user attribute %d is %d octets long, more than %d", i, len(uat.Packet.Packet), n)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,113 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+type PolicySuite struct{}
+
+var _ = gc.Suite(&PolicySuite{})
+
+func (s *PolicySuite) assertRejected(c *gc.C, p KeyPolicy, name, reason string) {
+	err := p.Check(MustInputAscKey(name))
+	c.Assert(err, gc.ErrorMatches, reason, gc.Commentf("%s", name))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrKeyRejected)
+}
+
+func (s *PolicySuite) assertAccepted(c *gc.C, p KeyPolicy, name string) {
+	c.Assert(p.Check(MustInputAscKey(name)), gc.IsNil, gc.Commentf("%s", name))
+}
+
+func (s *PolicySuite) TestMinRSABits(c *gc.C) {
+	s.assertRejected(c, MinRSABits(4096), "alice_signed.asc", "RSA key 361bc1f023e0dcca has 2048 bits, fewer than 4096")
+	s.assertAccepted(c, MinRSABits(2048), "alice_signed.asc")
+	s.assertAccepted(c, MinRSABits(4096), "v6_ed25519.asc")
+}
+
+func (s *PolicySuite) TestAllowedAlgorithms(c *gc.C) {
+	p, err := AllowedAlgorithms("rsa")
+	c.Assert(err, gc.IsNil)
+	s.assertAccepted(c, p, "alice_signed.asc")
+	s.assertRejected(c, p, "d7346e26.asc", "key 6eefb6afd7346e26 uses algorithm dsa, which is not allowed")
+
+	// Subkeys are checked too.
+	p, err = AllowedAlgorithms("ed25519")
+	c.Assert(err, gc.IsNil)
+	s.assertRejected(c, p, "v6_ed25519.asc", "key .* uses algorithm x25519, which is not allowed")
+
+	_, err = AllowedAlgorithms("rsa", "rot13")
+	c.Assert(err, gc.ErrorMatches, `unknown public key algorithm "rot13"`)
+}
+
+func (s *PolicySuite) TestMaxUserIDs(c *gc.C) {
+	s.assertRejected(c, MaxUserIDs(4), "0ff16c87.asc", "key has 9 user IDs, more than 4")
+	s.assertAccepted(c, MaxUserIDs(9), "0ff16c87.asc")
+}
+
+func (s *PolicySuite) TestRejectSHA1Bindings(c *gc.C) {
+	p := RejectSHA1Bindings()
+	s.assertRejected(c, p, "alice_signed.asc", `user ID "alice <alice@example.com>" is only bound by SHA-1 signatures`)
+	s.assertRejected(c, p, "a7400f5a_nobadsigs.asc", "subkey .* is only bound by SHA-1 signatures")
+	s.assertAccepted(c, p, "attested.asc")
+	s.assertAccepted(c, p, "tails.asc")
+
+	// A signature claiming to be a SHA-256 self-certification does not
+	// lift the rejection unless it verifies.
+	key := MustInputAscKey("alice_signed.asc")
+	uid := key.UserIDs[0]
+	var forged *Signature
+	for _, sig := range uid.Signatures {
+		if sig.issuedBy(&key.PublicKey) {
+			op, err := sig.opaquePacket()
+			c.Assert(err, gc.IsNil)
+			op.Contents[3] = 8 // SHA-256
+			forged, err = ParseSignature(op, key.Creation, key.UUID, uid.UUID)
+			c.Assert(err, gc.IsNil)
+			break
+		}
+	}
+	c.Assert(forged, gc.NotNil)
+	uid.Signatures = append(uid.Signatures, forged)
+	err := p.Check(key)
+	c.Assert(err, gc.ErrorMatches, `user ID "alice <alice@example.com>" is only bound by SHA-1 signatures`)
+}
+
+func (s *PolicySuite) TestDenyUserIDs(c *gc.C) {
+	p, err := DenyUserIDs(`^spam`, `@hotmail\.com>$`)
+	c.Assert(err, gc.IsNil)
+	s.assertRejected(c, p, "d7346e26.asc", `user ID "hansi <hansi@hotmail.com>" matches denied pattern "@hotmail\\\\.com>\$"`)
+	s.assertAccepted(c, p, "alice_signed.asc")
+
+	_, err = DenyUserIDs("(")
+	c.Assert(err, gc.ErrorMatches, `invalid user ID pattern "\(": .*`)
+}
+
+func (s *PolicySuite) TestMaxUserAttributeLen(c *gc.C) {
+	s.assertRejected(c, MaxUserAttributeLen(100), "uat.asc", "user attribute 0 is [0-9]+ octets long, more than 100")
+	s.assertAccepted(c, MaxUserAttributeLen(1<<20), "uat.asc")
+}
+
+func (s *PolicySuite) TestKeyPolicies(c *gc.C) {
+	p := KeyPolicies{MaxUserIDs(1), MinRSABits(4096)}
+	s.assertRejected(c, p, "alice_signed.asc", "RSA key .* has 2048 bits, fewer than 4096")
+	s.assertRejected(c, p, "0ff16c87.asc", "key has 9 user IDs, more than 1")
+	s.assertAccepted(c, KeyPolicies{}, "0ff16c87.asc")
+}
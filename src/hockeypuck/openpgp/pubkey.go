@@ -20,10 +20,8 @@ package openpgp
 import (
 	"bytes"
 	"crypto/md5"
-	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
-	"strings"
 	"time"
 
 	"golang.org/x/crypto/openpgp/packet"
@@ -69,6 +67,14 @@ func AlgorithmName(code int) string {
 		return "elg"
 	case 22:
 		return "eddsa"
+	case 25:
+		return "x25519"
+	case 26:
+		return "x448"
+	case 27:
+		return "ed25519"
+	case 28:
+		return "ed448"
 	default:
 		return fmt.Sprintf("unk(#%d)", code)
 	}
@@ -128,6 +134,17 @@ func (pkp *PublicKey) publicKeyV3Packet() (*packet.PublicKeyV3, error) {
 }
 
 func (pkp *PublicKey) parse(op *packet.OpaquePacket, subkey bool) error {
+	if isRawKeyPacket(op.Contents) {
+		if (op.Tag == 14) != subkey { // packet.PacketTypePublicSubKey
+			return ErrInvalidPacketType
+		}
+		pk, err := parseRawPublicKey(op.Contents)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return pkp.setRawPublicKey(pk)
+	}
+
 	p, err := op.Parse()
 	if err != nil {
 		return errgo.Mask(err)
@@ -152,13 +169,10 @@ func (pkp *PublicKey) parse(op *packet.OpaquePacket, subkey bool) error {
 
 func (pkp *PublicKey) setUnsupported(op *packet.OpaquePacket) error {
 	// Calculate opaque fingerprint on unsupported public key packet
-	h := sha1.New()
-	h.Write([]byte{0x99, byte(len(op.Contents) >> 8), byte(len(op.Contents))})
-	h.Write(op.Contents)
-	fpr := hex.EncodeToString(h.Sum(nil))
+	fpr := hex.EncodeToString(keyFingerprint(op.Contents))
 	pkp.RFingerprint = Reverse(fpr)
 	pkp.UUID = pkp.RFingerprint
-	return pkp.setV4IDs(pkp.UUID)
+	return pkp.setIDs(pkp.UUID)
 }
 
 func (pkp *PublicKey) setPublicKey(pk *packet.PublicKey) error {
@@ -197,6 +211,46 @@ func (pkp *PublicKey) setV4IDs(rfp string) error {
 	return nil
 }
 
+// setV6IDs sets the key IDs of a v6 key, which lead its fingerprint rather
+// than end it.
+func (pkp *PublicKey) setV6IDs(rfp string) error {
+	if len(rfp) != v6FingerprintLen {
+		return errgo.Newf("invalid fingerprint %q", rfp)
+	}
+	pkp.RKeyID = rfp[v6FingerprintLen-16:]
+	pkp.RShortID = pkp.RKeyID[:8]
+	return nil
+}
+
+// setIDs sets the key IDs of a v4 or v6 key from its fingerprint.
+func (pkp *PublicKey) setIDs(rfp string) error {
+	if len(rfp) == v6FingerprintLen {
+		return pkp.setV6IDs(rfp)
+	}
+	return pkp.setV4IDs(rfp)
+}
+
+func (pkp *PublicKey) setRawPublicKey(pk *rawPublicKey) error {
+	pkp.RFingerprint = Reverse(hex.EncodeToString(pk.Fingerprint))
+	pkp.UUID = pkp.RFingerprint
+	err := pkp.setIDs(pkp.UUID)
+	if err != nil {
+		return err
+	}
+	pkp.Creation = pk.CreationTime
+	pkp.Algorithm = pk.PubKeyAlgo
+	pkp.BitLen = pk.BitLength()
+	pkp.Parsed = true
+	return nil
+}
+
+// isRaw returns whether the key is parsed and verified by this package
+// rather than by golang.org/x/crypto/openpgp.
+func (pkp *PublicKey) isRaw() bool {
+	op, err := pkp.opaquePacket()
+	return err == nil && isRawKeyPacket(op.Contents)
+}
+
 func (pkp *PublicKey) setPublicKeyV3(pk *packet.PublicKeyV3) error {
 	var buf bytes.Buffer
 	err := pk.Serialize(&buf)
@@ -307,7 +361,7 @@ func (pubkey *PrimaryKey) SigInfo() (*SelfSigs, []*Signature) {
 	var otherSigs []*Signature
 	for _, sig := range pubkey.Signatures {
 		// Skip non-self-certifications.
-		if !strings.HasPrefix(pubkey.UUID, sig.RIssuerKeyID) {
+		if !sig.issuedBy(&pubkey.PublicKey) {
 			otherSigs = append(otherSigs, sig)
 			continue
 		}
@@ -0,0 +1,528 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/brainpool"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/errgo.v1"
+)
+
+// golang.org/x/crypto/openpgp only understands version 3 and 4 packets using
+// the algorithms of RFC 4880 and RFC 6637. Version 6 packets, and version 4
+// packets using the algorithms added by RFC 9580, are parsed and verified
+// here instead.
+
+// v6FingerprintLen is the length of a version 6 fingerprint in hex digits: a
+// SHA-256 digest.
+const v6FingerprintLen = 64
+
+// isRFC9580Algorithm returns whether the public key algorithm is one of those
+// added by RFC 9580: X25519, X448, Ed25519 and Ed448.
+func isRFC9580Algorithm(algo byte) bool {
+	return algo >= 25 && algo <= 28
+}
+
+// isRawKeyPacket returns whether the public key packet with the given body
+// must be parsed by parseRawPublicKey.
+func isRawKeyPacket(contents []byte) bool {
+	if len(contents) > 0 && contents[0] == 6 {
+		return true
+	}
+	return len(contents) > 5 && contents[0] == 4 && isRFC9580Algorithm(contents[5])
+}
+
+// isRawSignaturePacket returns whether the signature packet with the given
+// body must be parsed by parseRawSignature. This includes attestations,
+// whose subpackets x/crypto does not know.
+func isRawSignaturePacket(contents []byte) bool {
+	if len(contents) > 0 && contents[0] == 6 {
+		return true
+	}
+	return len(contents) > 2 && contents[0] == 4 &&
+		(isRFC9580Algorithm(contents[2]) || contents[1] == attestationSigType)
+}
+
+// rawPublicKey is a version 4 or 6 public key or subkey packet (RFC 9580
+// §5.5.2).
+type rawPublicKey struct {
+	contents []byte
+
+	Version      int
+	CreationTime time.Time
+	PubKeyAlgo   int
+	Material     []byte
+	Fingerprint  []byte
+}
+
+// parseRawPublicKey parses the body of a version 4 or 6 public key packet.
+func parseRawPublicKey(contents []byte) (*rawPublicKey, error) {
+	if len(contents) < 6 {
+		return nil, errgo.New("invalid public key packet")
+	}
+	pk := &rawPublicKey{
+		contents:     contents,
+		Version:      int(contents[0]),
+		CreationTime: time.Unix(int64(binary.BigEndian.Uint32(contents[1:5])), 0),
+		PubKeyAlgo:   int(contents[5]),
+		Fingerprint:  keyFingerprint(contents),
+	}
+	switch pk.Version {
+	case 4:
+		pk.Material = contents[6:]
+	case 6:
+		if len(contents) < 10 {
+			return nil, errgo.New("invalid v6 public key packet")
+		}
+		n := binary.BigEndian.Uint32(contents[6:10])
+		if uint64(n) != uint64(len(contents)-10) {
+			return nil, errgo.Newf("v6 public key material length %d does not match packet", n)
+		}
+		pk.Material = contents[10:]
+	default:
+		return nil, errgo.Newf("unsupported public key version %d", pk.Version)
+	}
+	return pk, nil
+}
+
+// keyFingerprint returns the fingerprint of the public key packet with the
+// given body: a SHA-256 digest for version 6 keys, and a SHA-1 digest
+// otherwise (RFC 9580 §5.5.4).
+func keyFingerprint(contents []byte) []byte {
+	var h hash.Hash
+	if len(contents) > 0 && contents[0] == 6 {
+		h = sha256.New()
+	} else {
+		h = sha1.New()
+	}
+	writeKeyPacket(h, contents)
+	return h.Sum(nil)
+}
+
+// writeKeyPacket writes a public key packet body to a fingerprint or
+// signature hash, after the prefix for its version.
+func writeKeyPacket(w io.Writer, contents []byte) {
+	if len(contents) > 0 && contents[0] == 6 {
+		writePrefixed(w, 0x9b, contents)
+		return
+	}
+	w.Write([]byte{0x99, byte(len(contents) >> 8), byte(len(contents))})
+	w.Write(contents)
+}
+
+// writePrefixed writes a packet body to a signature hash, preceded by the
+// given octet and its four-octet length.
+func writePrefixed(w io.Writer, prefix byte, contents []byte) {
+	var buf [5]byte
+	buf[0] = prefix
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(contents)))
+	w.Write(buf[:])
+	w.Write(contents)
+}
+
+// BitLength returns the size of the key, as reported for keys parsed by
+// golang.org/x/crypto/openpgp: the bit length of the modulus or prime for
+// RSA, DSA and Elgamal, or of the public point for the ECC algorithms of RFC
+// 6637. It is zero for unknown algorithms.
+func (pk *rawPublicKey) BitLength() int {
+	switch pk.PubKeyAlgo {
+	case 1, 2, 3, 16, 17: // RSA, Elgamal, DSA
+		return mpiBitLength(pk.Material)
+	case 18, 19, 22: // ECDH, ECDSA, EdDSA
+		_, point, ok := readOID(pk.Material)
+		if !ok {
+			return 0
+		}
+		return mpiBitLength(point)
+	case 25, 27: // X25519, Ed25519
+		return 256
+	case 26, 28: // X448, Ed448
+		return 448
+	}
+	return 0
+}
+
+// mpiBitLength returns the bit length of the multiprecision integer at the
+// start of b, or zero if b is too short to hold one.
+func mpiBitLength(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// readMPI returns the value of the multiprecision integer at the start of b,
+// and the bytes which follow it.
+func readMPI(b []byte) (value, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := (mpiBitLength(b) + 7) / 8
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
+
+// readOID returns the curve OID at the start of the public key material of
+// an ECC key, and the bytes which follow it.
+func readOID(b []byte) (oid, rest []byte, ok bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, nil, false
+	}
+	return b[1 : 1+int(b[0])], b[1+int(b[0]):], true
+}
+
+var (
+	oidEd25519Legacy = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+
+	// ecdsaCurves are the curves supported for ECDSA, by OID.
+	ecdsaCurves = []struct {
+		oid   []byte
+		curve func() elliptic.Curve
+	}{
+		{[]byte{0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}, elliptic.P256},
+		{[]byte{0x2b, 0x81, 0x04, 0x00, 0x22}, elliptic.P384},
+		{[]byte{0x2b, 0x81, 0x04, 0x00, 0x23}, elliptic.P521},
+		{[]byte{0x2b, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x07}, brainpool.P256r1},
+		{[]byte{0x2b, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x0b}, brainpool.P384r1},
+		{[]byte{0x2b, 0x24, 0x03, 0x03, 0x02, 0x08, 0x01, 0x01, 0x0d}, brainpool.P512r1},
+	}
+)
+
+func ecdsaCurve(oid []byte) (elliptic.Curve, bool) {
+	for _, c := range ecdsaCurves {
+		if bytes.Equal(c.oid, oid) {
+			return c.curve(), true
+		}
+	}
+	return nil, false
+}
+
+// rawSignature is a version 4 or 6 signature packet (RFC 9580 §5.2.3).
+type rawSignature struct {
+	Version    int
+	SigType    int
+	PubKeyAlgo int
+	Hash       crypto.Hash
+	HashAlgo   int
+
+	HashedSubpackets   []subpacket
+	UnhashedSubpackets []subpacket
+
+	// hashed is the part of the packet body covered by the signature:
+	// everything up to and including the hashed subpackets.
+	hashed []byte
+	left16 [2]byte
+	Salt   []byte
+
+	// Material holds the algorithm-specific signature fields.
+	Material []byte
+}
+
+// sigHashes maps the OpenPGP hash algorithms available to verify signatures
+// to their salt sizes in version 6 signatures, which may not use SHA-1 (RFC
+// 9580 §9.5).
+var sigHashes = map[int]struct {
+	hash     crypto.Hash
+	saltSize int
+}{
+	2:  {crypto.SHA1, 0},
+	8:  {crypto.SHA256, 16},
+	9:  {crypto.SHA384, 24},
+	10: {crypto.SHA512, 32},
+	11: {crypto.SHA224, 16},
+}
+
+// parseRawSignature parses the body of a version 4 or 6 signature packet.
+func parseRawSignature(contents []byte) (*rawSignature, error) {
+	if len(contents) < 4 {
+		return nil, errgo.New("invalid signature packet")
+	}
+	sig := &rawSignature{
+		Version:    int(contents[0]),
+		SigType:    int(contents[1]),
+		PubKeyAlgo: int(contents[2]),
+		HashAlgo:   int(contents[3]),
+	}
+	// Subpacket areas have two-octet lengths in version 4 signatures, and
+	// four-octet lengths in version 6.
+	var lenSize int
+	switch sig.Version {
+	case 4:
+		lenSize = 2
+	case 6:
+		lenSize = 4
+	default:
+		return nil, errgo.Newf("unsupported signature version %d", sig.Version)
+	}
+	readArea := func(b []byte) (area, rest []byte, ok bool) {
+		if len(b) < lenSize {
+			return nil, nil, false
+		}
+		var n uint64
+		for _, c := range b[:lenSize] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[lenSize:]
+		if n > uint64(len(b)) {
+			return nil, nil, false
+		}
+		return b[:n], b[n:], true
+	}
+
+	hashed, rest, ok := readArea(contents[4:])
+	if !ok {
+		return nil, errgo.New("truncated hashed subpackets")
+	}
+	sig.hashed = contents[:len(contents)-len(rest)]
+	unhashed, rest, ok := readArea(rest)
+	if !ok {
+		return nil, errgo.New("truncated unhashed subpackets")
+	}
+	if len(rest) < 2 {
+		return nil, errgo.New("truncated signature")
+	}
+	copy(sig.left16[:], rest[:2])
+	rest = rest[2:]
+	if sig.Version == 6 {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, errgo.New("truncated signature salt")
+		}
+		sig.Salt, rest = rest[1:1+int(rest[0])], rest[1+int(rest[0]):]
+	}
+	sig.Material = rest
+
+	var err error
+	sig.HashedSubpackets, err = parseSubpackets(hashed)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid hashed subpackets")
+	}
+	sig.UnhashedSubpackets, err = parseSubpackets(unhashed)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid unhashed subpackets")
+	}
+	if h, ok := sigHashes[sig.HashAlgo]; ok {
+		if sig.Version != 6 {
+			sig.Hash = h.hash
+		} else if h.saltSize != 0 {
+			if len(sig.Salt) != h.saltSize {
+				return nil, errgo.Newf("invalid salt size %d for hash algorithm %d", len(sig.Salt), sig.HashAlgo)
+			}
+			sig.Hash = h.hash
+		}
+	}
+	return sig, nil
+}
+
+// hashedSubpacket returns the contents of the first hashed subpacket of the
+// given type.
+func (sig *rawSignature) hashedSubpacket(typ byte) ([]byte, bool) {
+	for _, sp := range sig.HashedSubpackets {
+		if sp.Type == typ {
+			return sp.Contents, true
+		}
+	}
+	return nil, false
+}
+
+// IssuerKeyID returns the key ID of the issuer, from the issuer fingerprint
+// or issuer key ID subpacket in either area.
+func (sig *rawSignature) IssuerKeyID() ([]byte, bool) {
+	for _, area := range [][]subpacket{sig.HashedSubpackets, sig.UnhashedSubpackets} {
+		for _, sp := range area {
+			switch {
+			case sp.Type == issuerFingerprintSubpacket && len(sp.Contents) == 33 && sp.Contents[0] == 6:
+				// The key ID of a v6 key leads its fingerprint.
+				return sp.Contents[1:9], true
+			case sp.Type == issuerFingerprintSubpacket && len(sp.Contents) == 21 && sp.Contents[0] == 4:
+				return sp.Contents[13:], true
+			case sp.Type == issuerSubpacket && len(sp.Contents) == 8:
+				return sp.Contents, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// uint32Subpacket returns the value of the hashed four-octet subpacket of
+// the given type.
+func (sig *rawSignature) uint32Subpacket(typ byte) (uint32, bool) {
+	b, ok := sig.hashedSubpacket(typ)
+	if !ok || len(b) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
+
+// verify checks that sig was made by the key over the given signed data,
+// which is written to the hash by writeSigned (RFC 9580 §5.2.4).
+func (pk *rawPublicKey) verify(sig *rawSignature, writeSigned func(w io.Writer)) error {
+	if sig.Version != pk.Version {
+		return errgo.Newf("v%d signature cannot be made by a v%d key", sig.Version, pk.Version)
+	}
+	if sig.Hash == 0 || !sig.Hash.Available() {
+		return errgo.Newf("unsupported hash algorithm %d", sig.HashAlgo)
+	}
+	if sig.PubKeyAlgo != pk.PubKeyAlgo {
+		return errgo.Newf("signature algorithm %d does not match key algorithm %d", sig.PubKeyAlgo, pk.PubKeyAlgo)
+	}
+	h := sig.Hash.New()
+	h.Write(sig.Salt)
+	writeSigned(h)
+	h.Write(sig.hashed)
+	var trailer [6]byte
+	trailer[0], trailer[1] = byte(sig.Version), 0xff
+	binary.BigEndian.PutUint32(trailer[2:], uint32(len(sig.hashed)))
+	h.Write(trailer[:])
+	digest := h.Sum(nil)
+	if !bytes.Equal(digest[:2], sig.left16[:]) {
+		return errgo.New("signature hash does not match")
+	}
+
+	switch pk.PubKeyAlgo {
+	case 1, 3: // RSA
+		n, rest, ok := readMPI(pk.Material)
+		if !ok {
+			return errgo.New("invalid RSA public key")
+		}
+		e, _, ok := readMPI(rest)
+		if !ok || len(e) > 4 {
+			return errgo.New("invalid RSA public key")
+		}
+		s, _, ok := readMPI(sig.Material)
+		if !ok {
+			return errgo.New("invalid RSA signature")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		// The signature must be as long as the modulus.
+		if k := pub.Size(); len(s) < k {
+			s = append(make([]byte, k-len(s)), s...)
+		}
+		return errgo.Mask(rsa.VerifyPKCS1v15(pub, sig.Hash, digest, s))
+	case 19: // ECDSA
+		oid, point, ok := readOID(pk.Material)
+		if !ok {
+			return errgo.New("invalid ECDSA public key")
+		}
+		curve, ok := ecdsaCurve(oid)
+		if !ok {
+			return errgo.Newf("unsupported ECDSA curve %x", oid)
+		}
+		point, _, ok = readMPI(point)
+		if !ok {
+			return errgo.New("invalid ECDSA public key")
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return errgo.New("invalid ECDSA public key")
+		}
+		r, rest, ok := readMPI(sig.Material)
+		if !ok {
+			return errgo.New("invalid ECDSA signature")
+		}
+		s, _, ok := readMPI(rest)
+		if !ok {
+			return errgo.New("invalid ECDSA signature")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if !ecdsa.Verify(pub, digest, new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)) {
+			return errgo.New("ECDSA verification failure")
+		}
+		return nil
+	case 22: // EdDSA, as used by v4 keys before RFC 9580
+		if pk.Version != 4 {
+			return errgo.Newf("v%d keys may not use legacy EdDSA", pk.Version)
+		}
+		oid, point, ok := readOID(pk.Material)
+		if !ok || !bytes.Equal(oid, oidEd25519Legacy) {
+			return errgo.Newf("unsupported EdDSA curve %x", oid)
+		}
+		// The public point is prefixed with 0x40 to mark its native encoding.
+		point, _, ok = readMPI(point)
+		if !ok || len(point) != 1+ed25519.PublicKeySize || point[0] != 0x40 {
+			return errgo.New("invalid EdDSA public key")
+		}
+		r, rest, ok := readMPI(sig.Material)
+		if !ok || len(r) > 32 {
+			return errgo.New("invalid EdDSA signature")
+		}
+		s, _, ok := readMPI(rest)
+		if !ok || len(s) > 32 {
+			return errgo.New("invalid EdDSA signature")
+		}
+		// R and S lose their leading zeros as MPIs.
+		var rs [ed25519.SignatureSize]byte
+		copy(rs[32-len(r):32], r)
+		copy(rs[64-len(s):], s)
+		if !ed25519.Verify(ed25519.PublicKey(point[1:]), digest, rs[:]) {
+			return errgo.New("EdDSA verification failure")
+		}
+		return nil
+	case 27: // Ed25519
+		if len(pk.Material) != ed25519.PublicKeySize || len(sig.Material) != ed25519.SignatureSize {
+			return errgo.New("invalid Ed25519 key or signature")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(pk.Material), digest, sig.Material) {
+			return errgo.New("Ed25519 verification failure")
+		}
+		return nil
+	}
+	return errgo.Newf("unsupported public key algorithm %d", pk.PubKeyAlgo)
+}
+
+// verifyRawSelfSig checks that sig was made by the primary key over itself,
+// followed by whatever writeSigned writes, unless it is nil.
+func (pubkey *PrimaryKey) verifyRawSelfSig(sig *Signature, writeSigned func(w io.Writer)) error {
+	pkOpaque, err := pubkey.opaquePacket()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	pk, err := parseRawPublicKey(pkOpaque.Contents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sOpaque, err := sig.opaquePacket()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	s, err := parseRawSignature(sOpaque.Contents)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(pk.verify(s, func(w io.Writer) {
+		writeKeyPacket(w, pk.contents)
+		if writeSigned != nil {
+			writeSigned(w)
+		}
+	}))
+}
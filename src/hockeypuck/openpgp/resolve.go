@@ -24,6 +24,32 @@ import (
 	"gopkg.in/errgo.v1"
 )
 
+// SelfSigned returns whether the key has any valid self-signature: a key
+// revocation, or a certification or revocation of any of its user IDs, user
+// attributes or subkeys. ValidSelfSigned leaves nothing to serve of keys
+// without one.
+func SelfSigned(key *PrimaryKey) bool {
+	if ss, _ := key.SigInfo(); len(ss.Revocations) > 0 {
+		return true
+	}
+	for _, uid := range key.UserIDs {
+		if ss, _ := uid.SigInfo(key); len(ss.Certifications) > 0 || len(ss.Revocations) > 0 {
+			return true
+		}
+	}
+	for _, uat := range key.UserAttributes {
+		if ss, _ := uat.SigInfo(key); len(ss.Certifications) > 0 || len(ss.Revocations) > 0 {
+			return true
+		}
+	}
+	for _, subKey := range key.SubKeys {
+		if ss, _ := subKey.SigInfo(key); len(ss.Certifications) > 0 || len(ss.Revocations) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 	var userIDs []*UserID
 	var userAttributes []*UserAttribute
@@ -38,6 +64,9 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 		}
 		if len(certs) > 0 {
 			uid.Signatures = certs
+			for _, attestation := range ss.Attestations {
+				uid.Signatures = append(uid.Signatures, attestation.Signature)
+			}
 			if !selfSignedOnly {
 				uid.Signatures = append(uid.Signatures, others...)
 			}
@@ -54,6 +83,9 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 		}
 		if len(certs) > 0 {
 			uat.Signatures = certs
+			for _, attestation := range ss.Attestations {
+				uat.Signatures = append(uat.Signatures, attestation.Signature)
+			}
 			if !selfSignedOnly {
 				uat.Signatures = append(uat.Signatures, others...)
 			}
@@ -87,6 +119,36 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 	return key.updateMD5()
 }
 
+// ErrNoSelfSignature is the cause of the error returned by SanitizeKey for keys
+// without any valid self-signature.
+var ErrNoSelfSignature = errgo.New("key has no valid self-signature")
+
+// SanitizeKey prepares a key submitted by a client for storage, dropping its
+// malformed packets and duplicates. It returns the number of malformed
+// packets dropped, and an error if the key is malformed or, with cause
+// ErrNoSelfSignature, has no self-signature.
+func SanitizeKey(key *PrimaryKey) (int, error) {
+	var dropped int
+	var others []*Packet
+	for _, other := range key.Others {
+		if other.Malformed {
+			dropped++
+		} else {
+			others = append(others, other)
+		}
+	}
+	key.Others = others
+	// DropDuplicates also updates the digest for the packets dropped.
+	err := DropDuplicates(key)
+	if err != nil {
+		return dropped, errgo.Notef(err, "malformed key")
+	}
+	if !SelfSigned(key) {
+		return dropped, errgo.WithCausef(nil, ErrNoSelfSignature, "key %s has no valid self-signature", key.Fingerprint())
+	}
+	return dropped, nil
+}
+
 func DropDuplicates(key *PrimaryKey) error {
 	err := dedup(key, nil)
 	if err != nil {
@@ -21,6 +21,7 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"sort"
 	"strings"
 	"time"
@@ -28,6 +29,7 @@ import (
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 
 	"hockeypuck/testing"
 )
@@ -278,3 +280,292 @@ func (s *ResolveSuite) TestFakeNews(c *gc.C) {
 	c.Assert(ValidSelfSigned(key, false), gc.IsNil)
 	c.Assert(key.UserAttributes, gc.HasLen, 0)
 }
+
+func (s *ResolveSuite) TestNoModify(c *gc.C) {
+	c.Assert(NoModify(MustInputAscKey("alice_signed.asc")), gc.Equals, true)
+	c.Assert(NoModify(MustInputAscKey("d7346e26.asc")), gc.Equals, false)
+}
+
+func (s *ResolveSuite) TestDropUnowned(c *gc.C) {
+	key := MustInputAscKey("alice_signed.asc")
+	unsigned := MustInputAscKey("alice_unsigned.asc")
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 2)
+
+	unowned, err := DropUnowned(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(unowned.Len(), gc.Equals, 1)
+	c.Assert(unowned.Signatures, gc.HasLen, 1)
+	c.Assert(unowned.Signatures[0].RIssuerKeyID, gc.Equals, "5bf04676d10aea26")
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 1)
+	c.Assert(key.MD5, gc.Equals, unsigned.MD5)
+
+	// User IDs without a valid self-signature are dropped entirely.
+	key = MustInputAscKey("badselfsig.asc")
+	c.Assert(key.UserIDs, gc.HasLen, 5)
+	unowned, err = DropUnowned(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.UserIDs, gc.HasLen, 2)
+	c.Assert(unowned.UserIDs, gc.HasLen, 3)
+	for _, sig := range unowned.Signatures {
+		c.Assert(strings.HasPrefix(key.UUID, sig.RIssuerKeyID), gc.Equals, false)
+	}
+}
+
+func (s *ResolveSuite) TestDiff(c *gc.C) {
+	unsigned := MustInputAscKey("alice_unsigned.asc")
+	signed := MustInputAscKey("alice_signed.asc")
+
+	diff := Diff(unsigned, signed)
+	c.Assert(diff.Len(), gc.Equals, 1)
+	c.Assert(diff.Signatures, gc.HasLen, 1)
+	c.Assert(diff.Signatures[0].RIssuerKeyID, gc.Equals, "5bf04676d10aea26")
+	c.Assert(Diff(signed, unsigned).Len(), gc.Equals, 0)
+
+	diff = Diff(nil, unsigned)
+	c.Assert(diff.UserIDs, gc.HasLen, 1)
+	c.Assert(diff.SubKeys, gc.HasLen, 1)
+	c.Assert(diff.Signatures, gc.HasLen, 2)
+}
+
+func (s *ResolveSuite) TestSelfSigned(c *gc.C) {
+	key := MustInputAscKey("alice_unsigned.asc")
+	c.Assert(SelfSigned(key), gc.Equals, true)
+	key.UserIDs[0].Signatures = nil
+	c.Assert(SelfSigned(key), gc.Equals, true)
+	key.SubKeys = nil
+	c.Assert(SelfSigned(key), gc.Equals, false)
+}
+
+// thirdPartyCerts returns the signatures among sigs not issued by key.
+func thirdPartyCerts(key *PrimaryKey, sigs []*Signature) []*Signature {
+	var result []*Signature
+	for _, sig := range sigs {
+		if !sig.issuedBy(&key.PublicKey) {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
+
+func (s *ResolveSuite) TestCertPolicyMaxPerUserID(c *gc.C) {
+	key := MustInputAscKey("fece664e.asc")
+	md5 := key.MD5
+	var total, selfSigs int
+	owner := make(map[*Signature]*UserID)
+	for _, uid := range key.UserIDs {
+		for _, sig := range uid.Signatures {
+			owner[sig] = uid
+		}
+		total += len(thirdPartyCerts(key, uid.Signatures))
+		selfSigs += len(uid.Signatures) - len(thirdPartyCerts(key, uid.Signatures))
+	}
+
+	policy := &CertPolicy{MaxPerUserID: 10}
+	dropped, err := policy.Apply(key, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.MD5, gc.Not(gc.Equals), md5)
+	var kept int
+	for _, uid := range key.UserIDs {
+		certs := thirdPartyCerts(key, uid.Signatures)
+		c.Assert(len(certs) <= 10, gc.Equals, true)
+		kept += len(certs)
+		selfSigs -= len(uid.Signatures) - len(certs)
+	}
+	c.Assert(selfSigs, gc.Equals, 0)
+	c.Assert(len(dropped), gc.Equals, total-kept)
+
+	// The newest certifications are kept.
+	for _, uid := range key.UserIDs {
+		var oldest time.Time
+		for _, sig := range thirdPartyCerts(key, uid.Signatures) {
+			if oldest.IsZero() || sig.Creation.Before(oldest) {
+				oldest = sig.Creation
+			}
+		}
+		for _, sig := range dropped {
+			if owner[sig] == uid {
+				c.Assert(sig.Creation.After(oldest), gc.Equals, false)
+			}
+		}
+	}
+
+	// Applying the policy again changes nothing.
+	md5 = key.MD5
+	dropped, err = policy.Apply(key, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(dropped, gc.HasLen, 0)
+	c.Assert(key.MD5, gc.Equals, md5)
+}
+
+func (s *ResolveSuite) TestCertPolicyNewestPerIssuer(c *gc.C) {
+	key := MustInputAscKey("fece664e.asc")
+	owner := make(map[*Signature]*UserID)
+	for _, uid := range key.UserIDs {
+		for _, sig := range uid.Signatures {
+			owner[sig] = uid
+		}
+	}
+	policy := &CertPolicy{NewestPerIssuer: true}
+	dropped, err := policy.Apply(key, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(dropped, gc.Not(gc.HasLen), 0)
+	for _, uid := range key.UserIDs {
+		issuers := make(map[string]*Signature)
+		for _, sig := range thirdPartyCerts(key, uid.Signatures) {
+			c.Assert(issuers[sig.RIssuerKeyID], gc.IsNil)
+			issuers[sig.RIssuerKeyID] = sig
+		}
+		for _, sig := range dropped {
+			if owner[sig] == uid {
+				kept := issuers[sig.RIssuerKeyID]
+				c.Assert(kept, gc.NotNil)
+				c.Assert(sig.Creation.After(kept.Creation), gc.Equals, false)
+			}
+		}
+	}
+}
+
+func (s *ResolveSuite) TestCertPolicyKnownIssuersOnly(c *gc.C) {
+	key := MustInputAscKey("fece664e.asc")
+	policy := &CertPolicy{KnownIssuersOnly: true}
+	_, err := policy.Apply(key, nil)
+	c.Assert(err, gc.ErrorMatches, "known issuers policy requires an issuer lookup")
+
+	known := thirdPartyCerts(key, key.UserIDs[0].Signatures)[0].RIssuerKeyID
+	var calls int
+	lookups := make(map[string]int)
+	dropped, err := policy.Apply(key, func(rkeyids []string) (map[string]bool, error) {
+		calls++
+		for _, rkeyid := range rkeyids {
+			lookups[rkeyid]++
+		}
+		return map[string]bool{known: true}, nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(dropped, gc.Not(gc.HasLen), 0)
+	c.Assert(calls, gc.Equals, 1)
+	c.Assert(lookups[known], gc.Equals, 1)
+	for rkeyid, n := range lookups {
+		c.Assert(n, gc.Equals, 1, gc.Commentf("%s", rkeyid))
+	}
+	for _, uid := range key.UserIDs {
+		c.Assert(len(uid.Signatures) > 0, gc.Equals, true)
+		for _, sig := range thirdPartyCerts(key, uid.Signatures) {
+			c.Assert(sig.RIssuerKeyID, gc.Equals, known)
+		}
+	}
+
+	key = MustInputAscKey("fece664e.asc")
+	_, err = policy.Apply(key, func([]string) (map[string]bool, error) {
+		return nil, errgo.New("boom")
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot look up issuers: boom`)
+}
+
+func (s *ResolveSuite) TestCertPolicyMaxExamined(c *gc.C) {
+	key := MustInputAscKey("fece664e.asc")
+	uid := key.UserIDs[0]
+	flood := thirdPartyCerts(key, uid.Signatures)[0]
+	for i := 0; i < maxCertsExamined+10; i++ {
+		sig := *flood
+		sig.UUID = fmt.Sprintf("flood-%d", i)
+		sig.RIssuerKeyID = fmt.Sprintf("%016x", i)
+		sig.Creation = time.Now().Add(time.Duration(-i) * time.Second)
+		uid.Signatures = append(uid.Signatures, &sig)
+	}
+	policy := &CertPolicy{KnownIssuersOnly: true}
+	var n int
+	_, err := policy.Apply(key, func(rkeyids []string) (map[string]bool, error) {
+		for _, rkeyid := range rkeyids {
+			if strings.HasPrefix(rkeyid, "00000") {
+				n++
+			}
+		}
+		known := make(map[string]bool)
+		for _, rkeyid := range rkeyids {
+			known[rkeyid] = true
+		}
+		return known, nil
+	})
+	c.Assert(err, gc.IsNil)
+	// Only the newest certifications are examined, and kept.
+	c.Assert(n, gc.Equals, maxCertsExamined)
+	c.Assert(thirdPartyCerts(key, uid.Signatures), gc.HasLen, maxCertsExamined)
+}
+
+func (s *ResolveSuite) TestCertPolicyUnnamedIssuer(c *gc.C) {
+	key := MustInputAscKey("fece664e.asc")
+	unnamed := thirdPartyCerts(key, key.UserIDs[0].Signatures)[0]
+	unnamed.RIssuerKeyID = ""
+	policy := &CertPolicy{KnownIssuersOnly: true}
+	dropped, err := policy.Apply(key, func(rkeyids []string) (map[string]bool, error) {
+		known := make(map[string]bool)
+		for _, rkeyid := range rkeyids {
+			c.Assert(rkeyid, gc.Not(gc.Equals), "")
+			known[rkeyid] = true
+		}
+		return known, nil
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(dropped, gc.DeepEquals, []*Signature{unnamed})
+}
+
+func (s *ResolveSuite) TestCertPolicyWithoutLookups(c *gc.C) {
+	var policy *CertPolicy
+	c.Assert(policy.WithoutLookups(), gc.IsNil)
+	policy = &CertPolicy{KnownIssuersOnly: true}
+	c.Assert(policy.WithoutLookups(), gc.IsNil)
+	policy = &CertPolicy{MaxPerUserID: 10, NewestPerIssuer: true, KnownIssuersOnly: true}
+	c.Assert(policy.WithoutLookups(), gc.DeepEquals, &CertPolicy{MaxPerUserID: 10, NewestPerIssuer: true})
+}
+
+func (s *ResolveSuite) TestAttested(c *gc.C) {
+	const bob, carol = "8a540eb0b84d8c4f", "dda31aed3596b178"
+	key := MustInputAscKey("attested.asc")
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	uid := key.UserIDs[0]
+	c.Assert(uid.Signatures, gc.HasLen, 5)
+	ss, others := uid.SigInfo(key)
+	c.Assert(ss.Errors, gc.HasLen, 0)
+	c.Assert(ss.Attestations, gc.HasLen, 2)
+	c.Assert(others, gc.HasLen, 2)
+
+	// The latest attestation withdrew Carol's certification.
+	attested := uid.AttestedCerts(key)
+	c.Assert(attested, gc.HasLen, 1)
+	c.Assert(attested[0].IssuerKeyID(), gc.Equals, bob)
+
+	// Attestations are kept with the self-signatures.
+	err := ValidSelfSigned(key, false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 5)
+
+	md5 := key.MD5
+	dropped, err := DropUnattested(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(dropped, gc.HasLen, 1)
+	c.Assert(dropped[0].IssuerKeyID(), gc.Equals, carol)
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 4)
+	c.Assert(key.MD5, gc.Not(gc.Equals), md5)
+
+	// Without the latest attestation, the earlier one counts.
+	latest := ss.Attestations[0].Signature.Creation
+	key = MustInputAscKey("attested.asc")
+	uid = key.UserIDs[0]
+	var sigs []*Signature
+	for _, sig := range uid.Signatures {
+		if !sig.Creation.Equal(latest) {
+			sigs = append(sigs, sig)
+		}
+	}
+	uid.Signatures = sigs
+	c.Assert(uid.AttestedCerts(key), gc.HasLen, 2)
+
+	// Third-party certifications are dropped from keys without
+	// attestations.
+	key = MustInputAscKey("alice_signed.asc")
+	dropped, err = DropUnattested(key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(dropped, gc.HasLen, 1)
+	c.Assert(dropped[0].RIssuerKeyID, gc.Equals, "5bf04676d10aea26")
+}
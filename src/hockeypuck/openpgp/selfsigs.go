@@ -38,6 +38,7 @@ type SelfSigs struct {
 	Certifications []*CheckSig
 	Expirations    []*CheckSig
 	Primaries      []*CheckSig
+	Attestations   []*CheckSig
 	Errors         []*CheckSig
 
 	target packetNode
@@ -92,6 +93,7 @@ func (s *SelfSigs) resolve() {
 	sort.Sort(checkSigCreationDesc(s.Certifications))
 	sort.Sort(checkSigExpirationDesc(s.Expirations))
 	sort.Sort(checkSigCreationDesc(s.Primaries))
+	sort.Sort(checkSigCreationDesc(s.Attestations))
 }
 
 var zeroTime time.Time
@@ -110,6 +112,18 @@ func (s *SelfSigs) ExpiresAt() (time.Time, bool) {
 	return zeroTime, false
 }
 
+// KeyExpiresAt returns when the key expires according to the latest
+// self-certification of the target, which supersedes any earlier ones. ok is
+// false if the key does not expire, or the target has no
+// self-certifications.
+func (s *SelfSigs) KeyExpiresAt() (time.Time, bool) {
+	if len(s.Certifications) == 0 {
+		return zeroTime, false
+	}
+	expiresAt := s.Certifications[0].Signature.KeyExpiration
+	return expiresAt, !expiresAt.IsZero()
+}
+
 func (s *SelfSigs) Valid() bool {
 	revoked := len(s.Revocations) > 0
 	expiration, okExpiration := s.ExpiresAt()
@@ -35,10 +35,34 @@ type Signature struct {
 	Creation     time.Time
 	Expiration   time.Time
 	Primary      bool
+
+	// KeyExpiration is when the key expires according to the key
+	// expiration time subpacket of a self-signature, or zero if it has none.
+	// Unlike Expiration, it is not set by a signature expiration time.
+	KeyExpiration time.Time
+
+	// KeyserverNoModify indicates that the signer asked, in the hashed key
+	// server preferences, that the key only be modified by its holder.
+	KeyserverNoModify bool
 }
 
 const sigTag = "{sig}"
 
+// Signature subpacket types (RFC 9580 §5.2.3.7).
+const (
+	sigCreationTimeSubpacket   = 2
+	sigExpirationTimeSubpacket = 3
+	keyExpirationTimeSubpacket = 9
+	issuerSubpacket            = 16
+	primaryUserIDSubpacket     = 25
+	issuerFingerprintSubpacket = 33
+
+	// attestedCertificationsSubpacket lists the digests of the
+	// certifications attested by an attestation signature
+	// (draft-ietf-openpgp-rfc4880bis-10 §5.2.3.30).
+	attestedCertificationsSubpacket = 37
+)
+
 // contents implements the packetNode interface for default unclassified packets.
 func (sig *Signature) contents() []packetNode {
 	return []packetNode{sig}
@@ -99,6 +123,14 @@ func ParseSignature(op *packet.OpaquePacket, keyCreationTime time.Time, pubkeyUU
 }
 
 func (sig *Signature) parse(op *packet.OpaquePacket, keyCreationTime time.Time) error {
+	if isRawSignaturePacket(op.Contents) {
+		s, err := parseRawSignature(op.Contents)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return sig.setRawSignature(s, keyCreationTime)
+	}
+
 	p, err := op.Parse()
 	if err != nil {
 		return errgo.Mask(err)
@@ -106,6 +138,7 @@ func (sig *Signature) parse(op *packet.OpaquePacket, keyCreationTime time.Time)
 
 	switch s := p.(type) {
 	case *packet.Signature:
+		sig.KeyserverNoModify = keyserverNoModify(op.Contents)
 		return sig.setSignature(s, keyCreationTime)
 	case *packet.SignatureV3:
 		return sig.setSignatureV3(s)
@@ -136,6 +169,10 @@ func (sig *Signature) setSignature(s *packet.Signature, keyCreationTime time.Tim
 		sig.Expiration = keyCreationTime.Add(
 			time.Duration(*s.KeyLifetimeSecs) * time.Second)
 	}
+	if s.KeyLifetimeSecs != nil && *s.KeyLifetimeSecs != 0 {
+		sig.KeyExpiration = keyCreationTime.Add(
+			time.Duration(*s.KeyLifetimeSecs) * time.Second)
+	}
 
 	// Primary indicator
 	sig.Primary = s.IsPrimaryId != nil && *s.IsPrimaryId
@@ -155,6 +192,37 @@ func (sig *Signature) setSignatureV3(s *packet.SignatureV3) error {
 	return nil
 }
 
+func (sig *Signature) setRawSignature(s *rawSignature, keyCreationTime time.Time) error {
+	issuerKeyID, ok := s.IssuerKeyID()
+	if !ok {
+		return errgo.New("missing issuer key ID")
+	}
+	creation, ok := s.uint32Subpacket(sigCreationTimeSubpacket)
+	if !ok {
+		return errgo.New("missing signature creation time")
+	}
+	sig.Creation = time.Unix(int64(creation), 0)
+	sig.SigType = s.SigType
+	sig.RIssuerKeyID = Reverse(hex.EncodeToString(issuerKeyID))
+
+	// Expiration time
+	if secs, ok := s.uint32Subpacket(sigExpirationTimeSubpacket); ok {
+		sig.Expiration = sig.Creation.Add(time.Duration(secs) * time.Second)
+	} else if secs, ok := s.uint32Subpacket(keyExpirationTimeSubpacket); ok {
+		sig.Expiration = keyCreationTime.Add(time.Duration(secs) * time.Second)
+	}
+	if secs, ok := s.uint32Subpacket(keyExpirationTimeSubpacket); ok && secs != 0 {
+		sig.KeyExpiration = keyCreationTime.Add(time.Duration(secs) * time.Second)
+	}
+
+	// Primary indicator
+	primary, ok := s.hashedSubpacket(primaryUserIDSubpacket)
+	sig.Primary = ok && len(primary) == 1 && primary[0] != 0
+
+	sig.KeyserverNoModify = hasKeyserverNoModify(s.HashedSubpackets)
+	return nil
+}
+
 func (sig *Signature) signaturePacket() (*packet.Signature, error) {
 	op, err := sig.opaquePacket()
 	if err != nil {
@@ -190,3 +258,56 @@ func (sig *Signature) signatureV3Packet() (*packet.SignatureV3, error) {
 func (sig *Signature) IssuerKeyID() string {
 	return Reverse(sig.RIssuerKeyID)
 }
+
+// isRaw returns whether the signature is parsed and verified by this package
+// rather than by golang.org/x/crypto/openpgp.
+func (sig *Signature) isRaw() bool {
+	op, err := sig.opaquePacket()
+	return err == nil && isRawSignaturePacket(op.Contents)
+}
+
+// issuedBy returns whether the signature was issued by the given key.
+func (sig *Signature) issuedBy(pk *PublicKey) bool {
+	return sig.RIssuerKeyID == pk.RKeyID
+}
+
+// subpacket is a signature subpacket (RFC 9580 §5.2.3.7).
+type subpacket struct {
+	Type     byte
+	Critical bool
+	Contents []byte
+}
+
+// parseSubpackets parses a signature subpacket area.
+func parseSubpackets(b []byte) ([]subpacket, error) {
+	var result []subpacket
+	for len(b) > 0 {
+		var length int
+		switch {
+		case b[0] < 192:
+			length, b = int(b[0]), b[1:]
+		case b[0] < 255:
+			if len(b) < 2 {
+				return nil, errgo.New("truncated subpacket length")
+			}
+			length = (int(b[0])-192)<<8 + int(b[1]) + 192
+			b = b[2:]
+		default:
+			if len(b) < 5 {
+				return nil, errgo.New("truncated subpacket length")
+			}
+			length = int(binary.BigEndian.Uint32(b[1:5]))
+			b = b[5:]
+		}
+		if length < 1 || length > len(b) {
+			return nil, errgo.Newf("invalid subpacket length %d", length)
+		}
+		result = append(result, subpacket{
+			Type:     b[0] & 0x7f,
+			Critical: b[0]&0x80 != 0,
+			Contents: b[1:length],
+		})
+		b = b[length:]
+	}
+	return result, nil
+}
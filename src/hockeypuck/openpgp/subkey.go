@@ -19,7 +19,6 @@ package openpgp
 
 import (
 	"bytes"
-	"strings"
 
 	"golang.org/x/crypto/openpgp/packet"
 	"gopkg.in/errgo.v1"
@@ -101,7 +100,7 @@ func (subkey *SubKey) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 	var otherSigs []*Signature
 	for _, sig := range subkey.Signatures {
 		// Skip non-self-certifications.
-		if !strings.HasPrefix(pubkey.UUID, sig.RIssuerKeyID) {
+		if !sig.issuedBy(&pubkey.PublicKey) {
 			otherSigs = append(otherSigs, sig)
 			continue
 		}
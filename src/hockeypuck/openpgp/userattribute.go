@@ -19,7 +19,6 @@ package openpgp
 
 import (
 	"bytes"
-	"strings"
 
 	"golang.org/x/crypto/openpgp/packet"
 	"gopkg.in/errgo.v1"
@@ -125,7 +124,7 @@ func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature)
 	var otherSigs []*Signature
 	for _, sig := range uat.Signatures {
 		// Skip non-self-certifications.
-		if !strings.HasPrefix(pubkey.UUID, sig.RIssuerKeyID) {
+		if !sig.issuedBy(&pubkey.PublicKey) {
 			otherSigs = append(otherSigs, sig)
 			continue
 		}
@@ -149,6 +148,8 @@ func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature)
 			if sig.Primary {
 				selfSigs.Primaries = append(selfSigs.Primaries, checkSig)
 			}
+		case attestationSigType:
+			selfSigs.Attestations = append(selfSigs.Attestations, checkSig)
 		}
 	}
 	selfSigs.resolve()
@@ -19,7 +19,6 @@ package openpgp
 
 import (
 	"bytes"
-	"strings"
 	"unicode/utf8"
 
 	"golang.org/x/crypto/openpgp/packet"
@@ -152,7 +151,7 @@ func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 	var otherSigs []*Signature
 	for _, sig := range uid.Signatures {
 		// Skip non-self-certifications.
-		if !strings.HasPrefix(pubkey.UUID, sig.RIssuerKeyID) {
+		if !sig.issuedBy(&pubkey.PublicKey) {
 			otherSigs = append(otherSigs, sig)
 			continue
 		}
@@ -176,6 +175,8 @@ func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 			if sig.Primary {
 				selfSigs.Primaries = append(selfSigs.Primaries, checkSig)
 			}
+		case attestationSigType:
+			selfSigs.Attestations = append(selfSigs.Attestations, checkSig)
 		}
 	}
 	selfSigs.resolve()
@@ -18,14 +18,135 @@
 package openpgp
 
 import (
+	"bytes"
 	"crypto"
+	"encoding/hex"
 	"hash"
+	"io"
+	"io/ioutil"
 
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 	"gopkg.in/errgo.v1"
 )
 
+// CheckArmoredDetachedSignature checks that sigtext is an armored detached
+// signature over signed, made by the key or by one of its valid subkeys, and
+// returns the signature. Signatures by version 6 keys, and by keys using the
+// algorithms added by RFC 9580, are checked here; others by
+// golang.org/x/crypto/openpgp.
+func CheckArmoredDetachedSignature(key *PrimaryKey, signed []byte, sigtext io.Reader) (*Signature, error) {
+	block, err := armor.Decode(sigtext)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid armored signature")
+	} else if block.Type != xopenpgp.SignatureType {
+		return nil, errgo.Newf("expected %q, got %q", xopenpgp.SignatureType, block.Type)
+	}
+	body, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid armored signature")
+	}
+	op, err := packet.NewOpaqueReader(bytes.NewReader(body)).Next()
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid signature packet")
+	} else if op.Tag != 2 {
+		return nil, errgo.Newf("expected a signature packet, got tag %d", op.Tag)
+	}
+	sig, err := ParseSignature(op, key.Creation, key.UUID, key.UUID)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !isRawSignaturePacket(op.Contents) {
+		var buf bytes.Buffer
+		err = WritePackets(&buf, key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		keyring, err := xopenpgp.ReadKeyRing(&buf)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read key")
+		}
+		_, err = xopenpgp.CheckDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(body), nil)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return sig, nil
+	}
+
+	rawSig, err := parseRawSignature(op.Contents)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	switch rawSig.SigType {
+	case 0x00: // binary document
+	case 0x01: // canonical text document
+		signed = canonicalText(signed)
+	default:
+		return nil, errgo.Newf("signature type 0x%02x is not over a document", rawSig.SigType)
+	}
+	issuer, ok := rawSig.IssuerKeyID()
+	if !ok {
+		return nil, errgo.New("signature has no issuer")
+	}
+	signer := key.signingKey(Reverse(hex.EncodeToString(issuer)))
+	if signer == nil {
+		return nil, errgo.Newf("signature not made by key %q", key.Fingerprint())
+	}
+	signerOpaque, err := signer.opaquePacket()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	pk, err := parseRawPublicKey(signerOpaque.Contents)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = pk.verify(rawSig, func(w io.Writer) {
+		w.Write(signed)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return sig, nil
+}
+
+// signingKey returns the primary key if it has the given RKeyID, or the
+// valid subkey which does, or nil if there is neither.
+func (pubkey *PrimaryKey) signingKey(rkeyid string) *PublicKey {
+	if pubkey.RKeyID == rkeyid {
+		return &pubkey.PublicKey
+	}
+	for _, subKey := range pubkey.SubKeys {
+		if subKey.RKeyID != rkeyid {
+			continue
+		}
+		if ss, _ := subKey.SigInfo(pubkey); ss.Valid() {
+			return &subKey.PublicKey
+		}
+	}
+	return nil
+}
+
+// canonicalText returns text with its line endings converted to CRLF, as
+// signed in a canonical text signature.
+func canonicalText(text []byte) []byte {
+	text = bytes.Replace(text, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(text, []byte("\n"), []byte("\r\n"), -1)
+}
+
 func (pubkey *PrimaryKey) verifyPublicKeySelfSig(signed *PublicKey, sig *Signature) error {
+	if pubkey.isRaw() || signed.isRaw() || sig.isRaw() {
+		if signed == &pubkey.PublicKey {
+			return errgo.Mask(pubkey.verifyRawSelfSig(sig, nil))
+		}
+		subkeyOpaque, err := signed.opaquePacket()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(pubkey.verifyRawSelfSig(sig, func(w io.Writer) {
+			writeKeyPacket(w, subkeyOpaque.Contents)
+		}))
+	}
 	pkOpaque, err := pubkey.opaquePacket()
 	if err != nil {
 		return errgo.Mask(err)
@@ -61,6 +182,11 @@ func (pubkey *PrimaryKey) verifyUserIDSelfSig(uid *UserID, sig *Signature) error
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if pubkey.isRaw() || sig.isRaw() {
+		return errgo.Mask(pubkey.verifyRawSelfSig(sig, func(w io.Writer) {
+			writePrefixed(w, 0xb4, []byte(u.Id))
+		}))
+	}
 
 	pkOpaque, err := pubkey.opaquePacket()
 	if err != nil {
@@ -97,6 +223,15 @@ func (pubkey *PrimaryKey) verifyUserIDSelfSig(uid *UserID, sig *Signature) error
 }
 
 func (pubkey *PrimaryKey) verifyUserAttrSelfSig(uat *UserAttribute, sig *Signature) error {
+	if pubkey.isRaw() || sig.isRaw() {
+		uatOpaque, err := uat.opaquePacket()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(pubkey.verifyRawSelfSig(sig, func(w io.Writer) {
+			writePrefixed(w, 0xd1, uatOpaque.Contents)
+		}))
+	}
 	pk, err := pubkey.PublicKey.publicKeyPacket()
 	if err != nil {
 		return errgo.Mask(err)
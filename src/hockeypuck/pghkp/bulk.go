@@ -0,0 +1,396 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/errgo.v1"
+
+	"hockeypuck/hkp/jsonhkp"
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const defaultBulkBatchSize = 5000
+
+var crStagingSQL = []string{
+	`CREATE TEMPORARY TABLE IF NOT EXISTS keys_staging (
+rfingerprint TEXT NOT NULL,
+ctime TIMESTAMP WITH TIME ZONE NOT NULL,
+mtime TIMESTAMP WITH TIME ZONE NOT NULL,
+md5 TEXT NOT NULL,
+doc jsonb NOT NULL,
+keywords TEXT NOT NULL,
+rkeyid TEXT NOT NULL
+) ON COMMIT DELETE ROWS`,
+	`CREATE TEMPORARY TABLE IF NOT EXISTS subkeys_staging (
+rfingerprint TEXT NOT NULL,
+rsubfp TEXT NOT NULL,
+rkeyid TEXT NOT NULL
+) ON COMMIT DELETE ROWS`,
+}
+
+var drStagingSQL = []string{
+	`DROP TABLE IF EXISTS keys_staging`,
+	`DROP TABLE IF EXISTS subkeys_staging`,
+}
+
+// Keys are only merged from staging if neither their fingerprint nor their
+// digest is already stored.
+const mergeKeysSQL = `INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords, rkeyid)
+SELECT s.rfingerprint, s.ctime, s.mtime, s.md5, s.doc, to_tsvector(s.keywords), NULLIF(s.rkeyid, '')
+FROM keys_staging s
+WHERE NOT EXISTS (SELECT 1 FROM keys k WHERE k.rfingerprint = s.rfingerprint)
+AND NOT EXISTS (SELECT 1 FROM keys k WHERE k.md5 = s.md5)
+RETURNING rfingerprint`
+
+// Subkeys already claimed by another key are left alone, as with Insert.
+const mergeSubkeysSQL = `INSERT INTO subkeys (rfingerprint, rsubfp, rkeyid)
+SELECT DISTINCT ON (s.rsubfp) s.rfingerprint, s.rsubfp, NULLIF(s.rkeyid, '')
+FROM subkeys_staging s
+WHERE EXISTS (SELECT 1 FROM keys k WHERE k.rfingerprint = s.rfingerprint)
+AND NOT EXISTS (SELECT 1 FROM subkeys sk WHERE sk.rsubfp = s.rsubfp)
+ORDER BY s.rsubfp`
+
+// BulkInserter loads large numbers of new keys into PostgreSQL storage much
+// faster than Insert, by copying them into staging tables and merging each
+// batch in a single statement. It is intended for offline loading, such as
+// from a keyserver dump.
+//
+// A BulkInserter holds a single database connection until it is closed.
+type BulkInserter struct {
+	st          *storage
+	conn        *sql.Conn
+	batchSize   int
+	dropIndexes bool
+}
+
+// BulkOption is a functional option for a BulkInserter.
+type BulkOption func(*BulkInserter)
+
+// BatchSize sets the number of keys merged in each transaction.
+func BatchSize(n int) BulkOption {
+	return func(bi *BulkInserter) {
+		if n > 0 {
+			bi.batchSize = n
+		}
+	}
+}
+
+// DropIndexes drops the secondary indexes on the key and index tables while
+// loading, and recreates them when the BulkInserter is closed. This speeds up
+// loading considerably, but lookups will be slow until the load completes.
+func DropIndexes() BulkOption {
+	return func(bi *BulkInserter) {
+		bi.dropIndexes = true
+	}
+}
+
+// NewBulkInserter returns a BulkInserter for the given storage, which must
+// have been created by this package.
+func NewBulkInserter(ctx context.Context, st hkpstorage.Storage, options ...BulkOption) (*BulkInserter, error) {
+	pgst, ok := st.(*storage)
+	if !ok {
+		return nil, errgo.Newf("bulk insert not supported by %T", st)
+	}
+	bi := &BulkInserter{
+		st:        pgst,
+		batchSize: defaultBulkBatchSize,
+	}
+	for _, option := range options {
+		option(bi)
+	}
+
+	var err error
+	bi.conn, err = pgst.Conn(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = bi.exec(ctx, crStagingSQL)
+	if err != nil {
+		bi.conn.Close()
+		return nil, errgo.Notef(err, "cannot create staging tables")
+	}
+	if bi.dropIndexes {
+		log.Infof("dropping indexes for bulk load")
+		err = bi.exec(ctx, bulkIndexesSQL(false))
+		if err != nil {
+			bi.conn.Close()
+			return nil, errgo.Notef(err, "cannot drop indexes")
+		}
+	}
+	return bi, nil
+}
+
+func (bi *BulkInserter) exec(ctx context.Context, stmts []string) error {
+	for _, stmt := range stmts {
+		_, err := bi.conn.ExecContext(ctx, stmt)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// Insert stores the given keys in batches, returning the number of keys
+// inserted. Keys which are already stored, or repeated within the given keys,
+// are reported as duplicates in an InsertError. Keys which have been
+// suppressed are not stored, and are reported as errors with cause
+// ErrKeySuppressed. KeyAdded is notified for each inserted key once its batch
+// has been committed.
+//
+// If a batch cannot be merged, its keys are inserted one at a time instead so
+// that a single bad key does not prevent the rest from loading.
+func (bi *BulkInserter) Insert(ctx context.Context, keys []*openpgp.PrimaryKey) (int, error) {
+	var n int
+	var result hkpstorage.InsertError
+	rfps := make([]string, len(keys))
+	for i, key := range keys {
+		rfps[i] = key.RFingerprint
+	}
+	suppressed, err := bi.st.Suppressed(ctx, rfps)
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot check for suppressed keys")
+	}
+	isSuppressed := make(map[string]bool)
+	for _, rfp := range suppressed {
+		isSuppressed[rfp] = true
+	}
+	seenRFP := make(map[string]bool)
+	seenMD5 := make(map[string]bool)
+	batch := make([]*openpgp.PrimaryKey, 0, bi.batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, err := bi.insertBatch(ctx, batch, &result)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return errgo.Mask(ctxErr, errgo.Any)
+			}
+			log.Warningf("bulk insert of %d keys failed, inserting individually: %v", len(batch), err)
+			inserted, err = bi.st.InsertContext(ctx, batch)
+			if insertErr, ok := err.(hkpstorage.InsertError); ok {
+				result.Duplicates = append(result.Duplicates, insertErr.Duplicates...)
+				result.Errors = append(result.Errors, insertErr.Errors...)
+			} else if err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		n += inserted
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, key := range keys {
+		if isSuppressed[key.RFingerprint] {
+			result.Errors = append(result.Errors, errgo.WithCausef(nil, hkpstorage.ErrKeySuppressed,
+				"key %q has been taken down", key.Fingerprint()))
+			continue
+		}
+		if seenRFP[key.RFingerprint] || seenMD5[key.MD5] {
+			result.Duplicates = append(result.Duplicates, key)
+			continue
+		}
+		seenRFP[key.RFingerprint] = true
+		seenMD5[key.MD5] = true
+		batch = append(batch, key)
+		if len(batch) >= bi.batchSize {
+			if err := flush(); err != nil {
+				result.Errors = append(result.Errors, err)
+				return n, result
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+
+	if len(result.Duplicates) > 0 || len(result.Errors) > 0 {
+		return n, result
+	}
+	return n, nil
+}
+
+// insertBatch copies the keys into the staging tables and merges them in a
+// single transaction. Keys which cannot be serialized are added to the
+// result's errors and those already stored to its duplicates.
+func (bi *BulkInserter) insertBatch(ctx context.Context, keys []*openpgp.PrimaryKey, result *hkpstorage.InsertError) (_ int, retErr error) {
+	tx, err := bi.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+		}
+	}()
+
+	keyStmt, err := tx.PrepareContext(ctx, pq.CopyIn("keys_staging",
+		"rfingerprint", "ctime", "mtime", "md5", "doc", "keywords", "rkeyid"))
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer keyStmt.Close()
+
+	now := time.Now().UTC()
+	var errs []error
+	staged := make(map[string]*openpgp.PrimaryKey)
+	for _, key := range keys {
+		openpgp.Sort(key)
+		jsonBuf, err := json.Marshal(jsonhkp.NewPrimaryKey(key))
+		if err != nil {
+			errs = append(errs, errgo.Notef(err, "cannot serialize rfp=%q", key.RFingerprint))
+			continue
+		}
+		_, err = keyStmt.ExecContext(ctx, key.RFingerprint, now, now, key.MD5, string(jsonBuf), keywordsTSVector(key), hkpstorage.V3RKeyID(key))
+		if err != nil {
+			return 0, errgo.Notef(err, "cannot stage rfp=%q", key.RFingerprint)
+		}
+		staged[key.RFingerprint] = key
+	}
+	_, err = keyStmt.ExecContext(ctx)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+
+	subStmt, err := tx.PrepareContext(ctx, pq.CopyIn("subkeys_staging", "rfingerprint", "rsubfp", "rkeyid"))
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer subStmt.Close()
+	for rfp, key := range staged {
+		for _, subKey := range key.SubKeys {
+			_, err = subStmt.ExecContext(ctx, rfp, subKey.RFingerprint, hkpstorage.SubKeyRKeyID(subKey))
+			if err != nil {
+				return 0, errgo.Notef(err, "cannot stage rsubfp=%q", subKey.RFingerprint)
+			}
+		}
+	}
+	_, err = subStmt.ExecContext(ctx)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+
+	rows, err := tx.QueryContext(ctx, mergeKeysSQL)
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot merge keys")
+	}
+	var added []*openpgp.PrimaryKey
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			rows.Close()
+			return 0, errgo.Mask(err)
+		}
+		added = append(added, staged[rfp])
+		delete(staged, rfp)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, errgo.Mask(err)
+	}
+
+	// Merged keys are new, so their email and Web Key Directory addresses
+	// can be copied directly.
+	err = copyIndex(ctx, tx, "emails", "email", added, hkpstorage.Emails)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	err = copyIndex(ctx, tx, "wkd_addresses", "wkd", added, hkpstorage.WKDAddresses)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+
+	_, err = tx.ExecContext(ctx, mergeSubkeysSQL)
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot merge subkeys")
+	}
+	err = logKeysAdded(ctx, tx, added)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+
+	// Anything staged but not merged was already stored.
+	for _, key := range keys {
+		if _, ok := staged[key.RFingerprint]; ok {
+			result.Duplicates = append(result.Duplicates, key)
+		}
+	}
+	result.Errors = append(result.Errors, errs...)
+	for _, key := range added {
+		bi.st.Notify(hkpstorage.KeyAdded{
+			ID:           key.KeyID(),
+			Digest:       key.MD5,
+			RFingerprint: key.RFingerprint,
+		})
+	}
+	return len(added), nil
+}
+
+// Close recreates any indexes dropped for the load, removes the staging
+// tables and releases the database connection.
+func (bi *BulkInserter) Close() error {
+	defer bi.conn.Close()
+	ctx := context.Background()
+	if bi.dropIndexes {
+		log.Infof("recreating indexes, this may take a while...")
+		t := time.Now()
+		err := bi.exec(ctx, bulkIndexesSQL(true))
+		if err != nil {
+			return errgo.Notef(err, "cannot recreate indexes")
+		}
+		log.Infof("recreated indexes in %v", time.Since(t))
+	}
+	err := bi.exec(ctx, []string{"ANALYZE keys", "ANALYZE subkeys"})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(bi.exec(ctx, drStagingSQL))
+}
+
+// copyIndex copies the values of the given keys into column of table, keyed
+// by RFingerprint.
+func copyIndex(ctx context.Context, tx *sql.Tx, table, column string, keys []*openpgp.PrimaryKey, values func(*openpgp.PrimaryKey) []string) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, column, "rfingerprint"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer stmt.Close()
+	for _, key := range keys {
+		for _, value := range values(key) {
+			_, err = stmt.ExecContext(ctx, value, key.RFingerprint)
+			if err != nil {
+				return errgo.Notef(err, "cannot index %s for rfp=%q", column, key.RFingerprint)
+			}
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return errgo.Mask(err)
+}
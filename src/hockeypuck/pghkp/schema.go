@@ -0,0 +1,382 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pghkp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+// ErrSchemaTooNew is returned when the database schema was created by a newer
+// version of Hockeypuck than this one.
+var ErrSchemaTooNew = errgo.New("database schema is newer than supported")
+
+// ErrSchemaTooOld is returned when the database schema must be migrated with
+// hockeypuck-migrate-schema before it can be used.
+var ErrSchemaTooOld = errgo.New("database schema is older than supported")
+
+// migration is an ordered change to the database schema. Versions start at 1
+// and are contiguous; a migration is applied at most once, in a single
+// transaction with its version record.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+
+	// apply, if set, is run after the statements, for changes which cannot
+	// be made in SQL alone.
+	apply func(context.Context, *sql.Tx) error
+}
+
+// migrations lists every schema change, oldest first. Existing migrations
+// must never be edited once released; add a new one instead.
+//
+// Version 1 is the schema which was created before versioning was introduced.
+// Its statements are idempotent, so unversioned databases are adopted as-is.
+var migrations = []migration{{
+	version:     1,
+	description: "create keys and subkeys tables",
+	statements:  append(append([]string{}, crTablesSQL...), crIndexesSQL...),
+}, {
+	version:     2,
+	description: "index v3 key IDs",
+	statements: []string{
+		`ALTER TABLE keys ADD COLUMN rkeyid TEXT`,
+		// v3 fingerprints are MD5 digests, so only they are 32 digits long.
+		`UPDATE keys SET rkeyid = reverse(lower(doc->>'longKeyID')) WHERE length(rfingerprint) = 32`,
+		`CREATE INDEX keys_rkeyid ON keys(rkeyid text_pattern_ops) WHERE rkeyid IS NOT NULL`,
+	},
+}, {
+	version:     3,
+	description: "index exact email addresses",
+	statements: []string{
+		`CREATE TABLE emails (
+email TEXT NOT NULL,
+rfingerprint TEXT NOT NULL,
+PRIMARY KEY (email, rfingerprint),
+FOREIGN KEY (rfingerprint) REFERENCES keys(rfingerprint)
+)`,
+		`CREATE INDEX emails_rfp ON emails(rfingerprint)`,
+	},
+	apply: backfillEmails,
+}, {
+	version:     4,
+	description: "record user ID publication states",
+	statements: []string{
+		`CREATE TABLE uid_states (
+rfingerprint TEXT NOT NULL,
+email TEXT NOT NULL,
+state TEXT NOT NULL,
+mtime TIMESTAMP WITH TIME ZONE NOT NULL,
+PRIMARY KEY (rfingerprint, email),
+FOREIGN KEY (rfingerprint) REFERENCES keys(rfingerprint)
+)`,
+	},
+}, {
+	version:     5,
+	description: "record keys taken down by their owners",
+	statements: []string{
+		`CREATE TABLE suppressed_keys (
+rfingerprint TEXT NOT NULL PRIMARY KEY,
+ctime TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+)`,
+	},
+}, {
+	version:     6,
+	description: "index Web Key Directory addresses",
+	statements: []string{
+		`CREATE TABLE wkd_addresses (
+wkd TEXT NOT NULL,
+rfingerprint TEXT NOT NULL,
+PRIMARY KEY (wkd, rfingerprint),
+FOREIGN KEY (rfingerprint) REFERENCES keys(rfingerprint)
+)`,
+		`CREATE INDEX wkd_addresses_rfp ON wkd_addresses(rfingerprint)`,
+	},
+	apply: backfillWKD,
+}, {
+	version:     7,
+	description: "log key changes",
+	statements: []string{
+		// Changes outlive the keys they refer to, so there is no foreign key.
+		// xid is the ID of the transaction logging the change, by which
+		// changes are read in order once committed.
+		`CREATE TABLE key_changes (
+id BIGSERIAL PRIMARY KEY,
+xid BIGINT NOT NULL DEFAULT txid_current(),
+rfingerprint TEXT NOT NULL,
+change TEXT NOT NULL,
+old_md5 TEXT,
+new_md5 TEXT,
+ctime TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX key_changes_xid ON key_changes(xid, id)`,
+	},
+}, {
+	version:     8,
+	description: "index v6 key IDs",
+	statements: []string{
+		// v6 key IDs lead their 64 digit fingerprints, so end the reversed
+		// fingerprints and cannot be matched by prefix.
+		`ALTER TABLE subkeys ADD COLUMN rkeyid TEXT`,
+		`UPDATE subkeys SET rkeyid = right(rsubfp, 16) WHERE length(rsubfp) = 64`,
+		`UPDATE keys SET rkeyid = right(rfingerprint, 16) WHERE length(rfingerprint) = 64 AND rkeyid IS NULL`,
+		`CREATE INDEX subkeys_rkeyid ON subkeys(rkeyid text_pattern_ops) WHERE rkeyid IS NOT NULL`,
+	},
+}}
+
+const crSchemaVersionSQL = `CREATE TABLE IF NOT EXISTS schema_version (
+version INTEGER NOT NULL PRIMARY KEY,
+description TEXT NOT NULL,
+applied TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+)`
+
+// schemaLockID identifies the advisory lock held while migrating, so that
+// concurrently starting servers do not apply the same migration twice.
+const schemaLockID = 0x686b70
+
+// LatestSchemaVersion returns the schema version this package expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the schema in the given database, or
+// 0 if it has not been versioned.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_version') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	return schemaVersion(ctx, db)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func schemaVersion(ctx context.Context, q queryRower) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return version, nil
+}
+
+// CheckSchema returns an error with cause ErrSchemaTooNew if the database
+// schema is newer than this package supports, or ErrSchemaTooOld if it has
+// outstanding migrations.
+func CheckSchema(ctx context.Context, db *sql.DB) error {
+	version, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if latest := LatestSchemaVersion(); version > latest {
+		return errgo.WithCausef(nil, ErrSchemaTooNew,
+			"database schema version %d is newer than supported version %d", version, latest)
+	} else if version < latest {
+		return errgo.WithCausef(nil, ErrSchemaTooOld,
+			"database schema version %d must be migrated to version %d with hockeypuck-migrate-schema", version, latest)
+	}
+	return nil
+}
+
+// isNewDatabase returns whether the database has yet to be given a schema,
+// so that it can be created without anything to migrate.
+func isNewDatabase(ctx context.Context, db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "SELECT to_regclass('keys') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return !exists, nil
+}
+
+// MigrateSchema applies any outstanding migrations to the database, returning
+// the schema versions before and after. It refuses to touch a database whose
+// schema is newer than this package supports.
+func MigrateSchema(ctx context.Context, db *sql.DB) (from, to int, _ error) {
+	_, err := db.ExecContext(ctx, crSchemaVersionSQL)
+	if err != nil {
+		return 0, 0, errgo.Notef(err, "cannot create schema_version table")
+	}
+	from, err = schemaVersion(ctx, db)
+	if err != nil {
+		return 0, 0, errgo.Mask(err)
+	}
+	to = from
+	for _, m := range migrations {
+		if m.version <= to {
+			continue
+		}
+		applied, err := applyMigration(ctx, db, m)
+		if err != nil {
+			return from, to, errgo.Mask(err)
+		}
+		if applied {
+			log.Infof("applied schema migration %d: %s", m.version, m.description)
+		}
+		to = m.version
+	}
+	if latest := LatestSchemaVersion(); to > latest {
+		return from, to, errgo.WithCausef(nil, ErrSchemaTooNew,
+			"database schema version %d is newer than supported version %d", to, latest)
+	}
+	return from, to, nil
+}
+
+// applyMigration applies the given migration unless another process has
+// already done so, reporting whether it was applied here.
+func applyMigration(ctx context.Context, db *sql.DB, m migration) (_ bool, retErr error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+		} else {
+			retErr = tx.Commit()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", schemaLockID)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if version >= m.version {
+		return false, nil
+	} else if version != m.version-1 {
+		return false, errgo.Newf("cannot apply schema migration %d to version %d", m.version, version)
+	}
+
+	for _, stmt := range m.statements {
+		_, err := tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return false, errgo.Notef(err, "schema migration %d failed", m.version)
+		}
+	}
+	if m.apply != nil {
+		err = m.apply(ctx, tx)
+		if err != nil {
+			return false, errgo.Notef(err, "schema migration %d failed", m.version)
+		}
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, description) VALUES ($1, $2)",
+		m.version, m.description)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return true, nil
+}
+
+// backfillEmails indexes the email addresses of the keys already stored. The
+// addresses must be normalized in Go, so the user IDs are read back from each
+// key's JSON document.
+func backfillEmails(ctx context.Context, tx *sql.Tx) error {
+	return backfillUserIDs(ctx, tx, "emails", "email", hkpstorage.ParseEmail)
+}
+
+// backfillWKD indexes the Web Key Directory addresses of the keys already
+// stored.
+func backfillWKD(ctx context.Context, tx *sql.Tx) error {
+	return backfillUserIDs(ctx, tx, "wkd_addresses", "wkd", hkpstorage.ParseWKDAddress)
+}
+
+// backfillUserIDs indexes the given column of table, keyed by RFingerprint,
+// with the values parsed from the user IDs of the keys already stored.
+func backfillUserIDs(ctx context.Context, tx *sql.Tx, table, column string, parse func(string) (string, bool)) error {
+	insertSQL := fmt.Sprintf("INSERT INTO %s (%s, rfingerprint) VALUES ($1, $2) ON CONFLICT DO NOTHING", table, column)
+	var after string
+	var n int
+	for {
+		rows, err := tx.QueryContext(ctx, "SELECT rfingerprint, doc->'userIDs' FROM keys "+
+			"WHERE rfingerprint > $1 ORDER BY rfingerprint LIMIT $2", after, keyringBatchSize)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		type row struct {
+			rfp    string
+			values []string
+		}
+		var batch []row
+		for rows.Next() {
+			var rfp string
+			var uidsJSON []byte
+			err = rows.Scan(&rfp, &uidsJSON)
+			if err != nil {
+				rows.Close()
+				return errgo.Mask(err)
+			}
+			var uids []struct {
+				Keywords string `json:"keywords"`
+			}
+			if len(uidsJSON) > 0 {
+				err = json.Unmarshal(uidsJSON, &uids)
+				if err != nil {
+					rows.Close()
+					return errgo.Notef(err, "invalid user IDs for rfp=%q", rfp)
+				}
+			}
+			r := row{rfp: rfp}
+			seen := make(map[string]bool)
+			for _, uid := range uids {
+				if value, ok := parse(uid.Keywords); ok && !seen[value] {
+					seen[value] = true
+					r.values = append(r.values, value)
+				}
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return errgo.Mask(err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, r := range batch {
+			for _, value := range r.values {
+				_, err = tx.ExecContext(ctx, insertSQL, value, r.rfp)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+			}
+		}
+		after = batch[len(batch)-1].rfp
+		n += len(batch)
+		log.Infof("indexed %s of %d keys", table, n)
+	}
+	return nil
+}
@@ -19,17 +19,19 @@ package pghkp
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"unicode"
 	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"gopkg.in/errgo.v1"
 
 	"hockeypuck/hkp/jsonhkp"
@@ -39,7 +41,8 @@ import (
 )
 
 const (
-	maxInsertErrors = 100
+	maxInsertErrors  = 100
+	keyringBatchSize = 500
 )
 
 type storage struct {
@@ -52,6 +55,11 @@ type storage struct {
 }
 
 var _ hkpstorage.Storage = (*storage)(nil)
+var _ hkpstorage.KeyringImporter = (*storage)(nil)
+var _ hkpstorage.UIDPublisher = (*storage)(nil)
+var _ hkpstorage.Suppressor = (*storage)(nil)
+var _ hkpstorage.ChangeLogger = (*storage)(nil)
+var _ hkpstorage.DigestIterator = (*storage)(nil)
 
 var crTablesSQL = []string{
 	`CREATE TABLE IF NOT EXISTS keys (
@@ -78,17 +86,36 @@ var crIndexesSQL = []string{
 	`CREATE INDEX IF NOT EXISTS subkeys_rfp ON subkeys(rsubfp text_pattern_ops);`,
 }
 
-var drConstraintsSQL = []string{
-	`ALTER TABLE keys DROP CONSTRAINT keys_pk;`,
-	`ALTER TABLE keys DROP CONSTRAINT keys_md5;`,
-	`DROP INDEX keys_rfp;`,
-	`DROP INDEX keys_ctime;`,
-	`DROP INDEX keys_mtime;`,
-	`DROP INDEX keys_keywords;`,
+// bulkIndexes are the secondary indexes dropped for bulk loading: those
+// created by crIndexesSQL and by later schema migrations. Indexes backing
+// constraints are kept, as the load depends on them.
+var bulkIndexes = []struct {
+	name, on string
+}{
+	{"keys_rfp", "keys(rfingerprint text_pattern_ops)"},
+	{"keys_ctime", "keys(ctime)"},
+	{"keys_mtime", "keys(mtime)"},
+	{"keys_keywords", "keys USING gin(keywords)"},
+	{"subkeys_rfp", "subkeys(rsubfp text_pattern_ops)"},
+	{"keys_rkeyid", "keys(rkeyid text_pattern_ops) WHERE rkeyid IS NOT NULL"},
+	{"emails_rfp", "emails(rfingerprint)"},
+	{"wkd_addresses_rfp", "wkd_addresses(rfingerprint)"},
+	{"key_changes_xid", "key_changes(xid, id)"},
+	{"subkeys_rkeyid", "subkeys(rkeyid text_pattern_ops) WHERE rkeyid IS NOT NULL"},
+}
 
-	`ALTER TABLE subkeys DROP CONSTRAINT subkeys_pk;`,
-	`ALTER TABLE subkeys DROP CONSTRAINT subkeys_fk;`,
-	`DROP INDEX subkeys_rfp;`,
+// bulkIndexesSQL returns the statements dropping, or recreating, the
+// bulkIndexes.
+func bulkIndexesSQL(create bool) []string {
+	var stmts []string
+	for _, index := range bulkIndexes {
+		if create {
+			stmts = append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s", index.name, index.on))
+		} else {
+			stmts = append(stmts, fmt.Sprintf("DROP INDEX IF EXISTS %s", index.name))
+		}
+	}
+	return stmts
 }
 
 // Dial returns PostgreSQL storage connected to the given database URL.
@@ -100,41 +127,33 @@ func Dial(url string, options []openpgp.KeyReaderOption) (hkpstorage.Storage, er
 	return New(db, options)
 }
 
-// New returns a PostgreSQL storage implementation for an HKP service.
+// New returns a PostgreSQL storage implementation for an HKP service. The
+// schema of a new database is created; New fails if an existing schema is not
+// the version this version of Hockeypuck supports. Migrations may rewrite
+// every stored key, so they are left to hockeypuck-migrate-schema rather
+// than run at startup.
 func New(db *sql.DB, options []openpgp.KeyReaderOption) (hkpstorage.Storage, error) {
 	st := &storage{
 		DB:      db,
 		options: options,
 	}
-	err := st.createTables()
-	if err != nil {
-		return nil, errgo.NoteMask(err, "failed to create tables")
-	}
-	err = st.createIndexes()
+	ctx := context.Background()
+	isNew, err := isNewDatabase(ctx, db)
 	if err != nil {
-		return nil, errgo.NoteMask(err, "failed to create indexes")
+		return nil, errgo.Mask(err)
 	}
-	return st, nil
-}
-
-func (st *storage) createTables() error {
-	for _, crTableSQL := range crTablesSQL {
-		_, err := st.Exec(crTableSQL)
+	if isNew {
+		_, to, err := MigrateSchema(ctx, db)
 		if err != nil {
-			return errgo.Mask(err)
+			return nil, errgo.NoteMask(err, "failed to create schema", errgo.Is(ErrSchemaTooNew))
 		}
+		log.Infof("created database schema version %d", to)
 	}
-	return nil
-}
-
-func (st *storage) createIndexes() error {
-	for _, crIndexSQL := range crIndexesSQL {
-		_, err := st.Exec(crIndexSQL)
-		if err != nil {
-			return errgo.Mask(err)
-		}
+	err = CheckSchema(ctx, db)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrSchemaTooNew), errgo.Is(ErrSchemaTooOld))
 	}
-	return nil
+	return st, nil
 }
 
 type keyDoc struct {
@@ -147,6 +166,10 @@ type keyDoc struct {
 }
 
 func (st *storage) MatchMD5(md5s []string) ([]string, error) {
+	return st.MatchMD5Context(context.Background(), md5s)
+}
+
+func (st *storage) MatchMD5Context(ctx context.Context, md5s []string) ([]string, error) {
 	var md5In []string
 	for _, md5 := range md5s {
 		// Must validate to prevent SQL injection since we're appending SQL strings here.
@@ -158,7 +181,7 @@ func (st *storage) MatchMD5(md5s []string) ([]string, error) {
 	}
 
 	sqlStr := fmt.Sprintf("SELECT rfingerprint FROM keys WHERE md5 IN (%s)", strings.Join(md5In, ","))
-	rows, err := st.Query(sqlStr)
+	rows, err := st.QueryContext(ctx, sqlStr)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -181,69 +204,65 @@ func (st *storage) MatchMD5(md5s []string) ([]string, error) {
 }
 
 // Resolve implements storage.Storage.
-//
-// Only v4 key IDs are resolved by this backend. v3 short and long key IDs
-// currently won't match.
-func (st *storage) Resolve(keyids []string) (_ []string, retErr error) {
-	var result []string
-	sqlStr := "SELECT rfingerprint FROM keys WHERE rfingerprint LIKE $1 || '%'"
-	stmt, err := st.Prepare(sqlStr)
+func (st *storage) Resolve(keyids []string) ([]string, error) {
+	return st.ResolveContext(context.Background(), keyids)
+}
+
+func (st *storage) ResolveContext(ctx context.Context, keyids []string) ([]string, error) {
+	stmt, err := st.PrepareContext(ctx, "SELECT rfingerprint FROM keys "+
+		"WHERE rfingerprint LIKE $1 || '%' OR rkeyid LIKE $1 || '%' "+
+		"UNION SELECT rfingerprint FROM subkeys WHERE rsubfp LIKE $1 || '%' OR rkeyid LIKE $1 || '%' LIMIT $2")
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	defer stmt.Close()
 
-	var subKeyIDs []string
+	var result []string
+	seen := make(map[string]bool)
 	for _, keyid := range keyids {
+		// Must validate, since a key ID containing LIKE wildcards would match
+		// arbitrary keys.
 		keyid = strings.ToLower(keyid)
-		var rfp string
-		row := stmt.QueryRow(keyid)
-		err = row.Scan(&rfp)
-		if err == sql.ErrNoRows {
-			subKeyIDs = append(subKeyIDs, keyid)
-		} else if err != nil {
-			return nil, errgo.Mask(err)
+		if keyid == "" {
+			// An empty prefix would match every key.
+			continue
 		}
-		result = append(result, rfp)
-	}
-
-	if len(subKeyIDs) > 0 {
-		subKeyResult, err := st.resolveSubKeys(subKeyIDs)
+		if _, err := hex.DecodeString(keyid); err != nil {
+			return nil, errgo.Notef(err, "invalid key ID %q", keyid)
+		}
+		err = func() error {
+			rows, err := stmt.QueryContext(ctx, keyid, 100)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var rfp string
+				err = rows.Scan(&rfp)
+				if err != nil {
+					return errgo.Mask(err)
+				}
+				if !seen[rfp] {
+					seen[rfp] = true
+					result = append(result, rfp)
+				}
+			}
+			return errgo.Mask(rows.Err())
+		}()
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
-		result = append(result, subKeyResult...)
 	}
-
 	return result, nil
 }
 
-func (st *storage) resolveSubKeys(keyids []string) ([]string, error) {
-	var result []string
-	sqlStr := "SELECT rfingerprint FROM subkeys WHERE rsubfp LIKE $1 || '%'"
-	stmt, err := st.Prepare(sqlStr)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	defer stmt.Close()
-
-	for _, keyid := range keyids {
-		keyid = strings.ToLower(keyid)
-		var rfp string
-		row := stmt.QueryRow(keyid)
-		err = row.Scan(&rfp)
-		if err != nil && err != sql.ErrNoRows {
-			return nil, errgo.Mask(err)
-		}
-		result = append(result, rfp)
-	}
-
-	return result, nil
+func (st *storage) MatchKeyword(search []string) ([]string, error) {
+	return st.MatchKeywordContext(context.Background(), search)
 }
 
-func (st *storage) MatchKeyword(search []string) ([]string, error) {
+func (st *storage) MatchKeywordContext(ctx context.Context, search []string) ([]string, error) {
 	var result []string
-	stmt, err := st.Prepare("SELECT rfingerprint FROM keys WHERE keywords @@ plainto_tsquery($1) LIMIT $2")
+	stmt, err := st.PrepareContext(ctx, "SELECT rfingerprint FROM keys WHERE keywords @@ plainto_tsquery($1) LIMIT $2")
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -251,7 +270,7 @@ func (st *storage) MatchKeyword(search []string) ([]string, error) {
 
 	for _, term := range search {
 		err = func() error {
-			rows, err := stmt.Query(term, 100)
+			rows, err := stmt.QueryContext(ctx, term, 100)
 			if err != nil {
 				return errgo.Mask(err)
 			}
@@ -277,9 +296,71 @@ func (st *storage) MatchKeyword(search []string) ([]string, error) {
 	return result, nil
 }
 
+// MatchEmail implements storage.Storage.
+func (st *storage) MatchEmail(emails []string) ([]string, error) {
+	return st.MatchEmailContext(context.Background(), emails)
+}
+
+func (st *storage) MatchEmailContext(ctx context.Context, emails []string) ([]string, error) {
+	rows, err := st.QueryContext(ctx, "SELECT DISTINCT rfingerprint FROM emails WHERE email = ANY($1) LIMIT 100",
+		pq.Array(emails))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, rfp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// MatchWKD implements storage.Storage.
+func (st *storage) MatchWKD(wkds []string) ([]string, error) {
+	return st.MatchWKDContext(context.Background(), wkds)
+}
+
+func (st *storage) MatchWKDContext(ctx context.Context, wkds []string) ([]string, error) {
+	rows, err := st.QueryContext(ctx, "SELECT DISTINCT rfingerprint FROM wkd_addresses WHERE wkd = ANY($1) LIMIT 100",
+		pq.Array(wkds))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, rfp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
 func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
+	return st.ModifiedSinceContext(context.Background(), t)
+}
+
+func (st *storage) ModifiedSinceContext(ctx context.Context, t time.Time) ([]string, error) {
 	var result []string
-	rows, err := st.Query("SELECT rfingerprint FROM keys WHERE mtime > $1 ORDER BY mtime DESC LIMIT 100", t.UTC())
+	rows, err := st.QueryContext(ctx, "SELECT rfingerprint FROM keys WHERE mtime > $1 ORDER BY mtime DESC LIMIT 100", t.UTC())
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -300,6 +381,10 @@ func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
 }
 
 func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
+	return st.FetchKeysContext(context.Background(), rfps)
+}
+
+func (st *storage) FetchKeysContext(ctx context.Context, rfps []string) ([]*openpgp.PrimaryKey, error) {
 	if len(rfps) == 0 {
 		return nil, nil
 	}
@@ -313,7 +398,7 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 		rfpIn = append(rfpIn, "'"+strings.ToLower(rfp)+"'")
 	}
 	sqlStr := fmt.Sprintf("SELECT doc FROM keys WHERE rfingerprint IN (%s)", strings.Join(rfpIn, ","))
-	rows, err := st.Query(sqlStr)
+	rows, err := st.QueryContext(ctx, sqlStr)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -347,6 +432,10 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 }
 
 func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
+	return st.FetchKeyringsContext(context.Background(), rfps)
+}
+
+func (st *storage) FetchKeyringsContext(ctx context.Context, rfps []string) ([]*hkpstorage.Keyring, error) {
 	var rfpIn []string
 	for _, rfp := range rfps {
 		_, err := hex.DecodeString(rfp)
@@ -355,40 +444,147 @@ func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
 		}
 		rfpIn = append(rfpIn, "'"+strings.ToLower(rfp)+"'")
 	}
-	sqlStr := fmt.Sprintf("SELECT ctime, mtime, doc FROM keys WHERE rfingerprint IN (%s)", strings.Join(rfpIn, ","))
-	rows, err := st.Query(sqlStr)
+	sqlStr := fmt.Sprintf("SELECT rfingerprint, ctime, mtime, md5, doc FROM keys WHERE rfingerprint IN (%s)", strings.Join(rfpIn, ","))
+	rows, err := st.QueryContext(ctx, sqlStr)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	result, _, err := scanKeyrings(rows)
+	return result, err
+}
 
+// scanKeyrings reads keyring records from rows selecting rfingerprint, ctime,
+// mtime, md5 and doc columns, closing rows when done. Records which cannot be
+// read as keyrings are logged and skipped. It also returns the checkpoint
+// following the last row read, skipped or not, which is zero if there were
+// none.
+func scanKeyrings(rows *sql.Rows) ([]*hkpstorage.Keyring, hkpstorage.Checkpoint, error) {
+	defer rows.Close()
 	var result []*hkpstorage.Keyring
+	var last hkpstorage.Checkpoint
 	for rows.Next() {
 		var bufStr string
 		var kr hkpstorage.Keyring
-		err = rows.Scan(&bufStr, &kr.CTime, &kr.MTime)
+		var rfp string
+		err := rows.Scan(&rfp, &kr.CTime, &kr.MTime, &kr.Digest, &bufStr)
 		if err != nil && err != sql.ErrNoRows {
-			return nil, errgo.Mask(err)
+			return nil, last, errgo.Mask(err)
 		}
+		last = hkpstorage.Checkpoint{RFingerprint: rfp, MTime: kr.MTime}
 		var pk jsonhkp.PrimaryKey
 		err = json.Unmarshal([]byte(bufStr), &pk)
 		if err != nil {
-			return nil, errgo.Mask(err)
+			log.Warningf("skipping unreadable keyring rfp=%q: %v", rfp, err)
+			continue
 		}
 
-		rfp := openpgp.Reverse(pk.Fingerprint)
 		key, err := readOneKey(pk.Bytes(), rfp)
 		if err != nil {
-			return nil, errgo.Mask(err)
+			log.Warningf("skipping unreadable keyring rfp=%q: %v", rfp, err)
+			continue
+		} else if key == nil {
+			continue
 		}
 		kr.PrimaryKey = key
 		result = append(result, &kr)
 	}
-	err = rows.Err()
+	err := rows.Err()
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, last, errgo.Mask(err)
 	}
 
-	return result, nil
+	return result, last, nil
+}
+
+// IterKeyrings implements storage.Storage.
+//
+// Keyrings are read in batches of keyringBatchSize, each batch a separate
+// query resuming from the last keyring read, so that long iterations do not
+// hold a transaction open.
+func (st *storage) IterKeyrings(ctx context.Context, order hkpstorage.KeyringOrder, from hkpstorage.Checkpoint) (hkpstorage.KeyringCursor, error) {
+	switch order {
+	case hkpstorage.ByRFingerprint, hkpstorage.ByMTime:
+	default:
+		return nil, errgo.Newf("unsupported keyring order %v", order)
+	}
+	return hkpstorage.NewBatchCursor(from, func(cp hkpstorage.Checkpoint) ([]*hkpstorage.Keyring, hkpstorage.Checkpoint, error) {
+		var rows *sql.Rows
+		var err error
+		switch order {
+		case hkpstorage.ByRFingerprint:
+			rows, err = st.QueryContext(ctx, "SELECT rfingerprint, ctime, mtime, md5, doc FROM keys "+
+				"WHERE rfingerprint > $1 ORDER BY rfingerprint LIMIT $2",
+				cp.RFingerprint, keyringBatchSize)
+		case hkpstorage.ByMTime:
+			rows, err = st.QueryContext(ctx, "SELECT rfingerprint, ctime, mtime, md5, doc FROM keys "+
+				"WHERE (mtime, rfingerprint) > ($1, $2) ORDER BY mtime, rfingerprint LIMIT $3",
+				cp.MTime.UTC(), cp.RFingerprint, keyringBatchSize)
+		}
+		if err != nil {
+			return nil, hkpstorage.Checkpoint{}, errgo.Mask(err, errgo.Any)
+		}
+		return scanKeyrings(rows)
+	}), nil
+}
+
+// IterDigests implements storage.DigestIterator. Digests are read in
+// RFingerprint order, in batches as keyrings are.
+func (st *storage) IterDigests(ctx context.Context) (hkpstorage.DigestCursor, error) {
+	return &digestCursor{ctx: ctx, st: st}, nil
+}
+
+type digestCursor struct {
+	ctx   context.Context
+	st    *storage
+	batch []hkpstorage.KeyringDigest
+	cur   hkpstorage.KeyringDigest
+	done  bool
+	err   error
+}
+
+func (c *digestCursor) Next() bool {
+	if len(c.batch) == 0 && !c.done {
+		c.batch, c.err = c.fetch()
+		if c.err != nil || len(c.batch) < keyringBatchSize {
+			c.done = true
+		}
+	}
+	if len(c.batch) == 0 || c.err != nil {
+		c.cur = hkpstorage.KeyringDigest{}
+		return false
+	}
+	c.cur, c.batch = c.batch[0], c.batch[1:]
+	return true
+}
+
+// fetch reads the batch of digests following the current one.
+func (c *digestCursor) fetch() ([]hkpstorage.KeyringDigest, error) {
+	rows, err := c.st.QueryContext(c.ctx, "SELECT rfingerprint, md5 FROM keys "+
+		"WHERE rfingerprint > $1 ORDER BY rfingerprint LIMIT $2",
+		c.cur.RFingerprint, keyringBatchSize)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer rows.Close()
+	var result []hkpstorage.KeyringDigest
+	for rows.Next() {
+		var d hkpstorage.KeyringDigest
+		err = rows.Scan(&d.RFingerprint, &d.Digest)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, d)
+	}
+	return result, errgo.Mask(rows.Err(), errgo.Any)
+}
+
+func (c *digestCursor) Digest() hkpstorage.KeyringDigest { return c.cur }
+
+func (c *digestCursor) Err() error { return c.err }
+
+func (c *digestCursor) Close() error {
+	c.batch, c.done = nil, true
+	return nil
 }
 
 func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
@@ -409,29 +605,34 @@ func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
 	return keys[0], nil
 }
 
-func (st *storage) insertKey(key *openpgp.PrimaryKey) (isDuplicate bool, retErr error) {
-	tx, err := st.Begin()
+func (st *storage) insertKey(ctx context.Context, key *openpgp.PrimaryKey) (isDuplicate bool, retErr error) {
+	now := time.Now().UTC()
+	return st.insertKeyring(ctx, key, key.MD5, now, now, true)
+}
+
+// insertKeyring stores the given key with the given digest if it is not
+// already stored, and optionally records its addition in the change log.
+func (st *storage) insertKeyring(ctx context.Context, key *openpgp.PrimaryKey, digest string, ctime, mtime time.Time, logChange bool) (isDuplicate bool, retErr error) {
+	tx, err := st.BeginTx(ctx, nil)
 	if err != nil {
 		return false, errgo.Mask(err)
 	}
 	defer func() {
 		if retErr != nil {
 			tx.Rollback()
-		} else {
-			tx.Commit()
 		}
 	}()
 
-	stmt, err := tx.Prepare("INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords) " +
-		"SELECT $1::TEXT, $2::TIMESTAMP, $3::TIMESTAMP, $4::TEXT, $5::JSONB, to_tsvector($6) " +
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords, rkeyid) "+
+		"SELECT $1::TEXT, $2::TIMESTAMP, $3::TIMESTAMP, $4::TEXT, $5::JSONB, to_tsvector($6), NULLIF($7::TEXT, '') "+
 		"WHERE NOT EXISTS (SELECT 1 FROM keys WHERE rfingerprint = $1)")
 	if err != nil {
 		return false, errgo.Mask(err)
 	}
 	defer stmt.Close()
 
-	subStmt, err := tx.Prepare("INSERT INTO subkeys (rfingerprint, rsubfp) " +
-		"SELECT $1::TEXT, $2::TEXT WHERE NOT EXISTS (SELECT 1 FROM subkeys WHERE rsubfp = $2)")
+	subStmt, err := tx.PrepareContext(ctx, "INSERT INTO subkeys (rfingerprint, rsubfp, rkeyid) "+
+		"SELECT $1::TEXT, $2::TEXT, NULLIF($3::TEXT, '') WHERE NOT EXISTS (SELECT 1 FROM subkeys WHERE rsubfp = $2)")
 	if err != nil {
 		return false, errgo.Mask(err)
 	}
@@ -439,7 +640,7 @@ func (st *storage) insertKey(key *openpgp.PrimaryKey) (isDuplicate bool, retErr
 
 	openpgp.Sort(key)
 
-	now := time.Now().UTC()
+	ctime, mtime = ctime.UTC(), mtime.UTC()
 	jsonKey := jsonhkp.NewPrimaryKey(key)
 	jsonBuf, err := json.Marshal(jsonKey)
 	if err != nil {
@@ -448,7 +649,8 @@ func (st *storage) insertKey(key *openpgp.PrimaryKey) (isDuplicate bool, retErr
 
 	jsonStr := string(jsonBuf)
 	keywords := keywordsTSVector(key)
-	result, err := stmt.Exec(&key.RFingerprint, &now, &now, &key.MD5, &jsonStr, &keywords)
+	rkeyid := hkpstorage.V3RKeyID(key)
+	result, err := stmt.ExecContext(ctx, &key.RFingerprint, &ctime, &mtime, &digest, &jsonStr, &keywords, &rkeyid)
 	if err != nil {
 		return false, errgo.Notef(err, "cannot insert rfp=%q", key.RFingerprint)
 	}
@@ -460,10 +662,22 @@ func (st *storage) insertKey(key *openpgp.PrimaryKey) (isDuplicate bool, retErr
 		// If it doesn't, then something has gone badly awry!
 		return false, errgo.Notef(err, "rows affected not available when inserting rfp=%q", key.RFingerprint)
 	}
+	if keysInserted > 0 {
+		err = replaceAddresses(ctx, tx, key)
+		if err != nil {
+			return false, errgo.Mask(err)
+		}
+		if logChange {
+			err = logKeyChange(ctx, tx, key.RFingerprint, hkpstorage.ChangeAdded, "", digest)
+			if err != nil {
+				return false, errgo.Mask(err)
+			}
+		}
+	}
 
 	var rowsAffected int64
 	for _, subKey := range key.SubKeys {
-		result, err := subStmt.Exec(&key.RFingerprint, &subKey.RFingerprint)
+		result, err := subStmt.ExecContext(ctx, &key.RFingerprint, &subKey.RFingerprint, hkpstorage.SubKeyRKeyID(subKey))
 		if err != nil {
 			return false, errgo.Notef(err, "cannot insert rsubfp=%q", subKey.RFingerprint)
 		}
@@ -474,18 +688,86 @@ func (st *storage) insertKey(key *openpgp.PrimaryKey) (isDuplicate bool, retErr
 		keysInserted += rowsAffected
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return false, errgo.Notef(err, "cannot commit rfp=%q", key.RFingerprint)
+	}
 	return keysInserted == 0, nil
 }
 
-func (st *storage) Insert(keys []*openpgp.PrimaryKey) (n int, retErr error) {
+// replaceAddresses indexes the email and Web Key Directory addresses of the
+// given key, replacing any previously indexed for it.
+func replaceAddresses(ctx context.Context, tx *sql.Tx, key *openpgp.PrimaryKey) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM emails WHERE rfingerprint = $1", key.RFingerprint)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, email := range hkpstorage.Emails(key) {
+		_, err := tx.ExecContext(ctx, "INSERT INTO emails (email, rfingerprint) VALUES ($1, $2) "+
+			"ON CONFLICT DO NOTHING", email, key.RFingerprint)
+		if err != nil {
+			return errgo.Notef(err, "cannot index email for rfp=%q", key.RFingerprint)
+		}
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM wkd_addresses WHERE rfingerprint = $1", key.RFingerprint)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, wkd := range hkpstorage.WKDAddresses(key) {
+		_, err := tx.ExecContext(ctx, "INSERT INTO wkd_addresses (wkd, rfingerprint) VALUES ($1, $2) "+
+			"ON CONFLICT DO NOTHING", wkd, key.RFingerprint)
+		if err != nil {
+			return errgo.Notef(err, "cannot index WKD address for rfp=%q", key.RFingerprint)
+		}
+	}
+	return nil
+}
+
+// logKeyChange records a change to the given key in the change log.
+func logKeyChange(ctx context.Context, tx *sql.Tx, rfp string, change hkpstorage.ChangeType, oldMD5, newMD5 string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO key_changes (rfingerprint, change, old_md5, new_md5) "+
+		"VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''))", rfp, string(change), oldMD5, newMD5)
+	if err != nil {
+		return errgo.Notef(err, "cannot log change to rfp=%q", rfp)
+	}
+	return nil
+}
+
+// logKeysAdded records the addition of the given keys in the change log,
+// copying them in as one statement for bulk loads.
+func logKeysAdded(ctx context.Context, tx *sql.Tx, keys []*openpgp.PrimaryKey) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("key_changes", "rfingerprint", "change", "new_md5"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer stmt.Close()
+	for _, key := range keys {
+		_, err = stmt.ExecContext(ctx, key.RFingerprint, string(hkpstorage.ChangeAdded), key.MD5)
+		if err != nil {
+			return errgo.Notef(err, "cannot log change to rfp=%q", key.RFingerprint)
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return errgo.Mask(err)
+}
+
+func (st *storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
+	return st.InsertContext(context.Background(), keys)
+}
+
+func (st *storage) InsertContext(ctx context.Context, keys []*openpgp.PrimaryKey) (n int, retErr error) {
 	var result hkpstorage.InsertError
 	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			result.Errors = append(result.Errors, errgo.Mask(err, errgo.Any))
+			return n, result
+		}
 		if count, max := len(result.Errors), maxInsertErrors; count > max {
 			result.Errors = append(result.Errors, errgo.Newf("too many insert errors (%d > %d), bailing...", count, max))
 			return n, result
 		}
 
-		if isDuplicate, err := st.insertKey(key); err != nil {
+		if isDuplicate, err := st.insertKey(ctx, key); err != nil {
 			result.Errors = append(result.Errors, err)
 			continue
 		} else if isDuplicate {
@@ -494,8 +776,9 @@ func (st *storage) Insert(keys []*openpgp.PrimaryKey) (n int, retErr error) {
 		}
 
 		st.Notify(hkpstorage.KeyAdded{
-			ID:     key.KeyID(),
-			Digest: key.MD5,
+			ID:           key.KeyID(),
+			Digest:       key.MD5,
+			RFingerprint: key.RFingerprint,
 		})
 		n++
 	}
@@ -506,16 +789,51 @@ func (st *storage) Insert(keys []*openpgp.PrimaryKey) (n int, retErr error) {
 	return n, nil
 }
 
-func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string) (retErr error) {
-	tx, err := st.Begin()
+// ImportKeyrings implements storage.KeyringImporter.
+func (st *storage) ImportKeyrings(ctx context.Context, keyrings []*hkpstorage.Keyring) (n int, retErr error) {
+	var result hkpstorage.InsertError
+	for _, kr := range keyrings {
+		if err := ctx.Err(); err != nil {
+			result.Errors = append(result.Errors, errgo.Mask(err, errgo.Any))
+			return n, result
+		}
+		if count, max := len(result.Errors), maxInsertErrors; count > max {
+			result.Errors = append(result.Errors, errgo.Newf("too many insert errors (%d > %d), bailing...", count, max))
+			return n, result
+		}
+
+		digest := kr.Digest
+		if digest == "" {
+			digest = kr.MD5
+		}
+		if isDuplicate, err := st.insertKeyring(ctx, kr.PrimaryKey, digest, kr.CTime, kr.MTime, false); err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		} else if isDuplicate {
+			result.Duplicates = append(result.Duplicates, kr.PrimaryKey)
+			continue
+		}
+		n++
+	}
+
+	if len(result.Duplicates) > 0 || len(result.Errors) > 0 {
+		return n, result
+	}
+	return n, nil
+}
+
+func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string) error {
+	return st.UpdateContext(context.Background(), key, lastID, lastMD5)
+}
+
+func (st *storage) UpdateContext(ctx context.Context, key *openpgp.PrimaryKey, lastID string, lastMD5 string) (retErr error) {
+	tx, err := st.BeginTx(ctx, nil)
 	if err != nil {
 		return errgo.Mask(err)
 	}
 	defer func() {
 		if retErr != nil {
 			tx.Rollback()
-		} else {
-			tx.Commit()
 		}
 	}()
 
@@ -528,30 +846,294 @@ func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string
 		return errgo.Notef(err, "cannot serialize rfp=%q", key.RFingerprint)
 	}
 	keywords := keywordsTSVector(key)
-	_, err = tx.Exec("UPDATE keys SET mtime = $1, md5 = $2, keywords = to_tsvector($3), doc = $4 "+
-		"WHERE rfingerprint = $5",
-		&now, &key.MD5, &keywords, jsonBuf, &key.RFingerprint)
+	result, err := tx.ExecContext(ctx, "UPDATE keys SET mtime = $1, md5 = $2, keywords = to_tsvector($3), doc = $4 "+
+		"WHERE rfingerprint = $5 AND md5 = $6",
+		&now, &key.MD5, &keywords, jsonBuf, &key.RFingerprint, &lastMD5)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errgo.Mask(err)
+	} else if n == 0 {
+		return errgo.WithCausef(nil, hkpstorage.ErrConflict,
+			"failed to update rfp=%q, didn't match lastMD5=%q", key.RFingerprint, lastMD5)
+	}
+	err = replaceAddresses(ctx, tx, key)
 	if err != nil {
 		return errgo.Mask(err)
 	}
 	for _, subKey := range key.SubKeys {
-		_, err := tx.Exec("INSERT INTO subkeys (rfingerprint, rsubfp) "+
-			"SELECT $1::TEXT, $2::TEXT WHERE NOT EXISTS (SELECT 1 FROM subkeys WHERE rsubfp = $2)",
-			&key.RFingerprint, &subKey.RFingerprint)
+		_, err := tx.ExecContext(ctx, "INSERT INTO subkeys (rfingerprint, rsubfp, rkeyid) "+
+			"SELECT $1::TEXT, $2::TEXT, NULLIF($3::TEXT, '') WHERE NOT EXISTS (SELECT 1 FROM subkeys WHERE rsubfp = $2)",
+			&key.RFingerprint, &subKey.RFingerprint, hkpstorage.SubKeyRKeyID(subKey))
 		if err != nil {
 			return errgo.Mask(err)
 		}
 	}
+	err = logKeyChange(ctx, tx, key.RFingerprint, hkpstorage.ChangeReplaced, lastMD5, key.MD5)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errgo.Notef(err, "cannot commit rfp=%q", key.RFingerprint)
+	}
 
 	st.Notify(hkpstorage.KeyReplaced{
 		OldID:     lastID,
 		OldDigest: lastMD5,
 		NewID:     key.KeyID(),
 		NewDigest: key.MD5,
+
+		RFingerprint: key.RFingerprint,
 	})
 	return nil
 }
 
+func (st *storage) Delete(rfp string) (string, error) {
+	return st.DeleteContext(context.Background(), rfp)
+}
+
+func (st *storage) DeleteContext(ctx context.Context, rfp string) (_ string, retErr error) {
+	rfp = strings.ToLower(rfp)
+	tx, err := st.BeginTx(ctx, nil)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM subkeys WHERE rfingerprint = $1", rfp)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM emails WHERE rfingerprint = $1", rfp)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM wkd_addresses WHERE rfingerprint = $1", rfp)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM uid_states WHERE rfingerprint = $1", rfp)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	var md5 string
+	err = tx.QueryRowContext(ctx, "DELETE FROM keys WHERE rfingerprint = $1 RETURNING md5", rfp).Scan(&md5)
+	if err == sql.ErrNoRows {
+		return "", errgo.WithCausef(nil, hkpstorage.ErrKeyNotFound, "rfp=%q", rfp)
+	} else if err != nil {
+		return "", errgo.Mask(err)
+	}
+	err = logKeyChange(ctx, tx, rfp, hkpstorage.ChangeRemoved, md5, "")
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", errgo.Notef(err, "cannot commit rfp=%q", rfp)
+	}
+
+	st.Notify(hkpstorage.KeyRemoved{
+		ID:           keyID(rfp),
+		Digest:       md5,
+		RFingerprint: rfp,
+	})
+	return md5, nil
+}
+
+// UIDStates implements storage.UIDPublisher.
+func (st *storage) UIDStates(ctx context.Context, rfps []string) (map[string][]hkpstorage.UIDStatus, error) {
+	rows, err := st.QueryContext(ctx, "SELECT rfingerprint, email, state, mtime FROM uid_states "+
+		"WHERE rfingerprint = ANY($1) ORDER BY rfingerprint, email", pq.Array(rfps))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	result := make(map[string][]hkpstorage.UIDStatus)
+	for rows.Next() {
+		var rfp string
+		var status hkpstorage.UIDStatus
+		err = rows.Scan(&rfp, &status.Email, &status.State, &status.Modified)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result[rfp] = append(result[rfp], status)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// SetUIDState implements storage.UIDPublisher.
+func (st *storage) SetUIDState(ctx context.Context, rfp string, status hkpstorage.UIDStatus) error {
+	var exists bool
+	err := st.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM keys WHERE rfingerprint = $1)", rfp).Scan(&exists)
+	if err != nil {
+		return errgo.Mask(err)
+	} else if !exists {
+		return errgo.WithCausef(nil, hkpstorage.ErrKeyNotFound, "rfp=%q", rfp)
+	}
+	if status.State == hkpstorage.UIDUnpublished {
+		_, err = st.ExecContext(ctx, "DELETE FROM uid_states WHERE rfingerprint = $1 AND email = $2",
+			rfp, status.Email)
+		return errgo.Mask(err)
+	}
+	_, err = st.ExecContext(ctx, "INSERT INTO uid_states (rfingerprint, email, state, mtime) "+
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (rfingerprint, email) "+
+		"DO UPDATE SET state = EXCLUDED.state, mtime = EXCLUDED.mtime",
+		rfp, status.Email, string(status.State), status.Modified)
+	return errgo.Mask(err)
+}
+
+// Suppress implements storage.Suppressor.
+func (st *storage) Suppress(ctx context.Context, rfp string) error {
+	_, err := st.ExecContext(ctx, "INSERT INTO suppressed_keys (rfingerprint) VALUES ($1) "+
+		"ON CONFLICT (rfingerprint) DO NOTHING", strings.ToLower(rfp))
+	return errgo.Mask(err)
+}
+
+// Unsuppress implements storage.Suppressor.
+func (st *storage) Unsuppress(ctx context.Context, rfp string) error {
+	_, err := st.ExecContext(ctx, "DELETE FROM suppressed_keys WHERE rfingerprint = $1", strings.ToLower(rfp))
+	return errgo.Mask(err)
+}
+
+// Suppressed implements storage.Suppressor.
+func (st *storage) Suppressed(ctx context.Context, rfps []string) ([]string, error) {
+	var lower []string
+	for _, rfp := range rfps {
+		lower = append(lower, strings.ToLower(rfp))
+	}
+	rows, err := st.QueryContext(ctx, "SELECT rfingerprint FROM suppressed_keys WHERE rfingerprint = ANY($1)",
+		pq.Array(lower))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, rfp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// ListSuppressed implements storage.Suppressor.
+func (st *storage) ListSuppressed(ctx context.Context) ([]string, error) {
+	rows, err := st.QueryContext(ctx, "SELECT rfingerprint FROM suppressed_keys ORDER BY rfingerprint")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		result = append(result, rfp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// Changes implements storage.ChangeLogger. Changes are read in the order of
+// the transactions logging them, and only once no transaction which could
+// still log an earlier change is in progress, so that a reader following
+// cursors misses none. Change IDs alone are allocated before the
+// transactions commit, so cannot order the log. Cursors are the transaction
+// and change IDs, as "<xid>-<id>".
+//
+// So any transaction left open holds the log back, however long it runs and
+// whatever it does: changes logged after it began are not read until it
+// ends. Bulk loads commit each batch, but sessions left idle in a
+// transaction should be bounded with idle_in_transaction_session_timeout.
+func (st *storage) Changes(ctx context.Context, cursor string, limit int) ([]hkpstorage.Change, error) {
+	var xid, id int64
+	if cursor != "" {
+		var err error
+		xid, id, err = parseChangeCursor(cursor)
+		if err != nil {
+			return nil, errgo.WithCausef(nil, hkpstorage.ErrInvalidCursor, "cursor=%q", cursor)
+		}
+	}
+	rows, err := st.QueryContext(ctx, "SELECT xid, id, rfingerprint, change, COALESCE(old_md5, ''), COALESCE(new_md5, ''), ctime "+
+		"FROM key_changes WHERE (xid, id) > ($1, $2) AND xid < txid_snapshot_xmin(txid_current_snapshot()) "+
+		"ORDER BY xid, id LIMIT $3",
+		xid, id, limit)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	defer rows.Close()
+
+	var result []hkpstorage.Change
+	for rows.Next() {
+		var change hkpstorage.Change
+		var changeType string
+		err = rows.Scan(&xid, &id, &change.RFingerprint, &changeType, &change.OldDigest, &change.NewDigest, &change.Time)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		change.Cursor = strconv.FormatInt(xid, 10) + "-" + strconv.FormatInt(id, 10)
+		change.Type = hkpstorage.ChangeType(changeType)
+		change.Time = change.Time.UTC()
+		result = append(result, change)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// parseChangeCursor returns the transaction and change IDs of a cursor
+// returned by Changes.
+func parseChangeCursor(cursor string) (int64, int64, error) {
+	parts := strings.SplitN(cursor, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errgo.Newf("malformed cursor %q", cursor)
+	}
+	xid, err := strconv.ParseUint(parts[0], 10, 63)
+	if err != nil {
+		return 0, 0, errgo.Mask(err)
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 63)
+	if err != nil {
+		return 0, 0, errgo.Mask(err)
+	}
+	return int64(xid), int64(id), nil
+}
+
+// keyID returns the long key ID for the given RFingerprint.
+func keyID(rfp string) string {
+	if len(rfp) > 16 {
+		rfp = rfp[:16]
+	}
+	return openpgp.Reverse(rfp)
+}
+
 func keywordsTSVector(key *openpgp.PrimaryKey) string {
 	keywords := keywordsFromKey(key)
 	tsv, err := keywordsToTSVector(keywords)
@@ -19,6 +19,7 @@ package pghkp
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
@@ -26,15 +27,20 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"sort"
 	stdtesting "testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 	"hockeypuck/pgtest"
 	"hockeypuck/testing"
 
 	"hockeypuck/hkp"
 	"hockeypuck/hkp/jsonhkp"
+	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/storagetest"
 	"hockeypuck/openpgp"
 )
 
@@ -166,6 +172,21 @@ func (s *S) TestAddDuplicates(c *gc.C) {
 	c.Assert(keyDocs[0].MD5, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
 }
 
+func (s *S) TestResolveV3(c *gc.C) { storagetest.ResolveV3(c, s.storage) }
+
+func (s *S) TestResolveCollision(c *gc.C) {
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"subkey_collision/pubkey.asc", "subkey_collision/subkey.asc"} {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+	s.storage.Insert(keys)
+
+	rfps, err := s.storage.Resolve([]string{openpgp.Reverse("8a7558a6cd80ea04")})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 2)
+	c.Assert(rfps[0], gc.Not(gc.Equals), rfps[1])
+}
+
 func (s *S) TestResolve(c *gc.C) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x44a2d1db")
 	c.Assert(err, gc.IsNil)
@@ -225,6 +246,169 @@ func (s *S) TestResolve(c *gc.C) {
 		res.Body.Close()
 		c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound, comment)
 	}
+
+	// An empty key ID is not a prefix of every key.
+	rfps, err := s.storage.Resolve([]string{""})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *S) TestMatchEmail(c *gc.C) { storagetest.MatchEmail(c, s.storage) }
+
+func (s *S) TestMatchWKD(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	s.addKey(c, "revok_orig.asc")
+	alice := hkpstorage.WKDHash("alice") + "@example.com"
+
+	rfps, err := s.storage.MatchWKD([]string{alice})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	// The index is kept when the key is updated.
+	s.addKey(c, "alice_signed.asc")
+	rfps, err = s.storage.MatchWKD([]string{alice, hkpstorage.WKDHash("alice") + "@example.org"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"})
+
+	_, err = s.storage.Delete(rfps[0])
+	c.Assert(err, gc.IsNil)
+	rfps, err = s.storage.MatchWKD([]string{alice})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+}
+
+func (s *S) TestUIDStates(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	rfp := "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	mtime := time.Unix(1577836800, 0)
+
+	err := s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPending, Modified: mtime,
+	})
+	c.Assert(err, gc.IsNil)
+	states, err := s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states[rfp], gc.HasLen, 1)
+	c.Assert(states[rfp][0].State, gc.Equals, hkpstorage.UIDPending)
+	c.Assert(states[rfp][0].Modified.Equal(mtime), gc.Equals, true)
+
+	err = s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPublished, Modified: mtime,
+	})
+	c.Assert(err, gc.IsNil)
+	states, err = s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states[rfp], gc.HasLen, 1)
+	c.Assert(states[rfp][0].State, gc.Equals, hkpstorage.UIDPublished)
+
+	err = s.storage.SetUIDState(ctx, rfp, hkpstorage.UIDStatus{Email: "alice@example.com", State: hkpstorage.UIDUnpublished})
+	c.Assert(err, gc.IsNil)
+	states, err = s.storage.UIDStates(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.HasLen, 0)
+
+	err = s.storage.SetUIDState(ctx, "0000000000000000000000000000000000000000", hkpstorage.UIDStatus{
+		Email: "alice@example.com", State: hkpstorage.UIDPublished, Modified: mtime,
+	})
+	c.Assert(hkpstorage.IsNotFound(err), gc.Equals, true)
+}
+
+func (s *S) TestSuppress(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	rfp := "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+
+	suppressed, err := s.storage.Suppressed(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+
+	err = s.storage.Suppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Suppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	suppressed, err = s.storage.Suppressed(ctx, []string{rfp, "0000000000000000000000000000000000000000"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.DeepEquals, []string{rfp})
+	suppressed, err = s.storage.ListSuppressed(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.DeepEquals, []string{rfp})
+
+	// Suppressed keys are not stored again once deleted.
+	_, err = s.storage.Delete(rfp)
+	c.Assert(err, gc.IsNil)
+	s.addKey(c, "alice_signed.asc")
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	// Until the suppression is lifted.
+	err = s.storage.Unsuppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Unsuppress(ctx, rfp)
+	c.Assert(err, gc.IsNil)
+	suppressed, err = s.storage.Suppressed(ctx, []string{rfp})
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+	suppressed, err = s.storage.ListSuppressed(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.HasLen, 0)
+	s.addKey(c, "alice_signed.asc")
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+}
+
+func (s *S) TestChanges(c *gc.C) {
+	ctx := context.Background()
+	s.addKey(c, "alice_unsigned.asc")
+	s.addKey(c, "alice_signed.asc")
+	rfp := openpgp.Reverse("10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	_, err := s.storage.Delete(rfp)
+	c.Assert(err, gc.IsNil)
+
+	changes, err := s.storage.Changes(ctx, "", 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.HasLen, 3)
+	for _, change := range changes {
+		c.Assert(change.RFingerprint, gc.Equals, rfp)
+	}
+	c.Assert(changes[0].Type, gc.Equals, hkpstorage.ChangeAdded)
+	c.Assert(changes[0].OldDigest, gc.Equals, "")
+	c.Assert(changes[1].Type, gc.Equals, hkpstorage.ChangeReplaced)
+	c.Assert(changes[1].OldDigest, gc.Equals, changes[0].NewDigest)
+	c.Assert(changes[2].Type, gc.Equals, hkpstorage.ChangeRemoved)
+	c.Assert(changes[2].OldDigest, gc.Equals, changes[1].NewDigest)
+	c.Assert(changes[2].NewDigest, gc.Equals, "")
+
+	page, err := s.storage.Changes(ctx, changes[0].Cursor, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(page, gc.DeepEquals, changes[1:2])
+
+	_, err = s.storage.Changes(ctx, "bogus", 100)
+	c.Assert(errgo.Cause(err), gc.Equals, hkpstorage.ErrInvalidCursor)
+
+	// Changes committed are held back while a transaction which began
+	// before them could still log an earlier one.
+	tx, err := s.db.Begin()
+	c.Assert(err, gc.IsNil)
+	defer tx.Rollback()
+	err = logKeyChange(ctx, tx, rfp, hkpstorage.ChangeAdded, "", "aaa")
+	c.Assert(err, gc.IsNil)
+	s.addKey(c, "alice_signed.asc")
+	page, err = s.storage.Changes(ctx, changes[2].Cursor, 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(page, gc.HasLen, 0)
+
+	c.Assert(tx.Commit(), gc.IsNil)
+	page, err = s.storage.Changes(ctx, changes[2].Cursor, 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(page, gc.HasLen, 2)
+	c.Assert(page[0].NewDigest, gc.Equals, "aaa")
+	c.Assert(page[1].Type, gc.Equals, hkpstorage.ChangeAdded)
+	c.Assert(page[1].NewDigest, gc.Not(gc.Equals), "aaa")
 }
 
 func (s *S) TestMerge(c *gc.C) {
@@ -274,3 +458,329 @@ func (s *S) TestEd25519(c *gc.C) {
 		c.Assert(keys[0].Parsed, gc.Equals, true)
 	}
 }
+
+func (s *S) TestV6(c *gc.C) { storagetest.V6(c, s.storage) }
+
+func (s *S) TestUpdateConflict(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+
+	keyDocs := s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 1)
+	lastMD5 := keyDocs[0].MD5
+
+	keys, err := s.storage.FetchKeys([]string{keyDocs[0].RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	key := keys[0]
+	signed := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+	c.Assert(signed, gc.HasLen, 1)
+	err = openpgp.Merge(key, signed[0])
+	c.Assert(err, gc.IsNil)
+
+	// An update based on a stale digest is refused.
+	err = s.storage.Update(key, key.KeyID(), "00000000000000000000000000000000")
+	c.Assert(hkpstorage.IsConflict(err), gc.Equals, true)
+	keyDocs = s.queryAllKeys(c)
+	c.Assert(keyDocs[0].MD5, gc.Equals, lastMD5)
+
+	err = s.storage.Update(key, key.KeyID(), lastMD5)
+	c.Assert(err, gc.IsNil)
+	keyDocs = s.queryAllKeys(c)
+	c.Assert(keyDocs[0].MD5, gc.Equals, key.MD5)
+}
+
+func (s *S) TestContextCanceled(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.storage.MatchKeywordContext(ctx, []string{"alice"})
+	c.Assert(err, gc.NotNil)
+	_, err = s.storage.FetchKeysContext(ctx, []string{"acd0e032ca1cb163a2aa9305257f384b1fc8ef01"})
+	c.Assert(err, gc.NotNil)
+
+	rfps, err := s.storage.MatchKeywordContext(context.Background(), []string{"alice"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 1)
+}
+
+func (s *S) TestUpdateCanceledNotNotified(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	keyDocs := s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 1)
+	lastMD5 := keyDocs[0].MD5
+
+	keys, err := s.storage.FetchKeys([]string{keyDocs[0].RFingerprint})
+	c.Assert(err, gc.IsNil)
+	key := keys[0]
+	err = openpgp.Merge(key, openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0])
+	c.Assert(err, gc.IsNil)
+
+	var changes []hkpstorage.KeyChange
+	s.storage.Subscribe(func(kc hkpstorage.KeyChange) error {
+		changes = append(changes, kc)
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.storage.UpdateContext(ctx, key, key.KeyID(), lastMD5)
+	c.Assert(err, gc.NotNil)
+	_, err = s.storage.DeleteContext(ctx, key.RFingerprint)
+	c.Assert(err, gc.NotNil)
+	c.Assert(changes, gc.HasLen, 0)
+	keyDocs = s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 1)
+	c.Assert(keyDocs[0].MD5, gc.Equals, lastMD5)
+
+	err = s.storage.UpdateContext(context.Background(), key, key.KeyID(), lastMD5)
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.HasLen, 1)
+}
+
+func (s *S) TestIterKeyringsStoredDigest(c *gc.C) {
+	s.addKey(c, "alice_unsigned.asc")
+	const digest = "0123456789abcdef0123456789abcdef"
+	_, err := s.db.Exec("UPDATE keys SET md5 = $1", digest)
+	c.Assert(err, gc.IsNil)
+
+	cur, err := s.storage.IterKeyrings(context.Background(), hkpstorage.ByRFingerprint, hkpstorage.Checkpoint{})
+	c.Assert(err, gc.IsNil)
+	defer cur.Close()
+	c.Assert(cur.Next(), gc.Equals, true)
+	c.Assert(cur.Keyring().Digest, gc.Equals, digest)
+	c.Assert(cur.Keyring().MD5, gc.Not(gc.Equals), digest)
+	c.Assert(cur.Next(), gc.Equals, false)
+	c.Assert(cur.Err(), gc.IsNil)
+}
+
+func (s *S) TestIterKeyrings(c *gc.C) {
+	for _, name := range []string{"alice_unsigned.asc", "uat.asc", "e68e311d.asc"} {
+		s.addKey(c, name)
+	}
+
+	for _, order := range []hkpstorage.KeyringOrder{hkpstorage.ByRFingerprint, hkpstorage.ByMTime} {
+		comment := gc.Commentf("order=%v", order)
+		cur, err := s.storage.IterKeyrings(context.Background(), order, hkpstorage.Checkpoint{})
+		c.Assert(err, gc.IsNil, comment)
+		var rfps []string
+		for cur.Next() {
+			rfps = append(rfps, cur.Keyring().RFingerprint)
+		}
+		c.Assert(cur.Err(), gc.IsNil, comment)
+		c.Assert(cur.Close(), gc.IsNil, comment)
+		c.Assert(rfps, gc.HasLen, 3, comment)
+
+		// Resume after the first keyring.
+		cur, err = s.storage.IterKeyrings(context.Background(), order, hkpstorage.Checkpoint{})
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(cur.Next(), gc.Equals, true, comment)
+		cp := cur.Checkpoint()
+		c.Assert(cur.Close(), gc.IsNil, comment)
+
+		cur, err = s.storage.IterKeyrings(context.Background(), order, cp)
+		c.Assert(err, gc.IsNil, comment)
+		var resumed []string
+		for cur.Next() {
+			resumed = append(resumed, cur.Keyring().RFingerprint)
+		}
+		c.Assert(cur.Err(), gc.IsNil, comment)
+		c.Assert(cur.Close(), gc.IsNil, comment)
+		c.Assert(resumed, gc.DeepEquals, rfps[1:], comment)
+	}
+}
+
+func (s *S) TestIterKeyringsUnreadable(c *gc.C) {
+	for _, name := range []string{"alice_unsigned.asc", "uat.asc", "e68e311d.asc"} {
+		s.addKey(c, name)
+	}
+	var rfps []string
+	rows, err := s.db.Query("SELECT rfingerprint FROM keys ORDER BY rfingerprint")
+	c.Assert(err, gc.IsNil)
+	for rows.Next() {
+		var rfp string
+		c.Assert(rows.Scan(&rfp), gc.IsNil)
+		rfps = append(rfps, rfp)
+	}
+	c.Assert(rows.Err(), gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 3)
+
+	// Store the document of one key in the record of another, so that it
+	// cannot be read.
+	_, err = s.db.Exec("UPDATE keys SET doc = (SELECT doc FROM keys WHERE rfingerprint = $1) "+
+		"WHERE rfingerprint = $2", rfps[0], rfps[1])
+	c.Assert(err, gc.IsNil)
+
+	for _, order := range []hkpstorage.KeyringOrder{hkpstorage.ByRFingerprint, hkpstorage.ByMTime} {
+		comment := gc.Commentf("order=%v", order)
+		cur, err := s.storage.IterKeyrings(context.Background(), order, hkpstorage.Checkpoint{})
+		c.Assert(err, gc.IsNil, comment)
+		read := make(map[string]bool)
+		for cur.Next() {
+			read[cur.Keyring().RFingerprint] = true
+		}
+		c.Assert(cur.Err(), gc.IsNil, comment)
+		c.Assert(cur.Close(), gc.IsNil, comment)
+		c.Assert(read, gc.DeepEquals, map[string]bool{rfps[0]: true, rfps[2]: true}, comment)
+	}
+}
+
+func (s *S) TestIterDigests(c *gc.C) {
+	for _, name := range []string{"alice_unsigned.asc", "uat.asc", "e68e311d.asc"} {
+		s.addKey(c, name)
+	}
+	const digest = "0123456789abcdef0123456789abcdef"
+	_, err := s.db.Exec("UPDATE keys SET md5 = $1 WHERE rfingerprint = (SELECT min(rfingerprint) FROM keys)", digest)
+	c.Assert(err, gc.IsNil)
+
+	cur, err := s.storage.IterDigests(context.Background())
+	c.Assert(err, gc.IsNil)
+	defer cur.Close()
+	var digests []string
+	for cur.Next() {
+		digests = append(digests, cur.Digest().Digest)
+	}
+	c.Assert(cur.Err(), gc.IsNil)
+	c.Assert(digests, gc.HasLen, 3)
+	c.Assert(digests[0], gc.Equals, digest)
+}
+
+func (s *S) TestSchemaVersion(c *gc.C) {
+	ctx := context.Background()
+	version, err := SchemaVersion(ctx, s.db)
+	c.Assert(err, gc.IsNil)
+	c.Assert(version, gc.Equals, LatestSchemaVersion())
+
+	// Migrating an up to date schema is a no-op.
+	from, to, err := MigrateSchema(ctx, s.db)
+	c.Assert(err, gc.IsNil)
+	c.Assert(from, gc.Equals, version)
+	c.Assert(to, gc.Equals, version)
+	c.Assert(CheckSchema(ctx, s.db), gc.IsNil)
+
+	_, err = s.db.Exec("INSERT INTO schema_version (version, description) VALUES ($1, 'from the future')", version+1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(errgo.Cause(CheckSchema(ctx, s.db)), gc.Equals, ErrSchemaTooNew)
+	_, err = New(s.db, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrSchemaTooNew)
+}
+
+func (s *S) TestSchemaTooOld(c *gc.C) {
+	ctx := context.Background()
+	latest := LatestSchemaVersion()
+	_, err := s.db.Exec("DELETE FROM schema_version WHERE version = $1", latest)
+	c.Assert(err, gc.IsNil)
+
+	// An existing database is never migrated at startup.
+	_, err = New(s.db, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrSchemaTooOld)
+	c.Assert(err, gc.ErrorMatches, `.*hockeypuck-migrate-schema.*`)
+	c.Assert(errgo.Cause(CheckSchema(ctx, s.db)), gc.Equals, ErrSchemaTooOld)
+	version, err := SchemaVersion(ctx, s.db)
+	c.Assert(err, gc.IsNil)
+	c.Assert(version, gc.Equals, latest-1)
+}
+
+func (s *S) TestBulkInsert(c *gc.C) {
+	s.addKey(c, "uat.asc")
+
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"alice_unsigned.asc", "uat.asc", "e68e311d.asc", "alice_unsigned.asc"} {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+
+	var added []string
+	s.storage.Subscribe(func(kc hkpstorage.KeyChange) error {
+		if ka, ok := kc.(hkpstorage.KeyAdded); ok {
+			added = append(added, ka.Digest)
+		}
+		return nil
+	})
+
+	bi, err := NewBulkInserter(context.Background(), s.storage, BatchSize(2), DropIndexes())
+	c.Assert(err, gc.IsNil)
+	n, err := bi.Insert(context.Background(), keys)
+	c.Assert(n, gc.Equals, 2)
+	insertErr, ok := err.(hkpstorage.InsertError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(insertErr.Errors, gc.HasLen, 0)
+	// One already stored, one repeated in the input.
+	c.Assert(insertErr.Duplicates, gc.HasLen, 2)
+	c.Assert(bi.Close(), gc.IsNil)
+
+	c.Assert(added, gc.HasLen, 2)
+	c.Assert(s.queryAllKeys(c), gc.HasLen, 3)
+
+	// Bulk inserts are logged as adds are.
+	changes, err := s.storage.Changes(context.Background(), "", 100)
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.HasLen, 3)
+	for i, change := range changes[1:] {
+		c.Assert(change.Type, gc.Equals, hkpstorage.ChangeAdded)
+		c.Assert(change.NewDigest, gc.Equals, added[i])
+	}
+
+	for _, key := range keys {
+		for _, subKey := range key.SubKeys {
+			var rfp string
+			err := s.db.QueryRow("SELECT rfingerprint FROM subkeys WHERE rsubfp = $1", subKey.RFingerprint).Scan(&rfp)
+			c.Assert(err, gc.IsNil)
+			c.Assert(rfp, gc.Equals, key.RFingerprint)
+		}
+	}
+}
+
+func (s *S) TestBulkInsertSuppressed(c *gc.C) {
+	ctx := context.Background()
+	err := s.storage.Suppress(ctx, "accd0e320f1cb163a2aa9305257f384b1fc8ef01")
+	c.Assert(err, gc.IsNil)
+
+	var keys []*openpgp.PrimaryKey
+	for _, name := range []string{"alice_signed.asc", "uat.asc"} {
+		keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput(name))...)
+	}
+	bi, err := NewBulkInserter(ctx, s.storage)
+	c.Assert(err, gc.IsNil)
+	n, err := bi.Insert(ctx, keys)
+	c.Assert(n, gc.Equals, 1)
+	insertErr, ok := err.(hkpstorage.InsertError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(insertErr.Duplicates, gc.HasLen, 0)
+	c.Assert(insertErr.Errors, gc.HasLen, 1)
+	c.Assert(errgo.Cause(insertErr.Errors[0]), gc.Equals, hkpstorage.ErrKeySuppressed)
+	c.Assert(bi.Close(), gc.IsNil)
+	c.Assert(s.queryAllKeys(c), gc.HasLen, 1)
+}
+
+// secondaryIndexes returns the names of the indexes in the database which do
+// not back a constraint.
+func (s *S) secondaryIndexes(c *gc.C) []string {
+	rows, err := s.db.Query(`SELECT indexname FROM pg_indexes i WHERE schemaname = current_schema()
+AND NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conindid = (quote_ident(i.schemaname)||'.'||quote_ident(i.indexname))::regclass)
+ORDER BY indexname`)
+	c.Assert(err, gc.IsNil)
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		c.Assert(rows.Scan(&name), gc.IsNil)
+		names = append(names, name)
+	}
+	c.Assert(rows.Err(), gc.IsNil)
+	return names
+}
+
+func (s *S) TestBulkDropIndexes(c *gc.C) {
+	// Every index added by a migration must be dropped for bulk loading.
+	var want []string
+	for _, index := range bulkIndexes {
+		want = append(want, index.name)
+	}
+	sort.Strings(want)
+	c.Assert(s.secondaryIndexes(c), gc.DeepEquals, want)
+
+	bi, err := NewBulkInserter(context.Background(), s.storage, DropIndexes())
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.secondaryIndexes(c), gc.HasLen, 0)
+	c.Assert(bi.Close(), gc.IsNil)
+	c.Assert(s.secondaryIndexes(c), gc.DeepEquals, want)
+}
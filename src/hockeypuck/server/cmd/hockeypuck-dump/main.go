@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/hex"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,13 +9,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
 
 	"gopkg.in/errgo.v1"
-	"gopkg.in/tomb.v2"
-	"hockeypuck/conflux/recon"
-	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
 	"hockeypuck/openpgp"
 
@@ -77,118 +73,43 @@ func dump(settings *server.Settings) error {
 	}
 	defer st.Close()
 
-	ptree, err := sks.NewPrefixTree(settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings)
+	cur, err := st.IterKeyrings(context.Background(), storage.ByRFingerprint, storage.Checkpoint{})
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	err = ptree.Create()
-	if err != nil {
-		return errgo.Mask(err)
-	}
-	defer ptree.Close()
+	defer cur.Close()
 
-	root, err := ptree.Root()
-	if err != nil {
-		return errgo.Mask(err)
-	}
-
-	var t tomb.Tomb
-	ch := make(chan string)
-
-	t.Go(func() error {
-		var i int
-		var digests []string
-		defer func() {
-			for _ = range ch {
-			}
-		}() // drain if early return on error
-		for digest := range ch {
-			digests = append(digests, digest)
-			if len(digests) >= *count {
-				err := writeKeys(st, digests, i)
+	var f *os.File
+	var i, n int
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for cur.Next() {
+		if n%*count == 0 {
+			if f != nil {
+				err = f.Close()
 				if err != nil {
 					return errgo.Mask(err)
 				}
-				i++
-				digests = nil
+				log.Printf("wrote %d keys", n)
 			}
-		}
-		if len(digests) > 0 {
-			err := writeKeys(st, digests, i)
+			f, err = os.Create(filepath.Join(*outputDir, fmt.Sprintf("hkp-dump-%04d.pgp", i)))
 			if err != nil {
 				return errgo.Mask(err)
 			}
+			i++
 		}
-		return nil
-	})
-	t.Go(func() error {
-		return traverse(root, ch)
-	})
-	return t.Wait()
-}
-
-func traverse(root recon.PrefixNode, ch chan string) error {
-	defer close(ch)
-	// Depth-first walk of the prefix tree
-	nodes := []recon.PrefixNode{root}
-	for len(nodes) > 0 {
-		node := nodes[0]
-		nodes = nodes[1:]
-
-		if node.IsLeaf() {
-			elements, err := node.Elements()
-			if err != nil {
-				return errgo.Mask(err)
-			}
-			for _, element := range elements {
-				zb := element.Bytes()
-				ch <- strings.ToLower(hex.EncodeToString(zb))
-			}
-		} else {
-			children, err := node.Children()
-			if err != nil {
-				return errgo.Mask(err)
-			}
-			nodes = append(nodes, children...)
-		}
-	}
-	return nil
-}
-
-const chunksize = 20
-
-func writeKeys(st storage.Queryer, digests []string, num int) error {
-	rfps, err := st.MatchMD5(digests)
-	if err != nil {
-		return errgo.Mask(err)
-	}
-	log.Printf("matched %d fingerprints", len(rfps))
-	f, err := os.Create(filepath.Join(*outputDir, fmt.Sprintf("hkp-dump-%04d.pgp", num)))
-	if err != nil {
-		return errgo.Mask(err)
-	}
-	defer f.Close()
-
-	for len(rfps) > 0 {
-		var chunk []string
-		if len(rfps) > chunksize {
-			chunk = rfps[:chunksize]
-			rfps = rfps[chunksize:]
-		} else {
-			chunk = rfps
-			rfps = nil
-		}
-
-		keys, err := st.FetchKeys(chunk)
+		err = openpgp.WritePackets(f, cur.Keyring().PrimaryKey)
 		if err != nil {
 			return errgo.Mask(err)
 		}
-		for _, key := range keys {
-			err := openpgp.WritePackets(f, key)
-			if err != nil {
-				return errgo.Mask(err)
-			}
-		}
+		n++
+	}
+	if err := cur.Err(); err != nil {
+		return errgo.Mask(err)
 	}
+	log.Printf("wrote %d keys", n)
 	return nil
 }
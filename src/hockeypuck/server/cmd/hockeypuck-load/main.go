@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	"os"
@@ -15,15 +16,18 @@ import (
 	"hockeypuck/hkp/storage"
 	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
+	"hockeypuck/pghkp"
 
 	"hockeypuck/server"
 	"hockeypuck/server/cmd"
 )
 
 var (
-	configFile = flag.String("config", "", "config file")
-	cpuProf    = flag.Bool("cpuprof", false, "enable CPU profiling")
-	memProf    = flag.Bool("memprof", false, "enable mem profiling")
+	configFile  = flag.String("config", "", "config file")
+	bulk        = flag.Bool("bulk", true, "use bulk loading where supported by the storage driver")
+	dropIndexes = flag.Bool("drop-indexes", false, "drop indexes while bulk loading, do not use while serving from the same database")
+	cpuProf     = flag.Bool("cpuprof", false, "enable CPU profiling")
+	memProf     = flag.Bool("memprof", false, "enable mem profiling")
 )
 
 func main() {
@@ -111,7 +115,41 @@ func load(settings *server.Settings, args []string) error {
 		return nil
 	})
 
+	insert := st.Insert
+	if suppressor, ok := st.(storage.Suppressor); ok {
+		insert = func(keys []*openpgp.PrimaryKey) (int, error) {
+			keys, err := dropSuppressed(suppressor, keys)
+			if err != nil {
+				return 0, errgo.Mask(err)
+			}
+			return st.Insert(keys)
+		}
+	}
+	if *bulk && settings.OpenPGP.DB.Driver == "postgres-jsonb" {
+		var options []pghkp.BulkOption
+		if *dropIndexes {
+			options = append(options, pghkp.DropIndexes())
+		}
+		bi, err := pghkp.NewBulkInserter(context.Background(), st, options...)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer func() {
+			err := bi.Close()
+			if err != nil {
+				log.Errorf("failed to complete bulk load: %v", errgo.Details(err))
+			}
+		}()
+		insert = func(keys []*openpgp.PrimaryKey) (int, error) {
+			return bi.Insert(context.Background(), keys)
+		}
+	}
+
 	keyReaderOptions := server.KeyReaderOptions(settings)
+	keyPolicy, err := server.KeyPolicy(settings)
+	if err != nil {
+		return errgo.Notef(err, "invalid key policy")
+	}
 
 	for _, arg := range args {
 		matches, err := filepath.Glob(arg)
@@ -132,8 +170,11 @@ func load(settings *server.Settings, args []string) error {
 				continue
 			}
 			log.Infof("found %d keys in %q...", len(keys), file)
+			if keyPolicy != nil {
+				keys = checkKeyPolicy(keyPolicy, keys)
+			}
 			t := time.Now()
-			n, err := st.Insert(keys)
+			n, err := insert(keys)
 			if err != nil {
 				log.Errorf("some keys failed to insert from %q: %v", file, errgo.Details(err))
 				if hke, ok := err.(storage.InsertError); ok {
@@ -150,3 +191,50 @@ func load(settings *server.Settings, args []string) error {
 
 	return nil
 }
+
+// checkKeyPolicy returns the keys which the policy accepts, logging why each
+// of the others was rejected.
+func checkKeyPolicy(policy openpgp.KeyPolicy, keys []*openpgp.PrimaryKey) []*openpgp.PrimaryKey {
+	var accepted []*openpgp.PrimaryKey
+	for _, key := range keys {
+		err := policy.Check(key)
+		if err != nil {
+			log.Warningf("rejected key %q: %v", key.Fingerprint(), err)
+			continue
+		}
+		accepted = append(accepted, key)
+	}
+	if len(accepted) < len(keys) {
+		log.Infof("rejected %d keys by policy", len(keys)-len(accepted))
+	}
+	return accepted
+}
+
+// dropSuppressed returns the keys which have not been suppressed, logging
+// each of the others. The bulk inserter checks this itself.
+func dropSuppressed(suppressor storage.Suppressor, keys []*openpgp.PrimaryKey) ([]*openpgp.PrimaryKey, error) {
+	rfps := make([]string, len(keys))
+	for i, key := range keys {
+		rfps[i] = key.RFingerprint
+	}
+	suppressed, err := suppressor.Suppressed(context.Background(), rfps)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot check for suppressed keys")
+	}
+	if len(suppressed) == 0 {
+		return keys, nil
+	}
+	isSuppressed := make(map[string]bool)
+	for _, rfp := range suppressed {
+		isSuppressed[rfp] = true
+	}
+	var accepted []*openpgp.PrimaryKey
+	for _, key := range keys {
+		if isSuppressed[key.RFingerprint] {
+			log.Warningf("skipped key %q: it has been taken down", key.Fingerprint())
+			continue
+		}
+		accepted = append(accepted, key)
+	}
+	return accepted, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/errgo.v1"
+	log "hockeypuck/logrus"
+	"hockeypuck/pghkp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+	status     = flag.Bool("status", false, "report the schema version without migrating")
+)
+
+func main() {
+	flag.Parse()
+
+	if *configFile == "" {
+		log.Errorf("usage: %s -config <config> [-status]", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	conf, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		cmd.Die(errgo.Mask(err))
+	}
+	settings, err := server.ParseSettings(string(conf))
+	if err != nil {
+		cmd.Die(errgo.Mask(err))
+	}
+
+	err = migrateSchema(settings)
+	cmd.Die(err)
+}
+
+func migrateSchema(settings *server.Settings) error {
+	if driver := settings.OpenPGP.DB.Driver; driver != "postgres-jsonb" {
+		return errgo.Newf("storage driver %q does not have a versioned schema", driver)
+	}
+	db, err := sql.Open("postgres", settings.OpenPGP.DB.DSN)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	version, err := pghkp.SchemaVersion(ctx, db)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	latest := pghkp.LatestSchemaVersion()
+	if *status {
+		fmt.Printf("schema version %d, latest %d\n", version, latest)
+		return errgo.Mask(pghkp.CheckSchema(ctx, db), errgo.Any)
+	}
+
+	from, to, err := pghkp.MigrateSchema(ctx, db)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if from == to {
+		log.Infof("schema is up to date at version %d", to)
+	} else {
+		log.Infof("migrated schema from version %d to %d", from, to)
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	fromConfig     = flag.String("from", "", "config file of the storage to migrate from")
+	toConfig       = flag.String("to", "", "config file of the storage to migrate to")
+	checkpointFile = flag.String("checkpoint", "hockeypuck-migrate.checkpoint", "file recording migration progress")
+	resume         = flag.Bool("resume", false, "resume from the last recorded checkpoint")
+	batchSize      = flag.Int("batch", 500, "keys per batch")
+	verify         = flag.Bool("verify", true, "verify the destination against the source when done")
+)
+
+func main() {
+	flag.Parse()
+
+	if *fromConfig == "" || *toConfig == "" {
+		log.Errorf("usage: %s -from <config> -to <config> [flags]", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *batchSize < 1 {
+		cmd.Die(errgo.Newf("invalid batch size %d", *batchSize))
+	}
+
+	from, err := readSettings(*fromConfig)
+	if err != nil {
+		cmd.Die(errgo.Mask(err))
+	}
+	to, err := readSettings(*toConfig)
+	if err != nil {
+		cmd.Die(errgo.Mask(err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		log.Infof("received %v, stopping after the current batch", sig)
+		cancel()
+	}()
+
+	err = run(ctx, from, to)
+	cmd.Die(err)
+}
+
+func run(ctx context.Context, from, to *server.Settings) error {
+	src, err := server.DialStorage(from)
+	if err != nil {
+		return errgo.Notef(err, "cannot open source storage")
+	}
+	defer src.Close()
+
+	dst, err := server.DialStorage(to)
+	if err != nil {
+		return errgo.Notef(err, "cannot open destination storage")
+	}
+	defer dst.Close()
+
+	return migrate(ctx, src, dst)
+}
+
+func readSettings(path string) (*server.Settings, error) {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	settings, err := server.ParseSettings(string(conf))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse %q", path)
+	}
+	return settings, nil
+}
+
+// progress is recorded in the checkpoint file after each batch, so that an
+// interrupted migration can be resumed.
+type progress struct {
+	Checkpoint storage.Checkpoint `json:"checkpoint"`
+	Migrated   int                `json:"migrated"`
+	Skipped    int                `json:"skipped"`
+	Failed     int                `json:"failed"`
+}
+
+func readProgress(path string) (*progress, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &progress{}, nil
+	} else if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var p progress
+	err = json.Unmarshal(buf, &p)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read checkpoint %q", path)
+	}
+	return &p, nil
+}
+
+func writeProgress(path string, p *progress) error {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	tmpPath := path + ".part"
+	err = ioutil.WriteFile(tmpPath, buf, 0644)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(os.Rename(tmpPath, path))
+}
+
+// migrate copies the keyrings of src into dst, recording its progress in the
+// checkpoint file after each batch. Suppressed keys are carried over first,
+// so that keys which have been taken down are not stored again by the
+// destination, and the publication states of email addresses with the keys
+// they belong to.
+func migrate(ctx context.Context, src, dst storage.Storage) error {
+	importer, ok := dst.(storage.KeyringImporter)
+	if !ok {
+		return errgo.New("destination storage does not support importing keyrings")
+	}
+	err := migrateSuppressed(ctx, src, dst)
+	if err != nil {
+		return errgo.Notef(err, "cannot migrate suppressed keys")
+	}
+	srcPublisher, _ := src.(storage.UIDPublisher)
+	dstPublisher, _ := dst.(storage.UIDPublisher)
+	if srcPublisher != nil && dstPublisher == nil {
+		log.Warningf("destination storage does not record email publication states, they will not be migrated")
+	}
+
+	p := &progress{}
+	if *resume {
+		p, err = readProgress(*checkpointFile)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !p.Checkpoint.IsZero() {
+			log.Infof("resuming after rfp=%q, %d keys migrated so far", p.Checkpoint.RFingerprint, p.Migrated)
+		}
+	}
+
+	cur, err := src.IterKeyrings(ctx, storage.ByRFingerprint, p.Checkpoint)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer cur.Close()
+
+	start := time.Now()
+	var count int
+	batch := make([]*storage.Keyring, 0, *batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		n, err := importer.ImportKeyrings(ctx, batch)
+		p.Migrated += n
+		if insertErr, ok := err.(storage.InsertError); ok {
+			p.Skipped += len(insertErr.Duplicates)
+			p.Failed += len(insertErr.Errors)
+			for _, err := range insertErr.Errors {
+				log.Errorf("import error: %v", errgo.Details(err))
+			}
+		} else if err != nil {
+			return errgo.Mask(err)
+		}
+		if srcPublisher != nil && dstPublisher != nil {
+			err := migrateUIDStates(ctx, srcPublisher, dstPublisher, batch)
+			if err != nil {
+				return errgo.Notef(err, "cannot migrate email publication states")
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			// The batch may be incomplete, leave the checkpoint where it was.
+			return errgo.Mask(err, errgo.Any)
+		}
+
+		p.Checkpoint = storage.CheckpointOf(batch[len(batch)-1])
+		count += len(batch)
+		batch = batch[:0]
+		if err := writeProgress(*checkpointFile, p); err != nil {
+			return errgo.Notef(err, "cannot record checkpoint")
+		}
+		elapsed := time.Since(start)
+		log.Infof("%d keys migrated, %d skipped, %d failed (%.1f keys/s)",
+			p.Migrated, p.Skipped, p.Failed, float64(count)/elapsed.Seconds())
+		return nil
+	}
+	for cur.Next() {
+		batch = append(batch, cur.Keyring())
+		if len(batch) >= *batchSize {
+			if err := flush(); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := flush(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	log.Infof("migration complete: %d keys migrated, %d skipped, %d failed in %v",
+		p.Migrated, p.Skipped, p.Failed, time.Since(start))
+	log.Infof("run hockeypuck-pbuild against the destination to rebuild its prefix tree")
+
+	if *verify {
+		err = verifyKeyrings(ctx, src, dst)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	if p.Failed > 0 {
+		return errgo.Newf("%d keys failed to migrate", p.Failed)
+	}
+	return nil
+}
+
+// migrateSuppressed records every key suppressed in src as suppressed in dst.
+func migrateSuppressed(ctx context.Context, src, dst storage.Storage) error {
+	srcSuppressor, ok := src.(storage.Suppressor)
+	if !ok {
+		return nil
+	}
+	rfps, err := srcSuppressor.ListSuppressed(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(rfps) == 0 {
+		return nil
+	}
+	dstSuppressor, ok := dst.(storage.Suppressor)
+	if !ok {
+		return errgo.Newf("destination storage cannot record the %d suppressed keys", len(rfps))
+	}
+	for _, rfp := range rfps {
+		err = dstSuppressor.Suppress(ctx, rfp)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	log.Infof("%d suppressed keys migrated", len(rfps))
+	return nil
+}
+
+// migrateUIDStates copies the email publication states of the given keyrings
+// from src to dst. Keyrings which failed to import are skipped.
+func migrateUIDStates(ctx context.Context, src, dst storage.UIDPublisher, keyrings []*storage.Keyring) error {
+	rfps := make([]string, len(keyrings))
+	for i, keyring := range keyrings {
+		rfps[i] = keyring.RFingerprint
+	}
+	states, err := src.UIDStates(ctx, rfps)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for rfp, statuses := range states {
+		for _, status := range statuses {
+			err = dst.SetUIDState(ctx, rfp, status)
+			if errgo.Cause(err) == storage.ErrKeyNotFound {
+				log.Warningf("rfp=%q is missing from the destination, its email publication states were not migrated", rfp)
+				break
+			} else if err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyKeyrings walks both storages in fingerprint order and checks that
+// every source keyring is present in the destination with the same stored
+// digest, packets and timestamps. Backends store timestamps at different
+// precision, so these are compared to the second.
+func verifyKeyrings(ctx context.Context, src, dst storage.Storage) error {
+	log.Infof("verifying destination...")
+	srcCur, err := src.IterKeyrings(ctx, storage.ByRFingerprint, storage.Checkpoint{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer srcCur.Close()
+	dstCur, err := dst.IterKeyrings(ctx, storage.ByRFingerprint, storage.Checkpoint{})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer dstCur.Close()
+
+	var srcCount, dstCount, missing, mismatched, extra int
+	dstOk := dstCur.Next()
+	if dstOk {
+		dstCount++
+	}
+	for srcCur.Next() {
+		srcCount++
+		want := srcCur.Keyring()
+		for dstOk && dstCur.Keyring().RFingerprint < want.RFingerprint {
+			log.Warningf("rfp=%q is only in the destination", dstCur.Keyring().RFingerprint)
+			extra++
+			if dstOk = dstCur.Next(); dstOk {
+				dstCount++
+			}
+		}
+		if !dstOk || dstCur.Keyring().RFingerprint != want.RFingerprint {
+			log.Errorf("rfp=%q is missing from the destination", want.RFingerprint)
+			missing++
+			continue
+		}
+		got := dstCur.Keyring()
+		samePackets, err := equalPackets(got.PrimaryKey, want.PrimaryKey)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if got.Digest != want.Digest {
+			log.Errorf("rfp=%q digest mismatch: source %q destination %q", want.RFingerprint, want.Digest, got.Digest)
+			mismatched++
+		} else if !samePackets {
+			log.Errorf("rfp=%q packets differ", want.RFingerprint)
+			mismatched++
+		} else if !sameSecond(got.CTime, want.CTime) || !sameSecond(got.MTime, want.MTime) {
+			log.Errorf("rfp=%q timestamp mismatch: source ctime=%v mtime=%v destination ctime=%v mtime=%v",
+				want.RFingerprint, want.CTime, want.MTime, got.CTime, got.MTime)
+			mismatched++
+		}
+		if dstOk = dstCur.Next(); dstOk {
+			dstCount++
+		}
+	}
+	if err := srcCur.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for dstOk {
+		log.Warningf("rfp=%q is only in the destination", dstCur.Keyring().RFingerprint)
+		extra++
+		if dstOk = dstCur.Next(); dstOk {
+			dstCount++
+		}
+	}
+	if err := dstCur.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+
+	log.Infof("verified %d source keys against %d destination keys: %d missing, %d mismatched, %d extra",
+		srcCount, dstCount, missing, mismatched, extra)
+	if missing > 0 || mismatched > 0 {
+		return errgo.Newf("verification failed: %d keys missing, %d mismatched", missing, mismatched)
+	}
+	return nil
+}
+
+// equalPackets returns whether the keys are made of the same packets, byte
+// for byte.
+func equalPackets(a, b *openpgp.PrimaryKey) (bool, error) {
+	var abuf, bbuf bytes.Buffer
+	err := openpgp.WritePackets(&abuf, a)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	err = openpgp.WritePackets(&bbuf, b)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return bytes.Equal(abuf.Bytes(), bbuf.Bytes()), nil
+}
+
+func sameSecond(a, b time.Time) bool {
+	return a.Unix() == b.Unix()
+}
@@ -0,0 +1,233 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	stdtesting "testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	ldbstorage "github.com/syndtr/goleveldb/leveldb/storage"
+	gc "gopkg.in/check.v1"
+	"hockeypuck/testing"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/leveldbhkp"
+	"hockeypuck/openpgp"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type S struct {
+	src, dst storage.Storage
+}
+
+var _ = gc.Suite(&S{})
+
+func (s *S) SetUpTest(c *gc.C) {
+	s.src = newStorage(c)
+	s.dst = newStorage(c)
+
+	*checkpointFile = filepath.Join(c.MkDir(), "checkpoint")
+	*resume = false
+	*batchSize = 2
+	*verify = true
+}
+
+func (s *S) TearDownTest(c *gc.C) {
+	s.src.Close()
+	s.dst.Close()
+}
+
+func newStorage(c *gc.C) storage.Storage {
+	db, err := leveldb.Open(ldbstorage.NewMemStorage(), nil)
+	c.Assert(err, gc.IsNil)
+	st, err := leveldbhkp.New(db)
+	c.Assert(err, gc.IsNil)
+	return st
+}
+
+// importKeys stores the keys in st with the given digests, as they would have
+// been recorded by an earlier version of the server.
+func importKeys(c *gc.C, st storage.Storage, keys []*openpgp.PrimaryKey, digests []string) {
+	var keyrings []*storage.Keyring
+	for i, key := range keys {
+		keyrings = append(keyrings, &storage.Keyring{
+			PrimaryKey: key,
+			CTime:      time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC),
+			MTime:      time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+			Digest:     digests[i],
+		})
+	}
+	n, err := st.(storage.KeyringImporter).ImportKeyrings(context.Background(), keyrings)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, len(keys))
+}
+
+func (s *S) sourceKeys(c *gc.C) []*openpgp.PrimaryKey {
+	var keys []*openpgp.PrimaryKey
+	var digests []string
+	for _, name := range []string{"alice_signed.asc", "uat.asc", "e68e311d.asc", "fece664e.asc", "d7346e26.asc"} {
+		key := openpgp.MustReadArmorKeys(testing.MustInput(name))[0]
+		keys = append(keys, key)
+		// Not the digest the current parser would compute, so that
+		// recomputing it anywhere along the way is noticed.
+		digests = append(digests, "stored-"+key.MD5)
+	}
+	importKeys(c, s.src, keys, digests)
+	return keys
+}
+
+func allKeyrings(c *gc.C, st storage.Storage) []*storage.Keyring {
+	cur, err := st.IterKeyrings(context.Background(), storage.ByRFingerprint, storage.Checkpoint{})
+	c.Assert(err, gc.IsNil)
+	defer cur.Close()
+	var result []*storage.Keyring
+	for cur.Next() {
+		result = append(result, cur.Keyring())
+	}
+	c.Assert(cur.Err(), gc.IsNil)
+	return result
+}
+
+func (s *S) assertMigrated(c *gc.C) {
+	want := allKeyrings(c, s.src)
+	got := allKeyrings(c, s.dst)
+	c.Assert(got, gc.HasLen, len(want))
+	for i := range want {
+		c.Assert(got[i].RFingerprint, gc.Equals, want[i].RFingerprint)
+		c.Assert(got[i].Digest, gc.Equals, want[i].Digest)
+		c.Assert(got[i].Digest, gc.Equals, "stored-"+got[i].MD5)
+		c.Assert(got[i].CTime.Unix(), gc.Equals, want[i].CTime.Unix())
+		c.Assert(got[i].MTime.Unix(), gc.Equals, want[i].MTime.Unix())
+	}
+}
+
+func (s *S) TestMigrate(c *gc.C) {
+	keys := s.sourceKeys(c)
+
+	err := migrate(context.Background(), s.src, s.dst)
+	c.Assert(err, gc.IsNil)
+	s.assertMigrated(c)
+
+	p, err := readProgress(*checkpointFile)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.Migrated, gc.Equals, len(keys))
+	c.Assert(p.Skipped, gc.Equals, 0)
+	c.Assert(p.Failed, gc.Equals, 0)
+}
+
+func (s *S) TestMigrateSuppressedAndUIDStates(c *gc.C) {
+	ctx := context.Background()
+	keys := s.sourceKeys(c)
+	taken := "0000000000000000000000000000000000000001"
+	err := s.src.(storage.Suppressor).Suppress(ctx, taken)
+	c.Assert(err, gc.IsNil)
+	modified := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	status := storage.UIDStatus{Email: "alice@example.com", State: storage.UIDPublished, Modified: modified}
+	err = s.src.(storage.UIDPublisher).SetUIDState(ctx, keys[0].RFingerprint, status)
+	c.Assert(err, gc.IsNil)
+
+	err = migrate(ctx, s.src, s.dst)
+	c.Assert(err, gc.IsNil)
+	s.assertMigrated(c)
+
+	suppressed, err := s.dst.(storage.Suppressor).ListSuppressed(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(suppressed, gc.DeepEquals, []string{taken})
+	states, err := s.dst.(storage.UIDPublisher).UIDStates(ctx, []string{keys[0].RFingerprint, keys[1].RFingerprint})
+	c.Assert(err, gc.IsNil)
+	c.Assert(states, gc.HasLen, 1)
+	c.Assert(states[keys[0].RFingerprint], gc.HasLen, 1)
+	got := states[keys[0].RFingerprint][0]
+	c.Assert(got.Email, gc.Equals, status.Email)
+	c.Assert(got.State, gc.Equals, status.State)
+	c.Assert(got.Modified.Unix(), gc.Equals, modified.Unix())
+}
+
+// interruptingImporter cancels the migration once it has imported a given
+// number of batches, as an operator interrupting it would.
+type interruptingImporter struct {
+	storage.Storage
+	cancel  context.CancelFunc
+	batches int
+}
+
+func (st *interruptingImporter) ImportKeyrings(ctx context.Context, keyrings []*storage.Keyring) (int, error) {
+	n, err := st.Storage.(storage.KeyringImporter).ImportKeyrings(ctx, keyrings)
+	st.batches--
+	if st.batches == 0 {
+		st.cancel()
+	}
+	return n, err
+}
+
+func (s *S) TestMigrateResume(c *gc.C) {
+	keys := s.sourceKeys(c)
+	*batchSize = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := migrate(ctx, s.src, &interruptingImporter{Storage: s.dst, cancel: cancel, batches: 2})
+	c.Assert(err, gc.NotNil)
+	c.Assert(allKeyrings(c, s.dst), gc.HasLen, 2)
+
+	// The second batch was interrupted, so only the first is recorded.
+	p, err := readProgress(*checkpointFile)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.Migrated, gc.Equals, 1)
+	c.Assert(p.Checkpoint.RFingerprint, gc.Equals, allKeyrings(c, s.src)[0].RFingerprint)
+
+	*resume = true
+	err = migrate(context.Background(), s.src, s.dst)
+	c.Assert(err, gc.IsNil)
+	s.assertMigrated(c)
+
+	// The interrupted batch is imported again and found to be there already.
+	p, err = readProgress(*checkpointFile)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.Migrated, gc.Equals, len(keys)-1)
+	c.Assert(p.Skipped, gc.Equals, 1)
+	c.Assert(p.Failed, gc.Equals, 0)
+}
+
+func (s *S) TestVerifyDigestMismatch(c *gc.C) {
+	keys := s.sourceKeys(c)
+	digests := make([]string, len(keys))
+	for i, key := range keys {
+		digests[i] = key.MD5
+	}
+	importKeys(c, s.dst, keys, digests)
+
+	err := verifyKeyrings(context.Background(), s.src, s.dst)
+	c.Assert(err, gc.ErrorMatches, `verification failed: 0 keys missing, 5 mismatched`)
+}
+
+func (s *S) TestVerifyPacketMismatch(c *gc.C) {
+	signed := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	unsigned := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	c.Assert(signed.RFingerprint, gc.Equals, unsigned.RFingerprint)
+	importKeys(c, s.src, []*openpgp.PrimaryKey{signed}, []string{signed.MD5})
+	// Same key and same recorded digest, but not the same packets.
+	importKeys(c, s.dst, []*openpgp.PrimaryKey{unsigned}, []string{signed.MD5})
+
+	err := verifyKeyrings(context.Background(), s.src, s.dst)
+	c.Assert(err, gc.ErrorMatches, `verification failed: 0 keys missing, 1 mismatched`)
+}
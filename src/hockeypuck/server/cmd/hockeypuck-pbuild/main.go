@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	"os"
@@ -81,36 +82,45 @@ func pbuild(settings *server.Settings) error {
 
 	stats := sks.NewStats()
 
-	var n int
-	st.Subscribe(func(kc storage.KeyChange) error {
-		ka, ok := kc.(storage.KeyAdded)
-		if ok {
-			var digestZp cf.Zp
-			err := sks.DigestZp(ka.Digest, &digestZp)
-			if err != nil {
-				return errgo.Notef(err, "bad digest %q", ka.Digest)
-			}
-			err = ptree.Insert(&digestZp)
-			if err != nil {
-				return errgo.Notef(err, "failed to insert digest %q", ka.Digest)
-			}
-
-			stats.Update(kc)
-
-			n++
-			if n%5000 == 0 {
-				log.Infof("%d keys added", n)
-			}
-		}
-		return nil
-	})
-
 	defer func() {
 		err := stats.WriteFile(sks.StatsFilename(settings.Conflux.Recon.LevelDB.Path))
 		if err != nil {
 			log.Warningf("error writing stats: %v", err)
 		}
 	}()
-	err = st.RenotifyAll()
-	return errgo.Mask(err)
+
+	// Use the digests as stored, which are those known to peers. They are
+	// read without parsing the keys.
+	digests, ok := st.(storage.DigestIterator)
+	if !ok {
+		return errgo.Newf("storage %T cannot iterate over digests", st)
+	}
+	cur, err := digests.IterDigests(context.Background())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer cur.Close()
+
+	var n int
+	for cur.Next() {
+		d := cur.Digest()
+		var digestZp cf.Zp
+		err := sks.DigestZp(d.Digest, &digestZp)
+		if err != nil {
+			log.Warningf("skipping bad digest %q of rfp=%q: %v", d.Digest, d.RFingerprint, err)
+			continue
+		}
+		err = ptree.Insert(&digestZp)
+		if err != nil {
+			return errgo.Notef(err, "failed to insert digest %q", d.Digest)
+		}
+
+		stats.Update(storage.KeyAdded{Digest: d.Digest})
+
+		n++
+		if n%5000 == 0 {
+			log.Infof("%d keys added", n)
+		}
+	}
+	return errgo.Mask(cur.Err())
 }
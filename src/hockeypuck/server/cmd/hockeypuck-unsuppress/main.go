@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var configFile = flag.String("config", "", "config file")
+
+func main() {
+	flag.Parse()
+
+	if *configFile == "" || flag.NArg() == 0 {
+		log.Errorf("usage: %s -config <config> <fingerprint>...", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	conf, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		cmd.Die(errgo.Mask(err))
+	}
+	settings, err := server.ParseSettings(string(conf))
+	if err != nil {
+		cmd.Die(errgo.Mask(err))
+	}
+
+	err = unsuppress(settings, flag.Args())
+	cmd.Die(err)
+}
+
+// unsuppress lifts the suppression of the keys with the given fingerprints,
+// so that they may be uploaded or recovered from peers again after having
+// been taken down.
+func unsuppress(settings *server.Settings, fingerprints []string) error {
+	var rfps []string
+	for _, fp := range fingerprints {
+		fp = strings.TrimPrefix(strings.ToLower(fp), "0x")
+		if _, err := hex.DecodeString(fp); err != nil || len(fp) < 32 {
+			return errgo.Newf("invalid fingerprint %q", fp)
+		}
+		rfps = append(rfps, openpgp.Reverse(fp))
+	}
+
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errgo.Notef(err, "cannot open storage")
+	}
+	defer st.Close()
+	suppressor, ok := st.(storage.Suppressor)
+	if !ok {
+		return errgo.Newf("storage driver %q does not support takedowns", settings.OpenPGP.DB.Driver)
+	}
+
+	ctx := context.Background()
+	for _, rfp := range rfps {
+		err = suppressor.Unsuppress(ctx, rfp)
+		if err != nil {
+			return errgo.Notef(err, "cannot unsuppress %q", openpgp.Reverse(rfp))
+		}
+		log.WithFields(log.Fields{"fp": openpgp.Reverse(rfp)}).Info("suppression lifted")
+	}
+	return nil
+}
@@ -14,6 +14,7 @@ var serverMetrics = struct {
 	httpRequestDuration *prometheus.HistogramVec
 	keysAdded           prometheus.Counter
 	keysIgnored         prometheus.Counter
+	keysRemoved         prometheus.Counter
 	keysUpdated         prometheus.Counter
 }{
 	httpRequestDuration: prometheus.NewHistogramVec(
@@ -38,6 +39,13 @@ var serverMetrics = struct {
 			Help:      "Keys with no-op updates since startup",
 		},
 	),
+	keysRemoved: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "keys_removed",
+			Help:      "Keys removed since startup",
+		},
+	),
 	keysUpdated: prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Namespace: "hockeypuck",
@@ -54,6 +62,7 @@ func registerMetrics() {
 		prometheus.MustRegister(serverMetrics.httpRequestDuration)
 		prometheus.MustRegister(serverMetrics.keysAdded)
 		prometheus.MustRegister(serverMetrics.keysIgnored)
+		prometheus.MustRegister(serverMetrics.keysRemoved)
 		prometheus.MustRegister(serverMetrics.keysUpdated)
 	})
 }
@@ -66,6 +75,8 @@ func metricsStorageNotifier(kc storage.KeyChange) error {
 		serverMetrics.keysIgnored.Inc()
 	case storage.KeyReplaced:
 		serverMetrics.keysUpdated.Inc()
+	case storage.KeyRemoved:
+		serverMetrics.keysRemoved.Inc()
 	}
 	return nil
 }
@@ -16,8 +16,16 @@ import (
 	"gopkg.in/tomb.v2"
 
 	"hockeypuck/hkp"
+	"hockeypuck/hkp/changes"
+	"hockeypuck/hkp/pks"
+	"hockeypuck/hkp/ratelimit"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/takedown"
+	"hockeypuck/hkp/verify"
+	"hockeypuck/hkp/vks"
+	"hockeypuck/hkp/wkd"
+	"hockeypuck/leveldbhkp"
 	log "hockeypuck/logrus"
 	"hockeypuck/metrics"
 	"hockeypuck/mgohkp"
@@ -32,6 +40,7 @@ type Server struct {
 	r               *httprouter.Router
 	sksPeer         *sks.Peer
 	logWriter       io.WriteCloser
+	auditLog        io.WriteCloser
 	metricsListener *metrics.Metrics
 
 	t                 tomb.Tomb
@@ -54,6 +63,14 @@ func (scrw *statusCodeResponseWriter) WriteHeader(code int) {
 	scrw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush implements http.Flusher, so that responses can be streamed through
+// the writer.
+func (scrw *statusCodeResponseWriter) Flush() {
+	if flusher, ok := scrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func KeyReaderOptions(settings *Settings) []openpgp.KeyReaderOption {
 	var opts []openpgp.KeyReaderOption
 	if settings.OpenPGP.MaxKeyLength > 0 {
@@ -68,6 +85,57 @@ func KeyReaderOptions(settings *Settings) []openpgp.KeyReaderOption {
 	return opts
 }
 
+// CertPolicy returns the certification policy configured in settings, or
+// nil if none is.
+func CertPolicy(settings *Settings) *openpgp.CertPolicy {
+	c := settings.OpenPGP.CertPolicy
+	if c.MaxPerUserID <= 0 && !c.NewestPerIssuer && !c.KnownIssuersOnly {
+		return nil
+	}
+	return &openpgp.CertPolicy{
+		MaxPerUserID:     c.MaxPerUserID,
+		NewestPerIssuer:  c.NewestPerIssuer,
+		KnownIssuersOnly: c.KnownIssuersOnly,
+	}
+}
+
+// KeyPolicy returns the key policy configured in settings, or nil if none
+// is.
+func KeyPolicy(settings *Settings) (openpgp.KeyPolicy, error) {
+	c := settings.OpenPGP.Policy
+	var policies openpgp.KeyPolicies
+	if c.MinRSABits > 0 {
+		policies = append(policies, openpgp.MinRSABits(c.MinRSABits))
+	}
+	if len(c.AllowedAlgorithms) > 0 {
+		policy, err := openpgp.AllowedAlgorithms(c.AllowedAlgorithms...)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		policies = append(policies, policy)
+	}
+	if c.MaxUserIDs > 0 {
+		policies = append(policies, openpgp.MaxUserIDs(c.MaxUserIDs))
+	}
+	if c.RejectSHA1Bindings {
+		policies = append(policies, openpgp.RejectSHA1Bindings())
+	}
+	if len(c.DeniedUserIDs) > 0 {
+		policy, err := openpgp.DenyUserIDs(c.DeniedUserIDs...)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		policies = append(policies, policy)
+	}
+	if c.MaxUserAttributeLength > 0 {
+		policies = append(policies, openpgp.MaxUserAttributeLen(c.MaxUserAttributeLength))
+	}
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	return policies, nil
+}
+
 func NewServer(settings *Settings) (*Server, error) {
 	if settings == nil {
 		defaults := DefaultSettings()
@@ -113,6 +181,13 @@ func NewServer(settings *Settings) (*Server, error) {
 			recordHTTPRequestDuration(req.Method, scrw.statusCode, duration)
 		})
 	})
+	if settings.HKP.RateLimit.Enabled {
+		limiter, err := newRateLimiter(settings)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		s.middle.Use(limiter.Middleware)
+	}
 	s.middle.UseHandler(s.r)
 
 	keyReaderOptions := KeyReaderOptions(settings)
@@ -120,15 +195,45 @@ func NewServer(settings *Settings) (*Server, error) {
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	certPolicy := CertPolicy(settings)
+	keyPolicy, err := KeyPolicy(settings)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid key policy")
+	}
+	var upsertOptions []storage.UpsertOption
+	if settings.OpenPGP.HonourNoModify {
+		upsertOptions = append(upsertOptions, storage.HonourNoModify())
+	}
+	if certPolicy != nil {
+		upsertOptions = append(upsertOptions, storage.CertPolicy(certPolicy))
+	}
+	if keyPolicy != nil {
+		upsertOptions = append(upsertOptions, storage.KeyPolicy(keyPolicy))
+	}
+	s.sksPeer.SetUpsertOptions(upsertOptions)
 
 	s.metricsListener = metrics.NewMetrics(settings.Metrics)
 
 	options := []hkp.HandlerOption{
 		hkp.StatsFunc(s.stats),
 		hkp.SelfSignedOnly(settings.HKP.Queries.SelfSignedOnly),
+		hkp.AttestedCertsOnly(settings.HKP.Queries.AttestedCertsOnly),
 		hkp.FingerprintOnly(settings.HKP.Queries.FingerprintOnly),
+		hkp.ShortKeyIDsDisabled(settings.HKP.Queries.ShortKeyIDsDisabled),
+		hkp.AdminKeys(settings.HKP.AdminKeys),
+		hkp.AdminSignatureMaxAge(time.Duration(settings.HKP.AdminSignatureMaxAgeSecs) * time.Second),
+		hkp.LookupTimeout(time.Duration(settings.HKP.Timeouts.LookupSecs) * time.Second),
+		hkp.AddTimeout(time.Duration(settings.HKP.Timeouts.AddSecs) * time.Second),
+		hkp.DeleteTimeout(time.Duration(settings.HKP.Timeouts.DeleteSecs) * time.Second),
+		hkp.HashQueryTimeout(time.Duration(settings.HKP.Timeouts.HashQuerySecs) * time.Second),
+		hkp.HonourNoModify(settings.OpenPGP.HonourNoModify),
+		hkp.CertPolicy(certPolicy),
+		hkp.KeyPolicy(keyPolicy),
 		hkp.KeyReaderOptions(keyReaderOptions),
 	}
+	for op, value := range settings.HKP.CacheControl {
+		options = append(options, hkp.CacheControl(hkp.Operation(op), value))
+	}
 	if settings.IndexTemplate != "" {
 		options = append(options, hkp.IndexTemplate(settings.IndexTemplate))
 	}
@@ -138,12 +243,66 @@ func NewServer(settings *Settings) (*Server, error) {
 	if settings.StatsTemplate != "" {
 		options = append(options, hkp.StatsTemplate(settings.StatsTemplate))
 	}
+	vksOptions := []vks.HandlerOption{
+		vks.SelfSignedOnly(settings.HKP.Queries.SelfSignedOnly),
+		vks.AttestedCertsOnly(settings.HKP.Queries.AttestedCertsOnly),
+		vks.FingerprintOnly(settings.HKP.Queries.FingerprintOnly),
+		vks.LookupTimeout(time.Duration(settings.HKP.Timeouts.LookupSecs) * time.Second),
+		vks.UploadTimeout(time.Duration(settings.HKP.Timeouts.AddSecs) * time.Second),
+		vks.HonourNoModify(settings.OpenPGP.HonourNoModify),
+		vks.CertPolicy(certPolicy),
+		vks.KeyPolicy(keyPolicy),
+		vks.KeyReaderOptions(keyReaderOptions),
+	}
+	wkdOptions := []wkd.HandlerOption{
+		wkd.Domains(settings.HKP.WKD.Domains),
+		wkd.Policy(settings.HKP.WKD.Policy),
+		wkd.LookupTimeout(time.Duration(settings.HKP.Timeouts.LookupSecs) * time.Second),
+	}
+	if settings.HKP.Verification.Enabled {
+		verifier, err := newVerifier(s.st, settings)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		options = append(options, hkp.Verifier(verifier))
+		vksOptions = append(vksOptions, vks.Verifier(verifier))
+		wkdOptions = append(wkdOptions, wkd.Verifier(verifier))
+	}
+	if settings.HKP.Takedown.Enabled {
+		remover, err := s.newRemover(settings)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		options = append(options, hkp.Remover(remover))
+	}
 	h, err := hkp.NewHandler(s.st, options...)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	h.Register(s.r)
 
+	vh, err := vks.NewHandler(s.st, vksOptions...)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	vh.Register(s.r)
+
+	if len(settings.HKP.WKD.Domains) > 0 {
+		wh, err := wkd.NewHandler(s.st, wkdOptions...)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		wh.Register(s.r)
+	}
+
+	if settings.HKP.Changes.Enabled {
+		ch, err := changes.NewHandler(s.st)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		ch.Register(s.r)
+	}
+
 	if settings.Webroot != "" {
 		err := s.registerWebroot(settings.Webroot)
 		if err != nil {
@@ -157,6 +316,100 @@ func NewServer(settings *Settings) (*Server, error) {
 	return s, nil
 }
 
+// newRateLimiter returns a Limiter configured by the rate limit settings.
+func newRateLimiter(settings *Settings) (*ratelimit.Limiter, error) {
+	conf := settings.HKP.RateLimit
+	options := []ratelimit.Option{
+		ratelimit.IPv4Prefix(conf.IPv4Prefix),
+		ratelimit.IPv6Prefix(conf.IPv6Prefix),
+		ratelimit.ExemptCIDRs(conf.ExemptCIDRs),
+		ratelimit.OpLimit(ratelimit.OpGet, ratelimit.Limit(conf.Get)),
+		ratelimit.OpLimit(ratelimit.OpIndex, ratelimit.Limit(conf.Index)),
+		ratelimit.OpLimit(ratelimit.OpVIndex, ratelimit.Limit(conf.VIndex)),
+		ratelimit.OpLimit(ratelimit.OpAdd, ratelimit.Limit(conf.Add)),
+		ratelimit.OpLimit(ratelimit.OpHashQuery, ratelimit.Limit(conf.HashQuery)),
+		ratelimit.OpLimit(ratelimit.OpVerify, ratelimit.Limit(conf.Verify)),
+		ratelimit.OpLimit(ratelimit.OpDelete, ratelimit.Limit(conf.Delete)),
+		ratelimit.OpLimit(ratelimit.OpTakedown, ratelimit.Limit(conf.Takedown)),
+	}
+	if conf.ClientIPHeader != "" {
+		options = append(options, ratelimit.ClientIPHeader(conf.ClientIPHeader))
+	}
+	if conf.ExemptPartners {
+		matcher, err := settings.Conflux.Recon.Settings.Matcher()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		options = append(options, ratelimit.Exempt(matcher))
+	}
+	return ratelimit.NewLimiter(options...)
+}
+
+// newMailSender returns a MailSender which relays through the given SMTP
+// server, or the PKS SMTP relay if none is given.
+func newMailSender(smtpConf *SMTPConfig, settings *Settings) (verify.MailSender, error) {
+	if smtpConf == nil && settings.OpenPGP.PKS != nil {
+		smtpConf = &settings.OpenPGP.PKS.SMTP
+	}
+	var senderConf pks.SMTPConfig
+	if smtpConf != nil {
+		senderConf = pks.SMTPConfig{
+			Host:     smtpConf.Host,
+			ID:       smtpConf.ID,
+			User:     smtpConf.User,
+			Password: smtpConf.Password,
+		}
+	}
+	return verify.NewSMTPSender(senderConf)
+}
+
+// newVerifier returns a Verifier configured by the verification settings.
+func newVerifier(st storage.Storage, settings *Settings) (*verify.Verifier, error) {
+	conf := &settings.HKP.Verification
+	sender, err := newMailSender(conf.SMTP, settings)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return verify.NewVerifier(st,
+		verify.Secret(conf.Secret),
+		verify.BaseURL(conf.BaseURL),
+		verify.From(conf.From),
+		verify.Sender(sender),
+		verify.TokenTTL(time.Duration(conf.TokenTTLSecs)*time.Second),
+	)
+}
+
+// newRemover returns a Remover configured by the takedown settings, opening
+// its audit log if one is configured.
+func (s *Server) newRemover(settings *Settings) (*takedown.Remover, error) {
+	conf := &settings.HKP.Takedown
+	options := []takedown.Option{
+		takedown.Secret(conf.Secret),
+		takedown.TokenTTL(time.Duration(conf.TokenTTLSecs) * time.Second),
+		takedown.MailInterval(time.Duration(conf.MailIntervalSecs) * time.Second),
+	}
+	if conf.From != "" {
+		sender, err := newMailSender(conf.SMTP, settings)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		options = append(options,
+			takedown.BaseURL(conf.BaseURL),
+			takedown.From(conf.From),
+			takedown.Sender(sender),
+		)
+	}
+	if conf.AuditLog != "" {
+		f, err := os.OpenFile(conf.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open takedown audit log %q", conf.AuditLog)
+		}
+		s.auditLog = f
+		options = append(options, takedown.AuditLog(f))
+	}
+	return takedown.NewRemover(s.st, options...)
+}
+
 func DialStorage(settings *Settings) (storage.Storage, error) {
 	switch settings.OpenPGP.DB.Driver {
 	case "mongo":
@@ -172,6 +425,8 @@ func DialStorage(settings *Settings) (storage.Storage, error) {
 		return mgohkp.Dial(settings.OpenPGP.DB.DSN, options...)
 	case "postgres-jsonb":
 		return pghkp.Dial(settings.OpenPGP.DB.DSN, KeyReaderOptions(settings))
+	case "leveldb":
+		return leveldbhkp.Open(settings.OpenPGP.DB.DSN)
 	}
 	return nil, errgo.Newf("storage driver %q not supported", settings.OpenPGP.DB.Driver)
 }
@@ -194,8 +449,11 @@ type stats struct {
 }
 
 type statsQueryConfig struct {
-	SelfSignedOnly  bool `json:"selfSignedOnly"`
-	FingerprintOnly bool `json:"keywordSearchDisabled"`
+	SelfSignedOnly      bool `json:"selfSignedOnly"`
+	AttestedCertsOnly   bool `json:"attestedCertsOnly"`
+	FingerprintOnly     bool `json:"keywordSearchDisabled"`
+	ShortKeyIDsDisabled bool `json:"shortKeyIDSearchDisabled"`
+	VerifiedOnly        bool `json:"verifiedUserIDsOnly"`
 }
 
 type loadStat struct {
@@ -230,8 +488,11 @@ func (s *Server) stats() (interface{}, error) {
 		Contact:  s.settings.Contact,
 		HTTPAddr: s.settings.HKP.Bind,
 		QueryConfig: statsQueryConfig{
-			SelfSignedOnly:  s.settings.HKP.Queries.SelfSignedOnly,
-			FingerprintOnly: s.settings.HKP.Queries.FingerprintOnly,
+			SelfSignedOnly:      s.settings.HKP.Queries.SelfSignedOnly,
+			AttestedCertsOnly:   s.settings.HKP.Queries.AttestedCertsOnly,
+			FingerprintOnly:     s.settings.HKP.Queries.FingerprintOnly,
+			ShortKeyIDsDisabled: s.settings.HKP.Queries.ShortKeyIDsDisabled,
+			VerifiedOnly:        s.settings.HKP.Verification.Enabled,
 		},
 		ReconAddr: s.settings.Conflux.Recon.Settings.ReconAddr,
 		Software:  s.settings.Software,
@@ -383,6 +644,9 @@ func (s *Server) Stop() {
 	}
 	s.t.Kill(nil)
 	s.t.Wait()
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
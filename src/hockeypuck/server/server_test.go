@@ -0,0 +1,80 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ServerSuite struct {
+	server *Server
+	srv    *httptest.Server
+}
+
+var _ = gc.Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *gc.C) {
+	settings := DefaultSettings()
+	settings.OpenPGP.DB.Driver = "leveldb"
+	settings.OpenPGP.DB.DSN = c.MkDir()
+	settings.Conflux.Recon.LevelDB.Path = c.MkDir()
+	settings.HKP.Changes.Enabled = true
+	var err error
+	s.server, err = NewServer(&settings)
+	c.Assert(err, gc.IsNil)
+	s.srv = httptest.NewServer(s.server.middle)
+}
+
+func (s *ServerSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+	s.server.st.Close()
+}
+
+func (s *ServerSuite) TestStreamChanges(c *gc.C) {
+	req, err := http.NewRequest("GET", s.srv.URL+"/pks/changes", nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "text/event-stream")
+
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+	_, err = s.server.st.Insert(keys)
+	c.Assert(err, gc.IsNil)
+	body := bufio.NewReader(res.Body)
+	line, err := body.ReadString('\n')
+	c.Assert(err, gc.IsNil)
+	c.Assert(strings.HasPrefix(line, "id: "), gc.Equals, true, gc.Commentf("%q", line))
+	line, err = body.ReadString('\n')
+	c.Assert(err, gc.IsNil)
+	c.Assert(line, gc.Equals, "event: "+string(storage.ChangeAdded)+"\n")
+}
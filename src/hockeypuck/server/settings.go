@@ -22,6 +22,7 @@ import (
 	"gopkg.in/errgo.v1"
 
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/ratelimit"
 	"hockeypuck/metrics"
 )
 
@@ -40,19 +41,169 @@ type reconConfig struct {
 
 const (
 	DefaultHKPBind = ":11371"
+
+	DefaultLookupTimeoutSecs    = 30
+	DefaultAddTimeoutSecs       = 60
+	DefaultDeleteTimeoutSecs    = 60
+	DefaultHashQueryTimeoutSecs = 60
+
+	DefaultAdminSignatureMaxAgeSecs = 300
 )
 
 type HKPConfig struct {
 	Bind string `toml:"bind"`
 
 	Queries queryConfig `toml:"queries"`
+
+	// AdminKeys lists the fingerprints of keys authorized to sign
+	// administrative requests, such as /pks/delete.
+	AdminKeys []string `toml:"adminKeys"`
+
+	// AdminSignatureMaxAgeSecs is how long a signed administrative request
+	// may be made after it was signed. Each signature is accepted only once
+	// by each server, so that requests cannot be replayed.
+	AdminSignatureMaxAgeSecs int `toml:"adminSignatureMaxAgeSecs"`
+
+	// Timeouts limits the time spent in storage servicing each kind of
+	// request. A timeout of zero means no limit.
+	Timeouts timeoutsConfig `toml:"timeouts"`
+
+	// Verification, if enabled, only serves user IDs whose email addresses
+	// have been verified by their owners.
+	Verification verificationConfig `toml:"verification"`
+
+	// Takedown, if enabled, lets key owners remove their keys by proving
+	// control of them.
+	Takedown takedownConfig `toml:"takedown"`
+
+	// WKD serves the OpenPGP Web Key Directory for the given mail domains.
+	WKD wkdConfig `toml:"wkd"`
+
+	// RateLimit, if enabled, throttles clients which make too many
+	// requests.
+	RateLimit rateLimitConfig `toml:"rateLimit"`
+
+	// Changes, if enabled, serves a feed of the changes made to keys at
+	// /pks/changes. With PostgreSQL storage, the feed waits for open
+	// transactions to end, so a session left idle in a transaction holds it
+	// back; bound these with idle_in_transaction_session_timeout.
+	Changes changesConfig `toml:"changes"`
+
+	// CacheControl sets the Cache-Control header of lookup responses, by
+	// operation: get, hget, index or vindex. An empty value sends none.
+	CacheControl map[string]string `toml:"cacheControl"`
+}
+
+const (
+	DefaultGetCacheControl   = "public, max-age=300"
+	DefaultIndexCacheControl = "public, max-age=60"
+)
+
+const (
+	DefaultVerificationTokenTTLSecs = 86400
+	DefaultTakedownTokenTTLSecs     = 3600
+	DefaultTakedownMailIntervalSecs = 900
+)
+
+type verificationConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Secret authenticates verification tokens. It must be kept private,
+	// and shared by every server using the same database.
+	Secret string `toml:"secret"`
+	// BaseURL is the public URL of this server, under which verification
+	// links are made.
+	BaseURL string `toml:"baseURL"`
+	// From is the sender address of verification messages.
+	From         string `toml:"from"`
+	TokenTTLSecs int    `toml:"tokenTTLSecs"`
+	// SMTP configures the relay for verification messages. If not set, the
+	// openpgp.pks SMTP settings are used.
+	SMTP *SMTPConfig `toml:"smtp"`
+}
+
+type takedownConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Secret authenticates takedown tokens and challenges. It must be kept
+	// private, and shared by every server using the same database.
+	Secret string `toml:"secret"`
+	// BaseURL is the public URL of this server, under which takedown links
+	// are made.
+	BaseURL string `toml:"baseURL"`
+	// From is the sender address of takedown messages. Takedown by email is
+	// only offered if it is set; otherwise owners must sign a challenge.
+	From         string `toml:"from"`
+	TokenTTLSecs int    `toml:"tokenTTLSecs"`
+	// MailIntervalSecs is how long to wait before sending another takedown
+	// link to the same address. Zero sends a link on every request.
+	MailIntervalSecs int `toml:"mailIntervalSecs"`
+	// AuditLog is the path of a file to which each takedown is appended.
+	AuditLog string `toml:"auditLog"`
+	// SMTP configures the relay for takedown messages. If not set, the
+	// openpgp.pks SMTP settings are used.
+	SMTP *SMTPConfig `toml:"smtp"`
+}
+
+type wkdConfig struct {
+	// Domains lists the mail domains whose directories are served. Each
+	// domain's host, or its openpgpkey subdomain for the advanced method,
+	// must resolve to this server.
+	Domains []string `toml:"domains"`
+	// Policy is the content of each domain's policy file.
+	Policy string `toml:"policy"`
+}
+
+type changesConfig struct {
+	Enabled bool `toml:"enabled"`
+}
+
+type rateLimitConfig struct {
+	Enabled bool `toml:"enabled"`
+	// IPv4Prefix and IPv6Prefix set the prefix lengths of the networks into
+	// which clients are grouped, each network sharing its limits.
+	IPv4Prefix int `toml:"ipv4Prefix"`
+	IPv6Prefix int `toml:"ipv6Prefix"`
+	// ClientIPHeader identifies clients by the last address in the given
+	// header, such as X-Forwarded-For, when behind a reverse proxy.
+	ClientIPHeader string `toml:"clientIPHeader"`
+	// ExemptPartners does not throttle recon partners, nor the addresses
+	// allowed by conflux.recon.allowCIDRs.
+	ExemptPartners bool     `toml:"exemptPartners"`
+	ExemptCIDRs    []string `toml:"exemptCIDRs"`
+
+	Get       rateConfig `toml:"get"`
+	Index     rateConfig `toml:"index"`
+	VIndex    rateConfig `toml:"vindex"`
+	Add       rateConfig `toml:"add"`
+	HashQuery rateConfig `toml:"hashquery"`
+	Verify    rateConfig `toml:"verify"`
+	Delete    rateConfig `toml:"delete"`
+	Takedown  rateConfig `toml:"takedown"`
+}
+
+// rateConfig is a token bucket, refilled at Rate requests per second up to
+// Burst requests. A zero rate means no limit.
+type rateConfig struct {
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+type timeoutsConfig struct {
+	LookupSecs    int `toml:"lookupSecs"`
+	AddSecs       int `toml:"addSecs"`
+	DeleteSecs    int `toml:"deleteSecs"`
+	HashQuerySecs int `toml:"hashquerySecs"`
 }
 
 type queryConfig struct {
 	// Only respond with verified self-signed key material in queries
 	SelfSignedOnly bool `toml:"selfSignedOnly"`
+	// Only respond with third-party certifications the key holder has
+	// attested
+	AttestedCertsOnly bool `toml:"attestedCertsOnly"`
 	// Only allow fingerprint / key ID queries; no UID keyword searching allowed
 	FingerprintOnly bool `toml:"keywordSearchDisabled"`
+	// Refuse 8-digit short key ID queries, which are trivial to collide
+	ShortKeyIDsDisabled bool `toml:"shortKeyIDSearchDisabled"`
 }
 
 type HKPSConfig struct {
@@ -84,9 +235,13 @@ const (
 )
 
 type DBConfig struct {
-	Driver string       `toml:"driver"`
-	DSN    string       `toml:"dsn"`
-	Mongo  *mongoConfig `toml:"mongo"`
+	// Driver selects the storage backend: "mongo", "postgres-jsonb", or
+	// "leveldb" for embedded storage.
+	Driver string `toml:"driver"`
+	// DSN locates the database. For the leveldb driver, this is the path to
+	// the database directory.
+	DSN   string       `toml:"dsn"`
+	Mongo *mongoConfig `toml:"mongo"`
 }
 
 type mongoConfig struct {
@@ -140,6 +295,74 @@ type OpenPGPConfig struct {
 	// also drop subkeys and signatures made with these keys -- not only from
 	// new key material, but also from lookup responses.
 	Blacklist []string `toml:"blacklist"`
+
+	// HonourNoModify only accepts material self-signed by the key holder
+	// into keys which carry the keyserver no-modify preference, whether the
+	// material is added by clients or recovered from peers. It is off by
+	// default, so that keys are merged as they always have been.
+	HonourNoModify bool `toml:"honourNoModify"`
+
+	// CertPolicy limits the third-party certifications kept on each user
+	// ID, as a defence against certificate flooding. It is applied to keys
+	// added by clients, keys recovered from peers, and, but for its issuer
+	// check, stored keys as they are served.
+	CertPolicy CertPolicyConfig `toml:"certPolicy"`
+
+	// Policy rejects whole keys which do not meet its rules. It is applied
+	// to keys added by clients, recovered from peers, and loaded with
+	// hockeypuck-load, and each rejection is logged or reported with the
+	// rule that rejected it. Keys stored before a rule was enabled may still
+	// be revoked, and renewed by self-signatures which the policy accepts on
+	// their own, but gain nothing else.
+	//
+	// Unlike MaxKeyLength, MaxPacketLength and Blacklist, which drop
+	// material as it is read, including from stored keys as they are
+	// served, the policy judges whole keys as they are stored.
+	Policy KeyPolicyConfig `toml:"policy"`
+}
+
+type CertPolicyConfig struct {
+	// MaxPerUserID is the most third-party certifications kept on each user
+	// ID and user attribute, newest first. Zero means no limit.
+	MaxPerUserID int `toml:"maxPerUserID"`
+
+	// NewestPerIssuer keeps only the newest certification by each issuer on
+	// each user ID and user attribute.
+	NewestPerIssuer bool `toml:"newestPerIssuer"`
+
+	// KnownIssuersOnly drops certifications whose issuer's key is not
+	// stored on this server. Issuers are checked as keys are stored, not as
+	// they are served. Only the newest thousand certifications on each user
+	// ID and user attribute are checked; older ones are dropped.
+	KnownIssuersOnly bool `toml:"knownIssuersOnly"`
+}
+
+type KeyPolicyConfig struct {
+	// MinRSABits rejects keys with an RSA primary key or subkey shorter
+	// than this many bits. Zero means no minimum.
+	MinRSABits int `toml:"minRSABits"`
+
+	// AllowedAlgorithms rejects keys with a primary key or subkey using a
+	// public key algorithm not listed here, by name: "rsa", "dsa",
+	// "elg", "ecdh", "ecdsa", "eddsa", "x25519", "x448", "ed25519" or
+	// "ed448". Empty means all are allowed.
+	AllowedAlgorithms []string `toml:"allowedAlgorithms"`
+
+	// MaxUserIDs rejects keys with more user IDs than this. Zero means no
+	// limit.
+	MaxUserIDs int `toml:"maxUserIDs"`
+
+	// RejectSHA1Bindings rejects keys with a user ID, user attribute or
+	// subkey which is only bound to the key by SHA-1 signatures.
+	RejectSHA1Bindings bool `toml:"rejectSHA1Bindings"`
+
+	// DeniedUserIDs rejects keys with a user ID matching any of these
+	// regular expressions.
+	DeniedUserIDs []string `toml:"deniedUserIDs"`
+
+	// MaxUserAttributeLength rejects keys with a user attribute packet,
+	// such as a photo, longer than this many octets. Zero means no limit.
+	MaxUserAttributeLength int `toml:"maxUserAttributeLength"`
 }
 
 func DefaultOpenPGP() OpenPGPConfig {
@@ -195,7 +418,40 @@ func DefaultSettings() Settings {
 			},
 		},
 		HKP: HKPConfig{
-			Bind: DefaultHKPBind,
+			Bind:                     DefaultHKPBind,
+			AdminSignatureMaxAgeSecs: DefaultAdminSignatureMaxAgeSecs,
+			Timeouts: timeoutsConfig{
+				LookupSecs:    DefaultLookupTimeoutSecs,
+				AddSecs:       DefaultAddTimeoutSecs,
+				DeleteSecs:    DefaultDeleteTimeoutSecs,
+				HashQuerySecs: DefaultHashQueryTimeoutSecs,
+			},
+			Verification: verificationConfig{
+				TokenTTLSecs: DefaultVerificationTokenTTLSecs,
+			},
+			Takedown: takedownConfig{
+				TokenTTLSecs:     DefaultTakedownTokenTTLSecs,
+				MailIntervalSecs: DefaultTakedownMailIntervalSecs,
+			},
+			RateLimit: rateLimitConfig{
+				IPv4Prefix:     ratelimit.DefaultIPv4Prefix,
+				IPv6Prefix:     ratelimit.DefaultIPv6Prefix,
+				ExemptPartners: true,
+				Get:            rateConfig{Rate: 5, Burst: 20},
+				Index:          rateConfig{Rate: 1, Burst: 10},
+				VIndex:         rateConfig{Rate: 1, Burst: 10},
+				Add:            rateConfig{Rate: 0.5, Burst: 10},
+				HashQuery:      rateConfig{Rate: 0.2, Burst: 5},
+				Verify:         rateConfig{Rate: 0.2, Burst: 5},
+				Delete:         rateConfig{Rate: 0.2, Burst: 5},
+				Takedown:       rateConfig{Rate: 0.05, Burst: 5},
+			},
+			CacheControl: map[string]string{
+				"get":    DefaultGetCacheControl,
+				"hget":   DefaultGetCacheControl,
+				"index":  DefaultIndexCacheControl,
+				"vindex": DefaultIndexCacheControl,
+			},
 		},
 		Metrics:  metricsSettings,
 		OpenPGP:  DefaultOpenPGP(),
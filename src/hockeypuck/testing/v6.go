@@ -0,0 +1,97 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package testing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// RFC9580V6Seed is the secret Ed25519 seed of the primary key of the sample
+// v6 certificate of RFC 9580 §A.4, in rfc9580_v6.asc.
+const RFC9580V6Seed = "1972817b12be707e8d5f586ce61361201d344eb266a2c82fde6835762b65b0b7"
+
+// RFC9580V6Fingerprint is the fingerprint of the primary key of
+// rfc9580_v6.asc.
+const RFC9580V6Fingerprint = "cb186c4f0609a697e4d52dfa6c722b0c1f1e27c18a56708f6525ec27bad9acc9"
+
+// MustDetachSignV6 returns an armored v6 binary document signature over data,
+// made with SHA-256 by the Ed25519 key with the given hex seed and hex
+// fingerprint.
+func MustDetachSignV6(seed, fingerprint string, created time.Time, data []byte) string {
+	seedBytes, err := hex.DecodeString(seed)
+	if err != nil {
+		panic(fmt.Errorf("invalid seed: %v", err))
+	}
+	fp, err := hex.DecodeString(fingerprint)
+	if err != nil || len(fp) != 32 {
+		panic(fmt.Errorf("invalid v6 fingerprint %q", fingerprint))
+	}
+	// GenerateKey reads the seed of the key from its reader.
+	_, priv, err := ed25519.GenerateKey(bytes.NewReader(seedBytes))
+	if err != nil {
+		panic(err)
+	}
+
+	var hashed bytes.Buffer
+	// Signature creation time and issuer fingerprint subpackets.
+	var subpackets bytes.Buffer
+	subpackets.Write([]byte{5, 2})
+	binary.Write(&subpackets, binary.BigEndian, uint32(created.Unix()))
+	subpackets.Write([]byte{34, 33, 6})
+	subpackets.Write(fp)
+	// Version 6, binary document, Ed25519, SHA-256.
+	hashed.Write([]byte{6, 0x00, 27, 8})
+	binary.Write(&hashed, binary.BigEndian, uint32(subpackets.Len()))
+	hashed.Write(subpackets.Bytes())
+
+	salt := bytes.Repeat([]byte{0x5a}, 16)
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(data)
+	h.Write(hashed.Bytes())
+	h.Write([]byte{6, 0xff})
+	binary.Write(h, binary.BigEndian, uint32(hashed.Len()))
+	digest := h.Sum(nil)
+
+	body := bytes.NewBuffer(hashed.Bytes())
+	// No unhashed subpackets.
+	body.Write([]byte{0, 0, 0, 0})
+	body.Write(digest[:2])
+	body.WriteByte(byte(len(salt)))
+	body.Write(salt)
+	body.Write(ed25519.Sign(priv, digest))
+
+	var out bytes.Buffer
+	w, err := armor.Encode(&out, "PGP SIGNATURE", nil)
+	if err != nil {
+		panic(err)
+	}
+	// A new format signature packet with a one-octet length.
+	w.Write([]byte{0xc2, byte(body.Len())})
+	w.Write(body.Bytes())
+	w.Close()
+	return out.String()
+}